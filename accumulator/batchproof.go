@@ -291,6 +291,17 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 
 	targetHashes = sortedDelHashes
 
+	// keep the sorted targets around so a failure can say which one it was
+	allTargets, allHashes := targets, targetHashes
+	firstTarget := func(pos uint64) uint64 {
+		t, _ := targetUnder(allTargets, allHashes, pos, treeRows(numLeaves))
+		return t
+	}
+	failed := func(pos uint64) string {
+		t, h := targetUnder(allTargets, allHashes, pos, treeRows(numLeaves))
+		return fmt.Sprintf("target %d (%s)", t, h)
+	}
+
 	if cached == nil {
 		cached = func(_ uint64) (bool, Hash) { return false, empty }
 	}
@@ -330,8 +341,9 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 		// AND the tree has a root at row 0 (numLeaves&1==1)
 		if targets[0] == numLeaves-1 && numLeaves&1 == 1 {
 			// target is the row 0 root, append it to the root candidates.
+			// It's still checked against the root with the others.
 			rootCandidates = append(rootCandidates,
-				node{Val: roots[len(roots)-1], Pos: targets[0]})
+				node{Val: targetHashes[0], Pos: targets[0]})
 			break
 		}
 
@@ -354,8 +366,8 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 		// hashes or less than 2 targets left the proof is invalid because
 		// there is a target without matching proof.
 		if len(targetHashes) < 2 || len(targets) < 2 {
-			err := fmt.Errorf("verifyBatchProof: target to prove is without its sibling." +
-				" Cannot verify proof")
+			err := fmt.Errorf("verifyBatchProof: %s is without its sibling."+
+				" Cannot verify proof", failed(targets[0]))
 			return nil, nil, err
 		}
 
@@ -386,8 +398,8 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 			// target should have its sibling in targetNodes
 			if len(targetNodes) == 1 {
 				// sibling not found
-				err := fmt.Errorf("verifyBatchProof: target to prove is without its sibling." +
-					" Verify failed")
+				err := fmt.Errorf("verifyBatchProof: %s is without its sibling."+
+					" Verify failed", failed(target.Pos))
 				return nil, nil, err
 			}
 
@@ -420,19 +432,19 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 				} else {
 					// The left and right did not match the cached
 					// left and right.
-					err := fmt.Errorf("verifyBatchProof: cached hash doesn't match with the"+
-						" calculated hash. Left calculated %x, left cached %x. Right calculated"+
-						" %x, right cached %x",
-						left.Val, cachedLeft, right.Val, cachedRight)
+					err := fmt.Errorf("verifyBatchProof: %s doesn't verify. cached hash"+
+						" doesn't match with the calculated hash. Left calculated %s,"+
+						" left cached %s. Right calculated %s, right cached %s",
+						failed(parentPos), left.Val, cachedLeft, right.Val, cachedRight)
 					return nil, nil, err
 				}
 			} else {
 				hash = parentHash(left.Val, right.Val)
 				if hash != cachedParent {
 					// The calculated hash did not match the cached parent.
-					err := fmt.Errorf("verifyBatchProof: calculated parent hash of %x doesn't"+
-						" match with the cached hash of %x.",
-						hash, cachedParent)
+					err := fmt.Errorf("verifyBatchProof: %s doesn't verify. calculated"+
+						" parent hash of %s at %d doesn't match with the cached hash of %s.",
+						failed(parentPos), hash, parentPos, cachedParent)
 					return nil, nil, err
 				}
 			}
@@ -467,27 +479,43 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 		return nil, nil, err
 	}
 
-	// `roots` is ordered, therefore to verify that `rootCandidates`
-	// holds a subset of the roots
-	// we count the roots that match in order.
-	rootMatches := 0
-	for i, _ := range roots {
-		if len(rootCandidates) > rootMatches &&
-			roots[len(roots)-(i+1)] == rootCandidates[rootMatches].Val {
-			rootMatches++
+	// `roots` is ordered biggest tree first, so each root candidate is
+	// checked against the root of the tree it's at.  If more than one
+	// doesn't match, the error is for the one with the first target.
+	var failedRoot *node
+	for i, candidate := range rootCandidates {
+		tree, _, _ := detectOffset(candidate.Pos, numLeaves)
+		if int(tree) < len(roots) && roots[tree] == candidate.Val {
+			continue
+		}
+		if failedRoot == nil || firstTarget(candidate.Pos) < firstTarget(failedRoot.Pos) {
+			failedRoot = &rootCandidates[i]
 		}
 	}
-	if len(rootCandidates) != rootMatches {
-		// the proof is invalid because some root candidates were not
-		// included in `roots`.
-		err := fmt.Errorf("verifyBatchProof: generated %d roots but only"+
-			"matched %d roots", len(rootCandidates), rootMatches)
+	if failedRoot != nil {
+		// the proof is invalid because a root candidate isn't the root
+		// at its position.
+		err := fmt.Errorf("verifyBatchProof: %s doesn't verify. calculated"+
+			" root %s at %d isn't in the roots",
+			failed(failedRoot.Pos), failedRoot.Val, failedRoot.Pos)
 		return nil, nil, err
 	}
 
 	return trees, rootCandidates, nil
 }
 
+// targetUnder returns the first of the sorted targets under pos, and its
+// hash.
+func targetUnder(targets []uint64, hashes []Hash, pos uint64, rows uint8) (uint64, Hash) {
+	rise := detectRow(pos, rows)
+	for i, t := range targets {
+		if parentMany(t, rise, rows) == pos {
+			return t, hashes[i]
+		}
+	}
+	return targets[0], hashes[0]
+}
+
 // Reconstruct takes a number of leaves and rows, and turns a block proof back
 // into a partial proof tree. Should leave bp intact
 func (bp *BatchProof) Reconstruct(
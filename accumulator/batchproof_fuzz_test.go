@@ -0,0 +1,49 @@
+//go:build go1.18
+// +build go1.18
+
+package accumulator
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// FuzzBatchProofDeserialize feeds arbitrary bytes to the BatchProof
+// deserializers.  They have to give an error, or a proof that serializes back
+// to the bytes that were read, and both have to agree.
+func FuzzBatchProofDeserialize(f *testing.F) {
+	var buf bytes.Buffer
+	bp := BatchProof{Targets: []uint64{1, 5}, Proof: []Hash{{1}, {2}}}
+	bp.Serialize(&buf)
+	f.Add(buf.Bytes())
+	// says it has lots of targets but doesn't
+	f.Add([]byte{0, 1, 0, 0, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var bp BatchProof
+		r := bytes.NewReader(data)
+		err := bp.Deserialize(r)
+		fromBytes, bytesErr := DeserializeBPFromBytes(data)
+		if (err == nil) != (bytesErr == nil) {
+			t.Fatalf("Deserialize gave error %v, DeserializeBPFromBytes %v",
+				err, bytesErr)
+		}
+		if err != nil {
+			return
+		}
+		if !reflect.DeepEqual(*fromBytes, bp) {
+			t.Fatalf("Deserialize gave %s DeserializeBPFromBytes %s",
+				bp.ToString(), fromBytes.ToString())
+		}
+
+		var buf bytes.Buffer
+		err = bp.Serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[:len(data)-r.Len()]) {
+			t.Fatalf("read %x but serialized %x",
+				data[:len(data)-r.Len()], buf.Bytes())
+		}
+	})
+}
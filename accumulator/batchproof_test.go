@@ -1,7 +1,10 @@
 package accumulator
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -145,3 +148,327 @@ func TestProofShouldNotValidateAfterNodeDeleted(t *testing.T) {
 			proofIndex))
 	}
 }
+
+// A batch proof for 64 leaves next to each other should be a lot smaller
+// than 64 separate proofs.
+func TestProveSequential(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	adds := make([]Leaf, 300)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i), byte(i >> 8), 0xaa}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := make([]uint64, 64)
+	targetHashes := make([]Hash, 64)
+	var separateHashes int
+	for i := range targets {
+		targets[i] = uint64(100 + i)
+		targetHashes[i] = adds[100+i].Hash
+
+		p, err := f.Prove(targetHashes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		separateHashes += len(p.Siblings)
+	}
+
+	bp, stats, err := f.ProveSequential(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bp.Proof) >= separateHashes {
+		t.Fatalf("sequential proof has %d hashes, separate proofs have %d",
+			len(bp.Proof), separateHashes)
+	}
+	if stats.UniqueHashes != len(bp.Proof) ||
+		stats.UniqueHashes+stats.SharedHashes != separateHashes {
+		t.Fatalf("stats %+v don't add up to %d proof hashes and %d separate",
+			stats, len(bp.Proof), separateHashes)
+	}
+
+	err = f.VerifyBatchProof(targetHashes, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unsorted targets aren't allowed
+	targets[3], targets[4] = targets[4], targets[3]
+	_, _, err = f.ProveSequential(targets)
+	if err == nil {
+		t.Fatal("expected error for unsorted targets")
+	}
+}
+
+func TestBatchProve(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	// 24 leaves are a tree of 16 and a tree of 8
+	adds := make([]Leaf, 24)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i + 1), 0xbb}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []uint64{20, 3, 5}
+	bp, paths, err := f.BatchProve(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.VerifyBatchProof(
+		[]Hash{adds[3].Hash, adds[5].Hash, adds[20].Hash}, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every path has the same siblings as a single proof
+	for _, target := range targets {
+		p, err := f.Prove(adds[target].Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(paths[target]) != len(p.Siblings) {
+			t.Fatalf("target %d path %v, expected %d siblings",
+				target, paths[target], len(p.Siblings))
+		}
+		for i, pos := range paths[target] {
+			if f.data.read(pos) != p.Siblings[i] {
+				t.Fatalf("target %d sibling %d at %d isn't in its proof",
+					target, i, pos)
+			}
+		}
+	}
+
+	// 20 is the only target in the tree of 8, so its whole path is in the
+	// proof.  Pick its hashes out of the batch and check it by itself.
+	var proofPositions []uint64
+	ProofPositions(bp.Targets, f.numLeaves, f.rows, &proofPositions)
+	proofHashes := make(map[uint64]Hash)
+	for i, pos := range proofPositions {
+		proofHashes[pos] = bp.Proof[i]
+	}
+	single := Proof{Position: 20, Payload: adds[20].Hash}
+	for _, pos := range paths[20] {
+		h, ok := proofHashes[pos]
+		if !ok {
+			t.Fatalf("sibling %d of target 20 isn't in the batch proof", pos)
+		}
+		single.Siblings = append(single.Siblings, h)
+	}
+	if !f.Verify(single) {
+		t.Fatal("target 20 didn't verify from its path in the batch proof")
+	}
+
+	// 3 and 5 share a tree, so above where they meet the sibling is
+	// computed and isn't in the proof
+	if _, ok := proofHashes[paths[3][2]]; ok {
+		t.Fatalf("sibling %d of target 3 is in the proof but can be computed",
+			paths[3][2])
+	}
+}
+
+func TestProveBatchSorted(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 24)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i + 1), 0xbc}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// out of order, with 7 in there twice
+	hs := []Hash{adds[20].Hash, adds[7].Hash, adds[3].Hash, adds[7].Hash}
+	bp, index, err := f.ProveBatchSorted(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bp.Targets, []uint64{3, 7, 20}) {
+		t.Fatalf("targets %v, expected [3 7 20]", bp.Targets)
+	}
+	if !reflect.DeepEqual(index, []int{2, 1, 0, 1}) {
+		t.Fatalf("index %v, expected [2 1 0 1]", index)
+	}
+	for i, h := range hs {
+		if f.data.read(bp.Targets[index[i]]) != h {
+			t.Fatalf("hash %d maps to target %d", i, bp.Targets[index[i]])
+		}
+	}
+	expected, err := f.ProveBatch(
+		[]Hash{adds[3].Hash, adds[7].Hash, adds[20].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bp, expected) {
+		t.Fatal("proof differs from proving the sorted hashes")
+	}
+	err = f.VerifyBatchProof(
+		[]Hash{adds[3].Hash, adds[7].Hash, adds[20].Hash}, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every missing hash is in the error, not just the first
+	missing := []Hash{{0xee, 1}, {0xee, 2}}
+	_, _, err = f.ProveBatchSorted(
+		[]Hash{adds[1].Hash, missing[0], adds[2].Hash, missing[1]})
+	if !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("got error %v, expected ErrLeafNotFound", err)
+	}
+	for _, h := range missing {
+		if !strings.Contains(err.Error(), h.String()) {
+			t.Fatalf("error %q doesn't list %s", err.Error(), h)
+		}
+	}
+}
+
+// A proof for 4096 leaves in a row only needs the hashes along the edges of
+// the range, so it's far smaller than 4096 separate proofs.
+func TestProveRange(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 10000)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i), byte(i >> 8), 0xad}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const start, count = 1000, 4096
+	bp, err := f.ProveRange(start, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rangeHashes := make([]Hash, count)
+	var separateHashes int
+	for i := range rangeHashes {
+		rangeHashes[i] = adds[start+i].Hash
+		p, err := f.Prove(rangeHashes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		separateHashes += len(p.Siblings)
+	}
+	err = f.VerifyBatchProof(rangeHashes, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// at most 2 hashes per row
+	if len(bp.Proof) > 2*int(f.rows) || len(bp.Proof)*1000 > separateHashes {
+		t.Fatalf("range proof has %d hashes, separate proofs %d",
+			len(bp.Proof), separateHashes)
+	}
+
+	_, err = f.ProveRange(9000, 1001)
+	if err == nil {
+		t.Fatal("proved a range past the last leaf")
+	}
+}
+
+func TestProveAtPositions(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 24)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i + 1), 0xae}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	positions := []uint64{20, 3, 7}
+	bp, err := f.ProveAtPositions(positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := f.ProveBatch(
+		[]Hash{adds[20].Hash, adds[3].Hash, adds[7].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bp, expected) {
+		t.Fatal("proof differs from proving the hashes")
+	}
+
+	for _, bad := range [][]uint64{{3, 24}, {3, 7, 3}} {
+		_, err = f.ProveAtPositions(bad)
+		if err == nil {
+			t.Fatalf("proved positions %v", bad)
+		}
+	}
+}
+
+// Every position of a 64 leaf forest: the leaves get proofs that verify,
+// without the positionMap, and everything above them is ErrNotLeaf.
+func TestProvePosition(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 64)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i + 1), 0xd0}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := make([]Hash, len(adds))
+	for i, a := range adds {
+		hashes[i] = a.Hash
+	}
+	expected, err := f.ProveMany(hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.positionMap = nil
+
+	var leaves []uint64
+	for pos := uint64(0); pos < f.data.size(); pos++ {
+		pr, err := f.ProvePosition(pos)
+		if detectRow(pos, f.rows) != 0 {
+			if !errors.Is(err, ErrNotLeaf) {
+				t.Fatalf("position %d at row %d gave error %v, expected "+
+					"ErrNotLeaf", pos, detectRow(pos, f.rows), err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.Verify(pr) {
+			t.Fatalf("proof for position %d doesn't verify", pos)
+		}
+		if !reflect.DeepEqual(pr, expected[pos]) {
+			t.Fatalf("proof for position %d differs from proving its hash",
+				pos)
+		}
+		leaves = append(leaves, pos)
+	}
+	if len(leaves) != 64 {
+		t.Fatalf("proved %d leaves, expected 64", len(leaves))
+	}
+
+	bp, err := f.ProvePositions([]uint64{40, 2, 63})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.VerifyBatchProof([]Hash{hashes[40], hashes[2], hashes[63]}, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.ProvePositions([]uint64{2, 64})
+	if !errors.Is(err, ErrNotLeaf) {
+		t.Fatalf("ProvePositions gave error %v, expected ErrNotLeaf", err)
+	}
+	_, err = f.ProvePosition(f.data.size())
+	if err == nil {
+		t.Fatal("proved a position past the end of the forest")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !unsafe
+// +build !unsafe
+
+package accumulator
+
+import "sync"
+
+// cacheMutex guards a cacheForestData and its diskForestCache so proofs can
+// be made from many goroutines at once.  Building with the unsafe tag
+// swaps it for one that does nothing, for programs that only ever touch the
+// forest from one goroutine.  See cachelock_unsafe.go.
+type cacheMutex struct {
+	sync.RWMutex
+}
+
+// cacheLocked says the cache locks are real, so a CacheForest can prime
+// its cache in the background.
+const cacheLocked = true
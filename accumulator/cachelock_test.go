@@ -0,0 +1,68 @@
+//go:build !unsafe
+// +build !unsafe
+
+package accumulator
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Hammer one cacheForestData from 16 goroutines.  Each goroutine writes its
+// own positions and reads everyone's, so run with -race to check the locks.
+func TestCacheForestDataConcurrent(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "cachelock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+	defer forestFile.Close()
+
+	// 2 cached rows out of 7, so positions hit both the cache and the disk
+	d := &cacheForestData{file: forestFile, cache: newDiskForestCache(2)}
+	d.SetFlushInterval(500)
+	const hashes = (2 << 6) - 1
+	d.resize(hashes)
+
+	const workers, iterations = 16, 10000
+	errs := make(chan string, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				// each hash has its position and the iteration that wrote
+				// it twice, so a torn read shows up
+				pos := uint64(w + (i%(hashes/workers+1))*workers)
+				if pos < hashes {
+					var h Hash
+					binary.BigEndian.PutUint64(h[:8], pos)
+					binary.BigEndian.PutUint64(h[8:16], uint64(i))
+					binary.BigEndian.PutUint64(h[16:24], uint64(i))
+					d.write(pos, h)
+				}
+
+				readPos := uint64(i*7+w) % hashes
+				h := d.read(readPos)
+				if h == empty {
+					continue
+				}
+				if binary.BigEndian.Uint64(h[:8]) != readPos ||
+					binary.BigEndian.Uint64(h[8:16]) !=
+						binary.BigEndian.Uint64(h[16:24]) {
+					errs <- "bad hash " + h.String()
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for e := range errs {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build unsafe
+// +build unsafe
+
+package accumulator
+
+// With the unsafe build tag the cache locks compile away to nothing, so a
+// cacheForestData must only be used from one goroutine.  See cachelock.go.
+type cacheMutex struct{}
+
+func (m *cacheMutex) Lock()    {}
+func (m *cacheMutex) Unlock()  {}
+func (m *cacheMutex) RLock()   {}
+func (m *cacheMutex) RUnlock() {}
+
+// cacheLocked says the cache locks are real, so a CacheForest can prime
+// its cache in the background.
+const cacheLocked = false
@@ -0,0 +1,8 @@
+package accumulator
+
+import "errors"
+
+// ErrHashCollision is returned when collision detection is on (build with
+// the utreexo_debug tag and call EnableCollisionDetection) and two different
+// hashes share a MiniHash in the positionMap.
+var ErrHashCollision = errors.New("MiniHash collision in positionMap")
@@ -0,0 +1,79 @@
+//go:build utreexo_debug
+// +build utreexo_debug
+
+package accumulator
+
+// collisionDetector keeps the full hash for every MiniHash in the
+// positionMap, so that two leaves that only share a MiniHash can be told
+// apart.  Only built with the utreexo_debug tag.
+type collisionDetector struct {
+	fullHashes map[MiniHash]Hash
+
+	checks, collisions uint64
+}
+
+// EnableCollisionDetection starts keeping the full hash of every leaf in
+// fullHashes, and makes positionMap lookups and adds return ErrHashCollision
+// when a MiniHash matches but the full hash doesn't.  fullHashes can be nil,
+// and is filled in with the leaves already in the forest.
+func (f *Forest) EnableCollisionDetection(fullHashes map[MiniHash]Hash) {
+	if fullHashes == nil {
+		fullHashes = make(map[MiniHash]Hash)
+	}
+	for i := uint64(0); i < f.numLeaves; i++ {
+		h := f.data.read(i)
+		fullHashes[h.Mini()] = h
+	}
+	f.collisions.fullHashes = fullHashes
+}
+
+// CollisionStats gives how many positionMap lookups have been checked and
+// how many of those were collisions.
+func (f *Forest) CollisionStats() (checks, collisions uint64) {
+	return f.collisions.checks, f.collisions.collisions
+}
+
+// checkLookup is called after h's MiniHash was found in the positionMap.
+func (f *Forest) checkLookup(h Hash) error {
+	if f.collisions.fullHashes == nil {
+		return nil
+	}
+	f.collisions.checks++
+	full, ok := f.collisions.fullHashes[h.Mini()]
+	if ok && full != h {
+		f.collisions.collisions++
+		return ErrHashCollision
+	}
+	return nil
+}
+
+// checkAdd is called before h is added.  Adding a hash whose MiniHash is
+// already in the positionMap would overwrite the other leaf's position.
+func (f *Forest) checkAdd(h Hash) error {
+	if f.collisions.fullHashes == nil {
+		return nil
+	}
+	if _, ok := f.positionMap[h.Mini()]; !ok {
+		return nil
+	}
+	return f.checkLookup(h)
+}
+
+// recordAdd saves the full hash of a leaf being added.
+func (f *Forest) recordAdd(h Hash) {
+	if f.collisions.fullHashes != nil {
+		f.collisions.fullHashes[h.Mini()] = h
+	}
+}
+
+// clone copies the full hashes so a cloned forest has its own.
+func (cd collisionDetector) clone() collisionDetector {
+	if cd.fullHashes != nil {
+		full := make(map[MiniHash]Hash, len(cd.fullHashes))
+		for m, h := range cd.fullHashes {
+			full[m] = h
+		}
+		cd.fullHashes = full
+	}
+	return cd
+}
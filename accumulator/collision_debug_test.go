@@ -0,0 +1,66 @@
+//go:build utreexo_debug
+// +build utreexo_debug
+
+package accumulator
+
+import "testing"
+
+func TestCollisionDetection(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i + 1), 0xcc}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.EnableCollisionDetection(nil)
+
+	// same MiniHash as leaf 3, different everywhere after that
+	collider := adds[3].Hash
+	collider[31] = 0xff
+	if collider.Mini() != adds[3].Mini() {
+		t.Fatal("collider doesn't share the MiniHash")
+	}
+
+	_, err = f.Prove(adds[3].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Prove(collider)
+	if err != ErrHashCollision {
+		t.Fatalf("Prove gave %v, expected ErrHashCollision", err)
+	}
+	_, err = f.ProveBatch([]Hash{adds[1].Hash, collider})
+	if err != ErrHashCollision {
+		t.Fatalf("ProveBatch gave %v, expected ErrHashCollision", err)
+	}
+	if f.FindLeaf(collider) {
+		t.Fatal("FindLeaf found the collider")
+	}
+	_, err = f.Modify([]Leaf{{Hash: collider}}, nil)
+	if err != ErrHashCollision {
+		t.Fatalf("Modify gave %v, expected ErrHashCollision", err)
+	}
+
+	// leaves added after enabling are tracked too
+	late := Hash{0xaa, 0xcc}
+	_, err = f.Modify([]Leaf{{Hash: late}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lateCollider := late
+	lateCollider[20] = 1
+	_, err = f.Prove(lateCollider)
+	if err != ErrHashCollision {
+		t.Fatalf("Prove gave %v, expected ErrHashCollision", err)
+	}
+
+	checks, collisions := f.CollisionStats()
+	if checks != 7 || collisions != 5 {
+		t.Fatalf("%d checks %d collisions, expected 7 and 5",
+			checks, collisions)
+	}
+}
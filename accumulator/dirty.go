@@ -0,0 +1,133 @@
+package accumulator
+
+import "fmt"
+
+// SetDirtyCallback has fn called with every forest position that changed,
+// sorted, each time Modify, Undo or Rehash finishes.  That includes leaves
+// that moved, parents that were rehashed, and leaves moved past the right
+// edge by deletions.  fn runs after all the hashes are done, and the forest
+// can't be changed from inside it; Modify, Undo and Rehash return an error
+// if fn calls them.  fn gets its own slice and can keep it.  Pass nil to stop
+// the calls.
+func (f *Forest) SetDirtyCallback(fn func(changed []uint64)) {
+	f.dirtyCallback = fn
+}
+
+// MarkDirty says the leaves at positions were changed some way other than
+// through the forest, like by writing the forest data directly, so their
+// parents need hashing again.  They're hashed all at once by FlushDirt, or
+// by the next Modify before it changes anything.
+func (f *Forest) MarkDirty(positions ...uint64) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	for _, pos := range positions {
+		if pos >= f.numLeaves {
+			return fmt.Errorf("MarkDirty: position %d but only %d leaves",
+				pos, f.numLeaves)
+		}
+	}
+	f.pendingDirt = append(f.pendingDirt, positions...)
+	return nil
+}
+
+// PendingDirt gives the positions marked dirty that haven't been hashed
+// yet, sorted.  It's a copy, so changing it doesn't change the forest.
+func (f *Forest) PendingDirt() []uint64 {
+	pending := make([]uint64, len(f.pendingDirt))
+	copy(pending, f.pendingDirt)
+	sortUint64s(pending)
+	return pending
+}
+
+// FlushDirt hashes everything above the positions marked dirty, and
+// clears them.  With nothing marked it does nothing.
+func (f *Forest) FlushDirt() error {
+	if len(f.pendingDirt) == 0 {
+		return nil
+	}
+	return f.trackDirty(f.flushDirt)
+}
+
+// flushDirt is FlushDirt for inside trackDirty.
+func (f *Forest) flushDirt() error {
+	if len(f.pendingDirt) == 0 {
+		return nil
+	}
+	dirt := make([]uint64, 0, len(f.pendingDirt))
+	for _, pos := range f.PendingDirt() {
+		if len(dirt) == 0 || dirt[len(dirt)-1] != pos {
+			dirt = append(dirt, pos)
+		}
+	}
+	err := f.reHash(dirt)
+	if err != nil {
+		return err
+	}
+	f.pendingDirt = nil
+	return nil
+}
+
+// trackDirty runs op, which changes the forest, and then gives the dirty
+// callback every position op wrote to.  Nothing is sent if op fails.
+func (f *Forest) trackDirty(op func() error) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	if f.inDirtyCallback {
+		return fmt.Errorf("can't change the forest from the dirty callback")
+	}
+	if f.dirtyCallback == nil {
+		return op()
+	}
+
+	dd := &dirtyData{ForestData: f.data, changed: make(map[uint64]bool)}
+	f.data = dd
+	err := op()
+	f.data = dd.ForestData
+	if err != nil {
+		return err
+	}
+
+	changed := make([]uint64, 0, len(dd.changed))
+	for pos := range dd.changed {
+		changed = append(changed, pos)
+	}
+	sortUint64s(changed)
+
+	f.inDirtyCallback = true
+	defer func() { f.inDirtyCallback = false }()
+	f.dirtyCallback(changed)
+	return nil
+}
+
+// dirtyData is a ForestData that keeps track of every position written.
+type dirtyData struct {
+	ForestData
+	changed map[uint64]bool
+}
+
+// zeroOnResize is the same as for the ForestData under it, so trackDirty
+// doesn't slow down reMap.
+func (d *dirtyData) zeroOnResize() bool {
+	return zeroesOnResize(d.ForestData)
+}
+
+func (d *dirtyData) write(pos uint64, h Hash) {
+	d.changed[pos] = true
+	d.ForestData.write(pos, h)
+}
+
+func (d *dirtyData) swapHash(a, b uint64) {
+	d.changed[a] = true
+	d.changed[b] = true
+	d.ForestData.swapHash(a, b)
+}
+
+func (d *dirtyData) swapHashRange(a, b, w uint64) {
+	for i := uint64(0); i < w; i++ {
+		d.changed[a+i] = true
+		d.changed[b+i] = true
+	}
+	d.ForestData.swapHashRange(a, b, w)
+}
@@ -0,0 +1,105 @@
+package accumulator
+
+import "testing"
+
+// Leaves written straight to the forest data and marked dirty get hashed
+// by FlushDirt, or by the next Modify, the same as if they'd been added
+// that way.
+func TestMarkDirtyFlush(t *testing.T) {
+	adds := make([]Leaf, 20)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0x0d}
+	}
+	f := NewForest(RamForest, nil, "", 0)
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := append([]Leaf{}, adds...)
+	changed[3].Hash = Hash{0xf3}
+	changed[12].Hash = Hash{0xfc}
+	expected := NewForest(RamForest, nil, "", 0)
+	_, err = expected.Modify(changed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.data.write(12, changed[12].Hash)
+	f.data.write(3, changed[3].Hash)
+	err = f.MarkDirty(12, 3, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := f.PendingDirt()
+	if len(pending) != 3 || pending[0] != 3 || pending[2] != 12 {
+		t.Fatalf("pending dirt %v, expected [3 12 12]", pending)
+	}
+	pending[0] = 99
+	if f.PendingDirt()[0] != 3 {
+		t.Fatal("changing PendingDirt's slice changed the forest")
+	}
+	err = f.MarkDirty(20)
+	if err == nil {
+		t.Fatal("marked a position past the leaves dirty")
+	}
+
+	err = f.FlushDirt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.PendingDirt()) != 0 {
+		t.Fatalf("pending dirt %v after flushing", f.PendingDirt())
+	}
+	assertSameRoots(t, f, expected)
+
+	// flushing again with nothing marked does nothing
+	hashes := f.historicHashes
+	calls := 0
+	f.SetDirtyCallback(func(changed []uint64) { calls++ })
+	err = f.FlushDirt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.historicHashes != hashes || calls != 0 {
+		t.Fatalf("second flush did %d hashes and %d callbacks",
+			f.historicHashes-hashes, calls)
+	}
+	f.SetDirtyCallback(nil)
+
+	// Modify hashes what's marked before it moves anything
+	f.data.write(0, Hash{0xf0})
+	expected.data.write(0, Hash{0xf0})
+	err = f.MarkDirty(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = expected.Rehash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, forest := range []*Forest{f, expected} {
+		_, err = forest.Modify(
+			[]Leaf{{Hash: Hash{0xaa}}}, []uint64{17, 19})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertSameRoots(t, f, expected)
+}
+
+// assertSameRoots checks f has the same roots as expected.  Leaves written
+// straight to the data aren't in the positionMap, so AssertEqual won't do.
+func assertSameRoots(t *testing.T, f, expected *Forest) {
+	t.Helper()
+	roots, expectedRoots := f.GetRoots(), expected.GetRoots()
+	if len(roots) != len(expectedRoots) {
+		t.Fatalf("%d roots, expected %d", len(roots), len(expectedRoots))
+	}
+	for i := range roots {
+		if roots[i] != expectedRoots[i] {
+			t.Fatalf("root %d is %s, expected %s",
+				i, roots[i], expectedRoots[i])
+		}
+	}
+}
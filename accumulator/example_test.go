@@ -0,0 +1,140 @@
+package accumulator
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// exampleLeaves makes leaves out of the hashes of some strings.
+func exampleLeaves(names ...string) []Leaf {
+	leaves := make([]Leaf, len(names))
+	for i, name := range names {
+		leaves[i] = Leaf{Hash: sha256.Sum256([]byte(name))}
+	}
+	return leaves
+}
+
+// A forest keeps every leaf, so it can prove any of them.  Adding and
+// deleting leaves is one Modify per block.  Deleted leaves get filled in by
+// leaves from the right, so positions change.
+func ExampleForest_Modify() {
+	f := NewForest(RamForest, nil, "", 0)
+
+	leaves := exampleLeaves("alice", "bob", "carol", "dave", "erin")
+	_, err := f.Modify(leaves, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("leaves:", f.NumLeaves(), "roots:", len(f.GetRoots()))
+
+	// spend bob and carol, and add frank, in one block
+	pos, _ := f.PositionsOf([]Hash{leaves[1].Hash, leaves[2].Hash})
+	_, err = f.Modify(exampleLeaves("frank"), pos)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("leaves:", f.NumLeaves(), "roots:", len(f.GetRoots()))
+
+	erin, _ := f.PositionOf(leaves[4].Hash)
+	fmt.Println("erin is at", erin)
+	fmt.Println("bob is there:", f.FindLeaf(leaves[1].Hash))
+
+	// Output:
+	// leaves: 5 roots: 2
+	// leaves: 4 roots: 1
+	// erin is at 2
+	// bob is there: false
+}
+
+// A batch proof proves many leaves at once, sharing the hashes they have
+// in common.  Anyone with the roots can check it.  The hashes have to be
+// given in the same order they were proven in.
+func ExampleForest_proveAndVerify() {
+	f := NewForest(RamForest, nil, "", 0)
+
+	leaves := exampleLeaves("alice", "bob", "carol", "dave", "erin", "frank")
+	_, err := f.Modify(leaves, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	toProve := []Hash{leaves[0].Hash, leaves[3].Hash}
+	bp, err := f.ProveBatch(toProve)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("targets:", bp.Targets, "proof hashes:", len(bp.Proof))
+
+	err = f.VerifyBatchProof(toProve, bp)
+	fmt.Println("verified:", err == nil)
+
+	// the proof doesn't work for a different leaf
+	err = f.VerifyBatchProof([]Hash{leaves[0].Hash, leaves[4].Hash}, bp)
+	fmt.Println("verified with the wrong leaf:", err == nil)
+
+	// Output:
+	// targets: [0 3] proof hashes: 2
+	// verified: true
+	// verified with the wrong leaf: false
+}
+
+// A pollard only keeps the roots, and the leaves it was told to remember.
+// To delete leaves it doesn't have, it gets a batch proof for them from a
+// forest, and then does the same Modify the forest did, ending up with the
+// same roots.
+func ExamplePollard_sync() {
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+
+	// the first block adds some leaves, and the pollard remembers dave's
+	leaves := exampleLeaves("alice", "bob", "carol", "dave", "erin", "frank")
+	leaves[3].Remember = true
+	_, err := f.Modify(leaves, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = p.Modify(leaves, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// the next block spends bob and frank, and adds grace
+	spent := []Hash{leaves[1].Hash, leaves[5].Hash}
+	bp, err := f.ProveBatch(spent)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = p.IngestBatchProof(spent, bp, false)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	adds := exampleLeaves("grace")
+	_, err = f.Modify(adds, bp.Targets)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	err = p.Modify(adds, bp.Targets)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	fRoots, pRoots := f.GetRoots(), p.GetRoots()
+	same := len(fRoots) == len(pRoots)
+	for i := 0; same && i < len(fRoots); i++ {
+		same = fRoots[i] == pRoots[i]
+	}
+	fmt.Println("leaves:", p.NumLeaves(), "same roots:", same)
+
+	// Output:
+	// leaves: 5 same roots: true
+}
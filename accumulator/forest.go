@@ -1,10 +1,13 @@
 package accumulator
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"time"
 )
@@ -14,6 +17,56 @@ const (
 	bridgeVerbose = false
 )
 
+// ErrLeafNotFound is returned by BulkDelete when a hash isn't in the forest.
+var ErrLeafNotFound = errors.New("leaf not found in forest")
+
+// ErrEmptyLeaf is returned by Add and Modify when one of the leaves is all
+// 0s.  The forest uses the empty hash to mean there's nothing at a position.
+var ErrEmptyLeaf = errors.New("can't add empty (all 0s) leaf to accumulator")
+
+// ErrDuplicateLeaf is returned by Add and Modify when a leaf being added is
+// already in the forest, or is being added twice.  The positionMap only
+// keeps one position for a leaf, so the first copy would be left
+// unprovable and undeletable.  A leaf can be added again once it's
+// deleted, including by the same Modify that deletes it.
+var ErrDuplicateLeaf = errors.New("leaf already in accumulator")
+
+// ErrForestFull is returned by Add, Modify and reMap when the forest would
+// need more than MaxLeaves leaves or maxRows rows.
+var ErrForestFull = errors.New("forest can't have more leaves")
+
+// ErrForestMismatch is returned by RestoreForest when the numLeaves and rows
+// in the misc file don't fit the forest data, like when the files were
+// copied at different times.
+var ErrForestMismatch = errors.New("misc file doesn't match forest data")
+
+// maxRows is the most rows a forest can have.  A forest with more would
+// have positions that don't fit in a uint64.
+const maxRows = 63
+
+// MaxLeaves is the most leaves a forest can have.
+const MaxLeaves = uint64(1) << maxRows
+
+// ctxCheckInterval is how many leaves or nodes the Ctx functions go
+// through between checking if their context is done.
+const ctxCheckInterval = 1 << 14
+
+// leavesAfter gives how many leaves a forest with numLeaves has after
+// deleting numDels and adding numAdds, or an error if it'd go below 0 or
+// past MaxLeaves.
+func leavesAfter(numLeaves uint64, numDels, numAdds int) (uint64, error) {
+	if uint64(numDels) > numLeaves {
+		return 0, fmt.Errorf("can't delete %d leaves, only %d exist",
+			numDels, numLeaves)
+	}
+	left := numLeaves - uint64(numDels)
+	if uint64(numAdds) > MaxLeaves-left {
+		return 0, fmt.Errorf("can't add %d leaves to %d: %w",
+			numAdds, left, ErrForestFull)
+	}
+	return left + uint64(numAdds), nil
+}
+
 // A FullForest is the entire accumulator of the UTXO set. This is
 // what the bridge node stores.  Everything is always full.
 
@@ -65,6 +118,33 @@ type Forest struct {
 	// map from hashes to positions.
 	positionMap map[MiniHash]uint64
 
+	// positions of leaves whose MiniHash another leaf already had in
+	// positionMap, and how many times that's happened.  See positionmap.go.
+	collidedLeaves map[Hash]uint64
+	miniCollisions uint64
+
+	// data kept with leaves by SetLeafData, by position.  See leafdata.go.
+	leafData map[uint64][]byte
+
+	// which MiniHashes might be in positionMap, for Exists
+	presence presenceFilter
+
+	// leaves that someone asked to hear about with Watch()
+	watchedLeaves map[MiniHash]chan<- LeafEvent
+
+	// full hashes for catching MiniHash collisions.  Does nothing unless
+	// built with the utreexo_debug tag.
+	collisions collisionDetector
+
+	// called with every changed position after Modify, Undo and Rehash.
+	// inDirtyCallback is set while it runs so it can't change the forest.
+	dirtyCallback   func(changed []uint64)
+	inDirtyCallback bool
+
+	// pendingDirt are leaf positions changed with MarkDirty whose parents
+	// haven't been hashed yet.  FlushDirt hashes them.
+	pendingDirt []uint64
+
 	/*
 	 * below are just for testing / benchmarking
 	 */
@@ -92,6 +172,14 @@ type Forest struct {
 	// timeInVerify represents how long the verify operations took.
 	// Meant for testing / benchmarking.
 	timeInVerify time.Duration
+
+	// timeAdd represents how long the addv2() function took.
+	// Meant for testing / benchmarking.
+	timeAdd time.Duration
+
+	// leavesAdded and leavesDeleted are how many leaves Modify has added
+	// and deleted.  Meant for testing / benchmarking.
+	leavesAdded, leavesDeleted uint64
 }
 
 // ForestType defines the 4 type of forests:
@@ -109,38 +197,88 @@ const (
 	RamForest
 	// CacheForest - keeps the entire forest on disk but caches recent nodes. It's
 	//               faster than disk. Is compatible with the above two forest types.
-	//               Pass cached = true to create a cacheForest.
+	//               Pass cached = true to create a cacheForest. maxCache is how
+	//               many rows of leaves to cache (0 for DefaultCacheRows).
 	CacheForest
 	// CowForest   - A copy-on-write (really a redirect on write) forest. It strikes
 	//               a balance between ram usage and speed. Not compatible with other
 	//               forest types though (meaning there isn't functionality implemented
 	//               to convert a CowForest to DiskForest and vise-versa). Pass a filepath
-	//               and cowMaxCache(how much MB to use in ram) to create a CowForest.
+	//               and maxCache(how much MB to use in ram) to create a CowForest.
 	CowForest
 )
 
+// ForestOption changes how NewForest and RestoreForest set up a forest.
+type ForestOption func(*forestOptions)
+
+type forestOptions struct {
+	// how many rows to start with.  The forest still grows past this.
+	rows uint8
+	// wrap the ForestData so it can't be changed
+	readOnly bool
+	// read and write a DiskForest through io_uring
+	uring bool
+	// check every leaf on restore instead of a sample
+	fullLeafCheck bool
+}
+
+// WithExpectedLeaves makes the forest big enough for n leaves from the
+// start, so it doesn't reMap every time it passes a power of 2 on the way
+// there.  Forests that are already bigger are left alone.
+func WithExpectedLeaves(n uint64) ForestOption {
+	return func(o *forestOptions) {
+		o.rows = treeRows(n)
+	}
+}
+
+// WithFullLeafCheck makes RestoreForest check that every leaf is there
+// instead of restoreLeafSamples of them.  That reads all of the bottom row,
+// which the positionMap rebuild does anyway for everything but a CowForest.
+func WithFullLeafCheck() ForestOption {
+	return func(o *forestOptions) {
+		o.fullLeafCheck = true
+	}
+}
+
+func getForestOptions(opts []ForestOption) forestOptions {
+	var o forestOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // NewForest initializes a Forest and returns it. The given arguments determine
-// what type of forest it will be.
-func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMaxCache int) *Forest {
+// what type of forest it will be.  maxCache is MB of ram for a CowForest and
+// rows of leaves for a CacheForest.
+func NewForest(forestType ForestType, forestFile *os.File, cowPath string,
+	maxCache int, opts ...ForestOption) *Forest {
 
 	f := new(Forest)
 	f.numLeaves = 0
-	f.rows = 0
+	f.rows = getForestOptions(opts).rows
 
 	switch forestType {
 	case DiskForest:
 		d := new(diskForestData)
 		d.file = forestFile
 		f.data = d
+		if getForestOptions(opts).uring {
+			f.data = uringOrDisk(forestFile)
+		}
 	case RamForest:
 		f.data = new(ramForestData)
 	case CacheForest:
+		cacheRows, err := checkCacheRows(maxCache)
+		if err != nil {
+			panic(err)
+		}
 		d := new(cacheForestData)
 		d.file = forestFile
-		d.cache = newDiskForestCache(20)
+		d.cache = newDiskForestCache(cacheRows)
 		f.data = d
 	case CowForest:
-		d, err := initialize(cowPath, cowMaxCache)
+		d, err := initialize(cowPath, maxCache)
 		if err != nil {
 			panic(err)
 		}
@@ -149,6 +287,9 @@ func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMa
 
 	f.data.resize((2 << f.rows) - 1)
 	f.positionMap = make(map[MiniHash]uint64)
+	if getForestOptions(opts).readOnly {
+		f.data = &readOnlyData{ForestData: f.data}
+	}
 	return f
 }
 
@@ -161,28 +302,47 @@ func (f *Forest) removev4(dels []uint64) error {
 	nextNumLeaves := f.numLeaves - uint64(len(dels))
 	// check that all dels are there
 	for _, dpos := range dels {
-		if dpos > f.numLeaves {
+		if dpos >= f.numLeaves {
 			return fmt.Errorf(
 				"Trying to delete leaf at %d, beyond max %d", dpos, f.numLeaves)
 		}
 	}
+	// grab the watched leaves before they get swapped around
+	var watchedDels []LeafEvent
+	if len(f.watchedLeaves) != 0 {
+		for _, dpos := range dels {
+			h := f.data.read(dpos)
+			if _, ok := f.watchedLeaves[h.Mini()]; ok {
+				watchedDels = append(watchedDels,
+					LeafEvent{Type: LeafDeleted, Hash: h, Position: dpos})
+			}
+		}
+	}
 	var hashDirt []uint64
 	swapRows := remTrans2(dels, f.numLeaves, f.rows)
 	// loop taken from pollard rem2.
 	// TODO Maybe pollard and forest can both satisfy the same interface..?
 	for r := uint8(0); r < f.rows; r++ {
 		hashDirt = updateDirt(hashDirt, swapRows[r], f.numLeaves, f.rows)
+		mstStart := time.Now()
 		for _, swap := range swapRows[r] {
 			f.swapNodes(swap, r)
 		}
+		f.timeMST += time.Since(mstStart)
 		// do all the hashes at once at the end
+		hashStart := time.Now()
 		err := f.hashRow(hashDirt)
+		f.timeInHash += time.Since(hashStart)
 		if err != nil {
 			return err
 		}
 	}
 	f.numLeaves = nextNumLeaves
 
+	for _, ev := range watchedDels {
+		f.watchedLeaves[ev.Hash.Mini()] <- ev
+	}
+
 	return nil
 }
 
@@ -239,8 +399,9 @@ func (f *Forest) swapNodes(s arrow, row uint8) {
 	}
 	if row == 0 {
 		f.data.swapHash(s.from, s.to)
-		f.positionMap[f.data.read(s.to).Mini()] = s.to
-		f.positionMap[f.data.read(s.from).Mini()] = s.from
+		f.swapLeafData(s.from, s.to)
+		f.setPosition(f.data.read(s.to), s.to)
+		f.setPosition(f.data.read(s.from), s.from)
 		return
 	}
 	a := childMany(s.from, row, f.rows)
@@ -249,8 +410,9 @@ func (f *Forest) swapNodes(s arrow, row uint8) {
 
 	// happens before the actual swap, so swapping a and b
 	for i := uint64(0); i < run; i++ {
-		f.positionMap[f.data.read(a+i).Mini()] = b + i
-		f.positionMap[f.data.read(b+i).Mini()] = a + i
+		f.setPosition(f.data.read(a+i), b+i)
+		f.setPosition(f.data.read(b+i), a+i)
+		f.swapLeafData(a+i, b+i)
 	}
 
 	// start at the bottom and go to the top
@@ -271,6 +433,9 @@ func (f *Forest) reHash(dirt []uint64) error {
 	if f.rows == 0 || len(dirt) == 0 { // nothing to hash
 		return nil
 	}
+	defer func(start time.Time) {
+		f.timeInHash += time.Since(start)
+	}(time.Now())
 	positionList := NewPositionList()
 	defer positionList.Free()
 
@@ -359,22 +524,142 @@ func (f *Forest) reHash(dirt []uint64) error {
 	return nil
 }
 
+// Rehash recomputes every internal node in the forest from the leaves up.
+// Useful after the backing ForestData was modified directly (tests, repair
+// tools) and the internal hashes can't be trusted anymore.
+func (f *Forest) Rehash() error {
+	return f.trackDirty(func() error {
+		if f.numLeaves == 0 {
+			return nil
+		}
+		// every leaf is dirty, so reHash ends up touching every parent
+		dirt := make([]uint64, f.numLeaves)
+		for i := range dirt {
+			dirt[i] = uint64(i)
+		}
+		err := f.reHash(dirt)
+		if err != nil {
+			return err
+		}
+		// that covered anything marked dirty too
+		f.pendingDirt = nil
+		return nil
+	})
+}
+
 // cleanup removes extraneous hashes from the forest.  Currently only the bottom
 // Probably don't need this at all, if everything else is working.
 func (f *Forest) cleanup(overshoot uint64) {
 	for p := f.numLeaves; p < f.numLeaves+overshoot; p++ {
 		// TODO this probably does nothing. or at least should.
-		delete(f.positionMap, f.data.read(p).Mini()) // clear position map
+		f.removePosition(f.data.read(p)) // clear position map
+		f.presence.remove()
 	}
 }
 
-// Add adds leaves to the forest.  This is the easy part.
-func (f *Forest) Add(adds []Leaf) {
-	f.addv2(adds)
+// LeafEventType says what happened to a watched leaf.
+type LeafEventType uint8
+
+const (
+	// LeafAdded is sent when a watched leaf is added to the forest.
+	LeafAdded LeafEventType = iota
+	// LeafDeleted is sent when a watched leaf is removed from the forest.
+	LeafDeleted
+)
+
+// LeafEvent is sent to the channel given to Watch() when a watched leaf is
+// added or removed.  Position is where the leaf was added, or where it was
+// before it was removed.
+type LeafEvent struct {
+	Type     LeafEventType
+	Hash     Hash
+	Position uint64
+}
+
+// Watch sends a LeafEvent to events every time leaf is added to or removed
+// from the forest, until Unwatch is called.  The sends happen inside
+// Modify() and block, so events should be buffered or read from another
+// goroutine.  Undo does not send events.
+func (f *Forest) Watch(leaf Hash, events chan<- LeafEvent) {
+	if f.watchedLeaves == nil {
+		f.watchedLeaves = make(map[MiniHash]chan<- LeafEvent)
+	}
+	f.watchedLeaves[leaf.Mini()] = events
+}
+
+// Unwatch stops sending events for leaf.
+func (f *Forest) Unwatch(leaf Hash) {
+	delete(f.watchedLeaves, leaf.Mini())
 }
 
 // Add adds leaves to the forest.  This is the easy part.
-func (f *Forest) addv2(adds []Leaf) {
+// Nothing is added if any of the leaves are empty or already in the forest.
+func (f *Forest) Add(adds []Leaf) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	err := f.checkAdds(context.Background(), adds, nil)
+	if err != nil {
+		return err
+	}
+	return f.addv2(adds)
+}
+
+// checkAdds checks that none of adds are empty, already in the forest, or
+// in adds twice.  Leaves at dels, which have to be sorted, don't count as
+// in the forest since they're being deleted.  Stops with ctx's error if
+// it's done.
+func (f *Forest) checkAdds(
+	ctx context.Context, adds []Leaf, dels []uint64) error {
+
+	var seen map[Hash]struct{}
+	if len(adds) > 1 {
+		seen = make(map[Hash]struct{}, len(adds))
+	}
+	for i, a := range adds {
+		if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return fmt.Errorf("stopped after checking %d of %d leaves: %w",
+				i, len(adds), ctx.Err())
+		}
+		if a.Hash == empty {
+			return ErrEmptyLeaf
+		}
+		if seen != nil {
+			if _, ok := seen[a.Hash]; ok {
+				return fmt.Errorf("%x added twice: %w", a.Hash[:4],
+					ErrDuplicateLeaf)
+			}
+			seen[a.Hash] = struct{}{}
+		}
+		pos, ok := f.leafPosition(a.Hash)
+		if ok && pos < f.numLeaves && f.data.read(pos) == a.Hash {
+			i := sort.Search(len(dels), func(i int) bool {
+				return dels[i] >= pos
+			})
+			if i == len(dels) || dels[i] != pos {
+				return fmt.Errorf("%x at %d: %w", a.Hash[:4], pos,
+					ErrDuplicateLeaf)
+			}
+		}
+		err := f.checkAdd(a.Hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addv2 adds leaves to the forest, which has to have the rows for them.
+// The leaves have to be checked with checkAdds first.
+func (f *Forest) addv2(adds []Leaf) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	_, err := leavesAfter(f.numLeaves, 0, len(adds))
+	if err != nil {
+		return err
+	}
+
 	// allocate the positionList first
 	positionList := NewPositionList()
 	defer positionList.Free()
@@ -383,7 +668,13 @@ func (f *Forest) addv2(adds []Leaf) {
 		// reset positionList
 		positionList.list = positionList.list[:0]
 
-		f.positionMap[add.Mini()] = f.numLeaves
+		f.addPosition(add.Hash, f.numLeaves)
+		f.presence.add(add.Mini())
+		f.recordAdd(add.Hash)
+		if events, ok := f.watchedLeaves[add.Mini()]; ok {
+			events <- LeafEvent{
+				Type: LeafAdded, Hash: add.Hash, Position: f.numLeaves}
+		}
 		getRootsForwards(f.numLeaves, f.rows, &positionList.list)
 		pos := f.numLeaves
 		n := add.Hash
@@ -400,6 +691,8 @@ func (f *Forest) addv2(adds []Leaf) {
 		}
 		f.numLeaves++
 	}
+
+	return nil
 }
 
 // Modify changes the forest, adding and deleting leaves and updating internal nodes.
@@ -407,26 +700,226 @@ func (f *Forest) addv2(adds []Leaf) {
 // adds, which show up on the right.
 // Also, the deletes need there to be correct proof data, so you should first call Verify().
 func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
+	return f.ModifyCtx(context.Background(), adds, delsUn)
+}
+
+// ModifyCtx is Modify, but stops with an error wrapping ctx's error if
+// ctx is done while the adds are being checked.  Once the forest starts
+// changing the modify is finished, so it's never left half done.
+func (f *Forest) ModifyCtx(
+	ctx context.Context, adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
+
+	var ub *UndoBlock
+	err := f.trackDirty(func() error {
+		var err error
+		ub, err = f.modify(ctx, adds, delsUn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ub, nil
+}
+
+// BulkDelete deletes leaves by hash instead of position.  All the hashes are
+// looked up in the positionMap first, and if any aren't there nothing gets
+// deleted and the error wraps ErrLeafNotFound.  Gives back the positions
+// that were deleted, in the same order as leafHashes.
+func (f *Forest) BulkDelete(leafHashes []Hash) (dels []uint64, err error) {
+	dels = make([]uint64, len(leafHashes))
+	for i, h := range leafHashes {
+		pos, ok := f.leafPosition(h)
+		if !ok {
+			return nil, fmt.Errorf("BulkDelete: %x: %w", h[:4], ErrLeafNotFound)
+		}
+		err = f.checkLookup(h)
+		if err != nil {
+			return nil, err
+		}
+		dels[i] = pos
+	}
+
+	_, err = f.Modify(nil, dels)
+	if err != nil {
+		return nil, err
+	}
+	return dels, nil
+}
+
+// Positions looks up where each of hashes is, for making the dels for
+// Modify.  found has the positions of the hashes that are in the forest, in
+// the same order as hashes, and missing has the ones that aren't.  Every
+// position is checked against the full hash at it, so a hash that only
+// shares a MiniHash with a leaf is missing.  It's an error if the
+// positionMap points past the leaves.
+func (f *Forest) Positions(hashes []Hash) (
+	found []uint64, missing []Hash, err error) {
+
+	found = make([]uint64, 0, len(hashes))
+	for _, h := range hashes {
+		pos, ok := f.leafPosition(h)
+		if ok && pos >= f.numLeaves {
+			return nil, nil, fmt.Errorf("Positions: positionMap has %s at %d "+
+				"but only %d leaves exist", h, pos, f.numLeaves)
+		}
+		if !ok || f.data.read(pos) != h {
+			missing = append(missing, h)
+			continue
+		}
+		found = append(found, pos)
+	}
+	return found, missing, nil
+}
+
+// PositionOf gives where leaf is in the forest.  That's a position like
+// BatchProof.Targets and Modify's dels use, not an index that stays with
+// the leaf: it changes when leaves to its left are deleted.  found is false
+// if leaf isn't in the forest, including when it only shares a MiniHash
+// with a leaf that is.
+func (f *Forest) PositionOf(leaf Hash) (pos uint64, found bool) {
+	pos, ok := f.leafPosition(leaf)
+	if !ok || pos >= f.numLeaves || f.data.read(pos) != leaf {
+		return 0, false
+	}
+	return pos, true
+}
+
+// PositionsOf is Positions for callers that only care what's there: the
+// positions of the leaves that are in the forest, in the same order as
+// leaves, and the ones that aren't.  A positionMap entry past the leaves,
+// which Positions gives an error for, counts as missing, same as with
+// PositionOf.
+func (f *Forest) PositionsOf(leaves []Hash) (positions []uint64, missing []Hash) {
+	positions, missing, err := f.Positions(leaves)
+	if err == nil {
+		return positions, missing
+	}
+	positions, missing = nil, nil
+	for _, leaf := range leaves {
+		pos, found := f.PositionOf(leaf)
+		if !found {
+			missing = append(missing, leaf)
+			continue
+		}
+		positions = append(positions, pos)
+	}
+	return positions, missing
+}
+
+// BlockModify is the adds and dels for one block, for ModifyMany.
+type BlockModify struct {
+	Adds []Leaf
+	Dels []uint64
+}
+
+// ModifyMany does a Modify for each block in order, but first grows the
+// forest to as many rows as the biggest of them needs, so there's only one
+// reMap.  Gives back the undo data for each block.  If a block fails, the
+// blocks before it are undone and the forest goes back to how it was.
+func (f *Forest) ModifyMany(blocks []BlockModify) ([]*UndoBlock, error) {
+	startRows := f.rows
+	numLeaves, maxLeaves := f.numLeaves, f.numLeaves
+	for i, b := range blocks {
+		var err error
+		numLeaves, err = leavesAfter(numLeaves, len(b.Dels), len(b.Adds))
+		if err != nil {
+			return nil, fmt.Errorf("ModifyMany: block %d: %w", i, err)
+		}
+		if numLeaves > maxLeaves {
+			maxLeaves = numLeaves
+		}
+	}
+
+	err := f.trackDirty(func() error {
+		for f.rows < treeRows(maxLeaves) {
+			err := f.reMap(f.rows + 1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ubs := make([]*UndoBlock, 0, len(blocks))
+	for i, b := range blocks {
+		ub, err := f.Modify(b.Adds, b.Dels)
+		if err == nil {
+			ubs = append(ubs, ub)
+			continue
+		}
+		err = fmt.Errorf("ModifyMany: block %d: %w", i, err)
+
+		for j := len(ubs) - 1; j >= 0; j-- {
+			undoErr := f.Undo(*ubs[j])
+			if undoErr != nil {
+				return nil, fmt.Errorf("%s, then undoing block %d: %s",
+					err.Error(), j, undoErr.Error())
+			}
+		}
+		undoErr := f.trackDirty(func() error {
+			for f.rows > startRows {
+				err := f.reMap(f.rows - 1)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if undoErr != nil {
+			return nil, fmt.Errorf("%s, then shrinking back: %s",
+				err.Error(), undoErr.Error())
+		}
+		return nil, err
+	}
+	return ubs, nil
+}
+
+func (f *Forest) modify(
+	ctx context.Context, adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
+
 	numdels, numadds := len(delsUn), len(adds)
-	delta := int64(numadds - numdels) // watch 32/64 bit
-	if int64(f.numLeaves)+delta < 0 {
-		return nil, fmt.Errorf("can't delete %d leaves, only %d exist",
-			len(delsUn), f.numLeaves)
+	newLeaves, err := leavesAfter(f.numLeaves, numdels, numadds)
+	if err != nil {
+		return nil, err
+	}
+
+	// anything marked dirty gets hashed while its positions still mean
+	// what they did when it was marked
+	err = f.flushDirt()
+	if err != nil {
+		return nil, err
 	}
 
 	// TODO for now just sort
 	dels := make([]uint64, len(delsUn))
 	copy(dels, delsUn)
 	sortUint64s(dels)
-
-	for _, a := range adds { // check for empty leaves
-		if a.Hash == empty {
-			return nil, fmt.Errorf("Can't add empty (all 0s) leaf to accumulator")
+	// check dels before anything moves
+	for i, dpos := range dels {
+		if dpos >= f.numLeaves {
+			return nil, fmt.Errorf(
+				"Trying to delete leaf at %d, beyond max %d", dpos, f.numLeaves)
+		}
+		if i > 0 && dpos == dels[i-1] {
+			return nil, fmt.Errorf("Trying to delete leaf at %d twice", dpos)
 		}
 	}
+
+	// check for empty and duplicate leaves
+	err = f.checkAdds(ctx, adds, dels)
+	if err != nil {
+		return nil, err
+	}
+	// last chance to stop before anything changes
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("ModifyCtx: stopped before changing the "+
+			"forest: %w", ctx.Err())
+	}
 	// remap to expand the forest if needed
-	for int64(f.numLeaves)+delta > int64(1<<f.rows) {
-		// 1<<f.rows, f.numLeaves+delta)
+	for newLeaves > uint64(1)<<f.rows {
 		err := f.reMap(f.rows + 1)
 		if err != nil {
 			return nil, err
@@ -434,11 +927,14 @@ func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 	}
 
 	// v3 should do the exact same thing as v2 now
-	err := f.removev4(dels)
+	remStart := time.Now()
+	err = f.removev4(dels)
+	f.timeRem += time.Since(remStart)
 	if err != nil {
 		return nil, err
 	}
 	f.cleanup(uint64(numdels))
+	f.leavesDeleted += uint64(numdels)
 
 	// save the leaves past the edge for undo
 	// dels hasn't been mangled by remove up above, right?
@@ -446,10 +942,47 @@ func (f *Forest) Modify(adds []Leaf, delsUn []uint64) (*UndoBlock, error) {
 	// and saves it in the order it's in, which should make it go back to
 	// the right place when it's swapped in reverse
 	ub := f.BuildUndoData(uint64(numadds), dels)
+	f.takeDeletedLeafData(ub)
 
-	f.addv2(adds)
+	addStart := time.Now()
+	err = f.addv2(adds)
+	f.timeAdd += time.Since(addStart)
+	if err != nil {
+		return ub, err
+	}
+	f.leavesAdded += uint64(numadds)
 
-	return ub, err
+	return ub, nil
+}
+
+// SetRows grows or shrinks the forest to targetRows, one reMap at a time.
+// Setting more rows than the leaves need is safe and works the same as the
+// rows Modify leaves behind after going past a power of 2: nothing reMaps
+// until the leaves outgrow targetRows.  It's an error if the leaves don't
+// fit in targetRows.  Shrinking doesn't make a disk forest's file smaller;
+// ShrinkFile does that.
+func (f *Forest) SetRows(targetRows uint8) error {
+	// 2 << 63 overflows
+	if targetRows >= 63 {
+		return fmt.Errorf("SetRows: %d rows is too many", targetRows)
+	}
+	if f.numLeaves > 1<<targetRows {
+		return fmt.Errorf("SetRows: %d leaves don't fit in %d rows",
+			f.numLeaves, targetRows)
+	}
+	return f.trackDirty(func() error {
+		for f.rows != targetRows {
+			destRows := f.rows + 1
+			if targetRows < f.rows {
+				destRows = f.rows - 1
+			}
+			err := f.reMap(destRows)
+			if err != nil {
+				return fmt.Errorf("SetRows: %s", err.Error())
+			}
+		}
+		return nil
+	})
 }
 
 // reMap changes the rows in the forest
@@ -460,6 +993,10 @@ func (f *Forest) reMap(destRows uint8) error {
 			destRows, destRows)
 	}
 
+	if destRows > maxRows {
+		return fmt.Errorf("can't remap to %d rows: %w", destRows, ErrForestFull)
+	}
+
 	if destRows > f.rows+1 || (f.rows > 0 && destRows < f.rows-1) {
 		return fmt.Errorf("changing by more than 1 not programmed yet")
 	}
@@ -470,42 +1007,154 @@ func (f *Forest) reMap(destRows uint8) error {
 
 	// for row reduction
 	if destRows < f.rows {
-		return fmt.Errorf("row reduction not implemented")
+		return f.reMapDown(destRows)
 	}
-	// I don't think you ever need to remap down.  It really doesn't
-	// matter.  Something to program someday if you feel like it for fun.
 	// rows increase
 	f.data.resize((2 << destRows) - 1)
+	f.reMapUp(destRows, zeroesOnResize(f.data))
+	return nil
+}
+
+// reMapUp moves rows 1 and up to where they go with destRows rows, which has
+// to be 1 more than now.  Every row ends up past the end of the old forest,
+// and the old rows are all in what's now the right half of the bottom row,
+// which is emptied.
+// If the space resize added is known to be empty, each row is swapped
+// there in one swapHashRange, which empties the old row at the same time.
+// Otherwise non-empty positions are copied and then emptied one at a time.
+func (f *Forest) reMapUp(destRows uint8, newIsEmpty bool) {
 	pos := uint64(1 << destRows) // leftmost position of row 1
 	reach := pos >> 1            // how much to next row up
 	// start on row 1, row 0 doesn't move
 	for h := uint8(1); h < destRows; h++ {
 		runLength := reach >> 1
-		for x := uint64(0); x < runLength; x++ {
-			// ok if source position is non-empty
-			ok := f.data.size() > (pos>>1)+x &&
-				f.data.read((pos>>1)+x) != empty
-			src := f.data.read((pos >> 1) + x)
-			if ok {
+		if newIsEmpty {
+			f.data.swapHashRange(pos>>1, pos, runLength)
+		} else {
+			for x := uint64(0); x < runLength; x++ {
+				src := f.data.read((pos >> 1) + x)
+				if src == empty {
+					continue
+				}
 				f.data.write(pos+x, src)
+				f.data.write((pos>>1)+x, empty)
 			}
 		}
 		pos += reach
 		reach >>= 1
 	}
 
-	// zero out (what is now the) right half of the bottom row
-	//	copy(t.fs[1<<(t.rows-1):1<<t.rows], make([]Hash, 1<<(t.rows-1)))
-	for x := uint64(1 << f.rows); x < 1<<destRows; x++ {
-		// here you may actually need / want to delete?  but numleaves
-		// should still ensure that you're not reading over the edge...
-		f.data.write(x, empty)
+	f.rows = destRows
+}
+
+// reMapDown moves every row up to destRows into where it goes with destRows
+// rows, and empties everything past that.  The leaves have to fit in
+// destRows.  Nothing gets smaller, but ShrinkFile can then cut off the end.
+func (f *Forest) reMapDown(destRows uint8) error {
+	if f.numLeaves > 1<<destRows {
+		return fmt.Errorf("can't remap %d leaves to %d rows",
+			f.numLeaves, destRows)
+	}
+
+	// rows only move left, and each row's new spot is past where the row
+	// below it used to be, so going up from row 1 never overwrites anything
+	// not yet moved.  Row 0 doesn't move.
+	for h := uint8(1); h <= destRows; h++ {
+		from := parentMany(0, h, f.rows)
+		to := parentMany(0, h, destRows)
+		for x := uint64(0); x < 1<<(destRows-h); x++ {
+			f.data.write(to+x, f.data.read(from+x))
+		}
+	}
+
+	for pos := uint64(2<<destRows) - 1; pos < (2<<f.rows)-1; pos++ {
+		f.data.write(pos, empty)
 	}
 
 	f.rows = destRows
 	return nil
 }
 
+// ShrinkFile brings the forest down to as few rows as its leaves need and
+// truncates the disk or cache forest file to just those rows.  The file
+// otherwise never gets smaller: rows only go up in Modify, and the
+// DiskForest allocates twice what it needs.  Fails before changing anything
+// if a leaf or root would end up past the new end.
+func (f *Forest) ShrinkFile() error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	var file *os.File
+	switch d := f.data.(type) {
+	case *diskForestData:
+		err := d.Flush()
+		if err != nil {
+			return err
+		}
+		file = d.file
+	case *cacheForestData:
+		// writes the whole cache out and empties it
+		flushCacheToDisk(d)
+		file = d.file
+	default:
+		return fmt.Errorf("ShrinkFile: %T has no file to shrink", f.data)
+	}
+
+	destRows := treeRows(f.numLeaves)
+	if destRows > f.rows {
+		return fmt.Errorf("ShrinkFile: %d leaves but only %d rows",
+			f.numLeaves, f.rows)
+	}
+	newSize := uint64(2<<destRows) - 1
+
+	// make sure everything live fits
+	for _, pos := range f.positionMap {
+		if pos >= f.numLeaves {
+			return fmt.Errorf("ShrinkFile: leaf at %d past %d leaves",
+				pos, f.numLeaves)
+		}
+	}
+	var rootPositions []uint64
+	getRootsForwards(f.numLeaves, f.rows, &rootPositions)
+	for _, pos := range rootPositions {
+		if detectRow(pos, f.rows) > destRows {
+			return fmt.Errorf("ShrinkFile: root at %d is above %d rows",
+				pos, destRows)
+		}
+	}
+
+	roots := f.GetRoots()
+	if destRows < f.rows {
+		err := f.reMapDown(destRows)
+		if err != nil {
+			return err
+		}
+	}
+	newRoots := f.GetRoots()
+	if len(roots) != len(newRoots) {
+		return fmt.Errorf("ShrinkFile: %d roots before but %d after",
+			len(roots), len(newRoots))
+	}
+	for i := range roots {
+		if roots[i] != newRoots[i] {
+			return fmt.Errorf("ShrinkFile: root %d changed from %x to %x",
+				i, roots[i][:4], newRoots[i][:4])
+		}
+	}
+
+	switch d := f.data.(type) {
+	case *diskForestData:
+		err := d.Flush()
+		if err != nil {
+			return err
+		}
+	case *cacheForestData:
+		flushCacheToDisk(d)
+		d.hashCount = newSize
+	}
+	return file.Truncate(int64(newSize * leafSize))
+}
+
 // sanity checks forest sanity: does numleaves make sense, and are the roots
 // populated?
 func (f *Forest) sanity() error {
@@ -526,9 +1175,14 @@ func (f *Forest) sanity() error {
 		}
 	}
 
-	if uint64(len(f.positionMap)) > f.numLeaves {
+	if uint64(f.numPositions()) > f.numLeaves {
 		return fmt.Errorf("sanity: positionMap %d leaves but forest %d leaves",
-			len(f.positionMap), f.numLeaves)
+			f.numPositions(), f.numLeaves)
+	}
+
+	// slow, so only when debugging
+	if verbose {
+		return f.CheckConsistency()
 	}
 
 	return nil
@@ -536,20 +1190,146 @@ func (f *Forest) sanity() error {
 
 // PosMapSanity is costly / slow: check that everything in posMap is correct
 func (f *Forest) PosMapSanity() error {
+	return f.posMapSanity(context.Background())
+}
+
+// posMapSanity is PosMapSanity, stopping if ctx is done.
+func (f *Forest) posMapSanity(ctx context.Context) error {
 	for i := uint64(0); i < f.numLeaves; i++ {
-		if f.positionMap[f.data.read(i).Mini()] != i {
+		if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return fmt.Errorf("stopped checking positionMap at leaf %d "+
+				"of %d: %w", i, f.numLeaves, ctx.Err())
+		}
+		pos, _ := f.leafPosition(f.data.read(i))
+		if pos != i {
 			return fmt.Errorf("positionMap error: map says %x @%d but @%d",
-				f.data.read(i).Prefix(), f.positionMap[f.data.read(i).Mini()], i)
+				f.data.read(i).Prefix(), pos, i)
+		}
+	}
+	return nil
+}
+
+// AssertInvariants runs every check there is on the forest: sanity and
+// Audit.  Slow; meant for tests and debugging.
+func (f *Forest) AssertInvariants() error {
+	err := f.sanity()
+	if err != nil {
+		return err
+	}
+	return f.Audit()
+}
+
+// Audit recomputes every internal node from its children, bottom up, and
+// gives an error for the first one that doesn't match what's stored.  Then
+// it checks the positionMap against the leaves both ways.  It only reads
+// from f.data as it goes, so it doesn't need more memory for big disk
+// forests, but it does read the whole forest.
+func (f *Forest) Audit() error {
+	return f.AuditCtx(context.Background())
+}
+
+// AuditCtx is Audit, but stops with an error wrapping ctx's error if ctx is
+// done before it's through.
+func (f *Forest) AuditCtx(ctx context.Context) error {
+	// a node at row r and index i in that row exists if all the leaves
+	// under it do, which is when i < numLeaves >> r
+	for row := uint8(0); row < f.rows; row++ {
+		rowStart := parentMany(0, row, f.rows)
+		parentStart := parent(rowStart, f.rows)
+		for i := uint64(0); i < f.numLeaves>>(row+1); i++ {
+			if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+				return fmt.Errorf("Audit: stopped at row %d of %d, node "+
+					"%d of %d: %w", row, f.rows, i, f.numLeaves>>(row+1),
+					ctx.Err())
+			}
+			l := f.data.read(rowStart + (i << 1))
+			r := f.data.read(rowStart + (i << 1) + 1)
+			if l == empty || r == empty {
+				return fmt.Errorf("Audit: empty child under %d",
+					parentStart+i)
+			}
+			p := f.data.read(parentStart + i)
+			if p != parentHash(l, r) {
+				return fmt.Errorf("Audit: %d is %x but its "+
+					"children hash to %x", parentStart+i, p.Prefix(),
+					parentHash(l, r).Prefix())
+			}
+		}
+	}
+
+	err := f.posMapSanity(ctx)
+	if err != nil {
+		return fmt.Errorf("Audit: %w", err)
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("Audit: stopped before checking the positionMap "+
+			"entries: %w", ctx.Err())
+	}
+	err = f.CheckConsistency()
+	if err != nil {
+		return fmt.Errorf("Audit: %s", err.Error())
+	}
+	return nil
+}
+
+// CheckConsistency is the other direction of PosMapSanity: go through the
+// positionMap and make sure every entry points to a leaf that's actually
+// there.  Also costly / slow.
+func (f *Forest) CheckConsistency() error {
+	if uint64(f.numPositions()) != f.numLeaves {
+		return fmt.Errorf("CheckConsistency: positionMap has %d entries "+
+			"but forest has %d leaves", f.numPositions(), f.numLeaves)
+	}
+
+	for mini, pos := range f.positionMap {
+		// anything at or past numLeaves is either an internal node or
+		// past the right edge of the forest
+		if pos >= f.numLeaves {
+			return fmt.Errorf("CheckConsistency: positionMap says %x @%d "+
+				"but forest only has %d leaves", mini[:4], pos, f.numLeaves)
+		}
+		got := f.data.read(pos).Mini()
+		if got != mini {
+			return fmt.Errorf("CheckConsistency: positionMap says %x @%d "+
+				"but %x is there", mini[:4], pos, got[:4])
+		}
+	}
+	for h, pos := range f.collidedLeaves {
+		if pos >= f.numLeaves || f.data.read(pos) != h {
+			return fmt.Errorf("CheckConsistency: collided leaf %x not @%d",
+				h[:4], pos)
 		}
 	}
 	return nil
 }
 
 // RestoreForest restores the forest on restart. Needed when resuming after exiting.
-// miscForestFile is where numLeaves and rows is stored
+// miscForestFile is where numLeaves and rows is stored.
+// maxCache means the same thing as it does for NewForest.  WithExpectedLeaves
+// grows the forest to that size once it's restored, so it can't be used with
+// ReadOnly.
 func RestoreForest(
 	miscForestFile *os.File, forestFile *os.File,
-	toRAM, cached bool, cow string, cowMaxCache int) (*Forest, error) {
+	toRAM, cached bool, cow string, maxCache int,
+	opts ...ForestOption) (*Forest, error) {
+
+	return RestoreForestCtx(context.Background(), miscForestFile, forestFile,
+		toRAM, cached, cow, maxCache, opts...)
+}
+
+// RestoreForestCtx is RestoreForest, but stops with an error wrapping ctx's
+// error if ctx is done while a RAM forest is being read in or while the
+// positionMap is being rebuilt, which are the slow parts.  Nothing has been
+// written to the forest files then.
+func RestoreForestCtx(ctx context.Context,
+	miscForestFile *os.File, forestFile *os.File,
+	toRAM, cached bool, cow string, maxCache int,
+	opts ...ForestOption) (*Forest, error) {
+
+	o := getForestOptions(opts)
+	if o.readOnly && o.rows != 0 {
+		return nil, fmt.Errorf("RestoreForest: can't grow a read only forest")
+	}
 
 	// start a forest for restore
 	f := new(Forest)
@@ -562,13 +1342,24 @@ func RestoreForest(
 	// Restore number of rows
 	// TODO optimize away "rows" and only save in minimzed form
 	// (this requires code to shrink the forest
-	binary.Read(miscForestFile, binary.BigEndian, &f.rows)
+	err = binary.Read(miscForestFile, binary.BigEndian, &f.rows)
 	if err != nil {
 		return nil, err
 	}
+	if f.rows > maxRows || f.rows < treeRows(f.numLeaves) {
+		return nil, fmt.Errorf("RestoreForest: %d leaves need %d rows but "+
+			"there are %d: %w", f.numLeaves, treeRows(f.numLeaves), f.rows,
+			ErrForestMismatch)
+	}
+	if cow == "" {
+		err = checkForestFileSize(forestFile, f.rows)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	if cow != "" {
-		cowData, err := loadCowForest(cow, cowMaxCache)
+		cowData, err := loadCowForest(cow, maxCache)
 		if err != nil {
 			return nil, err
 		}
@@ -588,6 +1379,11 @@ func RestoreForest(
 			// documented) maxRW of 1GB.
 			var bytesRead int
 			for bytesRead < len(ramData.m) {
+				if ctx.Err() != nil {
+					return nil, fmt.Errorf("RestoreForest: stopped after "+
+						"reading %d of %d bytes: %w",
+						bytesRead, len(ramData.m), ctx.Err())
+				}
 				n, err := diskData.file.Read(ramData.m[bytesRead:])
 				if err != nil {
 					return nil, err
@@ -599,10 +1395,16 @@ func RestoreForest(
 		} else {
 			if cached {
 				// on disk, with cache
+				cacheRows, err := checkCacheRows(maxCache)
+				if err != nil {
+					return nil, err
+				}
 				cfd := new(cacheForestData)
-				cfd.cache = newDiskForestCache(20)
+				cfd.cache = newDiskForestCache(cacheRows)
 				cfd.file = forestFile
 				f.data = cfd
+			} else if o.uring {
+				f.data = uringOrDisk(forestFile)
 			} else {
 				// on disk, no cache
 				f.data = diskData
@@ -611,34 +1413,224 @@ func RestoreForest(
 		}
 	}
 
+	err = f.checkRestoredLeaves(ctx, o.fullLeafCheck)
+	if err != nil {
+		return nil, err
+	}
+
 	// Restore positionMap by rebuilding from all leaves
-	f.positionMap = make(map[MiniHash]uint64)
-	for i := uint64(0); i < f.numLeaves; i++ {
-		f.positionMap[f.data.read(i).Mini()] = i
+	err = f.rebuildPositionMapCtx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("RestoreForest: %w", err)
 	}
 	if f.positionMap == nil {
 		return nil, fmt.Errorf("Generated positionMap is nil")
 	}
+	err = f.readPresence(filepath.Join(
+		filepath.Dir(miscForestFile.Name()), bloomFileName))
+	if err != nil {
+		return nil, err
+	}
+	err = f.readLeafData(filepath.Join(
+		filepath.Dir(miscForestFile.Name()), leafDataFileName))
+	if err != nil {
+		return nil, err
+	}
 
 	// for cacheForestData the `hashCount` field gets
 	// set throught the size() call.
 	f.data.size()
 
+	// grow now while it's small, instead of on the way to the expected size
+	for f.rows < o.rows {
+		err = f.reMap(f.rows + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// fill the cache in the background instead of a miss at a time
+	if cfd, ok := f.data.(*cacheForestData); ok {
+		cfd.startPrime()
+	}
+	if o.readOnly {
+		f.data = &readOnlyData{ForestData: f.data}
+	}
+
 	return f, nil
 }
 
+// restoreLeafSamples is how many leaves RestoreForest checks are there,
+// without WithFullLeafCheck.
+const restoreLeafSamples = 64
+
+// checkForestFileSize makes sure forestFile is big enough for a forest with
+// rows.  It can be bigger, since forests never shrink their file.
+func checkForestFileSize(forestFile *os.File, rows uint8) error {
+	info, err := forestFile.Stat()
+	if err != nil {
+		return err
+	}
+	positions := (uint64(2) << rows) - 1
+	if uint64(info.Size())/leafSize < positions {
+		return fmt.Errorf("RestoreForest: forest file is %d bytes but %d "+
+			"rows take %d: %w", info.Size(), rows, positions*leafSize,
+			ErrForestMismatch)
+	}
+	return nil
+}
+
+// checkRestoredLeaves makes sure the leaves f's numLeaves says there are
+// aren't empty.  Without full, only restoreLeafSamples of them spread out
+// from first to last are checked.
+func (f *Forest) checkRestoredLeaves(ctx context.Context, full bool) error {
+	step := uint64(1)
+	if !full && f.numLeaves > restoreLeafSamples {
+		step = f.numLeaves / restoreLeafSamples
+	}
+	check := func(pos uint64) error {
+		if f.data.read(pos) == empty {
+			return fmt.Errorf("RestoreForest: leaf %d of %d is empty: %w",
+				pos, f.numLeaves, ErrForestMismatch)
+		}
+		return nil
+	}
+	for i := uint64(0); i*step < f.numLeaves; i++ {
+		if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return fmt.Errorf("RestoreForest: stopped checking leaves at "+
+				"%d of %d: %w", i*step, f.numLeaves, ctx.Err())
+		}
+		err := check(i * step)
+		if err != nil {
+			return err
+		}
+	}
+	// a forest cut short is most likely to be missing the last leaf
+	if f.numLeaves != 0 {
+		return check(f.numLeaves - 1)
+	}
+	return nil
+}
+
+// MaintainCowForest checks the files of a CowForest against its manifest,
+// then removes the files it doesn't use anymore.  The forest can still be
+// used afterwards.
+func (f *Forest) MaintainCowForest() error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return fmt.Errorf("MaintainCowForest: not a CowForest")
+	}
+	err := cow.Check()
+	if err != nil {
+		return err
+	}
+	return cow.Compact()
+}
+
+// CowAudit gives how many nodes under the roots of a CowForest are stored,
+// and how many nodes it has stored in all, in memory and on disk.  The
+// difference is space taken by stale tables and by treeBlocks nothing is
+// in, which MaintainCowForest gets back some of.  Doesn't change anything.
+func (f *Forest) CowAudit() (liveNodes, totalNodes uint64, err error) {
+	cow, ok := f.backingData().(*cowForest)
+	if !ok {
+		return 0, 0, fmt.Errorf("CowAudit: not a CowForest")
+	}
+	return cow.Audit(f.numLeaves)
+}
+
+// SetCacheFlushInterval makes a CacheForest write its cache to disk after
+// every writes hashes go into it, instead of only when it resizes or closes.
+// 0 turns it off.
+func (f *Forest) SetCacheFlushInterval(writes int) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	d, ok := f.data.(*cacheForestData)
+	if !ok {
+		return fmt.Errorf("SetCacheFlushInterval: not a CacheForest")
+	}
+	d.SetFlushInterval(writes)
+	return nil
+}
+
+// CachePrimeProgress gives how many positions a CacheForest has primed its
+// cache with since it was restored, and how many the cache holds.
+func (f *Forest) CachePrimeProgress() (primed, total uint64, err error) {
+	d, ok := f.backingData().(*cacheForestData)
+	if !ok {
+		return 0, 0, fmt.Errorf("CachePrimeProgress: not a CacheForest")
+	}
+	primed, total = d.PrimeProgress()
+	return primed, total, nil
+}
+
+// SetCacheAdaptive lets a CacheForest grow and shrink its cache between
+// minRows and maxRows of leaves when fewer than minHitRatio of the reads
+// from it are hits.  See cacheForestData.SetAdaptive.  A maxRows of 0 turns
+// it back off, leaving the cache the size it got to.
+func (f *Forest) SetCacheAdaptive(
+	minRows, maxRows int, minHitRatio float64) error {
+
+	d, ok := f.backingData().(*cacheForestData)
+	if !ok {
+		return fmt.Errorf("SetCacheAdaptive: not a CacheForest")
+	}
+	return d.SetAdaptive(minRows, maxRows, minHitRatio)
+}
+
+// CacheForestStats returns the cache statistics of a CacheForest.
+func (f *Forest) CacheForestStats() (CacheForestStats, error) {
+	d, ok := f.backingData().(*cacheForestData)
+	if !ok {
+		return CacheForestStats{},
+			fmt.Errorf("CacheForestStats: not a CacheForest")
+	}
+	return d.CacheStats(), nil
+}
+
+// CowCacheStats returns the cache statistics of a CowForest.
+func (f *Forest) CowCacheStats() (CowCacheStats, error) {
+	cow, ok := f.backingData().(*cowForest)
+	if !ok {
+		return CowCacheStats{}, fmt.Errorf("CowCacheStats: not a CowForest")
+	}
+	return cow.CacheStats(), nil
+}
+
+// SetCowMaxCache changes how many MB of ram a CowForest uses, like maxCache
+// does for NewForest.  Making it smaller commits the forest and evicts tables
+// until it fits.
+func (f *Forest) SetCowMaxCache(mb int) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	cow, ok := f.data.(*cowForest)
+	if !ok {
+		return fmt.Errorf("SetCowMaxCache: not a CowForest")
+	}
+	return cow.SetMaxCache(mb)
+}
+
 func (f *Forest) PrintPositionMap() string {
 	var s string
 	for pos := uint64(0); pos < f.numLeaves; pos++ {
 		l := f.data.read(pos).Mini()
-		s += fmt.Sprintf("pos %d, leaf %x map to %d\n", pos, l, f.positionMap[l])
+		s += fmt.Sprintf("pos %d, leaf %s map to %d\n", pos, l, f.positionMap[l])
 	}
 
 	return s
 }
 
-// WriteMiscData writes the numLeaves and rows to miscForestFile
+// WriteMiscData writes the numLeaves and rows to miscForestFile.  If
+// EnableBloomFilter was called, the filter goes to bloom.dat in the same
+// directory.
 func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
 	err := binary.Write(miscForestFile, binary.BigEndian, f.numLeaves)
 	if err != nil {
 		return err
@@ -649,15 +1641,48 @@ func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
 		return err
 	}
 
+	if f.presence.enabled {
+		err = f.writePresence(filepath.Join(
+			filepath.Dir(miscForestFile.Name()), bloomFileName))
+		if err != nil {
+			return err
+		}
+	}
+	err = f.writeLeafData(filepath.Join(
+		filepath.Dir(miscForestFile.Name()), leafDataFileName))
+	if err != nil {
+		return err
+	}
+
 	f.data.close()
 
 	return nil
 }
 
+// Close lets go of what the forest has open: it stops filling the cache,
+// writes out what hasn't been written yet and closes the forest file.  A
+// ReadOnly forest writes nothing.  The forest can't be used after.  The
+// files given to RestoreForest for a RamForest aren't kept, so the caller
+// closes those.
+func (f *Forest) Close() error {
+	if !f.isReadOnly() {
+		f.data.close()
+		return nil
+	}
+	r, ok := f.backingData().(releaser)
+	if !ok {
+		return nil
+	}
+	return r.release()
+}
+
 // WriteForestToDisk writes the whole forest to disk
 // this only makes sense to do if the forest is in ram.  So it'll return
 // an error if it's not a ramForestData
 func (f *Forest) WriteForestToDisk(dumpFile *os.File, ram, cow bool) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
 	// Only the RamForest needs to be written.
 	if ram {
 		ramForest, ok := f.data.(*ramForestData)
@@ -677,6 +1702,75 @@ func (f *Forest) WriteForestToDisk(dumpFile *os.File, ram, cow bool) error {
 	return nil
 }
 
+// ReadAt gives the hash at pos.  Unlike reading f.data directly, it gives an
+// error for positions past the end of the forest data or outside the forest
+// with its current number of leaves, instead of panicking or returning garbage.
+// Empty positions inside the forest give an empty hash and no error.
+func (f *Forest) ReadAt(pos uint64) (Hash, error) {
+	if pos >= f.data.size() {
+		return empty, fmt.Errorf("ReadAt: position %d but forest size is %d",
+			pos, f.data.size())
+	}
+	if !inForest(pos, f.numLeaves, f.rows) {
+		return empty, fmt.Errorf("ReadAt: position %d not in forest with "+
+			"%d leaves", pos, f.numLeaves)
+	}
+	return f.data.read(pos), nil
+}
+
+// RowPositions returns the positions of all the non-empty nodes at row r, in
+// order.  Row 0 is the leaves.
+func (f *Forest) RowPositions(r uint8) ([]uint64, error) {
+	if r > f.rows {
+		return nil, fmt.Errorf("RowPositions: row %d but forest has %d rows",
+			r, f.rows)
+	}
+	start := parentMany(0, r, f.rows)
+	var positions []uint64
+	for pos := start; pos < start+(1<<(f.rows-r)); pos++ {
+		if inForest(pos, f.numLeaves, f.rows) && f.data.read(pos) != empty {
+			positions = append(positions, pos)
+		}
+	}
+	return positions, nil
+}
+
+// Row returns the hashes of all the non-empty nodes at row r, in the same
+// order as RowPositions.  A new node can sync the forest a row at a time
+// with this instead of getting the whole thing at once.
+func (f *Forest) Row(r uint8) ([]Hash, error) {
+	positions, err := f.RowPositions(r)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]Hash, len(positions))
+	for i, pos := range positions {
+		hashes[i] = f.data.read(pos)
+	}
+	return hashes, nil
+}
+
+// RowCount returns how many nodes at row r are non-empty, and how many
+// positions there are at that row.  Both are 0 for rows above the forest.
+func (f *Forest) RowCount(r uint8) (populated, total uint64) {
+	positions, err := f.RowPositions(r)
+	if err != nil {
+		return 0, 0
+	}
+	return uint64(len(positions)), 1 << (f.rows - r)
+}
+
+// ReconstructStats gives the number of leaves and rows in the forest, the
+// same as Pollard.ReconstructStats.
+func (f *Forest) ReconstructStats() (uint64, uint8) {
+	return f.numLeaves, f.rows
+}
+
+// NumLeaves returns the number of leaves that the accumulator has.
+func (f *Forest) NumLeaves() uint64 {
+	return f.numLeaves
+}
+
 // GetRoots returns all the roots of all the trees in the accumulator.
 func (f *Forest) GetRoots() []Hash {
 	positionList := NewPositionList()
@@ -692,17 +1786,18 @@ func (f *Forest) GetRoots() []Hash {
 	return roots
 }
 
+// RootPositions gives the positions of the roots, in the same order as
+// GetRoots, so each root hash can be matched up with where it is.
+func (f *Forest) RootPositions() []uint64 {
+	var positions []uint64
+	getRootsForwards(f.numLeaves, f.rows, &positions)
+	return positions
+}
+
 // Stats returns the current forest statics as a string. This includes
-// number of total leaves, historic hashes, length of the position map,
-// and the size of the forest
+// the Metrics, minihash collisions, memory use and the cache.
 func (f *Forest) Stats() string {
-	s := fmt.Sprintf("numleaves: %d hashesever: %d posmap: %d forest: %d\n",
-		f.numLeaves, f.historicHashes, len(f.positionMap), f.data.size())
-	s += fmt.Sprintf("\thashT: %.2f remT: %.2f (of which MST %.2f) proveT: %.2f",
-		f.timeInHash.Seconds(), f.timeRem.Seconds(), f.timeMST.Seconds(),
-		f.timeInProve.Seconds())
-
-	return s
+	return f.GetStats().String()
 }
 
 // ToString prints out the whole thing.  Only viable for small forests
@@ -714,7 +1809,7 @@ func (f *Forest) ToString() string {
 		s := fmt.Sprintf("can't print %d leaves. roots:\n", f.numLeaves)
 		roots := f.GetRoots()
 		for i, r := range roots {
-			s += fmt.Sprintf("\t%d %x\n", i, r.Mini())
+			s += fmt.Sprintf("\t%d %s\n", i, r.Mini())
 		}
 		return s
 	}
@@ -730,7 +1825,7 @@ func (f *Forest) ToString() string {
 			if ok {
 				val := f.data.read(uint64(pos))
 				if val != empty {
-					valstring = fmt.Sprintf("%x", val[:2])
+					valstring = val.Short()
 				}
 			}
 			if valstring != "" {
@@ -765,10 +1860,14 @@ func (f *Forest) ToString() string {
 
 }
 
-// FindLeaf finds a leave from the positionMap and returns a bool
+// FindLeaf says if leaf is in the forest.  A hash that only shares a
+// leaf's MiniHash isn't.
 func (f *Forest) FindLeaf(leaf Hash) bool {
-	_, found := f.positionMap[leaf.Mini()]
-	return found
+	if f.presence.enabled {
+		return f.Exists(leaf)
+	}
+	_, found := f.PositionOf(leaf)
+	return found && f.checkLookup(leaf) == nil
 }
 
 // AssertEqual compares the two forests. Returns an error if the forests are not equal.
@@ -808,6 +1907,17 @@ func (f *Forest) AssertEqual(compareForest *Forest) error {
 			return err
 		}
 	}
+	if len(f.collidedLeaves) != len(compareForest.collidedLeaves) {
+		return fmt.Errorf("forest has %d collided leaves, compared forest %d",
+			len(f.collidedLeaves), len(compareForest.collidedLeaves))
+	}
+	for h, pos := range f.collidedLeaves {
+		compPos, ok := compareForest.collidedLeaves[h]
+		if !ok || pos != compPos {
+			return fmt.Errorf("collided leaf %s at %d in forest but not in "+
+				"the compared forest", h, pos)
+		}
+	}
 
 	// Each forest needs its own position tracking as they may differ in the
 	// actual forest rows allocated.
@@ -0,0 +1,52 @@
+//go:build go1.18
+// +build go1.18
+
+package accumulator
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// FuzzForestModify applies arbitrary blocks to a forest.  Each block is a
+// byte with the number of adds in the top 4 bits and the number of deletions
+// in the bottom 4, then a byte for the position of each deletion.  Bad
+// deletions have to give an error instead of a panic, and the forest has to
+// stay sane either way.
+func FuzzForestModify(f *testing.F) {
+	f.Add([]byte{0x80, 0x32, 0, 5, 0x01, 3})
+	// out of range and duplicate deletions
+	f.Add([]byte{0x40, 0x01, 4, 0x02, 1, 1})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		forest := NewForest(RamForest, nil, "", 0)
+		var leafNum uint32
+		for len(data) > 0 {
+			numAdds, numDels := int(data[0]>>4), int(data[0]&0x0f)
+			data = data[1:]
+			if numDels > len(data) {
+				numDels = len(data)
+			}
+			dels := make([]uint64, numDels)
+			for i := range dels {
+				dels[i] = uint64(data[i])
+			}
+			data = data[numDels:]
+
+			adds := make([]Leaf, numAdds)
+			for i := range adds {
+				leafNum++
+				binary.BigEndian.PutUint32(adds[i].Hash[:], leafNum)
+			}
+			// errors are fine, but the forest can't be broken afterwards
+			forest.Modify(adds, dels)
+			err := forest.sanity()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = forest.PosMapSanity()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
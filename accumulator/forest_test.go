@@ -1,11 +1,18 @@
 package accumulator
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"testing/quick"
 )
@@ -61,7 +68,10 @@ func TestCowForestAddDelComp(t *testing.T) {
 		fmt.Println(memstring)
 	}
 
-	tmpDir := os.TempDir()
+	tmpDir, err := ioutil.TempDir("", "cowadddelcomp")
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer os.RemoveAll(tmpDir)
 
 	cowF := NewForest(CowForest, nil, tmpDir, 2500)
@@ -100,7 +110,7 @@ func TestCowForestAddDelComp(t *testing.T) {
 		}
 	}
 
-	err := cowF.AssertEqual(memF)
+	err = cowF.AssertEqual(memF)
 	if err != nil {
 		writeLog(cowF, memF)
 		t.Fatal(err)
@@ -110,7 +120,11 @@ func TestCowForestAddDelComp(t *testing.T) {
 func TestCowForestAddDel(t *testing.T) {
 	numAdds := uint32(10)
 
-	tmpDir := os.TempDir()
+	tmpDir, err := ioutil.TempDir("", "cowadddel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
 	cowF := NewForest(CowForest, nil, tmpDir, 500)
 
 	sc := newSimChain(0x07)
@@ -289,6 +303,141 @@ func TestDeleteNonExisting(t *testing.T) {
 	}
 }
 
+// The wrappers trackDirty and Rewind put around the ForestData don't hide
+// that resize only adds empty positions.
+func TestZeroesOnResizeWrapped(t *testing.T) {
+	ram := &ramForestData{}
+	wrapped := []ForestData{
+		ram,
+		&dirtyData{ForestData: ram},
+		&journalData{ForestData: ram},
+		&journalData{ForestData: &dirtyData{ForestData: ram}},
+	}
+	for i, d := range wrapped {
+		if !zeroesOnResize(d) {
+			t.Fatalf("ForestData %d doesn't zero on resize", i)
+		}
+	}
+	if zeroesOnResize(&dirtyData{ForestData: &cowForest{}}) {
+		t.Fatal("cow forest under dirtyData zeroes on resize")
+	}
+}
+
+// Both ways reMapUp moves rows have to end up with the same forest.
+func TestReMapUp(t *testing.T) {
+	var forests [2]*Forest
+	for i := range forests {
+		forests[i] = NewForest(RamForest, nil, "", 0)
+		sc := newSimChain(0x07)
+		adds, _, _ := sc.NextBlock(64)
+		_, err := forests[i].Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// leave some holes in the upper rows
+		_, err = forests[i].Modify(nil, []uint64{3, 20, 21, 40})
+		if err != nil {
+			t.Fatal(err)
+		}
+		forests[i].data.resize((2 << (forests[i].rows + 1)) - 1)
+		forests[i].reMapUp(forests[i].rows+1, i == 0)
+	}
+
+	moved := forests[0].data.(*ramForestData).m
+	copied := forests[1].data.(*ramForestData).m
+	if !bytes.Equal(moved, copied) {
+		t.Fatal("moving and copying the rows gave different forests")
+	}
+	err := forests[0].Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the old rows are gone from the right half of the bottom row
+	for pos := uint64(64); pos < 128; pos++ {
+		if forests[0].data.read(pos) != empty {
+			t.Fatalf("position %d not emptied", pos)
+		}
+	}
+}
+
+func TestAddEmptyLeaf(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	err := f.Add([]Leaf{{Hash: Hash{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adds := []Leaf{{Hash: Hash{2}}, {Hash: empty}}
+	err = f.Add(adds)
+	if !errors.Is(err, ErrEmptyLeaf) {
+		t.Fatalf("Add gave error %v, expected ErrEmptyLeaf", err)
+	}
+	_, err = f.Modify(adds, nil)
+	if !errors.Is(err, ErrEmptyLeaf) {
+		t.Fatalf("Modify gave error %v, expected ErrEmptyLeaf", err)
+	}
+	// the good leaf before the empty one didn't get added either
+	if f.numLeaves != 1 || f.FindLeaf(Hash{2}) {
+		t.Fatalf("forest has %d leaves after adding an empty one", f.numLeaves)
+	}
+}
+
+func TestAddDuplicateLeaf(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	_, err := f.Modify([]Leaf{{Hash: Hash{1}}, {Hash: Hash{2}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := f.GetRoots()
+
+	// twice in the same block
+	adds := []Leaf{{Hash: Hash{3}}, {Hash: Hash{4}}, {Hash: Hash{3}}}
+	err = f.Add(adds)
+	if !errors.Is(err, ErrDuplicateLeaf) {
+		t.Fatalf("Add gave error %v, expected ErrDuplicateLeaf", err)
+	}
+	_, err = f.Modify(adds, nil)
+	if !errors.Is(err, ErrDuplicateLeaf) {
+		t.Fatalf("Modify gave error %v, expected ErrDuplicateLeaf", err)
+	}
+
+	// already added in an earlier block
+	adds = []Leaf{{Hash: Hash{3}}, {Hash: Hash{2}}}
+	err = f.Add(adds)
+	if !errors.Is(err, ErrDuplicateLeaf) {
+		t.Fatalf("Add gave error %v, expected ErrDuplicateLeaf", err)
+	}
+	_, err = f.Modify(adds, nil)
+	if !errors.Is(err, ErrDuplicateLeaf) {
+		t.Fatalf("Modify gave error %v, expected ErrDuplicateLeaf", err)
+	}
+
+	if f.numLeaves != 2 || f.FindLeaf(Hash{3}) || !reflect.DeepEqual(f.GetRoots(), roots) {
+		t.Fatalf("forest changed after rejected adds, %d leaves", f.numLeaves)
+	}
+
+	// a leaf can come back once it's deleted, even in the same block
+	_, err = f.Modify([]Leaf{{Hash: Hash{2}}}, []uint64{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, []uint64{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Add([]Leaf{{Hash: Hash{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.numLeaves != 2 || !f.FindLeaf(Hash{1}) || !f.FindLeaf(Hash{2}) {
+		t.Fatalf("re-added leaves missing, %d leaves", f.numLeaves)
+	}
+	err = f.sanity()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestSmallRandomForests(t *testing.T) {
 	rand := rand.New(rand.NewSource(0))
 
@@ -387,3 +536,1286 @@ func TestSmallRandomForests(t *testing.T) {
 		}
 	}
 }
+
+func TestForestRehash(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 50; b++ {
+		adds, _, delHashes := sc.NextBlock(10)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	roots := f.GetRoots()
+
+	// wipe out everything above the bottom row
+	for pos := uint64(1 << f.rows); pos < f.data.size(); pos++ {
+		f.data.write(pos, empty)
+	}
+
+	err := f.Rehash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roots, f.GetRoots()) {
+		t.Fatalf("roots after Rehash don't match.\nwant %v\ngot  %v",
+			roots, f.GetRoots())
+	}
+
+	// rehashing an already correct forest shouldn't change anything
+	err = f.Rehash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roots, f.GetRoots()) {
+		t.Fatal("second Rehash changed the roots")
+	}
+}
+
+func TestForestCheckConsistency(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(10)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CheckConsistency()
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	}
+
+	// swap a real leaf's entry for a stale one pointing at a leaf that's
+	// holding a different hash.
+	leaf := f.data.read(0).Mini()
+	delete(f.positionMap, leaf)
+	stale := Hash{0xde, 0xad, 0xbe, 0xef}
+	f.positionMap[stale.Mini()] = 1
+	if f.CheckConsistency() == nil {
+		t.Fatal("CheckConsistency didn't catch a stale positionMap entry")
+	}
+
+	// entry pointing past the leaves
+	delete(f.positionMap, stale.Mini())
+	f.positionMap[leaf] = f.numLeaves
+	if f.CheckConsistency() == nil {
+		t.Fatal("CheckConsistency didn't catch a non-leaf position")
+	}
+}
+
+// applyRandomBlocks runs blocks random blocks through Modify, checking
+// AssertInvariants after each one.  The same seed always gives the same
+// adds and deletes, so a failure can be rerun and debugged.
+func applyRandomBlocks(f *Forest, seed int64, blocks int) error {
+	rnd := rand.New(rand.NewSource(seed))
+
+	var leafNum uint64
+	for b := 0; b < blocks; b++ {
+		// sometimes wipe out most of the forest to hit the small cases
+		var numDels int
+		if f.numLeaves > 0 {
+			if rnd.Intn(10) == 0 {
+				numDels = int(f.numLeaves) - rnd.Intn(3)
+				if numDels < 0 {
+					numDels = 0
+				}
+			} else {
+				numDels = rnd.Intn(int(f.numLeaves/2) + 1)
+			}
+		}
+
+		// random distinct leaf positions to delete
+		dels := rnd.Perm(int(f.numLeaves))[:numDels]
+		delPos := make([]uint64, numDels)
+		for i, d := range dels {
+			delPos[i] = uint64(d)
+		}
+
+		adds := make([]Leaf, rnd.Intn(33))
+		for i := range adds {
+			leafNum++
+			// leafNum keeps the hashes unique, the rest is just noise
+			rnd.Read(adds[i].Hash[:])
+			adds[i].Hash[0] = byte(leafNum >> 16)
+			adds[i].Hash[1] = byte(leafNum >> 8)
+			adds[i].Hash[2] = byte(leafNum)
+			adds[i].Hash[3] = 0xff
+		}
+
+		_, err := f.Modify(adds, delPos)
+		if err != nil {
+			return fmt.Errorf("seed %d block %d: %s", seed, b, err.Error())
+		}
+		err = f.AssertInvariants()
+		if err != nil {
+			return fmt.Errorf("seed %d block %d %d adds %d dels: %s",
+				seed, b, len(adds), len(delPos), err.Error())
+		}
+	}
+	return nil
+}
+
+func TestRandomBlocks(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		f := NewForest(RamForest, nil, "", 0)
+		err := applyRandomBlocks(f, seed, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// AssertInvariants should notice a bad internal node that the other checks
+// don't look at.
+func TestAssertInvariantsBadNode(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	err := applyRandomBlocks(f, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.numLeaves < 2 {
+		t.Skip("not enough leaves for an internal node")
+	}
+
+	pos := parent(0, f.rows)
+	f.data.write(pos, Hash{0xde, 0xad})
+	if f.AssertInvariants() == nil {
+		t.Fatalf("expected AssertInvariants to catch bad node at %d", pos)
+	}
+}
+
+func TestForestWatch(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	leaf := func(block, i uint8) Hash {
+		return Hash{block + 1, i, 0xaa}
+	}
+	type blockMod struct {
+		adds, dels [][2]uint8
+		unwatch    [][2]uint8
+	}
+	all := func(block uint8) (l [][2]uint8) {
+		for i := uint8(0); i < 8; i++ {
+			l = append(l, [2]uint8{block, i})
+		}
+		return
+	}
+	mods := []blockMod{
+		{adds: all(0)},
+		{adds: all(1), dels: [][2]uint8{{0, 0}, {0, 3}}},
+		{adds: all(2), dels: [][2]uint8{{0, 5}, {1, 2}, {1, 6}}},
+		{dels: [][2]uint8{{1, 4}, {0, 1}, {2, 0}},
+			unwatch: [][2]uint8{{1, 4}}},
+		// bring back a deleted leaf
+		{adds: [][2]uint8{{0, 0}}, dels: [][2]uint8{{0, 7}, {1, 0}, {2, 1}}},
+	}
+
+	watched := make(map[Hash]bool)
+	events := make(chan LeafEvent, 100)
+	for _, w := range [][2]uint8{{0, 0}, {0, 1}, {0, 3}, {0, 5}, {0, 7},
+		{1, 2}, {1, 4}, {1, 6}, {2, 0}, {2, 5}} {
+		watched[leaf(w[0], w[1])] = true
+		f.Watch(leaf(w[0], w[1]), events)
+	}
+
+	for b, mod := range mods {
+		for _, u := range mod.unwatch {
+			delete(watched, leaf(u[0], u[1]))
+			f.Unwatch(leaf(u[0], u[1]))
+		}
+
+		adds := make([]Leaf, len(mod.adds))
+		for i, a := range mod.adds {
+			adds[i].Hash = leaf(a[0], a[1])
+		}
+		dels := make([]uint64, len(mod.dels))
+		for i, d := range mod.dels {
+			dels[i] = f.positionMap[leaf(d[0], d[1]).Mini()]
+		}
+
+		// deletions come first in position order, then the adds
+		var expect []LeafEvent
+		sortedDels := make([]uint64, len(dels))
+		copy(sortedDels, dels)
+		sortUint64s(sortedDels)
+		for _, pos := range sortedDels {
+			h := f.data.read(pos)
+			if watched[h] {
+				expect = append(expect,
+					LeafEvent{Type: LeafDeleted, Hash: h, Position: pos})
+			}
+		}
+		for i, a := range adds {
+			if watched[a.Hash] {
+				expect = append(expect, LeafEvent{Type: LeafAdded,
+					Hash: a.Hash, Position: f.numLeaves - uint64(len(dels)) +
+						uint64(i)})
+			}
+		}
+
+		_, err := f.Modify(adds, dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, exp := range expect {
+			select {
+			case ev := <-events:
+				if ev != exp {
+					t.Fatalf("block %d event %d got %v expected %v",
+						b, i, ev, exp)
+				}
+			default:
+				t.Fatalf("block %d missing event %d %v", b, i, exp)
+			}
+		}
+		select {
+		case ev := <-events:
+			t.Fatalf("block %d unexpected event %v", b, ev)
+		default:
+		}
+	}
+}
+
+// Grow a disk and a cache forest, delete most of the leaves, shrink, and
+// make sure the file got smaller and the forest still works.
+func TestForestDirtyCallback(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got [][]uint64
+	var modifyErr error
+	f.SetDirtyCallback(func(changed []uint64) {
+		got = append(got, changed)
+		// can't change the forest from in here
+		_, modifyErr = f.Modify([]Leaf{{Hash: Hash{0xff}}}, nil)
+	})
+
+	before := make([]Hash, f.data.size())
+	for i := range before {
+		before[i] = f.data.read(uint64(i))
+	}
+	// deleting leaf 5 moves 4 up to 10, swapping it with 6 & 7's subtree,
+	// and 13 and the root get rehashed
+	ub, err := f.Modify(nil, []uint64{5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []uint64{4, 5, 6, 7, 10, 11, 13, 14}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], expect) {
+		t.Fatalf("callback got %v, expected %v", got, expect)
+	}
+	if modifyErr == nil {
+		t.Fatal("Modify from the dirty callback worked")
+	}
+	if f.numLeaves != 7 {
+		t.Fatalf("%d leaves, expected 7", f.numLeaves)
+	}
+	// everything whose hash changed is in there
+	given := make(map[uint64]bool)
+	for _, pos := range got[0] {
+		given[pos] = true
+	}
+	for i := range before {
+		if f.data.read(uint64(i)) != before[i] && !given[uint64(i)] {
+			t.Fatalf("position %d changed but wasn't given", i)
+		}
+	}
+
+	// undo changes the same positions back
+	err = f.Undo(*ub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("callback called %d times, expected 2", len(got))
+	}
+	for i := range before {
+		if f.data.read(uint64(i)) != before[i] {
+			t.Fatalf("position %d not undone", i)
+		}
+	}
+
+	f.SetDirtyCallback(nil)
+	_, err = f.Modify(nil, []uint64{5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatal("callback called after being cleared")
+	}
+}
+
+func TestForestShrinkFile(t *testing.T) {
+	for _, forestType := range []ForestType{DiskForest, CacheForest} {
+		forestFile, err := ioutil.TempFile("", "shrinkforest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(forestFile.Name())
+
+		f := NewForest(forestType, forestFile, "", 2)
+		memF := NewForest(RamForest, nil, "", 0)
+
+		adds := make([]Leaf, 1000)
+		for i := range adds {
+			adds[i].Hash[0] = byte(i >> 8)
+			adds[i].Hash[1] = byte(i)
+			adds[i].Hash[2] = 0xee
+		}
+		dels := make([]uint64, 900)
+		for i := range dels {
+			dels[i] = uint64(i + 50)
+		}
+		for _, forest := range []*Forest{f, memF} {
+			_, err = forest.Modify(adds, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = forest.Modify(nil, dels)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if f.rows != 10 {
+			t.Fatalf("%d rows before shrinking, expected 10", f.rows)
+		}
+		roots := f.GetRoots()
+
+		err = f.ShrinkFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f.rows != 7 {
+			t.Fatalf("%d rows after shrinking, expected 7", f.rows)
+		}
+		stat, err := forestFile.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() != ((2<<7)-1)*leafSize {
+			t.Fatalf("file is %d bytes after shrinking, expected %d",
+				stat.Size(), ((2<<7)-1)*leafSize)
+		}
+		if !reflect.DeepEqual(roots, f.GetRoots()) {
+			t.Fatal("roots changed after shrinking")
+		}
+		err = f.AssertInvariants()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// keep going, growing back past the old size
+		sc := newSimChain(0x07)
+		for b := 0; b < 20; b++ {
+			adds, _, delHashes := sc.NextBlock(100)
+			for _, forest := range []*Forest{f, memF} {
+				bp, err := forest.ProveBatch(delHashes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = forest.Modify(adds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(f.GetRoots(), memF.GetRoots()) {
+				t.Fatalf("block %d: roots differ from ram forest", b)
+			}
+			err = f.AssertInvariants()
+			if err != nil {
+				t.Fatalf("block %d: %s", b, err.Error())
+			}
+		}
+	}
+
+	err := NewForest(RamForest, nil, "", 0).ShrinkFile()
+	if err == nil {
+		t.Fatal("expected error shrinking a ram forest")
+	}
+}
+
+func TestForestReadAt(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	// nothing to read in an empty forest
+	_, err := f.ReadAt(0)
+	if err == nil {
+		t.Fatal("read position 0 of an empty forest")
+	}
+
+	adds := make([]Leaf, 5)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5 leaves take 3 rows, so 16 positions; 8, 9 and 12 are the 4 leaf
+	// subtree and 4 is on its own
+	for _, pos := range []uint64{0, 4, 8, 9, 12} {
+		h, err := f.ReadAt(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h != f.data.read(pos) {
+			t.Fatalf("ReadAt(%d) gave %s, expected %s", pos, h, f.data.read(pos))
+		}
+	}
+	// in the forest data but not the forest, or past the end of both
+	for _, pos := range []uint64{5, 7, 10, 13, 14, 16, 1 << 40} {
+		_, err := f.ReadAt(pos)
+		if err == nil {
+			t.Fatalf("read position %d in forest with 5 leaves", pos)
+		}
+	}
+
+	// proofs with positions that don't exist are just wrong
+	for _, pos := range []uint64{5, 14, 1 << 40} {
+		if f.Verify(Proof{Position: pos, Payload: Hash{1}}) {
+			t.Fatalf("proof for position %d verified", pos)
+		}
+	}
+}
+
+func TestForestRow(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a full bottom row is all the leaves
+	leaves, err := f.Row(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(leaves)) != f.numLeaves {
+		t.Fatalf("%d hashes at row 0, expected %d", len(leaves), f.numLeaves)
+	}
+	for i, h := range leaves {
+		if h != adds[i].Hash {
+			t.Fatalf("leaf %d is %s, expected %s", i, h, adds[i].Hash)
+		}
+	}
+	// and the top row is the root
+	top, err := f.Row(f.rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := f.GetRoots()
+	if len(top) != 1 || top[0] != roots[0] {
+		t.Fatalf("top row is %s, expected roots %s", top, roots)
+	}
+	_, err = f.Row(f.rows + 1)
+	if err == nil {
+		t.Fatal("read a row above the forest")
+	}
+
+	// with 5 leaves the roots are at rows 2 and 0, and row 1 has the 2
+	// parents of the 4 leaf subtree
+	bp, err := f.ProveBatch([]Hash{adds[5].Hash, adds[6].Hash, adds[7].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, bp.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for r, expected := range []uint64{5, 2, 1, 0} {
+		populated, total := f.RowCount(uint8(r))
+		if populated != expected || total != 8>>uint(r) {
+			t.Fatalf("row %d has %d of %d, expected %d of %d",
+				r, populated, total, expected, 8>>uint(r))
+		}
+	}
+	positionList := NewPositionList()
+	defer positionList.Free()
+	getRootsForwards(f.numLeaves, f.rows, &positionList.list)
+	for _, root := range positionList.list {
+		r := detectRow(root, f.rows)
+		positions, err := f.RowPositions(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes, err := f.Row(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found bool
+		for i, pos := range positions {
+			if pos == root && hashes[i] == f.data.read(root) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("root at %d not in row %d positions %v", root, r, positions)
+		}
+	}
+}
+
+func TestForestRootPositions(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	if len(f.RootPositions()) != 0 {
+		t.Fatalf("empty forest has roots at %v", f.RootPositions())
+	}
+	adds := make([]Leaf, 13)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := f.GetRoots()
+	positions := f.RootPositions()
+	// 13 leaves makes trees of 8, 4 and 1
+	if len(positions) != len(roots) || len(roots) != 3 {
+		t.Fatalf("%d root positions and %d roots, expected 3",
+			len(positions), len(roots))
+	}
+	for i, pos := range positions {
+		h := f.data.read(pos)
+		if h == empty {
+			t.Fatalf("root %d at %d is empty", i, pos)
+		}
+		if h != roots[i] {
+			t.Fatalf("root %d at %d is %s, GetRoots has %s",
+				i, pos, h, roots[i])
+		}
+		if f.RootCursor(i).Position() != pos {
+			t.Fatalf("root %d at %d but its cursor is at %d",
+				i, pos, f.RootCursor(i).Position())
+		}
+	}
+}
+
+func TestForestBulkDelete(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 16)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing happens if any of them are missing
+	_, err = f.BulkDelete([]Hash{adds[3].Hash, {0xee}})
+	if !errors.Is(err, ErrLeafNotFound) {
+		t.Fatalf("got error %v, expected ErrLeafNotFound", err)
+	}
+	if f.numLeaves != 16 || !f.FindLeaf(adds[3].Hash) {
+		t.Fatal("BulkDelete with a missing leaf changed the forest")
+	}
+
+	dels, err := f.BulkDelete([]Hash{adds[9].Hash, adds[3].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dels, []uint64{9, 3}) {
+		t.Fatalf("deleted %v, expected [9 3]", dels)
+	}
+	if f.numLeaves != 14 || f.FindLeaf(adds[3].Hash) ||
+		f.FindLeaf(adds[9].Hash) {
+		t.Fatal("leaves still there after BulkDelete")
+	}
+	err = f.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForestPositions(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 16)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0x90}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same MiniHash as leaf 5, but not in the forest
+	collider := adds[5].Hash
+	collider[31] = 1
+	absent := []Hash{{0xee}, collider, {0xef}}
+	found, missing, err := f.Positions([]Hash{absent[0], adds[12].Hash,
+		absent[1], adds[5].Hash, adds[0].Hash, absent[2]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []uint64{12, 5, 0}) {
+		t.Fatalf("found %v, expected [12 5 0]", found)
+	}
+	if !reflect.DeepEqual(missing, absent) {
+		t.Fatalf("missing %v, expected %v", missing, absent)
+	}
+
+	// the positions work as dels
+	_, err = f.Modify(nil, []uint64{0, 5, 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, missing, err = f.Positions([]Hash{adds[5].Hash})
+	if err != nil || len(found) != 0 || len(missing) != 1 {
+		t.Fatalf("found %v missing %v after deleting (%v)", found, missing, err)
+	}
+}
+
+// benchmarkDelete10k deletes 10k of 20k leaves with del, which is given the
+// hashes to delete.
+func benchmarkDelete10k(b *testing.B, del func(f *Forest, hs []Hash) error) {
+	adds := make([]Leaf, 20000)
+	for i := range adds {
+		adds[i].Hash = Hash{1, uint8(i), uint8(i >> 8)}
+	}
+	delHashes := make([]Hash, 10000)
+	for i := range delHashes {
+		delHashes[i] = adds[i*2].Hash
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		f := NewForest(RamForest, nil, "", 0)
+		_, err := f.Modify(adds, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		err = del(f, delHashes)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBulkDelete(b *testing.B) {
+	benchmarkDelete10k(b, func(f *Forest, hs []Hash) error {
+		_, err := f.BulkDelete(hs)
+		return err
+	})
+}
+
+func BenchmarkDeleteByProve(b *testing.B) {
+	benchmarkDelete10k(b, func(f *Forest, hs []Hash) error {
+		dels := make([]uint64, len(hs))
+		for i, h := range hs {
+			p, err := f.Prove(h)
+			if err != nil {
+				return err
+			}
+			dels[i] = p.Position
+		}
+		_, err := f.Modify(nil, dels)
+		return err
+	})
+}
+
+func TestForestAudit(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 11)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err := f.Modify(adds, []uint64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 11 leaves in 4 rows: 16-20 are row 1, 24-25 row 2, 28 row 3.  A bad
+	// node at 25 makes 28 wrong too, but 25 is the first one found.
+	good := f.data.read(25)
+	f.data.write(25, Hash{0xba, 0xd})
+	err = f.Audit()
+	if err == nil || !strings.Contains(err.Error(), "Audit: 25 is") {
+		t.Fatalf("got error %v, expected position 25 to be wrong", err)
+	}
+	f.data.write(25, good)
+
+	// a leaf that isn't in the positionMap
+	delete(f.positionMap, adds[10].Mini())
+	err = f.Audit()
+	if err == nil || !strings.Contains(err.Error(), "positionMap") {
+		t.Fatalf("got error %v, expected positionMap error", err)
+	}
+	f.positionMap[adds[10].Mini()] = 10
+	err = f.Audit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForestExpectedLeaves(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "expectedleaves")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	// 4000 leaves is 12 rows
+	sized := []*Forest{
+		NewForest(RamForest, nil, "", 0, WithExpectedLeaves(4000)),
+		NewForest(DiskForest, forestFile, "", 0, WithExpectedLeaves(4000)),
+	}
+	grown := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 30; b++ {
+		adds, _, delHashes := sc.NextBlock(100)
+		for _, f := range append(sized, grown) {
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, f := range sized {
+			if f.rows != 12 {
+				t.Fatalf("block %d: forest %d has %d rows, expected 12",
+					b, i, f.rows)
+			}
+			if !reflect.DeepEqual(f.GetRoots(), grown.GetRoots()) {
+				t.Fatalf("block %d: forest %d roots differ", b, i)
+			}
+			err = f.AssertInvariants()
+			if err != nil {
+				t.Fatalf("block %d: %s", b, err.Error())
+			}
+		}
+	}
+
+	// a restored forest grows to the expected size right away
+	miscFile, err := ioutil.TempFile("", "expectedleavesmisc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(miscFile.Name())
+	defer miscFile.Close()
+	err = grown.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumpFile, err := ioutil.TempFile("", "expectedleavesdump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dumpFile.Name())
+	defer dumpFile.Close()
+	err = grown.WriteForestToDisk(dumpFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile.Seek(0, 0)
+	dumpFile.Seek(0, 0)
+	restored, err := RestoreForest(miscFile, dumpFile, true, false, "", 0,
+		WithExpectedLeaves(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.rows != 20 {
+		t.Fatalf("restored forest has %d rows, expected 20", restored.rows)
+	}
+	if !reflect.DeepEqual(restored.GetRoots(), grown.GetRoots()) {
+		t.Fatal("restored roots differ")
+	}
+	err = restored.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForestModifyMany(t *testing.T) {
+	seq := NewForest(RamForest, nil, "", 0)
+	many := NewForest(RamForest, nil, "", 0)
+
+	// 10 blocks one at a time, saving what they did
+	sc := newSimChain(0x07)
+	blocks := make([]BlockModify, 10)
+	seqUndos := make([]*UndoBlock, len(blocks))
+	for i := range blocks {
+		adds, _, delHashes := sc.NextBlock(150)
+		bp, err := seq.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks[i] = BlockModify{Adds: adds, Dels: bp.Targets}
+		seqUndos[i], err = seq.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// then all at once in two halves
+	var undos []*UndoBlock
+	for _, half := range [][]BlockModify{blocks[:5], blocks[5:]} {
+		ubs, err := many.ModifyMany(half)
+		if err != nil {
+			t.Fatal(err)
+		}
+		undos = append(undos, ubs...)
+	}
+	if !reflect.DeepEqual(many.GetRoots(), seq.GetRoots()) {
+		t.Fatal("ModifyMany roots differ from Modify")
+	}
+	if !reflect.DeepEqual(undos, seqUndos) {
+		t.Fatal("ModifyMany undo data differs from Modify")
+	}
+	err := many.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bad block at the end puts everything back
+	roots, numLeaves, rows := many.GetRoots(), many.numLeaves, many.rows
+	adds, _, _ := sc.NextBlock(2000)
+	_, err = many.ModifyMany([]BlockModify{
+		{Adds: adds},
+		{Adds: []Leaf{{}}},
+	})
+	if !errors.Is(err, ErrEmptyLeaf) {
+		t.Fatalf("got error %v, expected ErrEmptyLeaf", err)
+	}
+	if many.numLeaves != numLeaves || many.rows != rows ||
+		!reflect.DeepEqual(many.GetRoots(), roots) {
+		t.Fatal("forest changed by a failed ModifyMany")
+	}
+	err = many.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForestSetRows(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	err := f.SetRows(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := f.data.size()
+
+	adds := make([]Leaf, 100)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0xab}
+	}
+	for i := 0; i < len(adds); i += 10 {
+		_, err = f.Modify(adds[i:i+10], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// a reMap would have changed the rows or resized the data
+		if f.rows != 10 || f.data.size() != size {
+			t.Fatalf("%d leaves: %d rows, size %d, expected 10 rows, size %d",
+				f.numLeaves, f.rows, f.data.size(), size)
+		}
+	}
+	expected := NewForest(RamForest, nil, "", 0)
+	_, err = expected.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.GetRoots(), expected.GetRoots()) {
+		t.Fatal("roots differ from a forest that wasn't given rows")
+	}
+
+	// down to the fewest rows 100 leaves fit in, and no further
+	err = f.SetRows(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.GetRoots(), expected.GetRoots()) {
+		t.Fatal("roots changed shrinking to 7 rows")
+	}
+	err = f.SetRows(6)
+	if err == nil || f.rows != 7 {
+		t.Fatalf("100 leaves set to 6 rows, now %d rows", f.rows)
+	}
+}
+
+// TestForestTypeEquivalence does the same modifies on every type of forest
+// and checks they all end up with the same roots after each one.  The disk
+// backed types are slow so they're skipped with -short.
+func TestForestTypeEquivalence(t *testing.T) {
+	type namedForest struct {
+		name string
+		f    *Forest
+	}
+	forests := []namedForest{{"ram", NewForest(RamForest, nil, "", 0)}}
+
+	tmpFile := func(name string) *os.File {
+		file, err := ioutil.TempFile("", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	cacheFile := tmpFile("equivcache")
+	defer os.Remove(cacheFile.Name())
+	forests = append(forests,
+		namedForest{"cache", NewForest(CacheForest, cacheFile, "", 2)})
+
+	if !testing.Short() {
+		diskFile := tmpFile("equivdisk")
+		defer os.Remove(diskFile.Name())
+		cowDir, err := ioutil.TempDir("", "equivcow")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(cowDir)
+		forests = append(forests,
+			namedForest{"disk", NewForest(DiskForest, diskFile, "", 0)},
+			namedForest{"cow", NewForest(CowForest, nil, cowDir, 100)})
+	}
+
+	rnd := rand.New(rand.NewSource(847))
+	var added uint32
+	for round := 0; round < 20; round++ {
+		adds := make([]Leaf, rnd.Intn(200))
+		for i := range adds {
+			binary.BigEndian.PutUint32(adds[i].Hash[:], added)
+			adds[i].Hash[20] = 0xee
+			added++
+		}
+		// delete up to a third of the leaves, at the same positions in all
+		// of them
+		numLeaves := forests[0].f.numLeaves
+		var dels []uint64
+		if numLeaves > 0 {
+			chosen := make(map[uint64]bool)
+			for i := rnd.Intn(int(numLeaves)/3 + 1); i > 0; i-- {
+				pos := uint64(rnd.Int63n(int64(numLeaves)))
+				if !chosen[pos] {
+					chosen[pos] = true
+					dels = append(dels, pos)
+				}
+			}
+		}
+
+		for _, nf := range forests {
+			_, err := nf.f.Modify(adds, dels)
+			if err != nil {
+				t.Fatalf("round %d %s forest: %s", round, nf.name, err.Error())
+			}
+		}
+
+		roots := forests[0].f.GetRoots()
+		for _, nf := range forests[1:] {
+			if nf.f.numLeaves != forests[0].f.numLeaves {
+				t.Fatalf("round %d %s forest has %d leaves, ram %d", round,
+					nf.name, nf.f.numLeaves, forests[0].f.numLeaves)
+			}
+			fRoots := nf.f.GetRoots()
+			if !reflect.DeepEqual(fRoots, roots) {
+				t.Fatalf("round %d %s forest roots differ from ram\n%v\n%v",
+					round, nf.name, fRoots, roots)
+			}
+		}
+	}
+	for _, nf := range forests[1:] {
+		err := nf.f.AssertEqual(forests[0].f)
+		if err != nil {
+			t.Fatalf("%s forest: %s", nf.name, err.Error())
+		}
+	}
+}
+
+// A forest that's almost full can't get more leaves than MaxLeaves, or rows
+// past maxRows, and gets an error instead of wrapping around.
+func TestForestFull(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	// no data is behind this, but nothing should get far enough to touch it
+	f.numLeaves = MaxLeaves - 2
+	f.rows = maxRows
+
+	adds := []Leaf{{Hash: Hash{1}}, {Hash: Hash{2}}, {Hash: Hash{3}}}
+	_, err := f.Modify(adds, nil)
+	if !errors.Is(err, ErrForestFull) {
+		t.Fatalf("Modify gave error %v, expected ErrForestFull", err)
+	}
+	err = f.Add(adds)
+	if !errors.Is(err, ErrForestFull) {
+		t.Fatalf("Add gave error %v, expected ErrForestFull", err)
+	}
+	_, err = f.ModifyMany([]BlockModify{
+		{Adds: adds[:2]}, {Adds: adds[2:]}})
+	if !errors.Is(err, ErrForestFull) {
+		t.Fatalf("ModifyMany gave error %v, expected ErrForestFull", err)
+	}
+	err = f.reMap(maxRows + 1)
+	if !errors.Is(err, ErrForestFull) {
+		t.Fatalf("reMap gave error %v, expected ErrForestFull", err)
+	}
+	if f.numLeaves != MaxLeaves-2 || f.rows != maxRows {
+		t.Fatalf("forest changed to %d leaves %d rows", f.numLeaves, f.rows)
+	}
+
+	// deleting makes room, so the same adds go past the limit or don't
+	// depending on how many leaves are deleted
+	_, err = leavesAfter(MaxLeaves-2, 1, 3)
+	if err != nil {
+		t.Fatalf("deleting 1 and adding 3 to MaxLeaves-2: %s", err.Error())
+	}
+	_, err = leavesAfter(MaxLeaves-2, 0, 3)
+	if !errors.Is(err, ErrForestFull) {
+		t.Fatalf("leavesAfter gave error %v, expected ErrForestFull", err)
+	}
+	_, err = leavesAfter(2, 3, 0)
+	if err == nil {
+		t.Fatal("deleted more leaves than there are")
+	}
+}
+
+// stopAfterCtx is a context that's done once Err has been called n times,
+// to stop the Ctx functions partway through.
+type stopAfterCtx struct {
+	context.Context
+	n int
+}
+
+func (c *stopAfterCtx) Err() error {
+	if c.n == 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestForestCtx(t *testing.T) {
+	leaves := func(start, n int) []Leaf {
+		adds := make([]Leaf, n)
+		for i := range adds {
+			binary.BigEndian.PutUint64(adds[i].Hash[:], uint64(start+i+1))
+		}
+		return adds
+	}
+	f := NewForest(RamForest, nil, "", 0)
+	_, err := f.Modify(leaves(0, 3*ctxCheckInterval), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := f.GetRoots()
+
+	err = f.AuditCtx(&stopAfterCtx{context.Background(), 1})
+	if !errors.Is(err, context.Canceled) ||
+		!strings.Contains(err.Error(), "row 0 of 16, node 16384") {
+		t.Fatalf("AuditCtx gave error %v, expected to stop at node 16384", err)
+	}
+	// after checking twice in row 0 and once in rows 1 to 14
+	err = f.AuditCtx(&stopAfterCtx{context.Background(), 16})
+	if !errors.Is(err, context.Canceled) ||
+		!strings.Contains(err.Error(), "positionMap at leaf 0") {
+		t.Fatalf("AuditCtx gave error %v, expected to stop at leaf 0", err)
+	}
+	err = f.AuditCtx(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stops while checking the adds, or right before changing anything
+	for _, n := range []int{1, 2} {
+		_, err = f.ModifyCtx(&stopAfterCtx{context.Background(), n},
+			leaves(3*ctxCheckInterval, 2*ctxCheckInterval), []uint64{5})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("ModifyCtx gave error %v, expected context.Canceled", err)
+		}
+		if f.numLeaves != 3*ctxCheckInterval ||
+			!reflect.DeepEqual(f.GetRoots(), roots) {
+			t.Fatalf("forest changed after ModifyCtx stopped after %d", n)
+		}
+	}
+	err = f.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	miscFile, err := ioutil.TempFile("", "forestctxmisc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(miscFile.Name())
+	defer miscFile.Close()
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumpFile, err := ioutil.TempFile("", "forestctxdump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dumpFile.Name())
+	defer dumpFile.Close()
+	err = f.WriteForestToDisk(dumpFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	miscFile.Seek(0, 0)
+	dumpFile.Seek(0, 0)
+	_, err = RestoreForestCtx(ctx, miscFile, dumpFile, true, false, "", 0)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("RestoreForestCtx gave error %v, expected context.Canceled",
+			err)
+	}
+	miscFile.Seek(0, 0)
+	dumpFile.Seek(0, 0)
+	// after reading the file and checking the leaves
+	_, err = RestoreForestCtx(&stopAfterCtx{context.Background(), 3},
+		miscFile, dumpFile, true, false, "", 0)
+	if !errors.Is(err, context.Canceled) ||
+		!strings.Contains(err.Error(), "positionMap at leaf 16384") {
+		t.Fatalf("RestoreForestCtx gave error %v, expected to stop at "+
+			"leaf 16384", err)
+	}
+	miscFile.Seek(0, 0)
+	dumpFile.Seek(0, 0)
+	restored, err := RestoreForestCtx(context.Background(),
+		miscFile, dumpFile, true, false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restored.AssertEqual(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Misc files that don't go with the forest file get caught by RestoreForest
+// instead of giving a forest that breaks later.
+func TestRestoreForestMismatch(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 1000)
+	for i := range adds {
+		binary.BigEndian.PutUint64(adds[i].Hash[:], uint64(i+1))
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "restoremismatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	forestFile, err := os.Create(filepath.Join(dir, "forest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forestFile.Close()
+	err = f.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restore := func(misc []byte, opts ...ForestOption) error {
+		t.Helper()
+		miscFile, err := os.Create(filepath.Join(dir, "misc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer miscFile.Close()
+		_, err = miscFile.Write(misc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		miscFile.Seek(0, 0)
+		_, err = RestoreForest(miscFile, forestFile, false, false, "", 0,
+			opts...)
+		return err
+	}
+	misc := func(numLeaves uint64, rows uint8) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, numLeaves)
+		binary.Write(&buf, binary.BigEndian, rows)
+		return buf.Bytes()
+	}
+
+	err = restore(misc(1000, 10), WithFullLeafCheck())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no rows
+	err = restore(misc(1000, 10)[:8])
+	if err == nil {
+		t.Fatal("restored without rows in the misc file")
+	}
+	for _, bad := range []struct {
+		numLeaves uint64
+		rows      uint8
+		msg       string
+	}{
+		{1000, 9, "1000 leaves need 10 rows but there are 9"},
+		{1000, 11, "forest file is 65504 bytes but 11 rows take 131040"},
+		{1024, 10, "of 1024 is empty"},
+		{1010, 10, "of 1010 is empty"},
+	} {
+		err = restore(misc(bad.numLeaves, bad.rows))
+		if !errors.Is(err, ErrForestMismatch) ||
+			!strings.Contains(err.Error(), bad.msg) {
+			t.Fatalf("%d leaves %d rows gave error %v, expected %s",
+				bad.numLeaves, bad.rows, err, bad.msg)
+		}
+	}
+
+	// a leaf between the samples is only caught checking them all
+	_, err = forestFile.WriteAt(make([]byte, leafSize), 500*leafSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restore(misc(1000, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = restore(misc(1000, 10), WithFullLeafCheck())
+	if !errors.Is(err, ErrForestMismatch) ||
+		!strings.Contains(err.Error(), "leaf 500 of 1000 is empty") {
+		t.Fatalf("full check gave error %v, expected leaf 500 empty", err)
+	}
+}
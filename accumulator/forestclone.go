@@ -0,0 +1,58 @@
+package accumulator
+
+import "fmt"
+
+// Clone gives a copy of a RamForest that shares nothing with f, so either
+// can be changed without the other seeing it.  It's a lot quicker than
+// writing f out and restoring it.  Watches and the dirty callback stay
+// with f.  Forests that keep their hashes in files can't be cloned.
+func (f *Forest) Clone() (*Forest, error) {
+	data, err := cloneForestData(f.data)
+	if err != nil {
+		return nil, fmt.Errorf("Clone: %s", err.Error())
+	}
+
+	c := &Forest{
+		numLeaves:      f.numLeaves,
+		rows:           f.rows,
+		data:           data,
+		positionMap:    make(map[MiniHash]uint64, len(f.positionMap)),
+		miniCollisions: f.miniCollisions,
+		presence:       f.presence,
+		collisions:     f.collisions.clone(),
+		pendingDirt:    append([]uint64(nil), f.pendingDirt...),
+		historicHashes: f.historicHashes,
+	}
+	for m, pos := range f.positionMap {
+		c.positionMap[m] = pos
+	}
+	if f.collidedLeaves != nil {
+		c.collidedLeaves = make(map[Hash]uint64, len(f.collidedLeaves))
+		for h, pos := range f.collidedLeaves {
+			c.collidedLeaves[h] = pos
+		}
+	}
+	if f.leafData != nil {
+		c.leafData = make(map[uint64][]byte, len(f.leafData))
+		for pos, d := range f.leafData {
+			c.leafData[pos] = append([]byte(nil), d...)
+		}
+	}
+	c.presence.bits = append([]uint64(nil), f.presence.bits...)
+	return c, nil
+}
+
+// cloneForestData copies a ramForestData, keeping it read only if it was.
+func cloneForestData(data ForestData) (ForestData, error) {
+	switch d := data.(type) {
+	case *ramForestData:
+		return &ramForestData{m: append([]byte(nil), d.m...)}, nil
+	case *readOnlyData:
+		inner, err := cloneForestData(d.ForestData)
+		if err != nil {
+			return nil, err
+		}
+		return &readOnlyData{ForestData: inner}, nil
+	}
+	return nil, fmt.Errorf("%T can't be cloned", data)
+}
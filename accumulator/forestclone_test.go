@@ -0,0 +1,85 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Changing a clone leaves the forest it was cloned from as it was.
+func TestForestClone(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 20)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), 0xcc}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.SetLeafData(3, []byte("three"))
+	roots := f.GetRoots()
+
+	c, err := f.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := []Leaf{{Hash: Hash{0xdd}}, {Hash: Hash{0xde}}}
+	_, err = c.Modify(more, []uint64{0, 3, 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = f.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.numLeaves != 20 {
+		t.Fatalf("original has %d leaves after modifying the clone", f.numLeaves)
+	}
+	afterRoots := f.GetRoots()
+	if len(afterRoots) != len(roots) {
+		t.Fatalf("original has %d roots after modifying the clone, "+
+			"expected %d", len(afterRoots), len(roots))
+	}
+	for i := range roots {
+		if afterRoots[i] != roots[i] {
+			t.Fatalf("original root %d changed from %x to %x",
+				i, roots[i], afterRoots[i])
+		}
+	}
+	if _, ok := f.positionMap[Hash{0xdd}.Mini()]; ok {
+		t.Fatal("leaf added to the clone is in the original's positionMap")
+	}
+	if string(f.leafData[3]) != "three" {
+		t.Fatalf("original leaf data at 3 is %q", f.leafData[3])
+	}
+
+	// and the other way round
+	_, err = f.Modify(more, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.numLeaves != 19 {
+		t.Fatalf("clone has %d leaves, expected 19", c.numLeaves)
+	}
+}
+
+func TestForestCloneDisk(t *testing.T) {
+	file, err := ioutil.TempFile("", "forestclone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	f := NewForest(DiskForest, file, "", 0)
+	_, err = f.Clone()
+	if err == nil {
+		t.Fatal("cloned a DiskForest")
+	}
+}
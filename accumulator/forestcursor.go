@@ -0,0 +1,102 @@
+package accumulator
+
+// Cursor points at a node in a Forest and moves around the tree it's in, so
+// callers can walk the forest without knowing how positions work.  Start
+// from RootCursor.  Moving off the tree, like Left from a leaf or Parent
+// from a root, gives a Cursor that's off the forest: IsEmpty is true, Hash
+// is empty, and moving it again keeps it off.  Cursors are only good until
+// the forest is next modified.
+type Cursor struct {
+	f   *Forest
+	pos uint64
+	// row is the row of the node, and rootRow the row of its tree's root
+	row, rootRow uint8
+}
+
+// RootCursor gives a Cursor at the root of the treeIndex'th tree, in the
+// same order as GetRoots: biggest tree first.  An index past the last tree
+// gives a Cursor that's off the forest.
+func (f *Forest) RootCursor(treeIndex int) Cursor {
+	positionList := NewPositionList()
+	defer positionList.Free()
+
+	rows := getRootsForwards(f.numLeaves, f.rows, &positionList.list)
+	if treeIndex < 0 || treeIndex >= len(rows) {
+		return Cursor{}
+	}
+	return Cursor{
+		f:       f,
+		pos:     positionList.list[treeIndex],
+		row:     rows[treeIndex],
+		rootRow: rows[treeIndex],
+	}
+}
+
+// Left gives the left child.
+func (c Cursor) Left() Cursor {
+	if c.f == nil || c.row == 0 {
+		return Cursor{}
+	}
+	c.pos = child(c.pos, c.f.rows)
+	c.row--
+	return c
+}
+
+// Right gives the right child.
+func (c Cursor) Right() Cursor {
+	if c.f == nil || c.row == 0 {
+		return Cursor{}
+	}
+	c.pos = child(c.pos, c.f.rows) | 1
+	c.row--
+	return c
+}
+
+// Parent gives the parent.  Roots have no parent.
+func (c Cursor) Parent() Cursor {
+	if c.f == nil || c.row == c.rootRow {
+		return Cursor{}
+	}
+	c.pos = parent(c.pos, c.f.rows)
+	c.row++
+	return c
+}
+
+// Sibling gives the other child of the parent.  Roots have no sibling.
+func (c Cursor) Sibling() Cursor {
+	if c.f == nil || c.row == c.rootRow {
+		return Cursor{}
+	}
+	c.pos ^= 1
+	return c
+}
+
+// Hash gives the hash at the node, which is empty if there isn't one.
+func (c Cursor) Hash() Hash {
+	if c.f == nil {
+		return empty
+	}
+	return c.f.data.read(c.pos)
+}
+
+// Position gives where the node is in the forest.  It's meaningless for a
+// Cursor that's off the forest.
+func (c Cursor) Position() uint64 {
+	return c.pos
+}
+
+// IsLeaf says if the node is on the bottom row.
+func (c Cursor) IsLeaf() bool {
+	return c.f != nil && c.row == 0
+}
+
+// IsRoot says if the node is the root of its tree.
+func (c Cursor) IsRoot() bool {
+	return c.f != nil && c.row == c.rootRow
+}
+
+// IsEmpty says if the Cursor is off the forest or there's no hash at the
+// node.
+func (c Cursor) IsEmpty() bool {
+	return c.Hash() == empty
+}
@@ -0,0 +1,95 @@
+package accumulator
+
+import "testing"
+
+// rowHashes walks down from c and collects the hashes at row r, left to
+// right.
+func rowHashes(c Cursor, r uint8, hashes []Hash) []Hash {
+	if c.IsEmpty() {
+		return hashes
+	}
+	if c.row == r {
+		return append(hashes, c.Hash())
+	}
+	hashes = rowHashes(c.Left(), r, hashes)
+	return rowHashes(c.Right(), r, hashes)
+}
+
+func TestForestCursor(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := f.RootCursor(0)
+	if !root.IsRoot() || root.IsLeaf() || root.Hash() != f.GetRoots()[0] {
+		t.Fatalf("root cursor at %d isn't the root", root.Position())
+	}
+	row1, err := f.Row(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	walked := rowHashes(root, 1, nil)
+	if len(walked) != len(row1) {
+		t.Fatalf("walked %d hashes at row 1, Row(1) has %d",
+			len(walked), len(row1))
+	}
+	for i := range row1 {
+		if walked[i] != row1[i] {
+			t.Fatalf("row 1 hash %d is %s walking, %s from Row",
+				i, walked[i], row1[i])
+		}
+	}
+
+	// every parent is the hash of its children, and every node is its
+	// sibling's sibling
+	leaf := root.Left().Right().Left()
+	if !leaf.IsLeaf() || leaf.Hash() != adds[2].Hash {
+		t.Fatalf("left right left is %s, expected leaf 2", leaf.Hash())
+	}
+	for c := leaf; !c.IsRoot(); c = c.Parent() {
+		p := c.Parent()
+		if p.Hash() != parentHash(p.Left().Hash(), p.Right().Hash()) {
+			t.Fatalf("node %d isn't the hash of its children", p.Position())
+		}
+		if c.Sibling().Sibling() != c {
+			t.Fatalf("node %d isn't its sibling's sibling", c.Position())
+		}
+	}
+
+	// moving off the tree stays off
+	off := leaf.Left()
+	if !off.IsEmpty() || off.IsLeaf() || !off.Parent().IsEmpty() {
+		t.Fatal("left of a leaf isn't off the forest")
+	}
+	if !root.Parent().IsEmpty() || !root.Sibling().IsEmpty() {
+		t.Fatal("root has a parent or sibling")
+	}
+	if !f.RootCursor(1).IsEmpty() {
+		t.Fatal("8 leaves but there's a second tree")
+	}
+
+	// with 3 more leaves there are trees of 8, 2 and 1
+	for i := range adds[:3] {
+		adds[i].Hash = Hash{uint8(i + 9)}
+	}
+	_, err = f.Modify(adds[:3], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := f.GetRoots()
+	for i, r := range roots {
+		c := f.RootCursor(i)
+		if c.Hash() != r || !c.IsRoot() {
+			t.Fatalf("root cursor %d at %d isn't root %s", i, c.Position(), r)
+		}
+	}
+	if !f.RootCursor(2).IsLeaf() {
+		t.Fatal("single leaf tree's root isn't a leaf")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 // leafSize is a [32]byte hash (sha256).
@@ -48,6 +49,27 @@ type ForestData interface {
 	close()
 }
 
+// resizeZeroer is for ForestData that can say whether the positions resize
+// adds are always empty.  If they are, reMap can move rows into them with
+// swapHashRange instead of writing one position at a time.
+type resizeZeroer interface {
+	zeroOnResize() bool
+}
+
+// zeroesOnResize says whether d is a resizeZeroer that only adds empty
+// positions.
+func zeroesOnResize(d ForestData) bool {
+	z, ok := d.(resizeZeroer)
+	return ok && z.zeroOnResize()
+}
+
+// releaser is for ForestData that have files open or something going in
+// the background.  release lets go of them without writing anything, which
+// close does after writing out what it's holding on to.
+type releaser interface {
+	release() error
+}
+
 // ********************************************* forest in ram
 
 type ramForestData struct {
@@ -109,6 +131,9 @@ func (r *ramForestData) close() {
 	// nothing to do here fro a ram forest.
 }
 
+// append gives zeros
+func (r *ramForestData) zeroOnResize() bool { return true }
+
 // ********************************************* forest on disk
 
 // This is the same concept as forestRows, except for treeBlocks.
@@ -199,7 +224,7 @@ func (m *manifest) commit(basePath string) error {
 	fPath := filepath.Join(basePath, fName)
 
 	// Create new manifest on disk
-	fNewManifest, err := os.OpenFile(fPath, os.O_CREATE|os.O_RDWR, 0666)
+	fNewManifest, err := os.OpenFile(fPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	defer fNewManifest.Close()
 	if err != nil {
 		return err
@@ -303,6 +328,7 @@ func (m *manifest) commit(basePath string) error {
 			return e
 		}
 	}
+	m.currentManifestNum = manifestNum
 
 	return nil
 }
@@ -678,7 +704,62 @@ type cowForest struct {
 	// variables for statistics
 	hits          int64
 	misses        int64
+	evictions     int64
 	accessedTrees [][]uint64
+
+	// bytes of treeTable files read and written
+	bytesRead, bytesWritten uint64
+}
+
+// CowCacheStats is how well the cowForest's in-memory treeTables are doing.
+type CowCacheStats struct {
+	// Hits and Misses are lookups that did and didn't find the treeTable
+	// in memory
+	Hits, Misses uint64
+	// Evictions is how many treeTables were dropped from memory
+	Evictions uint64
+	// BytesInRAM is about how much memory the cached treeTables use
+	BytesInRAM uint64
+}
+
+// CacheStats returns the cache statistics so far.
+func (cow *cowForest) CacheStats() CowCacheStats {
+	hashes, overhead := cow.memory()
+	return CowCacheStats{
+		Hits:       uint64(cow.hits),
+		Misses:     uint64(cow.misses),
+		Evictions:  uint64(cow.evictions),
+		BytesInRAM: hashes + overhead,
+	}
+}
+
+func (cow *cowForest) diskBytes() (read, written uint64) {
+	return cow.bytesRead, cow.bytesWritten
+}
+
+// memory returns the bytes of hashes in the cached treeTables, and the bytes
+// of pointers to their treeBlocks.
+func (cow *cowForest) memory() (hashes, overhead uint64) {
+	for _, table := range cow.cachedTreeTables {
+		overhead += treeBlockPerTable * 8
+		for _, tb := range table.memTreeBlocks {
+			if tb != nil {
+				hashes += nodesPerTreeBlock * leafSize
+			}
+		}
+	}
+	return
+}
+
+// SetMaxCache changes how many MB of treeTables to keep in memory.  If there
+// are already more than that, the forest is committed and tables are evicted
+// right away.
+func (cow *cowForest) SetMaxCache(mb int) error {
+	cow.meta.maxCachedTreeTables = getTableCount(mb)
+	if cow.isFlushNeeded() {
+		return cow.flush()
+	}
+	return nil
 }
 
 // calculate the table count for the max memory to be used.
@@ -802,7 +883,7 @@ func (cow *cowForest) read(pos uint64) Hash {
 	hash := tb.leaves[fetch]
 
 	if verbose {
-		fmt.Printf("READ RETURN on pos: %d with hash: %x\n",
+		fmt.Printf("READ RETURN on pos: %d with hash: %s\n",
 			pos, hash)
 	}
 
@@ -813,7 +894,7 @@ func (cow *cowForest) read(pos uint64) Hash {
 // NOTE The treeBlocks on disk are not changed. commit must be called for that
 func (cow *cowForest) write(pos uint64, h Hash) {
 	if verbose {
-		fmt.Printf("WRITE CALLED on pos: %d with hash: %x\n", pos, h)
+		fmt.Printf("WRITE CALLED on pos: %d with hash: %s\n", pos, h)
 	}
 
 	if pos > getRowOffset(cow.manifest.forestRows, cow.manifest.forestRows) {
@@ -835,7 +916,7 @@ func (cow *cowForest) write(pos uint64, h Hash) {
 	// check if it exists in memory
 	table, found := cow.searchCache(location)
 
-	// if not found in memory, load then update the fileNum
+	// if not found in memory, load it
 	if !found {
 		// Load the treeTable onto memory. This maps the table to the location
 		table, err = cow.load(location)
@@ -843,7 +924,11 @@ func (cow *cowForest) write(pos uint64, h Hash) {
 			// TODO better to return err
 			panic(err)
 		}
+	}
 
+	// a table that isn't dirty is what the committed manifest points to.
+	// Give it a new fileNum so the committed file isn't overwritten
+	if !table.dirty {
 		cow.updateTableNum(table,
 			treeBlockRow, treeTableOffset, location)
 	}
@@ -868,9 +953,9 @@ func (cow *cowForest) write(pos uint64, h Hash) {
 	if sanity {
 		compH := cow.read(pos)
 		if compH != h {
-			fmt.Printf("%x\n", table.memTreeBlocks[treeBlockOffset%treeBlockPerTable].leaves[fetch])
+			fmt.Printf("%s\n", table.memTreeBlocks[treeBlockOffset%treeBlockPerTable].leaves[fetch])
 			err := fmt.Errorf("the hash written doesn't equal what's supposed to be written"+
-				"written %x but read %x\n", h, compH)
+				"written %s but read %s\n", h, compH)
 			panic(err)
 		}
 	}
@@ -1041,6 +1126,10 @@ func (cow *cowForest) load(fileNum uint64) (*cachedTreeTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	stat, err := f.Stat()
+	if err == nil {
+		cow.bytesRead += uint64(stat.Size())
+	}
 
 	ctt := cachedTreeTable{
 		treeTable: tt,
@@ -1068,11 +1157,13 @@ func (cow *cowForest) isFlushNeeded() bool {
 // flushes first commits the state of the cowForest, cleans up the stale
 // files, then purges cachedTreeTables
 func (cow *cowForest) flush() error {
-	// commit current forest
+	// commit current forest.  Don't evict anything if that didn't work as
+	// the dirty tables would be lost
 	err := cow.commit()
 	if err != nil {
-		fmt.Printf("cowForest close error:\n%s\n"+
+		fmt.Printf("cowForest flush error:\n%s\n"+
 			"Previously saved forest not overwritten", err)
+		return err
 	}
 
 	err = cow.clean()
@@ -1089,6 +1180,7 @@ func (cow *cowForest) flush() error {
 
 			if table.score < 0 {
 				delete(cow.cachedTreeTables, key)
+				cow.evictions++
 			}
 		}
 
@@ -1108,48 +1200,67 @@ func (cow *cowForest) flush() error {
 	return nil
 }
 
-// Saves the given treeTable to the disk with the given filepath
-func saveTreeTableToDisk(treeTable *treeTable, fName string) error {
+// Saves the given treeTable to the disk with the given filepath, and gives
+// how many bytes that was
+func saveTreeTableToDisk(treeTable *treeTable, fName string) (int, error) {
 	buf := make([]byte, 0, bytesPerTable)
 	treeTable.serialize(&buf)
 
 	// actual writing to file
 	// calculate the file name
-	f, err := os.OpenFile(fName, os.O_CREATE|os.O_RDWR, 0666)
+	// truncate as a crash may have left a file with this name behind
+	f, err := os.OpenFile(fName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	_, err = f.Write(buf)
+	n, err := f.Write(buf)
 	if err != nil {
-		return err
+		return n, err
 	}
 
 	f.Close()
 
-	return nil
+	return n, nil
 }
 
 // commit makes writes to the disk and sets the forest to point to the new
 // treeBlocks. The new forest state is commited to disk only when commit is called
 func (cow *cowForest) commit() error {
-	var err error
+	err := cow.writeTables()
+	if err != nil {
+		return err
+	}
+
+	err = cow.manifest.commit(cow.meta.fBasePath)
+	if err != nil {
+		// maybe if it couldn't commit then it should panic?
+		return err
+	}
+
+	// the tables on disk are now what the manifest points to. Any write
+	// after this goes to a new file
+	for _, cachedTreeTable := range cow.cachedTreeTables {
+		cachedTreeTable.dirty = false
+	}
+
+	return nil
+}
+
+// writeTables saves all the dirty treeTables to disk. Until the manifest is
+// committed, nothing points to them.
+func (cow *cowForest) writeTables() error {
 	for fileNum, cachedTreeTable := range cow.cachedTreeTables {
 		// only write the files that are dirty
 		if cachedTreeTable.dirty {
-			err = saveTreeTableToDisk(
+			n, err := saveTreeTableToDisk(
 				cachedTreeTable.treeTable, cow.getTreeTableFName(fileNum))
+			cow.bytesWritten += uint64(n)
 			if err != nil {
 				return err
 			}
 		}
 	}
 
-	err = cow.manifest.commit(cow.meta.fBasePath)
-	if err != nil {
-		// maybe if it couldn't commit then it should panic?
-		return err
-	}
-
 	return nil
 }
 
@@ -1171,23 +1282,356 @@ func (cow *cowForest) clean() error {
 	return nil
 }
 
+// Check makes sure that every treeTable in the manifest can be read.  Each
+// fileNum must be used only once and can't be newer than the manifest's
+// fileNum.  Tables that aren't in memory must be complete .ufod files.
+func (cow *cowForest) Check() error {
+	seen := make(map[uint64]bool)
+	for row, locations := range cow.manifest.location {
+		for offset, fileNum := range locations {
+			if fileNum == 0 || fileNum > cow.manifest.fileNum {
+				return fmt.Errorf("Check: treeTable %d at treeBlockRow %d "+
+					"is file %d but the newest file is %d",
+					offset, row, fileNum, cow.manifest.fileNum)
+			}
+			if seen[fileNum] {
+				return fmt.Errorf("Check: file %d is used by more than "+
+					"one treeTable", fileNum)
+			}
+			seen[fileNum] = true
+
+			// dirty tables haven't been written yet
+			_, found := cow.cachedTreeTables[fileNum]
+			if found {
+				continue
+			}
+			err := checkTreeTableFile(cow.getTreeTableFName(fileNum))
+			if err != nil {
+				return fmt.Errorf("Check: treeTable %d at treeBlockRow %d: %s",
+					offset, row, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkTreeTableFile makes sure the file is as long as the treeBlock count
+// at the start of it says it should be.
+func checkTreeTableFile(fName string) error {
+	f, err := os.Open(fName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var count uint16
+	err = binary.Read(f, binary.LittleEndian, &count)
+	if err != nil {
+		return fmt.Errorf("%s: %s", fName, err.Error())
+	}
+	if count > treeBlockPerTable {
+		return fmt.Errorf("%s has %d treeBlocks, max is %d",
+			fName, count, treeBlockPerTable)
+	}
+	expected := 2 + int64(count)*nodesPerTreeBlock*leafSize
+	if info.Size() != expected {
+		return fmt.Errorf("%s is %d bytes, expected %d for %d treeBlocks",
+			fName, info.Size(), expected, count)
+	}
+
+	return nil
+}
+
+// Compact commits the forest and removes the files in the forest directory
+// that the manifest doesn't point to.  These are stale tables that didn't get
+// cleaned up, tables from a commit that crashed before the manifest was
+// written, and old manifests.  The forest can still be used afterwards.
+func (cow *cowForest) Compact() error {
+	err := cow.commit()
+	if err != nil {
+		return err
+	}
+	err = cow.clean()
+	if err != nil {
+		return err
+	}
+
+	live := make(map[uint64]bool)
+	for _, locations := range cow.manifest.location {
+		for _, fileNum := range locations {
+			live[fileNum] = true
+		}
+	}
+	currentManifest := fmt.Sprintf("MANIFEST-%06d",
+		cow.manifest.currentManifestNum)
+
+	files, err := ioutil.ReadDir(cow.meta.fBasePath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, extension) {
+			fileNum, err := strconv.ParseUint(
+				strings.TrimSuffix(name, extension), 10, 64)
+			if err != nil || live[fileNum] {
+				continue
+			}
+		} else if !strings.HasPrefix(name, "MANIFEST-") ||
+			name == currentManifest {
+			continue
+		}
+
+		if verbose {
+			fmt.Printf("COMPACT removing %s\n", name)
+		}
+		err = os.Remove(filepath.Join(cow.meta.fBasePath, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Audit gives how many nodes of a forest with numLeaves are stored in the
+// treeTables the manifest points to, and how many nodes are stored in all.
+// All is the treeBlocks in memory and in every .ufod file in the forest
+// directory, so stale tables that haven't been cleaned up and files nothing
+// points to count too.  Nothing gets loaded, written or removed.
+func (cow *cowForest) Audit(numLeaves uint64) (live, total uint64, err error) {
+	for _, table := range cow.cachedTreeTables {
+		for _, tb := range table.memTreeBlocks {
+			if tb != nil {
+				total += nodesPerTreeBlock
+			}
+		}
+	}
+
+	// the treeBlock counts of the files that aren't in memory.  A table in
+	// memory is newer than its file.
+	fileBlocks := make(map[uint64]uint64)
+	files, err := ioutil.ReadDir(cow.meta.fBasePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, extension) {
+			continue
+		}
+		fileNum, err := strconv.ParseUint(
+			strings.TrimSuffix(name, extension), 10, 64)
+		if err != nil {
+			continue
+		}
+		if _, found := cow.cachedTreeTables[fileNum]; found {
+			continue
+		}
+		count, err := readTreeBlockCount(filepath.Join(cow.meta.fBasePath, name))
+		if err != nil {
+			return 0, 0, fmt.Errorf("Audit: %s", err.Error())
+		}
+		fileBlocks[fileNum] = count
+		total += count * nodesPerTreeBlock
+	}
+
+	// walk every position under the roots
+	forestRows := cow.manifest.forestRows
+	var roots []uint64
+	rootRows := getRootsForwards(numLeaves, forestRows, &roots)
+	for i, root := range roots {
+		for drop := uint8(0); drop <= rootRows[i]; drop++ {
+			first := childMany(root, drop, forestRows)
+			for pos := first; pos < first+1<<drop; pos++ {
+				if cow.isStored(pos, fileBlocks) {
+					live++
+				}
+			}
+		}
+	}
+
+	return live, total, nil
+}
+
+// isStored says if there's a treeBlock for pos, in memory or in the file the
+// manifest points to.  fileBlocks are the treeBlock counts of the files
+// that aren't in memory.
+func (cow *cowForest) isStored(pos uint64, fileBlocks map[uint64]uint64) bool {
+	treeBlockRow, treeBlockOffset, err := getTreeBlockPos(
+		pos, cow.manifest.forestRows)
+	if err != nil || int(treeBlockRow) >= len(cow.manifest.location) {
+		return false
+	}
+	locations := cow.manifest.location[treeBlockRow]
+	treeTableOffset := treeBlockOffset / treeBlockPerTable
+	if treeTableOffset >= uint64(len(locations)) {
+		return false
+	}
+	fileNum := locations[treeTableOffset]
+	if table, found := cow.cachedTreeTables[fileNum]; found {
+		return table.memTreeBlocks[treeBlockOffset%treeBlockPerTable] != nil
+	}
+	// files are written up to the first missing treeBlock
+	return treeBlockOffset%treeBlockPerTable < fileBlocks[fileNum]
+}
+
+// readTreeBlockCount reads the treeBlock count at the start of a treeTable
+// file.
+func readTreeBlockCount(fName string) (uint64, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var count uint16
+	err = binary.Read(f, binary.LittleEndian, &count)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %s", fName, err.Error())
+	}
+	return uint64(count), nil
+}
+
 type diskForestData struct {
 	file *os.File
+
+	// journal holds writes that haven't hit the disk yet.  nil unless
+	// EnableJournal was called.
+	journal map[uint64]Hash
+	// journalOps is how many writes went into the journal since the last flush
+	journalOps int
+	// flushThreshold is how many writes to journal before flushing
+	flushThreshold int
+
+	// diskWrites counts WriteAt calls, for benchmarks
+	diskWrites uint64
+	// bytesRead and bytesWritten are how much went to and from the file.
+	// Only touched atomically.
+	bytesRead, bytesWritten uint64
+}
+
+// readAt is file.ReadAt, counting the bytes read.
+func (d *diskForestData) readAt(b []byte, off int64) (int, error) {
+	n, err := d.file.ReadAt(b, off)
+	atomic.AddUint64(&d.bytesRead, uint64(n))
+	return n, err
+}
+
+// writeAt is file.WriteAt, counting the bytes written.
+func (d *diskForestData) writeAt(b []byte, off int64) (int, error) {
+	n, err := d.file.WriteAt(b, off)
+	atomic.AddUint64(&d.bytesWritten, uint64(n))
+	return n, err
+}
+
+func (d *diskForestData) diskBytes() (read, written uint64) {
+	return atomic.LoadUint64(&d.bytesRead), atomic.LoadUint64(&d.bytesWritten)
+}
+
+// EnableJournal keeps writes in ram and only writes them to disk every
+// flushThreshold writes, when size() is called, or on Flush.  Cuts down on
+// the syscalls during reHash which writes 32 bytes at a time.
+func (d *diskForestData) EnableJournal(flushThreshold int) {
+	if flushThreshold < 1 {
+		flushThreshold = 1
+	}
+	if d.journal == nil {
+		d.journal = make(map[uint64]Hash)
+	}
+	d.flushThreshold = flushThreshold
+}
+
+// DisableJournal flushes the journal and goes back to writing straight
+// to disk.
+func (d *diskForestData) DisableJournal() error {
+	err := d.Flush()
+	if err != nil {
+		return err
+	}
+	d.journal = nil
+	return nil
+}
+
+// Flush writes everything in the journal to disk.  Positions next to each
+// other get written together.
+func (d *diskForestData) Flush() error {
+	d.journalOps = 0
+	if len(d.journal) == 0 {
+		return nil
+	}
+
+	positions := make([]uint64, 0, len(d.journal))
+	for pos := range d.journal {
+		positions = append(positions, pos)
+	}
+	sortUint64s(positions)
+
+	buf := make([]byte, 0, len(positions)*leafSize)
+	start := positions[0]
+	for i, pos := range positions {
+		h := d.journal[pos]
+		buf = append(buf, h[:]...)
+
+		// keep going while the next position is right after this one
+		if i+1 < len(positions) && positions[i+1] == pos+1 {
+			continue
+		}
+
+		_, err := d.writeAt(buf, int64(start*leafSize))
+		d.diskWrites++
+		if err != nil {
+			return fmt.Errorf("diskForestData Flush pos %d len %d %s",
+				start, len(buf)/leafSize, err.Error())
+		}
+		buf = buf[:0]
+		if i+1 < len(positions) {
+			start = positions[i+1]
+		}
+	}
+
+	d.journal = make(map[uint64]Hash)
+	return nil
 }
 
 // read ignores errors. Probably get an empty hash if it doesn't work
 func (d *diskForestData) read(pos uint64) Hash {
+	if d.journal != nil {
+		h, ok := d.journal[pos]
+		if ok {
+			return h
+		}
+	}
+
 	var h Hash
-	_, err := d.file.ReadAt(h[:], int64(pos*leafSize))
+	_, err := d.readAt(h[:], int64(pos*leafSize))
 	if err != nil {
-		fmt.Printf("\tWARNING!! read %x pos %d %s\n", h, pos, err.Error())
+		fmt.Printf("\tWARNING!! read %s pos %d %s\n", h, pos, err.Error())
 	}
 	return h
 }
 
 // writeHash writes a hash.  Don't go out of bounds.
 func (d *diskForestData) write(pos uint64, h Hash) {
-	_, err := d.file.WriteAt(h[:], int64(pos*leafSize))
+	if d.journal != nil {
+		d.journal[pos] = h
+		d.journalOps++
+		if d.journalOps >= d.flushThreshold {
+			err := d.Flush()
+			if err != nil {
+				fmt.Printf("\tWARNING!! %s\n", err.Error())
+			}
+		}
+		return
+	}
+
+	_, err := d.writeAt(h[:], int64(pos*leafSize))
+	d.diskWrites++
 	if err != nil {
 		fmt.Printf("\tWARNING!! write pos %d %s\n", pos, err.Error())
 	}
@@ -1207,32 +1651,44 @@ func (d *diskForestData) swapHash(a, b uint64) {
 // depends if you count seeking from b-end to b-start as a seek. or if you have
 // like read & replace as one operation or something.
 func (d *diskForestData) swapHashRange(a, b, w uint64) {
+	// the ranges are swapped on disk so anything journaled has to be there
+	err := d.Flush()
+	if err != nil {
+		fmt.Printf("\tshr WARNING!! %s\n", err.Error())
+	}
+
 	arange := make([]byte, leafSize*w)
 	brange := make([]byte, leafSize*w)
-	_, err := d.file.ReadAt(arange, int64(a*leafSize)) // read at a
+	_, err = d.readAt(arange, int64(a*leafSize)) // read at a
 	if err != nil {
 		fmt.Printf("\tshr WARNING!! read pos %d len %d %s\n",
 			a*leafSize, w, err.Error())
 	}
-	_, err = d.file.ReadAt(brange, int64(b*leafSize)) // read at b
+	_, err = d.readAt(brange, int64(b*leafSize)) // read at b
 	if err != nil {
 		fmt.Printf("\tshr WARNING!! read pos %d len %d %s\n",
 			b*leafSize, w, err.Error())
 	}
-	_, err = d.file.WriteAt(arange, int64(b*leafSize)) // write arange to b
+	_, err = d.writeAt(arange, int64(b*leafSize)) // write arange to b
+	d.diskWrites++
 	if err != nil {
 		fmt.Printf("\tshr WARNING!! write pos %d len %d %s\n",
 			b*leafSize, w, err.Error())
 	}
-	_, err = d.file.WriteAt(brange, int64(a*leafSize)) // write brange to a
+	_, err = d.writeAt(brange, int64(a*leafSize)) // write brange to a
+	d.diskWrites++
 	if err != nil {
 		fmt.Printf("\tshr WARNING!! write pos %d len %d %s\n",
 			a*leafSize, w, err.Error())
 	}
 }
 
-// size gives you the size of the forest
+// size gives you the size of the forest.  Flushes the journal first.
 func (d *diskForestData) size() uint64 {
+	err := d.Flush()
+	if err != nil {
+		fmt.Printf("\tWARNING: %s\n", err.Error())
+	}
 	s, err := d.file.Stat()
 	if err != nil {
 		fmt.Printf("\tWARNING: %s. Returning 0", err.Error())
@@ -1249,9 +1705,20 @@ func (d *diskForestData) resize(newSize uint64) {
 	}
 }
 
+// Truncate fills with zeros, and nothing is written past the end of the forest
+func (d *diskForestData) zeroOnResize() bool { return true }
+
 func (d *diskForestData) close() {
-	err := d.file.Close()
+	err := d.Flush()
+	if err != nil {
+		fmt.Printf("diskForestData close error: %s\n", err.Error())
+	}
+	err = d.release()
 	if err != nil {
 		fmt.Printf("diskForestData close error: %s\n", err.Error())
 	}
 }
+
+func (d *diskForestData) release() error {
+	return d.file.Close()
+}
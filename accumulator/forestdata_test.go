@@ -5,8 +5,10 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"os/exec"
 	"reflect"
 	"testing"
 	"testing/quick"
@@ -133,7 +135,12 @@ func createRandomHash(i int64) [32]byte {
 func TestCowForestWrite(t *testing.T) {
 	// keep only 1 treetable in memory to force flush and
 	// test the flushing/restoring as well
-	f := NewForest(CowForest, nil, os.TempDir(), 1)
+	dir, err := ioutil.TempDir("", "cowwrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := NewForest(CowForest, nil, dir, 1)
 
 	numAdds := uint32(10)   // adds per block
 	sc := newSimChain(0x07) // A chain simulator
@@ -168,3 +175,471 @@ func TestCowForestWrite(t *testing.T) {
 		}
 	}
 }
+
+// Run a DiskForest with a small journal against a RamForest.
+func TestDiskForestJournal(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "diskforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	diskF := NewForest(DiskForest, forestFile, "", 0)
+	memF := NewForest(RamForest, nil, "", 0)
+	d := diskF.data.(*diskForestData)
+	d.EnableJournal(50)
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(8)
+
+		diskBP, err := diskF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memBP, err := memF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = diskF.Modify(adds, diskBP.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = memF.Modify(adds, memBP.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = diskF.AssertEqual(memF)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	}
+
+	// journaled writes are read back before they hit the disk
+	h := Hash{1, 2, 3}
+	d.write(0, h)
+	if d.read(0) != h {
+		t.Fatal("didn't read back the journaled write")
+	}
+	var onDisk Hash
+	_, err = forestFile.ReadAt(onDisk[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk == h {
+		t.Fatal("journaled write went to disk before flushing")
+	}
+
+	err = d.DisableJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.journal != nil {
+		t.Fatal("journal still there after DisableJournal")
+	}
+	_, err = forestFile.ReadAt(onDisk[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onDisk != h {
+		t.Fatal("DisableJournal didn't flush")
+	}
+}
+
+func BenchmarkDiskForestRehash(b *testing.B) {
+	b.Run("NoJournal", func(b *testing.B) { benchmarkDiskForestRehash(0, b) })
+	b.Run("Journal", func(b *testing.B) { benchmarkDiskForestRehash(100000, b) })
+}
+
+// rehash a 10k leaf DiskForest and report how many WriteAt calls it took
+func benchmarkDiskForestRehash(flushThreshold int, b *testing.B) {
+	forestFile, err := ioutil.TempFile("", "diskforest")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	f := NewForest(DiskForest, forestFile, "", 0)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(10000)
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	d := f.data.(*diskForestData)
+	if flushThreshold > 0 {
+		d.EnableJournal(flushThreshold)
+	}
+
+	b.ResetTimer()
+	d.diskWrites = 0
+	for i := 0; i < b.N; i++ {
+		err = f.Rehash()
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = d.Flush()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(d.diskWrites)/float64(b.N), "writes/op")
+}
+
+// Cross a power of 2 on a DiskForest with 2**14 leaves, moving the rows
+// one at a time or all at once.
+func BenchmarkReMapDiskForest(b *testing.B) {
+	b.Run("copy", func(b *testing.B) { benchmarkReMapDiskForest(false, b) })
+	b.Run("move", func(b *testing.B) { benchmarkReMapDiskForest(true, b) })
+}
+
+func benchmarkReMapDiskForest(newIsEmpty bool, b *testing.B) {
+	memF := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(1 << 14)
+	_, err := memF.Modify(adds, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	forestBytes := memF.data.(*ramForestData).m
+
+	forestFile, err := ioutil.TempFile("", "remap")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+	d := &diskForestData{file: forestFile}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		err = forestFile.Truncate(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = forestFile.WriteAt(forestBytes, 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		f := &Forest{numLeaves: memF.numLeaves, rows: memF.rows, data: d}
+		b.StartTimer()
+
+		d.resize((2 << (f.rows + 1)) - 1)
+		f.reMapUp(f.rows+1, newIsEmpty)
+	}
+	b.ReportMetric(float64(d.diskWrites)/float64(b.N), "writes/op")
+}
+
+// cowCrashBlocks runs blocks from through to of sc on all the forests.
+func cowCrashBlocks(t *testing.T, sc *simChain, from, to int, fs ...*Forest) {
+	for blockNum := from; blockNum < to; blockNum++ {
+		adds, _, delHashes := sc.NextBlock(10)
+		for _, f := range fs {
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// cowOrphans counts the .ufod files newer than what the manifest knows of.
+func cowOrphans(t *testing.T, cow *cowForest) int {
+	files, err := ioutil.ReadDir(cow.meta.fBasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orphans int
+	for _, file := range files {
+		var fileNum uint64
+		_, err := fmt.Sscanf(file.Name(), "%09d.ufod", &fileNum)
+		if err == nil && fileNum > cow.manifest.fileNum {
+			orphans++
+		}
+	}
+	return orphans
+}
+
+// TestCowForestCrash kills a process after it wrote its treeTables but
+// before it committed the manifest.  The forest on disk has to be what it was
+// at the last commit, pass Check, and keep working after Compact.
+func TestCowForestCrash(t *testing.T) {
+	const committed, crashed = 30, 45
+
+	// the child process builds the forest then crashes
+	if dir := os.Getenv("UTREEXO_COW_CRASH_DIR"); dir != "" {
+		f := NewForest(CowForest, nil, dir, 100)
+		sc := newSimChain(0x07)
+		cowCrashBlocks(t, sc, 0, committed, f)
+		cow := f.data.(*cowForest)
+		err := cow.commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cow.clean()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cowCrashBlocks(t, sc, committed, crashed, f)
+		err = cow.writeTables()
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Exit(3)
+	}
+
+	dir, err := ioutil.TempDir("", "cowcrash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCowForestCrash$")
+	cmd.Env = append(os.Environ(), "UTREEXO_COW_CRASH_DIR="+dir)
+	out, err := cmd.CombinedOutput()
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("crashing process exited with %v, expected 3:\n%s", err, out)
+	}
+
+	// the same blocks as the crashed process, up to its commit
+	ramF := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	cowCrashBlocks(t, sc, 0, committed, ramF)
+
+	var misc bytes.Buffer
+	binary.Write(&misc, binary.BigEndian, ramF.numLeaves)
+	binary.Write(&misc, binary.BigEndian, ramF.rows)
+	miscFile, err := ioutil.TempFile("", "cowcrashmisc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(miscFile.Name())
+	_, err = miscFile.Write(misc.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile.Seek(0, 0)
+	cowF, err := RestoreForest(miscFile, nil, false, false, dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cow := cowF.data.(*cowForest)
+
+	err = cow.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cowF.AssertEqual(ramF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cowOrphans(t, cow) == 0 {
+		t.Fatal("crashed process didn't leave any treeTables behind")
+	}
+
+	err = cowF.MaintainCowForest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cowOrphans(t, cow); n != 0 {
+		t.Fatalf("%d treeTables left after Compact", n)
+	}
+
+	// keeps going after Compact, including past the blocks that crashed
+	cowCrashBlocks(t, sc, committed, crashed+15, cowF, ramF)
+	err = cowF.AssertEqual(ramF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cow.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCowForestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cowcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewForest(CowForest, nil, dir, 100)
+	sc := newSimChain(0x07)
+	cowCrashBlocks(t, sc, 0, 30, f)
+	cow := f.data.(*cowForest)
+	err = cow.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// crash after the manifest is committed but before the stale tables
+	// are removed
+	err = cow.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cowCrashBlocks(t, sc, 30, 40, f)
+	err = cow.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := append([]uint64{}, cow.meta.staleFiles...)
+	if len(stale) == 0 {
+		t.Fatal("no stale treeTables after writing to committed ones")
+	}
+	cow.meta.staleFiles = cow.meta.staleFiles[:0]
+	err = cow.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cow.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fileNum := range stale {
+		_, err = os.Stat(cow.getTreeTableFName(fileNum))
+		if !os.IsNotExist(err) {
+			t.Fatalf("stale treeTable %d still there after Compact", fileNum)
+		}
+	}
+
+	// a truncated table and a missing one are both caught
+	cowCrashBlocks(t, sc, 40, 50, f)
+	err = cow.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cow.cachedTreeTables = make(map[uint64]*cachedTreeTable)
+	fName := cow.getTreeTableFName(cow.manifest.location[0][0])
+	err = os.Truncate(fName, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cow.Check() == nil {
+		t.Fatal("Check passed with a truncated treeTable")
+	}
+	err = os.Remove(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cow.Check() == nil {
+		t.Fatal("Check passed with a missing treeTable")
+	}
+}
+
+// Commits that don't clean up leave stale tables behind, which CowAudit
+// counts as stored but not live until MaintainCowForest removes them.
+func TestCowAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cowaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewForest(CowForest, nil, dir, 100)
+	cow := f.data.(*cowForest)
+	sc := newSimChain(0x07)
+	var lastGap uint64
+	for b := 0; b < 40; b += 10 {
+		cowCrashBlocks(t, sc, b, b+10, f)
+		err = cow.commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats := cow.CacheStats()
+		fileNum := cow.manifest.fileNum
+		live, total, err := f.CowAudit()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cow.CacheStats() != stats || cow.manifest.fileNum != fileNum {
+			t.Fatal("CowAudit changed the forest")
+		}
+		if live == 0 || total < live {
+			t.Fatalf("block %d: %d live nodes of %d", b+10, live, total)
+		}
+		// every commit after the first leaves the tables it wrote over
+		if b != 0 && total-live <= lastGap {
+			t.Fatalf("block %d: %d stored nodes aren't live, was %d",
+				b+10, total-live, lastGap)
+		}
+		lastGap = total - live
+	}
+
+	err = f.MaintainCowForest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, total, err := f.CowAudit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total < live || total-live >= lastGap {
+		t.Fatalf("%d live nodes of %d after MaintainCowForest, gap was %d",
+			live, total, lastGap)
+	}
+	_, _, err = NewForest(RamForest, nil, "", 0).CowAudit()
+	if err == nil {
+		t.Fatal("CowAudit worked on a RamForest")
+	}
+}
+
+// Shrink and grow the cowForest's cache while it's being modified.
+func TestCowForestSetMaxCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cowmaxcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cowF := NewForest(CowForest, nil, dir, 100)
+	memF := NewForest(RamForest, nil, "", 0)
+	cow := cowF.data.(*cowForest)
+	sc := newSimChain(0x07)
+	for b := 0; b < 200; b += 20 {
+		cowCrashBlocks(t, sc, b, b+20, cowF, memF)
+
+		// 5MB is 3 tables
+		mb := 100
+		if b%40 == 0 {
+			mb = 5
+		}
+		err = cowF.SetCowMaxCache(mb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cow.cachedTreeTables) > getTableCount(mb) {
+			t.Fatalf("%d tables in memory with a max of %d",
+				len(cow.cachedTreeTables), getTableCount(mb))
+		}
+		err = cow.Check()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cowF.AssertEqual(memF)
+		if err != nil {
+			t.Fatalf("block %d: %s", b+20, err.Error())
+		}
+	}
+
+	stats, err := cowF.CowCacheStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Evictions == 0 || stats.Hits == 0 || stats.BytesInRAM == 0 {
+		t.Fatalf("cache stats %+v after shrinking the cache", stats)
+	}
+	_, err = memF.CowCacheStats()
+	if err == nil {
+		t.Fatal("got cow cache stats for a RamForest")
+	}
+}
@@ -1,11 +1,50 @@
 package accumulator
 
 import (
+	"context"
 	"fmt"
+	"math/bits"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 // ********************************************* forest on disk with cache
+
+const (
+	// DefaultCacheRows is how many rows of leaves the CacheForest keeps in
+	// ram when nothing else is given.  2**20 leaves is a 64MB cache.
+	DefaultCacheRows = 20
+
+	// MaxCacheRows is the biggest cache allowed.  2**30 leaves is a 64GB
+	// cache which is already more than most machines have.
+	MaxCacheRows = 30
+
+	// primeChunk is how many hashes Prime reads from disk at a time
+	primeChunk = 1 << 13
+
+	// primePause is how long Prime waits between chunks so reads and
+	// writes of the forest get the lock in between
+	primePause = time.Millisecond
+
+	// adaptWindow is how many reads adaptive cache sizing takes the hit
+	// ratio over before deciding whether to resize
+	adaptWindow = 1 << 16
+)
+
+// checkCacheRows makes sure the given cache rows are within a sane range.
+// 0 gives back DefaultCacheRows.
+func checkCacheRows(cacheRows int) (uint64, error) {
+	if cacheRows == 0 {
+		return DefaultCacheRows, nil
+	}
+	if cacheRows < 0 || cacheRows > MaxCacheRows {
+		return 0, fmt.Errorf("cache rows %d out of range. Should be 1 to %d",
+			cacheRows, MaxCacheRows)
+	}
+	return uint64(cacheRows), nil
+}
+
 type diskForestCache struct {
 	// The number of leaves contained in the cached part of the forest.
 	size uint64
@@ -15,13 +54,19 @@ type diskForestCache struct {
 	// Based on the ttl distribution of bitcoin utxos.
 	// (see figure 2 in the paper)
 	data []byte
+
+	// mtx is taken by includes, get, rangeGet, set and rangeSet, so readers
+	// of the cacheForestData can fill in cache misses at the same time.
+	// flush and populated are only called with the cacheForestData locked
+	// for writing, so they don't take it.
+	mtx cacheMutex
 }
 
-// creates a new cache.
-func newDiskForestCache(trees uint64) *diskForestCache {
-	size := uint64(1 << trees)
-	fmt.Printf("newDiskForestCache: forest data cache size is set to %dMB\n",
-		((size<<1) /*valid*/ +(size<<1)*leafSize /*data*/)>>20)
+// creates a new cache that holds 2**rows leaves (and their parents).
+func newDiskForestCache(rows uint64) *diskForestCache {
+	size := uint64(1 << rows)
+	fmt.Printf("newDiskForestCache: forest data cache set to %d rows, %dMB\n",
+		rows, ((size<<1) /*valid*/ +(size<<1)*leafSize /*data*/)>>20)
 
 	return &diskForestCache{
 		size:  size,
@@ -40,12 +85,367 @@ type cacheRange struct {
 }
 
 type cacheForestData struct {
+	// mtx is held for reading by read and readRange, and for writing by
+	// everything that writes to the forest or changes its size.
+	mtx cacheMutex
+
 	file *os.File
 	// stores the size of the forest (the number of hashes stored).
 	// gets updated on every size()/resize() call.
 	hashCount uint64
 
 	cache *diskForestCache
+
+	// flushInterval is how many hashes get written to the cache between
+	// flushes to disk.  0 means only flush on resize and close.
+	flushInterval int
+	// cacheWrites is how many hashes were written to the cache since the
+	// last flush
+	cacheWrites int
+
+	// primed and primeTotal are how far Prime has got, and how many
+	// positions the cache holds.  Only touched atomically.
+	primed, primeTotal uint64
+	// stopPrime stops the Prime started by startPrime and waits for it
+	stopPrime func()
+
+	// hits and misses are reads that were and weren't answered from the
+	// cache.  Only touched atomically.
+	hits, misses uint64
+	// bytesRead and bytesWritten are how much went to and from the file.
+	// Only touched atomically.
+	bytesRead, bytesWritten uint64
+	// resizes is how many times adaptive sizing changed the cache
+	resizes uint64
+	// adapt is set by SetAdaptive.  nextAdapt is how many reads there will
+	// have been when adaptCache next looks at the hit ratio, 0 when adapt
+	// is off.  Only touched atomically.
+	adapt     *cacheAdapt
+	nextAdapt uint64
+}
+
+// cacheAdapt is the settings and state of adaptive cache sizing.
+type cacheAdapt struct {
+	minRows, maxRows uint64
+	minHitRatio      float64
+	// window is how many reads the hit ratio is taken over
+	window uint64
+	// hits and misses when the current window started
+	hits, misses uint64
+
+	// warming is set after a resize, so the window the new cache spends
+	// filling up isn't counted against it
+	warming bool
+	// grew is set when the cache was last grown from a window with a hit
+	// ratio of before.  held is set when growing it didn't help and it was
+	// shrunk back, until the hit ratio gets to minHitRatio again.
+	grew, held bool
+	before     float64
+}
+
+// CacheForestStats are how the cache of a CacheForest has been doing.
+type CacheForestStats struct {
+	// Hits and Misses are reads that were and weren't answered from the
+	// cache.  Reads of positions the cache doesn't cover are misses too.
+	Hits, Misses uint64
+	// Rows is how many rows of leaves the cache holds now, and Resizes is
+	// how many times adaptive sizing has changed that.
+	Rows, Resizes uint64
+}
+
+// HitRatio is the fraction of reads that were hits, 0 before any reads.
+func (s CacheForestStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheStats returns the cache statistics so far.
+func (d *cacheForestData) CacheStats() CacheForestStats {
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return CacheForestStats{
+		Hits:    atomic.LoadUint64(&d.hits),
+		Misses:  atomic.LoadUint64(&d.misses),
+		Rows:    d.cacheRows(),
+		Resizes: d.resizes,
+	}
+}
+
+// cacheRows is how many rows of leaves the cache holds.
+func (d *cacheForestData) cacheRows() uint64 {
+	return uint64(bits.Len64(d.cache.size) - 1)
+}
+
+// SetAdaptive turns on adaptive cache sizing.  Every adaptWindow reads, if
+// fewer than minHitRatio of them were hits, the cache grows a row, up to
+// maxRows.  If growing it didn't raise the hit ratio, the misses aren't
+// ones a bigger cache would catch, so it shrinks back a row, down to
+// minRows, and stays put until the hit ratio is back up.  Resizing flushes
+// the cache to disk.  A maxRows of 0 turns it off.
+func (d *cacheForestData) SetAdaptive(
+	minRows, maxRows int, minHitRatio float64) error {
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if maxRows == 0 {
+		d.adapt = nil
+		atomic.StoreUint64(&d.nextAdapt, 0)
+		return nil
+	}
+	if minRows < 1 || minRows > maxRows || maxRows > MaxCacheRows {
+		return fmt.Errorf("cache rows %d to %d out of range. Should be "+
+			"within 1 to %d", minRows, maxRows, MaxCacheRows)
+	}
+	d.adapt = &cacheAdapt{
+		minRows:     uint64(minRows),
+		maxRows:     uint64(maxRows),
+		minHitRatio: minHitRatio,
+		window:      adaptWindow,
+	}
+	d.startAdaptWindow()
+	return nil
+}
+
+// startAdaptWindow starts counting the hit ratio over again.  Call with
+// d.mtx held for writing.
+func (d *cacheForestData) startAdaptWindow() {
+	d.adapt.hits = atomic.LoadUint64(&d.hits)
+	d.adapt.misses = atomic.LoadUint64(&d.misses)
+	atomic.StoreUint64(&d.nextAdapt,
+		d.adapt.hits+d.adapt.misses+d.adapt.window)
+}
+
+// adaptCache resizes the cache if adaptive sizing is on and a window of
+// reads is done and says to.  Call it without d.mtx held.
+func (d *cacheForestData) adaptCache() {
+	next := atomic.LoadUint64(&d.nextAdapt)
+	if next == 0 ||
+		atomic.LoadUint64(&d.hits)+atomic.LoadUint64(&d.misses) < next {
+		return
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	a := d.adapt
+	hits, misses := atomic.LoadUint64(&d.hits), atomic.LoadUint64(&d.misses)
+	// someone else got to it first
+	if a == nil || hits+misses < atomic.LoadUint64(&d.nextAdapt) {
+		return
+	}
+	ratio := float64(hits-a.hits) / float64(hits+misses-a.hits-a.misses)
+	d.startAdaptWindow()
+
+	rows := d.cacheRows()
+	switch {
+	case a.warming:
+		a.warming = false
+	case ratio >= a.minHitRatio:
+		a.grew, a.held = false, false
+	case a.held:
+	case a.grew && ratio <= a.before:
+		a.grew, a.held = false, true
+		if rows > a.minRows {
+			d.resizeCache(rows - 1)
+		}
+	case rows < a.maxRows:
+		a.grew, a.before = true, ratio
+		d.resizeCache(rows + 1)
+	default:
+		a.grew = false
+	}
+}
+
+// resizeCache flushes the cache to disk and swaps it for an empty one of
+// the given rows.  Call with d.mtx held for writing.
+func (d *cacheForestData) resizeCache(rows uint64) {
+	flushCacheToDisk(d)
+	d.cache = newDiskForestCache(rows)
+	d.resizes++
+	d.adapt.warming = true
+}
+
+// SetFlushInterval makes the cache get written to disk and synced after
+// every writes hashes written to it, so a crash loses at most that many.
+// 0 turns it off.  The flush happens inside write, so nothing else can be
+// writing while it runs.
+func (d *cacheForestData) SetFlushInterval(writes int) {
+	if writes < 0 {
+		writes = 0
+	}
+	d.flushInterval = writes
+}
+
+// Flush writes everything in the cache to disk and syncs the file.  Unlike
+// on resize, the cache keeps everything in it.
+func (d *cacheForestData) Flush() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.flush()
+}
+
+// flush is Flush for when d.mtx is already held.
+func (d *cacheForestData) flush() error {
+	d.cacheWrites = 0
+	for _, r := range d.cache.populated(d.hashCount) {
+		_, err := d.writeAt(
+			d.cache.data[r.startCache*leafSize:(r.startCache+r.count)*leafSize],
+			int64(r.start*leafSize),
+		)
+		if err != nil {
+			return fmt.Errorf("cacheForestData Flush pos %d len %d %s",
+				r.start, r.count, err.Error())
+		}
+	}
+	return d.file.Sync()
+}
+
+// cacheWritten counts hashes written to the cache and flushes when there
+// have been flushInterval of them.
+func (d *cacheForestData) cacheWritten(count uint64) {
+	if d.flushInterval == 0 {
+		return
+	}
+	d.cacheWrites += int(count)
+	if d.cacheWrites >= d.flushInterval {
+		err := d.flush()
+		if err != nil {
+			fmt.Printf("\tWARNING!! %s\n", err.Error())
+		}
+	}
+}
+
+// Prime fills the cache from disk, a chunk of sequential positions at a
+// time, so it doesn't have to fill up one cache miss at a time after a
+// restore.  Positions already in the cache are left as they are.  It
+// pauses between chunks so it doesn't hold up the forest, and stops when
+// ctx is done.
+func (d *cacheForestData) Prime(ctx context.Context) error {
+	buf := make([]byte, primeChunk*leafSize)
+	var done uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		d.mtx.RLock()
+		rows := d.cache.rowRanges(d.hashCount)
+		var total uint64
+		for _, r := range rows {
+			total += r.count
+		}
+		atomic.StoreUint64(&d.primeTotal, total)
+		if done >= total {
+			d.mtx.RUnlock()
+			return nil
+		}
+		// find where done is in the rows
+		r, offset := rows[0], done
+		for _, r = range rows {
+			if offset < r.count {
+				break
+			}
+			offset -= r.count
+		}
+		count := r.count - offset
+		if count > primeChunk {
+			count = primeChunk
+		}
+		chunk := buf[:count*leafSize]
+		_, err := d.readAt(chunk, int64((r.start+offset)*leafSize))
+		if err == nil {
+			d.cache.fill(r.startCache+offset, chunk)
+		}
+		d.mtx.RUnlock()
+		if err != nil {
+			return fmt.Errorf("cacheForestData Prime pos %d %s",
+				r.start+offset, err.Error())
+		}
+		done += count
+		atomic.StoreUint64(&d.primed, done)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(primePause):
+		}
+	}
+}
+
+// PrimeProgress gives how many positions Prime has gone through and how
+// many the cache holds.
+func (d *cacheForestData) PrimeProgress() (primed, total uint64) {
+	return atomic.LoadUint64(&d.primed), atomic.LoadUint64(&d.primeTotal)
+}
+
+// startPrime runs Prime in the background until it's done or close is
+// called.  Without the cache locks nothing else can use the forest at the
+// same time, so then it does nothing.
+func (d *cacheForestData) startPrime() {
+	if !cacheLocked {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := d.Prime(ctx)
+		if err != nil && err != context.Canceled {
+			fmt.Printf("\tWARNING!! %s\n", err.Error())
+		}
+	}()
+	d.stopPrime = func() {
+		cancel()
+		<-done
+	}
+}
+
+// rowRanges gives the part of each row the cache holds, bottom row first.
+func (cache *diskForestCache) rowRanges(hashCount uint64) []cacheRange {
+	var rows []cacheRange
+
+	row := uint8(0)
+	rowOffset := uint64(0)
+
+	cacheSize := cache.size
+	if cacheSize > (hashCount+1)>>1 {
+		cacheSize = (hashCount + 1) >> 1
+	}
+
+	hashesNotCached := uint64(0)
+	for hashesCachedOnRow := cacheSize; hashesCachedOnRow != 0; hashesCachedOnRow >>= 1 {
+		totalHashesOnRow := (hashCount + 1) >> (row + 1)
+		minPosition := rowOffset + (totalHashesOnRow - hashesCachedOnRow)
+		hashesNotCached += (totalHashesOnRow - hashesCachedOnRow)
+
+		rows = append(rows, cacheRange{
+			start:      minPosition,
+			startCache: minPosition - hashesNotCached,
+			count:      hashesCachedOnRow,
+		})
+
+		row++
+		rowOffset += totalHashesOnRow
+	}
+
+	return rows
+}
+
+// fill sets the hashes from cache position start on, skipping the ones the
+// cache already has since they can be newer than what's on disk.
+func (cache *diskForestCache) fill(start uint64, hashes []byte) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	for i := uint64(0); i < uint64(len(hashes))/leafSize; i++ {
+		if cache.valid[start+i] {
+			continue
+		}
+		copy(cache.data[(start+i)*leafSize:(start+i+1)*leafSize],
+			hashes[i*leafSize:(i+1)*leafSize])
+		cache.valid[start+i] = true
+	}
 }
 
 // Calculates the overlap of a range (start, start+r) with the cache.
@@ -56,13 +456,13 @@ func (cache *diskForestCache) rangeOverlap(
 	rowOffset := uint64(0)
 
 	cacheSize := cache.size
-	if cacheSize > hashCount>>1 {
-		cacheSize = hashCount >> 1
+	if cacheSize > (hashCount+1)>>1 {
+		cacheSize = (hashCount + 1) >> 1
 	}
 
 	hashesNotCached := uint64(0)
 	for hashesCachedOnRow := cacheSize; hashesCachedOnRow != 0; hashesCachedOnRow >>= 1 {
-		totalHashesOnRow := hashCount >> (row + 1)
+		totalHashesOnRow := (hashCount + 1) >> (row + 1)
 		hashesNotCached += (totalHashesOnRow - hashesCachedOnRow)
 
 		minPosition := rowOffset + (totalHashesOnRow - hashesCachedOnRow)
@@ -70,7 +470,7 @@ func (cache *diskForestCache) rangeOverlap(
 
 		if start < minPosition &&
 			start+r >= minPosition {
-			return (start + r) - minPosition, (start + r) - hashesNotCached
+			return (start + r) - minPosition, minPosition - hashesNotCached
 		}
 
 		if start >= minPosition && start <= maxPosition {
@@ -89,17 +489,19 @@ func (cache *diskForestCache) rangeOverlap(
 // Goes through each forest row and checks if `pos` is in the cached portion of that row.
 func (cache *diskForestCache) includes(
 	pos uint64, hashCount uint64) (included bool, cachePosition uint64) {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
 	row := uint8(0)
 	rowOffset := uint64(0)
 
 	cacheSize := cache.size
-	if cacheSize > hashCount>>1 {
-		cacheSize = hashCount >> 1
+	if cacheSize > (hashCount+1)>>1 {
+		cacheSize = (hashCount + 1) >> 1
 	}
 
 	hashesNotCached := uint64(0)
 	for hashesCachedOnRow := cacheSize; hashesCachedOnRow != 0; hashesCachedOnRow >>= 1 {
-		totalHashesOnRow := hashCount >> (row + 1)
+		totalHashesOnRow := (hashCount + 1) >> (row + 1)
 		hashesNotCached += (totalHashesOnRow - hashesCachedOnRow)
 
 		minPosition := rowOffset + (totalHashesOnRow - hashesCachedOnRow)
@@ -125,6 +527,8 @@ func (cache *diskForestCache) includes(
 // from disk.
 // `pos` must be a cache position returned from `includes`.
 func (cache *diskForestCache) get(pos uint64) (Hash, bool) {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
 	populated := cache.valid[pos]
 	if !populated {
 		return empty, false
@@ -139,6 +543,8 @@ func (cache *diskForestCache) get(pos uint64) (Hash, bool) {
 // Gets a range of hashes.
 // Returns the hashes as a byte slice and unpopulated cache positions relative to `start`.
 func (cache *diskForestCache) rangeGet(start uint64, r uint64) ([]byte, []uint64) {
+	cache.mtx.RLock()
+	defer cache.mtx.RUnlock()
 	var misses []uint64
 	for check := uint64(0); check < r; check++ {
 		if !cache.valid[check+start] {
@@ -158,6 +564,8 @@ func (cache *diskForestCache) rangeGet(start uint64, r uint64) ([]byte, []uint64
 // or not it should actually be included.
 // Check inclusion first with `includes`.
 func (cache *diskForestCache) set(pos uint64, hash []byte) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
 	copy(cache.data[pos*leafSize:(pos+1)*leafSize], hash)
 	cache.valid[pos] = true
 }
@@ -173,6 +581,8 @@ func (cache *diskForestCache) rangeSet(start uint64,
 		)
 	}
 
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
 	for populate := start; populate < start+r; populate++ {
 		// mark all entries in the range as populated
 		cache.valid[populate] = true
@@ -184,20 +594,29 @@ func (cache *diskForestCache) rangeSet(start uint64,
 // Resets the cache and returns populated cache ranges.
 // sort of expensive but not needed often.
 func (cache *diskForestCache) flush(hashCount uint64) []cacheRange {
-	cacheLength := cache.size << 1
+	entries := cache.populated(hashCount)
+
+	// reset the populated map
+	cache.valid = make([]bool, cache.size<<1)
+
+	return entries
+}
+
+// Returns populated cache ranges without resetting the cache.
+func (cache *diskForestCache) populated(hashCount uint64) []cacheRange {
 	var entries []cacheRange
 
 	row := uint8(0)
 	rowOffset := uint64(0)
 
 	cacheSize := cache.size
-	if cacheSize > hashCount>>1 {
-		cacheSize = hashCount >> 1
+	if cacheSize > (hashCount+1)>>1 {
+		cacheSize = (hashCount + 1) >> 1
 	}
 
 	hashesNotCached := uint64(0)
 	for hashesCachedOnRow := cacheSize; hashesCachedOnRow != 0; hashesCachedOnRow >>= 1 {
-		totalHashesOnRow := hashCount >> (row + 1)
+		totalHashesOnRow := (hashCount + 1) >> (row + 1)
 		minPosition := rowOffset + (totalHashesOnRow - hashesCachedOnRow)
 		hashesNotCached += (totalHashesOnRow - hashesCachedOnRow)
 
@@ -226,14 +645,20 @@ func (cache *diskForestCache) flush(hashCount uint64) []cacheRange {
 		rowOffset += totalHashesOnRow
 	}
 
-	// reset the populated map
-	cache.valid = make([]bool, cacheLength)
-
 	return entries
 }
 
 // read ignores errors. Probably get an empty hash if it doesn't work
 func (d *cacheForestData) read(pos uint64) Hash {
+	defer d.adaptCache()
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.readHash(pos)
+}
+
+// readHash is read for when d.mtx is already held.  A cache miss gets filled
+// in under the cache's own lock, so holding d.mtx for reading is enough.
+func (d *cacheForestData) readHash(pos uint64) Hash {
 	var h Hash
 	inCache, cachePos := d.cache.includes(pos, d.hashCount)
 	cacheMissed := false
@@ -243,16 +668,18 @@ func (d *cacheForestData) read(pos uint64) Hash {
 		h, ok := d.cache.get(cachePos)
 		if ok {
 			// The cache did hold the value at `pos`.
+			atomic.AddUint64(&d.hits, 1)
 			return h
 		}
 		// The cache did not hold the value at `pos`.
 		cacheMissed = true
 	}
+	atomic.AddUint64(&d.misses, 1)
 
 	// Read `pos` from disk.
-	_, err := d.file.ReadAt(h[:], int64(pos*leafSize))
+	_, err := d.readAt(h[:], int64(pos*leafSize))
 	if err != nil {
-		fmt.Printf("\tWARNING!! read %x pos %d %s\n", h, pos, err.Error())
+		fmt.Printf("\tWARNING!! read %s pos %d %s\n", h, pos, err.Error())
 	}
 
 	if cacheMissed {
@@ -268,18 +695,26 @@ func (d *cacheForestData) read(pos uint64) Hash {
 	return h
 }
 
-// writeHash writes a hash.  Don't go out of bounds.
+// write writes a hash.  Don't go out of bounds.
 func (d *cacheForestData) write(pos uint64, h Hash) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.writeHash(pos, h)
+}
+
+// writeHash is write for when d.mtx is already held for writing.
+func (d *cacheForestData) writeHash(pos uint64, h Hash) {
 	inCache, cachePos := d.cache.includes(pos, d.hashCount)
 
 	// Write `h` to `pos` in the cache if `pos` should be included in the cache.
 	if inCache {
 		d.cache.set(cachePos, h[:])
+		d.cacheWritten(1)
 		return
 	}
 
 	// Write `h` to disk if it was not included in the cache.
-	_, err := d.file.WriteAt(h[:], int64(pos*leafSize))
+	_, err := d.writeAt(h[:], int64(pos*leafSize))
 	if err != nil {
 		fmt.Printf("\tWARNING!! write pos %d %s\n", pos, err.Error())
 	}
@@ -287,15 +722,26 @@ func (d *cacheForestData) write(pos uint64, h Hash) {
 
 // swapHash swaps 2 hashes.  Don't go out of bounds.
 func (d *cacheForestData) swapHash(a, b uint64) {
-	ha := d.read(a)
-	hb := d.read(b)
-	d.write(a, hb)
-	d.write(b, ha)
+	defer d.adaptCache()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	ha := d.readHash(a)
+	hb := d.readHash(b)
+	d.writeHash(a, hb)
+	d.writeHash(b, ha)
 }
 
 // read a range from the forest.
 // reads from cache and disk.
-func (d *cacheForestData) readRange(
+func (d *cacheForestData) readRange(start, r uint64) []byte {
+	defer d.adaptCache()
+	d.mtx.RLock()
+	defer d.mtx.RUnlock()
+	return d.readHashRange(start, r)
+}
+
+// readHashRange is readRange for when d.mtx is already held.
+func (d *cacheForestData) readHashRange(
 	start, r uint64) (hashes []byte) {
 	// The number of hashes from the range included in the cache.
 	cacheOverlap, cacheStart := d.cache.rangeOverlap(start, r, d.hashCount)
@@ -304,13 +750,15 @@ func (d *cacheForestData) readRange(
 	diskPosition := int64(start * leafSize)
 
 	cacheHashes, misses := d.cache.rangeGet(cacheStart, cacheOverlap)
+	atomic.AddUint64(&d.hits, cacheOverlap-uint64(len(misses)))
+	atomic.AddUint64(&d.misses, diskOverlap+uint64(len(misses)))
 
 	if len(misses) != 0 {
 		// Some entries were not in the cache and should be read from disk.
 		for _, miss := range misses {
 			diskPosition := int64((diskOverlap + miss + start) * leafSize)
 			// TODO: batch read for sequential misses.
-			_, err := d.file.ReadAt(cacheHashes[miss*leafSize:(miss+1)*leafSize], diskPosition)
+			_, err := d.readAt(cacheHashes[miss*leafSize:(miss+1)*leafSize], diskPosition)
 			if err != nil {
 				fmt.Printf("\tWARNING!! read pos %d %s\n", start, err.Error())
 			}
@@ -318,7 +766,7 @@ func (d *cacheForestData) readRange(
 	}
 
 	hashes = make([]byte, leafSize*diskOverlap)
-	_, err := d.file.ReadAt(hashes, diskPosition)
+	_, err := d.readAt(hashes, diskPosition)
 	if err != nil {
 		fmt.Printf("\tWARNING!! read pos %d %s\n", start, err.Error())
 	}
@@ -329,7 +777,14 @@ func (d *cacheForestData) readRange(
 
 // write a range to the forest data.
 // Writes to the cache and the disk.
-func (d *cacheForestData) writeRange(
+func (d *cacheForestData) writeRange(start, r uint64, hashes []byte) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.writeHashRange(start, r, hashes)
+}
+
+// writeHashRange is writeRange for when d.mtx is already held for writing.
+func (d *cacheForestData) writeHashRange(
 	start, r uint64, hashes []byte) {
 	// calculate the cacheOverlap for the range
 	cacheOverlap, cacheStart := d.cache.rangeOverlap(start, r, d.hashCount)
@@ -340,13 +795,14 @@ func (d *cacheForestData) writeRange(
 	d.cache.rangeSet(cacheStart, cacheOverlap, hashes[diskOverlap*leafSize:])
 
 	// write the diskoverlap of the range to disk
-	_, err := d.file.WriteAt(
+	_, err := d.writeAt(
 		hashes[:diskOverlap*leafSize],
 		diskPosition,
 	)
 	if err != nil {
 		fmt.Printf("\tWARNING!! write pos %d %s\n", diskPosition, err.Error())
 	}
+	d.cacheWritten(cacheOverlap)
 }
 
 // swapHashRange swaps 2 continuous ranges of hashes.  Don't go out of bounds.
@@ -355,14 +811,19 @@ func (d *cacheForestData) writeRange(
 // depends if you count seeking from b-end to b-start as a seek. or if you have
 // like read & replace as one operation or something.
 func (d *cacheForestData) swapHashRange(a, b, w uint64) {
-	hashesA := d.readRange(a, w)
-	hashesB := d.readRange(b, w)
-	d.writeRange(b, w, hashesA)
-	d.writeRange(a, w, hashesB)
+	defer d.adaptCache()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	hashesA := d.readHashRange(a, w)
+	hashesB := d.readHashRange(b, w)
+	d.writeHashRange(b, w, hashesA)
+	d.writeHashRange(a, w, hashesB)
 }
 
 // size gives you the size of the forest
 func (d *cacheForestData) size() uint64 {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
 	s, err := d.file.Stat()
 	if err != nil {
 		fmt.Printf("\tWARNING: %s. Returning 0", err.Error())
@@ -374,6 +835,8 @@ func (d *cacheForestData) size() uint64 {
 
 // resize makes the forest bigger (never gets smaller so don't try)
 func (d *cacheForestData) resize(newSize uint64) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
 	err := d.file.Truncate(int64(newSize * leafSize))
 	if err != nil {
 		panic(err)
@@ -384,8 +847,30 @@ func (d *cacheForestData) resize(newSize uint64) {
 	d.hashCount = newSize
 }
 
+// Truncate fills with zeros and the cache is flushed, so everything new is
+// read from disk
+func (d *cacheForestData) zeroOnResize() bool { return true }
+
 func (d *cacheForestData) close() {
+	if d.stopPrime != nil {
+		d.stopPrime()
+		d.stopPrime = nil
+	}
+	d.mtx.Lock()
 	flushCacheToDisk(d)
+	d.mtx.Unlock()
+	err := d.release()
+	if err != nil {
+		fmt.Printf("cacheForestData close error: %s\n", err.Error())
+	}
+}
+
+func (d *cacheForestData) release() error {
+	if d.stopPrime != nil {
+		d.stopPrime()
+		d.stopPrime = nil
+	}
+	return d.file.Close()
 }
 
 func flushCacheToDisk(d *cacheForestData) {
@@ -394,7 +879,7 @@ func flushCacheToDisk(d *cacheForestData) {
 	// write cache entries to disk.
 	for _, r := range cacheRanges {
 		// write to disk
-		_, err := d.file.WriteAt(
+		_, err := d.writeAt(
 			d.cache.data[r.startCache*leafSize:(r.startCache+r.count)*leafSize],
 			int64(r.start*leafSize),
 		)
@@ -403,3 +888,21 @@ func flushCacheToDisk(d *cacheForestData) {
 		}
 	}
 }
+
+// readAt is file.ReadAt, counting the bytes read.
+func (d *cacheForestData) readAt(b []byte, off int64) (int, error) {
+	n, err := d.file.ReadAt(b, off)
+	atomic.AddUint64(&d.bytesRead, uint64(n))
+	return n, err
+}
+
+// writeAt is file.WriteAt, counting the bytes written.
+func (d *cacheForestData) writeAt(b []byte, off int64) (int, error) {
+	n, err := d.file.WriteAt(b, off)
+	atomic.AddUint64(&d.bytesWritten, uint64(n))
+	return n, err
+}
+
+func (d *cacheForestData) diskBytes() (read, written uint64) {
+	return atomic.LoadUint64(&d.bytesRead), atomic.LoadUint64(&d.bytesWritten)
+}
@@ -0,0 +1,369 @@
+package accumulator
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// Run a CacheForest with a tiny cache so lots of reads and writes land on
+// both sides of the cache boundary, and compare it against a RamForest.
+func TestCacheForestSmallCache(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "cacheforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	cacheF := NewForest(CacheForest, forestFile, "", 2)
+	memF := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 200; b++ {
+		adds, _, delHashes := sc.NextBlock(8)
+
+		cacheBP, err := cacheF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memBP, err := memF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cacheF.Modify(adds, cacheBP.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = memF.Modify(adds, memBP.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = cacheF.AssertEqual(memF)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	}
+}
+
+// assertReopenedEqual builds a new CacheForest from what's on disk for f, as
+// if the process running f had crashed, and compares it to memF.  Gives an
+// error if it can't be restored or doesn't match.
+func assertReopenedEqual(t *testing.T, f *Forest, fName string, memF *Forest) error {
+	miscFile, err := ioutil.TempFile("", "cacheforestmisc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(miscFile.Name())
+	defer miscFile.Close()
+	binary.Write(miscFile, binary.BigEndian, f.numLeaves)
+	binary.Write(miscFile, binary.BigEndian, f.rows)
+	miscFile.Seek(0, 0)
+
+	forestFile, err := os.Open(fName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forestFile.Close()
+	reopened, err := RestoreForest(miscFile, forestFile, false, true, "", 2)
+	if err != nil {
+		return err
+	}
+	return reopened.AssertEqual(memF)
+}
+
+func TestCacheForestFlush(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "cacheforestflush")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	cacheF := NewForest(CacheForest, forestFile, "", 2)
+	memF := NewForest(RamForest, nil, "", 0)
+	var leafCount uint16
+	runBlock := func(numAdds int, dels []Hash) {
+		adds := make([]Leaf, numAdds)
+		for i := range adds {
+			leafCount++
+			binary.BigEndian.PutUint16(adds[i].Hash[:], leafCount)
+		}
+		for _, f := range []*Forest{cacheF, memF} {
+			bp, err := f.ProveBatch(dels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// 64 leaves fill the forest, so the newest ones at the right are in
+	// the cache
+	for b := 0; b < 8; b++ {
+		runBlock(8, nil)
+	}
+	// without a flush, what's in the cache is lost
+	if assertReopenedEqual(t, cacheF, forestFile.Name(), memF) == nil {
+		t.Fatal("forest on disk matches without flushing the cache")
+	}
+	err = cacheF.data.(*cacheForestData).Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assertReopenedEqual(t, cacheF, forestFile.Name(), memF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// flushing after every write means nothing is ever lost
+	err = cacheF.SetCacheFlushInterval(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for b := 0; b < 8; b++ {
+		// take out the 2 newest leaves and put 2 in
+		var dels []Hash
+		for _, pos := range []uint64{memF.numLeaves - 1, memF.numLeaves - 2} {
+			dels = append(dels, memF.data.read(pos))
+		}
+		runBlock(2, dels)
+		err = assertReopenedEqual(t, cacheF, forestFile.Name(), memF)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	}
+	err = memF.SetCacheFlushInterval(1)
+	if err == nil {
+		t.Fatal("set a cache flush interval on a RamForest")
+	}
+}
+
+// A restored CacheForest primes its whole cache in the background without
+// touching what's written to the cache in the meantime.
+func TestCacheForestPrime(t *testing.T) {
+	if !cacheLocked {
+		t.Skip("no background priming without the cache locks")
+	}
+	forestFile, err := ioutil.TempFile("", "cacheforestprime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+	defer forestFile.Close()
+
+	memF := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 100)
+	for i := range adds {
+		binary.BigEndian.PutUint16(adds[i].Hash[:], uint16(i+1))
+	}
+	_, err = memF.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = memF.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile, err := ioutil.TempFile("", "cacheforestprimemisc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(miscFile.Name())
+	defer miscFile.Close()
+	binary.Write(miscFile, binary.BigEndian, memF.numLeaves)
+	binary.Write(miscFile, binary.BigEndian, memF.rows)
+	miscFile.Seek(0, 0)
+
+	restored, err := RestoreForest(miscFile, forestFile, false, true, "", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := restored.data.(*cacheForestData)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		primed, total, err := restored.CachePrimeProgress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 0 && primed == total {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("primed %d of %d after 10s", primed, total)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	m := restored.Metrics()
+	// 16 leaves, then 8, 4, 2 and 1 up the rows
+	if m.CachePrimeTotal != 31 || m.CachePrimed != 31 {
+		t.Fatalf("primed %d of %d, expected 31 of 31",
+			m.CachePrimed, m.CachePrimeTotal)
+	}
+	for _, r := range d.cache.rowRanges(d.hashCount) {
+		for i := uint64(0); i < r.count; i++ {
+			h, ok := d.cache.get(r.startCache + i)
+			if !ok {
+				t.Fatalf("position %d not primed", r.start+i)
+			}
+			if h != memF.data.read(r.start+i) {
+				t.Fatalf("position %d primed with %s, expected %s",
+					r.start+i, h, memF.data.read(r.start+i))
+			}
+		}
+	}
+	err = restored.AssertEqual(memF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// priming again leaves newer hashes in the cache alone
+	newer := Hash{0xee}
+	rows := d.cache.rowRanges(d.hashCount)
+	d.cache.set(rows[0].startCache, newer[:])
+	err = d.Prime(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := d.read(rows[0].start); h != newer {
+		t.Fatalf("priming replaced %s with %s", newer, h)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if d.Prime(ctx) != context.Canceled {
+		t.Fatal("Prime didn't stop when cancelled")
+	}
+	restored.data.close()
+}
+
+func TestCheckCacheRows(t *testing.T) {
+	rows, err := checkCacheRows(0)
+	if err != nil || rows != DefaultCacheRows {
+		t.Fatalf("0 should give the default %d rows, got %d %v",
+			DefaultCacheRows, rows, err)
+	}
+	for _, bad := range []int{-1, MaxCacheRows + 1} {
+		_, err = checkCacheRows(bad)
+		if err == nil {
+			t.Fatalf("%d cache rows should be rejected", bad)
+		}
+	}
+}
+
+// A CacheForest with adaptive sizing leaves its cache alone while reads stay
+// in it, grows it for reads all over the forest, and gives back a row that
+// didn't help when reads only go where no cache size would reach.
+func TestCacheForestAdaptive(t *testing.T) {
+	const (
+		numLeaves = 1024
+		hashCount = numLeaves*2 - 1
+		minRows   = 2
+		maxRows   = 6
+		window    = 1 << 13
+	)
+	adds := make([]Leaf, numLeaves)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), uint8(i >> 8), 0xad}
+	}
+	memF := NewForest(RamForest, nil, "", 0)
+	_, err := memF.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// newAdaptive gives a CacheForest holding adds with adaptive sizing on
+	newAdaptive := func(name string) (*Forest, *cacheForestData) {
+		forestFile, err := ioutil.TempFile("", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := NewForest(CacheForest, forestFile, "", minRows)
+		_, err = f.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.SetCacheAdaptive(minRows, maxRows, 0.5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := f.data.(*cacheForestData)
+		d.mtx.Lock()
+		d.adapt.window = window
+		d.startAdaptWindow()
+		d.mtx.Unlock()
+		return f, d
+	}
+	// readWindows reads windows worth of positions from next, and gives the
+	// hit ratio over them
+	readWindows := func(f *Forest, windows int, next func() uint64) float64 {
+		before, err := f.CacheForestStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < windows*window; i++ {
+			f.data.read(next())
+		}
+		after, err := f.CacheForestStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return CacheForestStats{
+			Hits:   after.Hits - before.Hits,
+			Misses: after.Misses - before.Misses,
+		}.HitRatio()
+	}
+
+	f, d := newAdaptive("cacheadaptive")
+	defer os.Remove(d.file.Name())
+
+	// the rightmost leaves are always in the cache
+	var pos uint64
+	ratio := readWindows(f, 4, func() uint64 {
+		pos++
+		return numLeaves - 1 - pos%4
+	})
+	stats, _ := f.CacheForestStats()
+	if ratio < 0.99 || stats.Resizes != 0 || stats.Rows != minRows {
+		t.Fatalf("reading cached leaves gave hit ratio %.3f and %+v",
+			ratio, stats)
+	}
+
+	rnd := rand.New(rand.NewSource(3))
+	ratio = readWindows(f, 12, func() uint64 {
+		return uint64(rnd.Int63n(hashCount))
+	})
+	stats, _ = f.CacheForestStats()
+	if ratio >= 0.5 || stats.Rows != maxRows ||
+		stats.Resizes != maxRows-minRows {
+		t.Fatalf("reading all over gave hit ratio %.3f and %+v, "+
+			"expected the cache to grow to %d rows", ratio, stats, maxRows)
+	}
+	err = f.AssertEqual(memF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the leftmost leaves are never in the cache
+	f, d = newAdaptive("cacheadaptivecold")
+	defer os.Remove(d.file.Name())
+	ratio = readWindows(f, 6, func() uint64 {
+		pos++
+		return pos % 16
+	})
+	stats, _ = f.CacheForestStats()
+	if ratio != 0 || stats.Rows != minRows || stats.Resizes != 2 {
+		t.Fatalf("reading uncached leaves gave hit ratio %.3f and %+v, "+
+			"expected one grow and one shrink", ratio, stats)
+	}
+	err = f.AssertEqual(memF)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,33 @@
+package accumulator
+
+import (
+	"fmt"
+	"os"
+)
+
+// uringBatch is how many writes a uringForestData sends to the kernel at
+// once.  Has to match UF_BATCH in forestdatauring_linux.go.
+const uringBatch = 64
+
+// WithUring makes a DiskForest do its reads and writes through io_uring,
+// with the writes going out in batches without waiting for each one.  It
+// takes Linux, cgo, liburing and building with the utreexo_uring tag.
+// Without those, or if the kernel won't set up a ring, the forest reads
+// and writes its file the usual way.
+func WithUring() ForestOption {
+	return func(o *forestOptions) {
+		o.uring = true
+	}
+}
+
+// uringOrDisk gives a uringForestData for file if it can get one, and a
+// plain diskForestData if not.
+func uringOrDisk(file *os.File) ForestData {
+	d, err := newUringForestData(file)
+	if err != nil {
+		fmt.Printf("\tWARNING!! no io_uring, reading the forest file "+
+			"directly: %s\n", err.Error())
+		return &diskForestData{file: file}
+	}
+	return d
+}
@@ -0,0 +1,350 @@
+//go:build linux && cgo && utreexo_uring
+// +build linux,cgo,utreexo_uring
+
+package accumulator
+
+/*
+#cgo LDFLAGS: -luring
+#include <errno.h>
+#include <liburing.h>
+#include <stdlib.h>
+#include <string.h>
+
+// writes go to the kernel UF_BATCH at a time.  One batch fills while the
+// one before it is in flight, so wbuf holds two.
+#define UF_BATCH 64
+#define UF_HASH 32
+
+// how many times a read peeks for its completion before sleeping on it
+#define UF_READ_SPINS 4096
+
+typedef struct {
+	// wring is for the batched writes, rring for one read at a time, so
+	// submitting a read doesn't send a batch that isn't full yet
+	struct io_uring wring, rring;
+	int fd;
+
+	unsigned char wbuf[2][UF_BATCH][UF_HASH];
+	// filling is which half of wbuf is getting written to, queued how
+	// many writes it has, and inflight how many of the other half's
+	// writes haven't completed
+	int filling, queued, inflight;
+	// werr is the first failed write since the last uf_reap, as -errno
+	int werr;
+} uf_t;
+
+static int uf_open(uf_t **out, int fd) {
+	uf_t *u = calloc(1, sizeof(uf_t));
+	if (u == NULL) {
+		return -ENOMEM;
+	}
+	int err = io_uring_queue_init(UF_BATCH, &u->wring, 0);
+	if (err < 0) {
+		free(u);
+		return err;
+	}
+	err = io_uring_queue_init(1, &u->rring, 0);
+	if (err < 0) {
+		io_uring_queue_exit(&u->wring);
+		free(u);
+		return err;
+	}
+	u->fd = fd;
+	*out = u;
+	return 0;
+}
+
+// uf_write copies h into the next slot of the filling batch and queues a
+// write of it to off.
+static int uf_write(uf_t *u, const unsigned char *h, unsigned long long off) {
+	struct io_uring_sqe *sqe = io_uring_get_sqe(&u->wring);
+	if (sqe == NULL) {
+		return -EBUSY;
+	}
+	unsigned char *buf = u->wbuf[u->filling][u->queued];
+	memcpy(buf, h, UF_HASH);
+	io_uring_prep_write(sqe, u->fd, buf, UF_HASH, off);
+	u->queued++;
+	return 0;
+}
+
+// uf_rewrite changes the hash a queued write in the filling batch writes.
+static void uf_rewrite(uf_t *u, int slot, const unsigned char *h) {
+	memcpy(u->wbuf[u->filling][slot], h, UF_HASH);
+}
+
+// uf_reap waits for the writes in flight, and gives the first that failed.
+static int uf_reap(uf_t *u) {
+	while (u->inflight > 0) {
+		struct io_uring_cqe *cqe;
+		int err = io_uring_wait_cqe(&u->wring, &cqe);
+		if (err == -EINTR) {
+			continue;
+		}
+		if (err < 0) {
+			return err;
+		}
+		if (u->werr == 0 && cqe->res != UF_HASH) {
+			u->werr = cqe->res < 0 ? cqe->res : -EIO;
+		}
+		io_uring_cqe_seen(&u->wring, cqe);
+		u->inflight--;
+	}
+	int err = u->werr;
+	u->werr = 0;
+	return err;
+}
+
+// uf_submit sends the filling batch to the kernel without waiting for it,
+// once the batch before it is done so writes land in order.
+static int uf_submit(uf_t *u) {
+	if (u->queued == 0) {
+		return 0;
+	}
+	int err = uf_reap(u);
+	int submitted = 0;
+	while (submitted < u->queued) {
+		int n = io_uring_submit(&u->wring);
+		if (n == -EINTR) {
+			continue;
+		}
+		if (n <= 0) {
+			// the writes that did go out can still be reaped
+			u->inflight = submitted;
+			u->queued = 0;
+			u->filling ^= 1;
+			return n < 0 ? n : -EIO;
+		}
+		submitted += n;
+	}
+	u->inflight = u->queued;
+	u->queued = 0;
+	u->filling ^= 1;
+	return err;
+}
+
+// uf_read reads the hash at off into out, polling for the completion.  It
+// gives how many bytes were read or -errno.
+static int uf_read(uf_t *u, unsigned char *out, unsigned long long off) {
+	struct io_uring_sqe *sqe = io_uring_get_sqe(&u->rring);
+	if (sqe == NULL) {
+		return -EBUSY;
+	}
+	io_uring_prep_read(sqe, u->fd, out, UF_HASH, off);
+	int n = io_uring_submit(&u->rring);
+	if (n < 0) {
+		return n;
+	}
+
+	struct io_uring_cqe *cqe;
+	int err = -EAGAIN;
+	for (int i = 0; i < UF_READ_SPINS && err == -EAGAIN; i++) {
+		err = io_uring_peek_cqe(&u->rring, &cqe);
+	}
+	while (err == -EAGAIN || err == -EINTR) {
+		err = io_uring_wait_cqe(&u->rring, &cqe);
+	}
+	if (err < 0) {
+		return err;
+	}
+	int res = cqe->res;
+	io_uring_cqe_seen(&u->rring, cqe);
+	return res;
+}
+
+static void uf_close(uf_t *u) {
+	io_uring_queue_exit(&u->rring);
+	io_uring_queue_exit(&u->wring);
+	free(u);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// haveUring says WithUring does anything in this build.
+const haveUring = true
+
+// uringForestData is a diskForestData that reads and writes through
+// io_uring.  Writes are copied into a batch that goes to the kernel once
+// it has uringBatch of them, without waiting for it to land, while the
+// next batch fills up.  Until a write is known to be on disk, reads get it
+// from pending.  Everything else is done the diskForestData way once the
+// writes are flushed.
+type uringForestData struct {
+	diskForestData
+	u *C.uf_t
+
+	// pending are the writes that might not be on disk yet, by position
+	pending map[uint64]Hash
+	// slots are the positions in the filling batch and where they are in
+	// it.  inflight are the positions in the batch the kernel has.
+	slots    map[uint64]int
+	inflight []uint64
+}
+
+// newUringForestData sets up io_uring for reading and writing file.
+func newUringForestData(file *os.File) (ForestData, error) {
+	d := &uringForestData{
+		diskForestData: diskForestData{file: file},
+		pending:        make(map[uint64]Hash),
+		slots:          make(map[uint64]int, uringBatch),
+	}
+	var u *C.uf_t
+	res := C.uf_open(&u, C.int(file.Fd()))
+	if res < 0 {
+		return nil, fmt.Errorf("io_uring setup: %s", syscall.Errno(-res))
+	}
+	d.u = u
+	return d, nil
+}
+
+// read ignores errors. Probably get an empty hash if it doesn't work
+func (d *uringForestData) read(pos uint64) Hash {
+	h, ok := d.pending[pos]
+	if ok {
+		return h
+	}
+	res := C.uf_read(d.u, (*C.uchar)(unsafe.Pointer(&h[0])),
+		C.ulonglong(pos*leafSize))
+	if res < 0 {
+		fmt.Printf("\tWARNING!! read %s pos %d %s\n",
+			h, pos, syscall.Errno(-res))
+		return h
+	}
+	atomic.AddUint64(&d.bytesRead, uint64(res))
+	if res != leafSize {
+		fmt.Printf("\tWARNING!! read %s pos %d only %d bytes\n", h, pos, res)
+	}
+	return h
+}
+
+// write queues a write of h to pos.  Don't go out of bounds.
+func (d *uringForestData) write(pos uint64, h Hash) {
+	d.pending[pos] = h
+	slot, ok := d.slots[pos]
+	if ok {
+		C.uf_rewrite(d.u, C.int(slot), (*C.uchar)(unsafe.Pointer(&h[0])))
+		return
+	}
+
+	res := C.uf_write(d.u, (*C.uchar)(unsafe.Pointer(&h[0])),
+		C.ulonglong(pos*leafSize))
+	if res < 0 {
+		// no room in the ring, so write it the slow way once everything
+		// before it is down
+		err := d.flush()
+		if err != nil {
+			fmt.Printf("\tWARNING!! %s\n", err.Error())
+		}
+		d.diskForestData.write(pos, h)
+		delete(d.pending, pos)
+		return
+	}
+	atomic.AddUint64(&d.bytesWritten, leafSize)
+	d.slots[pos] = len(d.slots)
+	if len(d.slots) == uringBatch {
+		err := d.submit()
+		if err != nil {
+			fmt.Printf("\tWARNING!! %s\n", err.Error())
+		}
+	}
+}
+
+// submit sends the filling batch to the kernel once the batch before it is
+// on disk, and doesn't wait for it.
+func (d *uringForestData) submit() error {
+	if len(d.slots) == 0 {
+		return nil
+	}
+	res := C.uf_submit(d.u)
+	// the batch before is done, unless a position was written again since
+	for _, pos := range d.inflight {
+		if _, ok := d.slots[pos]; !ok {
+			delete(d.pending, pos)
+		}
+	}
+	d.inflight = d.inflight[:0]
+	for pos := range d.slots {
+		d.inflight = append(d.inflight, pos)
+	}
+	d.slots = make(map[uint64]int, uringBatch)
+	if res < 0 {
+		return fmt.Errorf("uringForestData write: %s", syscall.Errno(-res))
+	}
+	return nil
+}
+
+// flush gets every write onto disk.
+func (d *uringForestData) flush() error {
+	err := d.submit()
+	res := C.uf_reap(d.u)
+	d.pending = make(map[uint64]Hash)
+	d.inflight = d.inflight[:0]
+	if err != nil {
+		return err
+	}
+	if res < 0 {
+		return fmt.Errorf("uringForestData write: %s", syscall.Errno(-res))
+	}
+	return nil
+}
+
+// swapHash swaps 2 hashes.  Don't go out of bounds.
+func (d *uringForestData) swapHash(a, b uint64) {
+	ha := d.read(a)
+	hb := d.read(b)
+	d.write(a, hb)
+	d.write(b, ha)
+}
+
+// swapHashRange swaps 2 continuous ranges of hashes on disk, after the
+// writes before it are there.  Don't go out of bounds.
+func (d *uringForestData) swapHashRange(a, b, w uint64) {
+	err := d.flush()
+	if err != nil {
+		fmt.Printf("\tshr WARNING!! %s\n", err.Error())
+	}
+	d.diskForestData.swapHashRange(a, b, w)
+}
+
+// size gives you the size of the forest.  Flushes the writes first.
+func (d *uringForestData) size() uint64 {
+	err := d.flush()
+	if err != nil {
+		fmt.Printf("\tWARNING: %s\n", err.Error())
+	}
+	return d.diskForestData.size()
+}
+
+// resize makes the forest bigger (never gets smaller so don't try)
+func (d *uringForestData) resize(newSize uint64) {
+	err := d.flush()
+	if err != nil {
+		fmt.Printf("\tWARNING: %s\n", err.Error())
+	}
+	d.diskForestData.resize(newSize)
+}
+
+func (d *uringForestData) close() {
+	err := d.flush()
+	if err != nil {
+		fmt.Printf("uringForestData close error: %s\n", err.Error())
+	}
+	C.uf_close(d.u)
+	d.u = nil
+	d.diskForestData.close()
+}
+
+// release drops the writes that haven't been submitted.
+func (d *uringForestData) release() error {
+	C.uf_close(d.u)
+	d.u = nil
+	return d.diskForestData.release()
+}
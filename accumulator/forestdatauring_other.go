@@ -0,0 +1,15 @@
+//go:build !linux || !cgo || !utreexo_uring
+// +build !linux !cgo !utreexo_uring
+
+package accumulator
+
+import "os"
+
+// haveUring says WithUring does anything in this build.
+const haveUring = false
+
+// Without io_uring a DiskForest asked to use it reads and writes its file
+// like any other.  See forestdatauring_linux.go.
+func newUringForestData(file *os.File) (ForestData, error) {
+	return &diskForestData{file: file}, nil
+}
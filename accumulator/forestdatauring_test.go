@@ -0,0 +1,116 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// A DiskForest using io_uring gives the same forest as a RamForest, both
+// while its writes are still in flight and after it's reopened.  Without
+// io_uring in the build it's a plain DiskForest.
+func TestUringForest(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "uringforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	uringF := NewForest(DiskForest, forestFile, "", 0, WithUring())
+	memF := NewForest(RamForest, nil, "", 0)
+	if _, ok := uringF.data.(*diskForestData); ok == haveUring {
+		t.Fatalf("WithUring gave %T with io_uring %v", uringF.data, haveUring)
+	}
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(8)
+
+		uringBP, err := uringF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		memBP, err := memF.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = uringF.Modify(adds, uringBP.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = memF.Modify(adds, memBP.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = uringF.AssertEqual(memF)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	}
+
+	// everything's on disk once it's closed
+	uringF.data.close()
+	reopened, err := os.Open(forestFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	d := &diskForestData{file: reopened}
+	for pos := uint64(0); pos < memF.data.size(); pos++ {
+		if d.read(pos) != memF.data.read(pos) {
+			t.Fatalf("pos %d on disk is %x, expected %x",
+				pos, d.read(pos), memF.data.read(pos))
+		}
+	}
+}
+
+// BenchmarkForestDataRandom does 100k reads and writes at random positions
+// of a 2**16 hash forest file, with and without io_uring.
+func BenchmarkForestDataRandom(b *testing.B) {
+	b.Run("disk", func(b *testing.B) { benchmarkForestDataRandom(false, b) })
+	b.Run("uring", func(b *testing.B) {
+		if !haveUring {
+			b.Skip("built without io_uring; use -tags utreexo_uring")
+		}
+		benchmarkForestDataRandom(true, b)
+	})
+}
+
+func benchmarkForestDataRandom(uring bool, b *testing.B) {
+	const (
+		hashes   = 1 << 16
+		accesses = 100000
+	)
+	forestFile, err := ioutil.TempFile("", "forestdatarandom")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+	var d ForestData = &diskForestData{file: forestFile}
+	if uring {
+		d = uringOrDisk(forestFile)
+	}
+	// diskForestData makes the file twice what it's asked for
+	d.resize(hashes / 2)
+
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < accesses; j++ {
+			pos := uint64(rnd.Int63n(hashes))
+			if j&1 == 0 {
+				d.read(pos)
+			} else {
+				d.write(pos, Hash{uint8(j), uint8(j >> 8), 0x0e})
+			}
+		}
+		// wait for the writes
+		d.size()
+	}
+	b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*accesses),
+		"ns/access")
+	d.close()
+}
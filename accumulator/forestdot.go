@@ -0,0 +1,55 @@
+package accumulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// PrintDot writes the forest to w as a Graphviz DOT digraph, for looking at
+// forests too big for ToString.  Every non-empty position in the forest is a
+// vertex labeled with its position and the start of its hash, with an edge
+// from each parent to its children.  Roots are drawn as double circles.
+// Render it with something like `dot -Tsvg`.
+func (f *Forest) PrintDot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	isRoot := make(map[uint64]bool)
+	positionList := NewPositionList()
+	defer positionList.Free()
+	getRootsForwards(f.numLeaves, f.rows, &positionList.list)
+	for _, pos := range positionList.list {
+		isRoot[pos] = true
+	}
+
+	fmt.Fprintf(bw, "digraph forest {\n")
+	fmt.Fprintf(bw, "\tnode [shape=circle];\n")
+	for pos := uint64(0); pos < f.data.size(); pos++ {
+		// anything past the edge of the forest is left over from deletions
+		if !inForest(pos, f.numLeaves, f.rows) {
+			continue
+		}
+		h := f.data.read(pos)
+		if h == empty {
+			continue
+		}
+		shape := ""
+		if isRoot[pos] {
+			shape = ", shape=doublecircle"
+		}
+		fmt.Fprintf(bw, "\tn%d [label=\"%d\\n%x\"%s];\n", pos, pos, h[:3], shape)
+
+		if detectRow(pos, f.rows) == 0 {
+			continue
+		}
+		leftChild := child(pos, f.rows)
+		for _, c := range []uint64{leftChild, leftChild | 1} {
+			if inForest(c, f.numLeaves, f.rows) && f.data.read(c) != empty {
+				fmt.Fprintf(bw, "\tn%d -> n%d;\n", pos, c)
+			}
+		}
+	}
+	fmt.Fprintf(bw, "}\n")
+
+	return bw.Flush()
+}
@@ -0,0 +1,69 @@
+package accumulator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestForestPrintDot(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 16)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1)}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = f.PrintDot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+
+	if !strings.HasPrefix(dot, "digraph forest {") {
+		t.Fatalf("doesn't start with a digraph:\n%s", dot)
+	}
+	if strings.Count(dot, "{") != 1 || strings.Count(dot, "}") != 1 ||
+		!strings.HasSuffix(dot, "}\n") {
+		t.Fatalf("braces don't match:\n%s", dot)
+	}
+	// 16 leaves make a full tree of 31 nodes with 30 edges and 1 root
+	if n := strings.Count(dot, "label="); n != 31 {
+		t.Fatalf("%d vertices, expected 31", n)
+	}
+	if n := strings.Count(dot, "->"); n != 30 {
+		t.Fatalf("%d edges, expected 30", n)
+	}
+	if !strings.Contains(dot, "n30 [label=\"30\\n") ||
+		strings.Count(dot, "doublecircle") != 1 {
+		t.Fatalf("root isn't a double circle:\n%s", dot)
+	}
+	if !strings.Contains(dot, "n30 -> n28;") ||
+		!strings.Contains(dot, "n16 -> n1;") {
+		t.Fatalf("missing parent to child edges:\n%s", dot)
+	}
+
+	// after deleting a leaf there are 4 roots, and nothing left over past
+	// the edge of the forest shows up
+	_, err = f.Modify(nil, []uint64{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = f.PrintDot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot = buf.String()
+	// 8 + 4 + 2 + 1 leaf subtrees
+	if n := strings.Count(dot, "label="); n != 15+7+3+1 {
+		t.Fatalf("%d vertices after delete, expected 26", n)
+	}
+	if n := strings.Count(dot, "doublecircle"); n != 4 {
+		t.Fatalf("%d roots after delete, expected 4", n)
+	}
+}
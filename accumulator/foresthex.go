@@ -0,0 +1,147 @@
+package accumulator
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// DumpHex writes the forest as text for pasting into a bug report: a
+// numleaves line, a rows line, then a pos:hex line for every non-empty
+// position.  It doesn't depend on how any ForestData keeps things on disk,
+// and LoadHex reads it back.  The rows are always the fewest the leaves
+// need, even if the forest has more.
+func (f *Forest) DumpHex(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "numleaves: %d\nrows: %d\n",
+		f.numLeaves, treeRows(f.numLeaves))
+	f.dumpNodes(func(pos uint64, h Hash) {
+		fmt.Fprintf(bw, "%d:%x\n", pos, h[:])
+	})
+	return bw.Flush()
+}
+
+// dumpNodes calls fn with every non-empty node, and where it would be in a
+// forest with treeRows(numLeaves) rows.  Nodes in the rows above that, or
+// to the right of the last leaf, aren't part of the forest.
+func (f *Forest) dumpNodes(fn func(pos uint64, h Hash)) {
+	dumpRows := treeRows(f.numLeaves)
+	var from, to uint64
+	for row := uint8(0); row <= dumpRows; row++ {
+		for i := uint64(0); i < 1<<(dumpRows-row); i++ {
+			h := f.data.read(from + i)
+			if h != empty {
+				fn(to+i, h)
+			}
+		}
+		from += 1 << (f.rows - row)
+		to += 1 << (dumpRows - row)
+	}
+}
+
+// LoadHex makes a forest of forestType from DumpHex output.  Disk and cache
+// forests get a new file and cow forests a new dir in the temp dir, which
+// are left for the caller to look at or remove.
+func LoadHex(r io.Reader, forestType ForestType) (*Forest, error) {
+	scanner := bufio.NewScanner(r)
+	var numLeaves uint64
+	var rows uint8
+	for i, header := range []string{"numleaves", "rows"} {
+		if !scanner.Scan() {
+			return nil, fmt.Errorf("LoadHex: no %s line", header)
+		}
+		var n uint64
+		_, err := fmt.Sscanf(scanner.Text(), header+": %d", &n)
+		if err != nil {
+			return nil, fmt.Errorf("LoadHex: line %d: %s", i+1, err.Error())
+		}
+		if i == 0 {
+			numLeaves = n
+		} else if n != uint64(treeRows(numLeaves)) {
+			// DumpHex never gives more rows than the leaves need, and
+			// trusting a bigger number means allocating 2 << rows
+			return nil, fmt.Errorf("LoadHex: %d leaves need %d rows, not %d",
+				numLeaves, treeRows(numLeaves), n)
+		} else if n >= maxRows {
+			// 2 << 63 overflows
+			return nil, fmt.Errorf("LoadHex: %d rows is too many", n)
+		} else {
+			rows = uint8(n)
+		}
+	}
+
+	f, err := newHexForest(forestType)
+	if err != nil {
+		return nil, err
+	}
+	// grow a row at a time like Modify does, which cow forests need
+	err = f.SetRows(rows)
+	if err != nil {
+		return nil, fmt.Errorf("LoadHex: %s", err.Error())
+	}
+	f.numLeaves = numLeaves
+	numPositions := uint64(2<<rows) - 1
+
+	for line := 3; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		colon := strings.IndexByte(text, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("LoadHex: line %d has no colon", line)
+		}
+		pos, err := strconv.ParseUint(text[:colon], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("LoadHex: line %d: %s", line, err.Error())
+		}
+		if pos >= numPositions {
+			return nil, fmt.Errorf("LoadHex: line %d: position %d but %d "+
+				"rows only has %d", line, pos, rows, numPositions)
+		}
+		var h Hash
+		hexHash := text[colon+1:]
+		if len(hexHash) != 2*leafSize {
+			return nil, fmt.Errorf("LoadHex: line %d: hash is not %d bytes",
+				line, leafSize)
+		}
+		_, err = hex.Decode(h[:], []byte(hexHash))
+		if err != nil {
+			return nil, fmt.Errorf("LoadHex: line %d: %s", line, err.Error())
+		}
+		f.data.write(pos, h)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("LoadHex: %s", err.Error())
+	}
+
+	// rebuild positionMap from all leaves, same as RestoreForest
+	f.rebuildPositionMap()
+	return f, nil
+}
+
+// newHexForest makes an empty forest of forestType for LoadHex.
+func newHexForest(forestType ForestType) (*Forest, error) {
+	switch forestType {
+	case RamForest:
+		return NewForest(RamForest, nil, "", 0), nil
+	case DiskForest, CacheForest:
+		forestFile, err := ioutil.TempFile("", "loadhex")
+		if err != nil {
+			return nil, fmt.Errorf("LoadHex: %s", err.Error())
+		}
+		return NewForest(forestType, forestFile, "", 0), nil
+	case CowForest:
+		cowPath, err := ioutil.TempDir("", "loadhex")
+		if err != nil {
+			return nil, fmt.Errorf("LoadHex: %s", err.Error())
+		}
+		// 100MB is plenty for the forests in bug reports
+		return NewForest(CowForest, nil, cowPath, 100), nil
+	}
+	return nil, fmt.Errorf("LoadHex: unknown forest type %d", forestType)
+}
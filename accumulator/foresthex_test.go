@@ -0,0 +1,106 @@
+package accumulator
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A forest with deletions all over dumps as hex and loads back the same,
+// whatever kind of forest it's loaded into.
+func TestDumpLoadHex(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 40)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0x4e}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := []Leaf{{Hash: Hash{1, 0x4f}}, {Hash: Hash{2, 0x4f}}, {Hash: Hash{3, 0x4f}}}
+	_, err = f.Modify(more, []uint64{0, 7, 13, 22, 23, 39})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump bytes.Buffer
+	err = f.DumpHex(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(dump.String(), "numleaves: 37\nrows: 6\n") {
+		t.Fatalf("dump starts with:\n%.40s", dump.String())
+	}
+
+	for _, forestType := range []ForestType{
+		RamForest, DiskForest, CacheForest, CowForest} {
+
+		loaded, err := LoadHex(bytes.NewReader(dump.Bytes()), forestType)
+		if err != nil {
+			t.Fatalf("forest type %d: %s", forestType, err.Error())
+		}
+		switch d := loaded.data.(type) {
+		case *diskForestData:
+			defer os.Remove(d.file.Name())
+		case *cacheForestData:
+			defer os.Remove(d.file.Name())
+		case *cowForest:
+			defer os.RemoveAll(d.meta.fBasePath)
+		}
+
+		err = loaded.AssertEqual(f)
+		if err != nil {
+			t.Fatalf("forest type %d: %s", forestType, err.Error())
+		}
+		var again bytes.Buffer
+		err = loaded.DumpHex(&again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.String() != dump.String() {
+			t.Fatalf("forest type %d dumps differently once loaded",
+				forestType)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"numleaves: 3\n",
+		"numleaves: 30\nrows: 2\n",
+		"numleaves: 30\nrows: 60\n",
+		"numleaves: 3\nrows: 2\n9:" + strings.Repeat("ab", 32) + "\n",
+		"numleaves: 3\nrows: 2\n1:abcd\n",
+		"numleaves: 3\nrows: 2\n1 " + strings.Repeat("ab", 32) + "\n",
+	} {
+		_, err = LoadHex(strings.NewReader(bad), RamForest)
+		if err == nil {
+			t.Fatalf("loaded %q", bad)
+		}
+	}
+
+	// a forest with more rows than it needs dumps with the rows it needs
+	big := NewForest(RamForest, nil, "", 0, WithExpectedLeaves(1<<10))
+	_, err = big.Modify(adds[:3], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump.Reset()
+	err = big.DumpHex(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadHex(bytes.NewReader(dump.Bytes()), RamForest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loaded.AssertEqual(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.rows != 2 || loaded.GetRoots()[0] != big.GetRoots()[0] {
+		t.Fatalf("loaded %d rows, root %s, expected 2 rows, root %s",
+			loaded.rows, loaded.GetRoots()[0], big.GetRoots()[0])
+	}
+}
@@ -0,0 +1,124 @@
+package accumulator
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// forestJSON is the layout used by Forest.MarshalJSON
+type forestJSON struct {
+	NumLeaves uint64            `json:"numLeaves"`
+	Rows      uint8             `json:"rows"`
+	Roots     []string          `json:"roots"`
+	Nodes     map[uint64]string `json:"nodes"`
+	LeafData  map[uint64]string `json:"leafData,omitempty"`
+}
+
+// MarshalJSON gives the forest as JSON with the number of leaves, rows, the
+// roots and every non-empty position, all hashes in hex, plus any leaf data
+// by position.  The rows and positions are for the fewest rows the leaves
+// need, even if the forest has more.  This is for debugging only; it's nowhere near compact, so
+// use ToProto or WriteForestToDisk to actually store a forest.
+func (f *Forest) MarshalJSON() ([]byte, error) {
+	fj := forestJSON{
+		NumLeaves: f.numLeaves,
+		Rows:      treeRows(f.numLeaves),
+		Nodes:     make(map[uint64]string),
+	}
+
+	roots := f.GetRoots()
+	fj.Roots = make([]string, len(roots))
+	for i, r := range roots {
+		fj.Roots[i] = hex.EncodeToString(r[:])
+	}
+
+	f.dumpNodes(func(pos uint64, h Hash) {
+		fj.Nodes[pos] = hex.EncodeToString(h[:])
+	})
+	if len(f.leafData) != 0 {
+		fj.LeafData = make(map[uint64]string, len(f.leafData))
+		for pos, data := range f.leafData {
+			fj.LeafData[pos] = hex.EncodeToString(data)
+		}
+	}
+
+	return json.Marshal(fj)
+}
+
+// UnmarshalJSON replaces the forest with one read from MarshalJSON output.
+// The new forest is a RamForest.  Like MarshalJSON, this is only meant for
+// debugging.
+func (f *Forest) UnmarshalJSON(b []byte) error {
+	var fj forestJSON
+	err := json.Unmarshal(b, &fj)
+	if err != nil {
+		return err
+	}
+
+	// MarshalJSON never gives more rows than the leaves need, and trusting
+	// a bigger number means allocating 2 << rows
+	if fj.Rows != treeRows(fj.NumLeaves) {
+		return fmt.Errorf("UnmarshalJSON: %d leaves need %d rows, not %d",
+			fj.NumLeaves, treeRows(fj.NumLeaves), fj.Rows)
+	}
+	// 2 << 63 overflows
+	if fj.Rows >= maxRows {
+		return fmt.Errorf("UnmarshalJSON: %d rows is too many", fj.Rows)
+	}
+
+	nf := NewForest(RamForest, nil, "", 0)
+	nf.numLeaves = fj.NumLeaves
+	nf.rows = fj.Rows
+	numPositions := uint64(2<<fj.Rows) - 1
+	nf.data.resize(numPositions)
+
+	for pos, s := range fj.Nodes {
+		if pos >= numPositions {
+			return fmt.Errorf("UnmarshalJSON: node at position %d but %d "+
+				"rows only has %d", pos, fj.Rows, numPositions)
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("UnmarshalJSON: node at position %d: %s",
+				pos, err.Error())
+		}
+		if len(b) != leafSize {
+			return fmt.Errorf("UnmarshalJSON: node at position %d is not "+
+				"%d bytes", pos, leafSize)
+		}
+		var h Hash
+		copy(h[:], b)
+		nf.data.write(pos, h)
+	}
+
+	// rebuild positionMap from all leaves, same as RestoreForest
+	nf.rebuildPositionMap()
+
+	roots := nf.GetRoots()
+	if len(roots) != len(fj.Roots) {
+		return fmt.Errorf("UnmarshalJSON: nodes give %d roots but %d listed",
+			len(roots), len(fj.Roots))
+	}
+	for i, r := range roots {
+		if hex.EncodeToString(r[:]) != fj.Roots[i] {
+			return fmt.Errorf("UnmarshalJSON: root %d is %s but %s listed",
+				i, r, fj.Roots[i])
+		}
+	}
+
+	for pos, s := range fj.LeafData {
+		data, err := hex.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("UnmarshalJSON: leaf data at position %d: %s",
+				pos, err.Error())
+		}
+		err = nf.SetLeafData(pos, data)
+		if err != nil {
+			return fmt.Errorf("UnmarshalJSON: %s", err.Error())
+		}
+	}
+
+	*f = *nf
+	return nil
+}
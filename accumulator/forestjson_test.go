@@ -0,0 +1,123 @@
+package accumulator
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestForestJSONRoundTrip(t *testing.T) {
+	// more rows than it needs, which the json doesn't keep
+	f := NewForest(RamForest, nil, "", 0, WithExpectedLeaves(1<<10))
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 30; b++ {
+		adds, _, delHashes := sc.NextBlock(10)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		enc, err := json.Marshal(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2 := new(Forest)
+		err = json.Unmarshal(enc, f2)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+
+		err = f.AssertEqual(f2)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+		if !reflect.DeepEqual(f.GetRoots(), f2.GetRoots()) {
+			t.Fatalf("block %d: roots don't match", b)
+		}
+		err = f2.PosMapSanity()
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	}
+}
+
+func TestForestJSONSparse(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(5)
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fj forestJSON
+	err = json.Unmarshal(enc, &fj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 5 leaves, 2 parents and 1 grandparent
+	if len(fj.Nodes) != 8 {
+		t.Fatalf("%d nodes in json, expected 8:\n%s", len(fj.Nodes), enc)
+	}
+	if len(fj.Roots) != 2 || fj.NumLeaves != 5 || fj.Rows != f.rows {
+		t.Fatalf("bad json %s", enc)
+	}
+}
+
+func TestForestJSONBad(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(5)
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fj forestJSON
+	err = json.Unmarshal(enc, &fj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change a root but not the nodes under it
+	fj.Roots[0] = strings.Repeat("ab", 32)
+	wrongRoot, err := json.Marshal(fj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := strings.Repeat("ab", 32)
+	bad := map[string]string{
+		"wrong root": string(wrongRoot),
+		"short node": `{"numLeaves":1,"rows":0,"roots":["abcd"],` +
+			`"nodes":{"0":"abcd"}}`,
+		"not hex": `{"numLeaves":1,"rows":0,"roots":[],` +
+			`"nodes":{"0":"` + strings.Repeat("zz", 32) + `"}}`,
+		"position past rows": `{"numLeaves":1,"rows":0,"roots":[],` +
+			`"nodes":{"5":"` + node + `"}}`,
+		"long node": `{"numLeaves":1,"rows":0,"roots":[],` +
+			`"nodes":{"0":"` + node + `abcd"}}`,
+		"too many leaves": `{"numLeaves":3,"rows":1}`,
+		"too many rows":   `{"numLeaves":3,"rows":40}`,
+	}
+	for name, s := range bad {
+		err = new(Forest).UnmarshalJSON([]byte(s))
+		if err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package accumulator
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// ImportLeaves adds the 32 byte leaf hashes read from r to the end of f,
+// batchSize at a time, until r runs out.  It gives how many were added,
+// which are still in f if there's an error after them.  A forest can be
+// made from a UTXO set dump this way without going through every block.
+func (f *Forest) ImportLeaves(r io.Reader, batchSize int) (n uint64, err error) {
+	if f.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+	if batchSize < 1 {
+		return 0, fmt.Errorf("ImportLeaves: batch size %d", batchSize)
+	}
+
+	buf := make([]byte, batchSize*32)
+	adds := make([]Leaf, batchSize)
+	for {
+		read, readErr := io.ReadFull(r, buf)
+		if read%32 != 0 {
+			return n, fmt.Errorf("ImportLeaves: %d bytes after leaf %d",
+				read%32, n+uint64(read/32))
+		}
+		if readErr != nil && readErr != io.EOF &&
+			readErr != io.ErrUnexpectedEOF {
+			return n, fmt.Errorf("ImportLeaves: %s", readErr.Error())
+		}
+		batch := adds[:read/32]
+		for i := range batch {
+			copy(batch[i].Hash[:], buf[i*32:])
+		}
+		err = f.checkAdds(context.Background(), batch, nil)
+		if err != nil {
+			return n, err
+		}
+		for f.numLeaves+uint64(len(batch)) > 1<<f.rows {
+			err := f.reMap(f.rows + 1)
+			if err != nil {
+				return n, err
+			}
+		}
+		err = f.addv2(batch)
+		if err != nil {
+			return n, err
+		}
+		n += uint64(len(batch))
+		if readErr != nil {
+			// the last batch was short or there wasn't one
+			return n, nil
+		}
+	}
+}
+
+// ExportLeaves writes the hash of every leaf in f to w, in position order,
+// for ImportLeaves to read back.  It gives how many were written.
+func ExportLeaves(f *Forest, w io.Writer) (n uint64, err error) {
+	for pos := uint64(0); pos < f.numLeaves; pos++ {
+		leaf := f.data.read(pos)
+		_, err = w.Write(leaf[:])
+		if err != nil {
+			return n, fmt.Errorf("ExportLeaves: %s", err.Error())
+		}
+		n++
+	}
+	return n, nil
+}
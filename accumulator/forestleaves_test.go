@@ -0,0 +1,71 @@
+package accumulator
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Leaves exported from a forest with deletions and imported into a new one,
+// in batches that don't divide them evenly, give the same roots.
+func TestExportImportLeaves(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 300)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), uint8(i >> 8), 0xaa}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, []uint64{3, 17, 18, 150, 299})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := ExportLeaves(f, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != f.numLeaves || uint64(buf.Len()) != n*32 {
+		t.Fatalf("exported %d leaves in %d bytes, expected %d",
+			n, buf.Len(), f.numLeaves)
+	}
+
+	for _, batchSize := range []int{1, 7, 64, 1000} {
+		imported := NewForest(RamForest, nil, "", 0)
+		n, err = imported.ImportLeaves(bytes.NewReader(buf.Bytes()), batchSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != f.numLeaves {
+			t.Fatalf("batch size %d imported %d leaves, expected %d",
+				batchSize, n, f.numLeaves)
+		}
+		err = imported.AssertInvariants()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fRoots, importedRoots := f.GetRoots(), imported.GetRoots()
+		if len(fRoots) != len(importedRoots) {
+			t.Fatalf("batch size %d gave %d roots, expected %d",
+				batchSize, len(importedRoots), len(fRoots))
+		}
+		for i := range fRoots {
+			if fRoots[i] != importedRoots[i] {
+				t.Fatalf("batch size %d root %d is %x, expected %x",
+					batchSize, i, importedRoots[i], fRoots[i])
+			}
+		}
+	}
+
+	// a hash cut short
+	imported := NewForest(RamForest, nil, "", 0)
+	n, err = imported.ImportLeaves(bytes.NewReader(buf.Bytes()[:100]), 2)
+	if err == nil {
+		t.Fatal("expected error importing 100 bytes")
+	}
+	if n != 2 {
+		t.Fatalf("imported %d leaves before the short one, expected 2", n)
+	}
+}
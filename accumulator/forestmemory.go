@@ -0,0 +1,99 @@
+package accumulator
+
+// MemoryBreakdown is about how many bytes of ram a forest is using.
+// Hashes is the forest data itself, PositionMap is the keys and values in
+// the positionMap, and Overhead is everything kept around to index those,
+// like map buckets and the presence filter.
+type MemoryBreakdown struct {
+	Hashes, PositionMap, Overhead uint64
+
+	// LiveHashes is how much of Hashes isn't empty, from ByteUsage.  It's
+	// only worked out for RamForests, and isn't counted in Total.
+	LiveHashes uint64
+}
+
+// Total is all of the bytes in the breakdown.
+func (m MemoryBreakdown) Total() uint64 {
+	return m.Hashes + m.PositionMap + m.Overhead
+}
+
+// A positionMap entry is a MiniHash key and a uint64 position.
+const positionMapEntrySize = 12 + 8
+
+// positionMapOverhead estimates what a map with this many entries takes on
+// top of its keys and values.  Go maps keep entries in buckets of 8 with a
+// byte of hash per entry and a pointer to the next bucket, and grow when
+// they average 6.5 entries a bucket.
+func positionMapOverhead(entries uint64) uint64 {
+	const bucketSize = 8 + 8*positionMapEntrySize + 8
+	buckets := (entries*2)/13 + 1
+	return buckets*bucketSize - entries*positionMapEntrySize
+}
+
+// MemoryUsage says how much ram the forest is using.  For forests on disk,
+// Hashes is only what they keep in memory.
+func (f *Forest) MemoryUsage() MemoryBreakdown {
+	var m MemoryBreakdown
+
+	switch d := f.backingData().(type) {
+	case *ramForestData:
+		m.Hashes = uint64(cap(d.m))
+		m.LiveHashes = f.ByteUsage()
+	case *cacheForestData:
+		if d.cache != nil {
+			m.Hashes = uint64(cap(d.cache.data))
+			m.Overhead += uint64(cap(d.cache.valid))
+		}
+	case *diskForestData:
+		m.Hashes = uint64(len(d.journal)) * leafSize
+		m.Overhead += uint64(len(d.journal)) * 8
+	case *cowForest:
+		hashes, overhead := d.memory()
+		m.Hashes = hashes
+		m.Overhead += overhead
+	}
+
+	m.PositionMap = uint64(len(f.positionMap)) * positionMapEntrySize
+	m.Overhead += positionMapOverhead(uint64(len(f.positionMap)))
+	m.Overhead += uint64(cap(f.presence.bits)) * 8
+
+	return m
+}
+
+// HashCount counts the non-empty positions in the forest.  leaves are the
+// ones on row 0 and internal the ones above, roots included.  It reads every
+// position, so it's slow for big forests on disk.
+func (f *Forest) HashCount() (leaves, internal, total uint64) {
+	for r := uint8(0); r <= f.rows; r++ {
+		populated, _ := f.RowCount(r)
+		if r == 0 {
+			leaves = populated
+		} else {
+			internal += populated
+		}
+	}
+	return leaves, internal, leaves + internal
+}
+
+// ByteUsage is how many bytes the hashes HashCount counts take.
+func (f *Forest) ByteUsage() uint64 {
+	_, _, total := f.HashCount()
+	return total * leafSize
+}
+
+// ForestMemoryEstimate gives about how many bytes a RamForest with numLeaves
+// leaves needs, for working out how much ram to have before building one.
+func ForestMemoryEstimate(numLeaves uint64) uint64 {
+	hashes := ((uint64(2) << treeRows(numLeaves)) - 1) * leafSize
+	return hashes + numLeaves*positionMapEntrySize +
+		positionMapOverhead(numLeaves)
+}
+
+// EstimateForestSize gives how many bytes the file of a DiskForest with
+// numLeaves leaves takes, for planning storage before building one.  The
+// file has room for twice the forest's positions.  It's the size of a
+// forest with just enough rows; forests don't get smaller when leaves are
+// deleted, so a forest that had more leaves can be bigger.
+func EstimateForestSize(numLeaves uint64) uint64 {
+	return ((uint64(2) << treeRows(numLeaves)) - 1) * leafSize * 2
+}
@@ -0,0 +1,117 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestForestMemoryUsage(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 1000)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i)
+		adds[i].Hash[1] = uint8(i >> 8)
+		adds[i].Hash[20] = 0xff
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mem := f.MemoryUsage()
+	if mem.Hashes < 1000*leafSize {
+		t.Fatalf("%d bytes of hashes for 1000 leaves", mem.Hashes)
+	}
+	if mem.PositionMap != 1000*positionMapEntrySize {
+		t.Fatalf("positionMap is %d bytes, expected %d",
+			mem.PositionMap, 1000*positionMapEntrySize)
+	}
+	if mem.Overhead == 0 {
+		t.Fatal("no overhead for the positionMap")
+	}
+
+	// the estimate doesn't count room the forest's slice grew into
+	estimate := ForestMemoryEstimate(1000)
+	if estimate < 1000*leafSize+mem.PositionMap || estimate > mem.Total() {
+		t.Fatalf("estimate of %d bytes for 1000 leaves, forest uses %+v",
+			estimate, mem)
+	}
+}
+
+func TestEstimateForestSize(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "estimateforestsize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	f := NewForest(DiskForest, forestFile, "", 0)
+	var added uint64
+	for _, numLeaves := range []uint64{1, 2, 5, 8, 9, 100, 1000} {
+		adds := make([]Leaf, numLeaves-added)
+		for i := range adds {
+			adds[i].Hash[0] = uint8(added + uint64(i))
+			adds[i].Hash[1] = uint8((added + uint64(i)) >> 8)
+			adds[i].Hash[20] = 0xff
+		}
+		_, err = f.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added = numLeaves
+
+		actual := f.data.size() * leafSize
+		estimate := EstimateForestSize(numLeaves)
+		if estimate != actual {
+			t.Fatalf("estimated %d bytes for %d leaves, forest is %d",
+				estimate, numLeaves, actual)
+		}
+		stat, err := forestFile.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(stat.Size()) != estimate {
+			t.Fatalf("estimated %d bytes for %d leaves, file is %d",
+				estimate, numLeaves, stat.Size())
+		}
+	}
+}
+
+func TestForestHashCount(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 16)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i + 1)
+		adds[i].Hash[20] = 0xff
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one perfect tree of 16 leaves has 15 nodes above them
+	leaves, internal, total := f.HashCount()
+	if leaves != 16 || internal != 15 || total != 31 {
+		t.Fatalf("%d leaves %d internal %d total, expected 16 15 31",
+			leaves, internal, total)
+	}
+	if f.ByteUsage() != 31*leafSize {
+		t.Fatalf("%d bytes used, expected %d", f.ByteUsage(), 31*leafSize)
+	}
+	if f.MemoryUsage().LiveHashes != f.ByteUsage() {
+		t.Fatalf("memory usage says %d live bytes, ByteUsage %d",
+			f.MemoryUsage().LiveHashes, f.ByteUsage())
+	}
+
+	// 13 leaves are trees of 8, 4 and 1, so 7+3 internal nodes
+	_, err = f.Modify(nil, []uint64{0, 5, 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves, internal, total = f.HashCount()
+	if leaves != 13 || internal != 10 || total != 23 {
+		t.Fatalf("%d leaves %d internal %d total, expected 13 10 23",
+			leaves, internal, total)
+	}
+}
@@ -0,0 +1,138 @@
+package accumulator
+
+import (
+	"fmt"
+	"time"
+)
+
+// ForestMetrics are the forest's counters and timers from Stats, for
+// monitoring to read one at a time.
+type ForestMetrics struct {
+	// NumLeaves is how many leaves are in the forest now, HistoricHashes
+	// how many hashes it's ever done, PositionMapSize how many leaves the
+	// positionMap knows, and ForestSize how many positions the forest data
+	// has room for.
+	NumLeaves, HistoricHashes, PositionMapSize, ForestSize uint64
+
+	// HashTime, RemoveTime, MST, AddTime, ProveTime and VerifyTime are the
+	// time spent hashing, removing, moving subtrees while removing, adding,
+	// proving and verifying.  Hashing while removing counts in both
+	// HashTime and RemoveTime.
+	HashTime, RemoveTime, MST, AddTime, ProveTime, VerifyTime time.Duration
+
+	// LeavesAdded and LeavesDeleted are how many leaves Modify has added
+	// and deleted.
+	LeavesAdded, LeavesDeleted uint64
+
+	// DiskRead and DiskWritten are the bytes the forest data has read from
+	// and written to its files.  Both are 0 for RamForests.
+	DiskRead, DiskWritten uint64
+
+	// CachePrimed and CachePrimeTotal are how far a restored CacheForest
+	// has got priming its cache, out of how many positions it holds.  Both
+	// are 0 for other forests.
+	CachePrimed, CachePrimeTotal uint64
+
+	// CacheHits and CacheMisses are reads a CacheForest did and didn't
+	// answer from its cache.  Both are 0 for other forests.
+	CacheHits, CacheMisses uint64
+}
+
+// Metrics gives the forest's current ForestMetrics.
+func (f *Forest) Metrics() ForestMetrics {
+	m := ForestMetrics{
+		NumLeaves:       f.numLeaves,
+		HistoricHashes:  f.historicHashes,
+		PositionMapSize: uint64(len(f.positionMap)),
+		ForestSize:      f.data.size(),
+		HashTime:        f.timeInHash,
+		RemoveTime:      f.timeRem,
+		MST:             f.timeMST,
+		AddTime:         f.timeAdd,
+		ProveTime:       f.timeInProve,
+		VerifyTime:      f.timeInVerify,
+		LeavesAdded:     f.leavesAdded,
+		LeavesDeleted:   f.leavesDeleted,
+	}
+	if d, ok := f.backingData().(diskCounter); ok {
+		m.DiskRead, m.DiskWritten = d.diskBytes()
+	}
+	if cfd, ok := f.backingData().(*cacheForestData); ok {
+		m.CachePrimed, m.CachePrimeTotal = cfd.PrimeProgress()
+		cs := cfd.CacheStats()
+		m.CacheHits, m.CacheMisses = cs.Hits, cs.Misses
+	}
+	return m
+}
+
+// String gives the metrics the way Stats shows them.
+func (fm ForestMetrics) String() string {
+	s := fmt.Sprintf("numleaves: %d hashesever: %d posmap: %d forest: %d\n",
+		fm.NumLeaves, fm.HistoricHashes, fm.PositionMapSize, fm.ForestSize)
+	s += fmt.Sprintf("\thashT: %.2f remT: %.2f (of which MST %.2f) addT: %.2f"+
+		" proveT: %.2f verifyT: %.2f\n",
+		fm.HashTime.Seconds(), fm.RemoveTime.Seconds(), fm.MST.Seconds(),
+		fm.AddTime.Seconds(), fm.ProveTime.Seconds(), fm.VerifyTime.Seconds())
+	s += fmt.Sprintf("\tadded: %d deleted: %d disk read: %d written: %d",
+		fm.LeavesAdded, fm.LeavesDeleted, fm.DiskRead, fm.DiskWritten)
+	return s
+}
+
+// diskCounter is forest data that counts the bytes it reads from and writes
+// to disk.
+type diskCounter interface {
+	diskBytes() (read, written uint64)
+}
+
+// ForestStats is everything Stats shows, for reading without parsing it.
+type ForestStats struct {
+	ForestMetrics
+
+	// MiniCollisions is how many times a leaf's MiniHash was already in
+	// the positionMap, and CollidedLeaves how many of those leaves are
+	// still in the forest.
+	MiniCollisions, CollidedLeaves uint64
+
+	Memory MemoryBreakdown
+
+	// Cache is set for CacheForests, and Cow for CowForests.
+	Cache *CacheForestStats
+	Cow   *CowCacheStats
+}
+
+// GetStats gives the forest's current ForestStats.
+func (f *Forest) GetStats() ForestStats {
+	s := ForestStats{
+		ForestMetrics:  f.Metrics(),
+		MiniCollisions: f.miniCollisions,
+		CollidedLeaves: uint64(len(f.collidedLeaves)),
+		Memory:         f.MemoryUsage(),
+	}
+	switch d := f.backingData().(type) {
+	case *cacheForestData:
+		cs := d.CacheStats()
+		s.Cache = &cs
+	case *cowForest:
+		cs := d.CacheStats()
+		s.Cow = &cs
+	}
+	return s
+}
+
+// String gives the stats the way Stats shows them.
+func (s ForestStats) String() string {
+	str := s.ForestMetrics.String()
+	str += fmt.Sprintf("\n\tminihash collisions: %d (%d leaves now)",
+		s.MiniCollisions, s.CollidedLeaves)
+	str += fmt.Sprintf("\n\tmem hashes: %d posmap: %d overhead: %d bytes",
+		s.Memory.Hashes, s.Memory.PositionMap, s.Memory.Overhead)
+	if s.Cache != nil {
+		str += fmt.Sprintf("\n\tcache primed: %d of %d", s.CachePrimed,
+			s.CachePrimeTotal)
+	}
+	if s.Cow != nil {
+		str += fmt.Sprintf("\n\tcow cache hits: %d misses: %d evictions: %d",
+			s.Cow.Hits, s.Cow.Misses, s.Cow.Evictions)
+	}
+	return str
+}
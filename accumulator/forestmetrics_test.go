@@ -0,0 +1,125 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Metrics follow the leaves, positionMap and hashing through a Modify.
+func TestForestMetrics(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0xdd}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := f.Metrics()
+	// adding hashes on the way up but doesn't count them
+	if m.NumLeaves != 8 || m.PositionMapSize != 8 || m.ForestSize != 15 ||
+		m.HistoricHashes != 0 {
+		t.Fatalf("after 8 adds got %+v", m)
+	}
+
+	_, err = f.Modify(nil, []uint64{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = f.Metrics()
+	if m.NumLeaves != 7 || m.PositionMapSize != 7 || m.ForestSize != 15 {
+		t.Fatalf("after deleting a leaf got %+v", m)
+	}
+
+	// a tree of 4, one of 2 and one of 1 have 3+1 nodes to hash
+	err = f.Rehash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = f.Metrics()
+	if m.HistoricHashes != 4 {
+		t.Fatalf("%d hashes after rehashing, expected 4", m.HistoricHashes)
+	}
+
+	if m.ProveTime != 0 {
+		t.Fatalf("prove time %s before proving anything", m.ProveTime)
+	}
+	_, err = f.ProveBatch([]Hash{adds[3].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Metrics().ProveTime == 0 {
+		t.Fatal("no prove time after proving")
+	}
+
+	if !strings.HasPrefix(f.Stats(), f.Metrics().String()) {
+		t.Fatalf("Stats doesn't start with the Metrics:\n%s", f.Stats())
+	}
+}
+
+// The timers and counters all move once a disk forest has had a Modify, a
+// proof and a verify.
+func TestForestStatsCounters(t *testing.T) {
+	forestFile, err := ioutil.TempFile("", "foreststats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+
+	f := NewForest(DiskForest, forestFile, "", 0)
+	adds := make([]Leaf, 64)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0xee}
+	}
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, []uint64{1, 7, 30, 31, 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toProve := []Hash{adds[2].Hash, adds[40].Hash}
+	bp, err := f.ProveBatch(toProve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.VerifyBatchProof(toProve, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := f.GetStats()
+	if s.LeavesAdded != 64 || s.LeavesDeleted != 5 {
+		t.Fatalf("%d leaves added %d deleted, expected 64 and 5",
+			s.LeavesAdded, s.LeavesDeleted)
+	}
+	if s.HashTime == 0 || s.RemoveTime == 0 || s.MST == 0 ||
+		s.AddTime == 0 || s.ProveTime == 0 || s.VerifyTime == 0 {
+		t.Fatalf("a timer didn't move: %+v", s.ForestMetrics)
+	}
+	if s.DiskRead == 0 || s.DiskWritten < 64*leafSize {
+		t.Fatalf("disk read %d written %d bytes", s.DiskRead, s.DiskWritten)
+	}
+	if s.Cache != nil || s.Cow != nil {
+		t.Fatal("disk forest has cache stats")
+	}
+	if f.Stats() != s.String() {
+		t.Fatalf("Stats is\n%s\nbut stats string is\n%s", f.Stats(), s.String())
+	}
+
+	// a ram forest doesn't touch the disk
+	ramF := NewForest(RamForest, nil, "", 0)
+	_, err = ramF.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ramF.Metrics()
+	if m.DiskRead != 0 || m.DiskWritten != 0 {
+		t.Fatalf("ram forest read %d wrote %d bytes", m.DiskRead, m.DiskWritten)
+	}
+}
@@ -1,10 +1,17 @@
 package accumulator
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
+// ErrNotLeaf is returned by ProvePosition for positions above the bottom
+// row of the forest.
+var ErrNotLeaf = errors.New("position is not a leaf")
+
 // Proof :
 type Proof struct {
 	Position uint64 // where at the bottom of the tree it sits
@@ -17,11 +24,14 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 	starttime := time.Now()
 
 	var pr Proof
-	var empty [32]byte
 	// first look up where the hash is
-	pos, ok := f.positionMap[wanted.Mini()]
+	pos, ok := f.leafPosition(wanted)
 	if !ok {
-		return pr, fmt.Errorf("hash %x not found", wanted)
+		return pr, fmt.Errorf("hash %s not found", wanted)
+	}
+	err := f.checkLookup(wanted)
+	if err != nil {
+		return pr, err
 	}
 
 	// should never happen
@@ -30,22 +40,80 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 			pos, f.numLeaves)
 	}
 
-	// build empty proof branch slice of siblings
-	// not full rows -- need to figure out which subtree it's in!
-	pr.Siblings = make([]Hash, detectSubTreeRows(pos, f.numLeaves, f.rows))
-	pr.Payload = f.data.read(pos)
+	pr, err = f.proofAt(pos)
+	if err != nil {
+		return pr, err
+	}
 	if pr.Payload != wanted {
 		return pr, fmt.Errorf(
 			"prove: forest and position map conflict. want %x got %x at pos %d",
 			wanted[:4], pr.Payload[:4], pos)
 	}
+
+	donetime := time.Now()
+	f.timeInProve += donetime.Sub(starttime)
+	return pr, nil
+}
+
+// ProvePosition proves the leaf at pos, without looking it up in the
+// positionMap, for callers that know where leaves are instead of what they
+// are.  Gives ErrNotLeaf if pos isn't on the bottom row.
+func (f *Forest) ProvePosition(pos uint64) (Proof, error) {
+	starttime := time.Now()
+
+	if pos >= f.data.size() {
+		return Proof{}, fmt.Errorf("ProvePosition: position %d past the "+
+			"end of the forest", pos)
+	}
+	if detectRow(pos, f.rows) != 0 {
+		return Proof{}, fmt.Errorf("ProvePosition: position %d: %w",
+			pos, ErrNotLeaf)
+	}
+	if pos >= f.numLeaves {
+		return Proof{}, fmt.Errorf("ProvePosition: position %d but only "+
+			"%d leaves exist", pos, f.numLeaves)
+	}
+	pr, err := f.proofAt(pos)
+	if err != nil {
+		return pr, err
+	}
+
+	f.timeInProve += time.Since(starttime)
+	return pr, nil
+}
+
+// ProvePositions is ProveAtPositions, but like ProvePosition it gives
+// ErrNotLeaf for positions above the bottom row.
+func (f *Forest) ProvePositions(positions []uint64) (BatchProof, error) {
+	for _, pos := range positions {
+		if pos < f.data.size() && detectRow(pos, f.rows) != 0 {
+			return BatchProof{}, fmt.Errorf("ProvePositions: position %d: %w",
+				pos, ErrNotLeaf)
+		}
+	}
+	return f.ProveAtPositions(positions)
+}
+
+// proofAt builds the proof for the leaf at pos, which has to be less than
+// numLeaves.
+func (f *Forest) proofAt(pos uint64) (Proof, error) {
+	var pr Proof
+	var err error
+
+	// build empty proof branch slice of siblings
+	// not full rows -- need to figure out which subtree it's in!
+	pr.Siblings = make([]Hash, detectSubTreeRows(pos, f.numLeaves, f.rows))
+	pr.Payload = f.data.read(pos)
 	pr.Position = pos
 	//	fmt.Printf("nl %d proof for %d len %d\n", f.numLeaves, pos, len(pr.Siblings))
 	//	fmt.Printf("\tprove pos %d %x:\n", pos, pr.Payload[:4])
 	// go up and populate the siblings
 	for h, _ := range pr.Siblings {
 
-		pr.Siblings[h] = f.data.read(pos ^ 1)
+		pr.Siblings[h], err = f.ReadAt(pos ^ 1)
+		if err != nil {
+			return pr, fmt.Errorf("prove: %s", err.Error())
+		}
 		if pr.Siblings[h] == empty {
 			fmt.Print(f.ToString())
 			return pr, fmt.Errorf(
@@ -56,9 +124,6 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 		pos = parent(pos, f.rows)
 
 	}
-
-	donetime := time.Now()
-	f.timeInProve += donetime.Sub(starttime)
 	return pr, nil
 }
 
@@ -78,10 +143,20 @@ func (f *Forest) ProveMany(hs []Hash) ([]Proof, error) {
 // Verify checks an inclusion proof.
 // returns false on any errors
 func (f *Forest) Verify(p Proof) bool {
+	defer func(start time.Time) {
+		f.timeInVerify += time.Since(start)
+	}(time.Now())
 
 	n := p.Payload
 	//	fmt.Printf("check position %d %04x inclusion\n", p.Position, n[:4])
 
+	// position comes from whoever gave us the proof, so check it before
+	// detectSubTreeRows, which never returns for positions past the leaves
+	if p.Position >= f.numLeaves {
+		fmt.Printf("proof for position %d but only %d leaves\n",
+			p.Position, f.numLeaves)
+		return false
+	}
 	subTreeRows := detectSubTreeRows(p.Position, f.numLeaves, f.rows)
 	// there should be as many siblings as the rows of the sub-tree
 	// (0 rows means there are no siblings; there is no proof)
@@ -107,11 +182,11 @@ func (f *Forest) Verify(p Proof) bool {
 
 	subTreeRootPos := parentMany(p.Position, subTreeRows, f.rows)
 
-	if subTreeRootPos >= f.data.size() {
-		fmt.Printf("ERROR don't have root at %d\n", subTreeRootPos)
+	subRoot, err := f.ReadAt(subTreeRootPos)
+	if err != nil {
+		fmt.Printf("ERROR don't have root: %s\n", err.Error())
 		return false
 	}
-	subRoot := f.data.read(subTreeRootPos)
 
 	if n != subRoot {
 		fmt.Printf("got %04x subroot %04x\n", n[:4], subRoot[:4])
@@ -131,10 +206,12 @@ func (f *Forest) VerifyMany(ps []Proof) bool {
 
 // ProveBatch gets proofs (in the form of a node slice) for a bunch of leaves
 // The ordering of Targets is the same as the ordering of hashes given as
-// argument.
+// argument.  If any hashes aren't in the forest, the error lists all of them
+// and wraps ErrLeafNotFound.
 //
 // NOTE: The order in which the hashes are given matter when verifying
-// (aka permutation matters).
+// (aka permutation matters).  Use ProveBatchSorted for hashes that can
+// repeat or when the order doesn't matter.
 func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 	starttime := time.Now()
 	var bp BatchProof
@@ -153,11 +230,16 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 	// it's not an error.
 	bp.Targets = make([]uint64, len(hs))
 
+	var missing []string
 	for i, wanted := range hs {
-		pos, ok := f.positionMap[wanted.Mini()]
+		pos, ok := f.leafPosition(wanted)
 		if !ok {
-			fmt.Print(f.ToString())
-			return bp, fmt.Errorf("hash %x not found", wanted)
+			missing = append(missing, wanted.String())
+			continue
+		}
+		err := f.checkLookup(wanted)
+		if err != nil {
+			return bp, err
 		}
 
 		// should never happen
@@ -171,6 +253,10 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 		}
 		bp.Targets[i] = pos
 	}
+	if len(missing) != 0 {
+		return bp, fmt.Errorf("ProveBatch: %d of %d hashes not found: %s: %w",
+			len(missing), len(hs), strings.Join(missing, ", "), ErrLeafNotFound)
+	}
 	// targets need to be sorted because the proof hashes are sorted
 	// NOTE that this is a big deal -- we lose in-block positional information
 	// because of this sorting.  Does that hurt locality or performance?  My
@@ -187,7 +273,11 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 	bp.Proof = make([]Hash, len(proofPositions.list))
 	for i, proofPos := range proofPositions.list {
-		bp.Proof[i] = f.data.read(proofPos)
+		proofHash, err := f.ReadAt(proofPos)
+		if err != nil {
+			return bp, fmt.Errorf("ProveBatch: %s", err.Error())
+		}
+		bp.Proof[i] = proofHash
 	}
 
 	if verbose {
@@ -199,8 +289,204 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 	return bp, nil
 }
 
+// ProveBatchSorted is ProveBatch with the hashes put in order first.  Each
+// hash is proven once no matter how many times it's in hs, and Targets are
+// sorted by position, the way Modify wants deletions.  index says which
+// target each hash became: hs[i] is at bp.Targets[index[i]].  To verify,
+// give VerifyBatchProof the hashes in the order of Targets, one per target.
+// index is nil if there are no targets, like when the forest only has 1 leaf.
+func (f *Forest) ProveBatchSorted(hs []Hash) (BatchProof, []int, error) {
+	index := make([]int, len(hs))
+	unique := make([]Hash, 0, len(hs))
+	seen := make(map[Hash]int, len(hs))
+	for i, h := range hs {
+		j, ok := seen[h]
+		if !ok {
+			j = len(unique)
+			seen[h] = j
+			unique = append(unique, h)
+		}
+		index[i] = j
+	}
+
+	bp, err := f.ProveBatch(unique)
+	if err != nil {
+		return bp, nil, err
+	}
+	if len(bp.Targets) == 0 {
+		return bp, nil, nil
+	}
+
+	// order[k] is which of the unique hashes has the kth smallest position
+	order := make([]int, len(unique))
+	for k := range order {
+		order[k] = k
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return bp.Targets[order[a]] < bp.Targets[order[b]]
+	})
+	sorted := make([]uint64, len(order))
+	rank := make([]int, len(order))
+	for k, u := range order {
+		sorted[k] = bp.Targets[u]
+		rank[u] = k
+	}
+	bp.Targets = sorted
+	for i := range index {
+		index[i] = rank[index[i]]
+	}
+	return bp, index, nil
+}
+
+// ProofStats says how much a batch proof saved over separate proofs.
+type ProofStats struct {
+	// UniqueHashes is how many hashes are in the batch proof
+	UniqueHashes int
+	// SharedHashes is how many hashes separate proofs for each target would
+	// have had on top of UniqueHashes, because targets shared them or could
+	// compute them from each other.
+	SharedHashes int
+}
+
+// ProveSequential makes a batch proof straight from leaf positions, which
+// must be sorted with no duplicates.  When targets are next to each other
+// (like the inputs of a block often are) most of their siblings are shared
+// or computable, so each shared hash is only in the proof once.
+func (f *Forest) ProveSequential(
+	targets []uint64) (BatchProof, ProofStats, error) {
+
+	starttime := time.Now()
+	var bp BatchProof
+	var stats ProofStats
+	if len(targets) == 0 || f.numLeaves <= 1 {
+		return bp, stats, nil
+	}
+
+	var separateHashes int
+	for i, pos := range targets {
+		if pos >= f.numLeaves {
+			return bp, stats, fmt.Errorf("ProveSequential: target %d "+
+				"but only %d leaves exist", pos, f.numLeaves)
+		}
+		if i > 0 && pos <= targets[i-1] {
+			return bp, stats, fmt.Errorf("ProveSequential: targets not "+
+				"sorted, %d after %d", pos, targets[i-1])
+		}
+		separateHashes += int(detectSubTreeRows(pos, f.numLeaves, f.rows))
+	}
+
+	bp.Targets = make([]uint64, len(targets))
+	copy(bp.Targets, targets)
+
+	proofPositions := NewPositionList()
+	defer proofPositions.Free()
+	ProofPositions(bp.Targets, f.numLeaves, f.rows, &proofPositions.list)
+
+	bp.Proof = make([]Hash, len(proofPositions.list))
+	for i, proofPos := range proofPositions.list {
+		proofHash, err := f.ReadAt(proofPos)
+		if err != nil {
+			return bp, stats, fmt.Errorf("ProveSequential: %s", err.Error())
+		}
+		bp.Proof[i] = proofHash
+	}
+
+	stats.UniqueHashes = len(bp.Proof)
+	stats.SharedHashes = separateHashes - stats.UniqueHashes
+
+	donetime := time.Now()
+	f.timeInProve += donetime.Sub(starttime)
+	return bp, stats, nil
+}
+
+// BatchProve is like ProveSequential but takes targets in any order, and also
+// gives the positions of the siblings on each target's path up to the root of
+// its tree.  bp.Targets comes back sorted.  Siblings that aren't in bp.Proof
+// are computed from other targets, so a target whose path is all in bp.Proof
+// can be checked on its own with Verify.
+func (f *Forest) BatchProve(
+	targets []uint64) (BatchProof, map[uint64][]uint64, error) {
+
+	sorted := make([]uint64, len(targets))
+	copy(sorted, targets)
+	sortUint64s(sorted)
+
+	bp, _, err := f.ProveSequential(sorted)
+	if err != nil {
+		return bp, nil, fmt.Errorf("BatchProve: %s", err.Error())
+	}
+
+	paths := make(map[uint64][]uint64, len(sorted))
+	for _, target := range sorted {
+		path := make([]uint64, detectSubTreeRows(target, f.numLeaves, f.rows))
+		pos := target
+		for i := range path {
+			path[i] = pos ^ 1
+			pos = parent(pos, f.rows)
+		}
+		paths[target] = path
+	}
+	return bp, paths, nil
+}
+
+// ProveAtPositions is ProveBatch for callers that already know where the
+// leaves are, like from ForEachLeaf, so it skips the positionMap.  Targets
+// are in the same order as positions, so verify with the hashes in that
+// order.  Every position has to be a leaf that's there, and only once.
+func (f *Forest) ProveAtPositions(positions []uint64) (BatchProof, error) {
+	for _, pos := range positions {
+		if pos >= f.numLeaves {
+			return BatchProof{}, fmt.Errorf("ProveAtPositions: position %d "+
+				"but only %d leaves exist", pos, f.numLeaves)
+		}
+		if f.data.read(pos) == empty {
+			return BatchProof{}, fmt.Errorf("ProveAtPositions: "+
+				"no leaf at position %d", pos)
+		}
+	}
+	sorted := make([]uint64, len(positions))
+	copy(sorted, positions)
+	sortUint64s(sorted)
+	if !checkSortedNoDupes(sorted) {
+		return BatchProof{}, fmt.Errorf("ProveAtPositions: duplicate positions")
+	}
+
+	bp, _, err := f.ProveSequential(sorted)
+	if err != nil {
+		return bp, fmt.Errorf("ProveAtPositions: %s", err.Error())
+	}
+	if bp.Targets != nil {
+		copy(bp.Targets, positions)
+	}
+	return bp, nil
+}
+
+// ProveRange proves the count leaves starting at start, for sending a chunk
+// of the UTXO set along with what ties it to the roots.  Siblings inside the
+// range get computed from the leaves, so only the hashes along the edges of
+// the range are in the proof: about 2 per row instead of 1 per row for every
+// leaf.
+func (f *Forest) ProveRange(start, count uint64) (BatchProof, error) {
+	if count == 0 || start+count < start || start+count > f.numLeaves {
+		return BatchProof{}, fmt.Errorf("ProveRange: %d leaves from %d "+
+			"not in %d leaves", count, start, f.numLeaves)
+	}
+	targets := make([]uint64, count)
+	for i := range targets {
+		targets[i] = start + uint64(i)
+	}
+	bp, _, err := f.ProveSequential(targets)
+	if err != nil {
+		return bp, fmt.Errorf("ProveRange: %s", err.Error())
+	}
+	return bp, nil
+}
+
 // VerifyBatchProof is just a wrapper around verifyBatchProof
 func (f *Forest) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
+	defer func(start time.Time) {
+		f.timeInVerify += time.Since(start)
+	}(time.Now())
 	_, _, err := verifyBatchProof(toProve, bp, f.GetRoots(), f.numLeaves, nil)
 	return err
 }
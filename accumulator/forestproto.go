@@ -0,0 +1,105 @@
+package accumulator
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator/proto"
+)
+
+// ToProto gives back the forest as a proto.ForestState.  Every position is
+// in Nodes, but empty positions are left as zero length so that sparse
+// forests stay small.
+func (f *Forest) ToProto() *proto.ForestState {
+	s := &proto.ForestState{
+		NumLeaves: f.numLeaves,
+		Rows:      uint32(f.rows),
+		Nodes:     make([][]byte, (2<<f.rows)-1),
+	}
+
+	for pos := range s.Nodes {
+		h := f.data.read(uint64(pos))
+		if h == empty {
+			continue
+		}
+		s.Nodes[pos] = make([]byte, leafSize)
+		copy(s.Nodes[pos], h[:])
+	}
+
+	return s
+}
+
+// ForestFromProto makes a RamForest out of a proto.ForestState made by
+// ToProto.
+func ForestFromProto(s *proto.ForestState) (*Forest, error) {
+	// 2 << 63 overflows
+	if s.Rows >= 63 {
+		return nil, fmt.Errorf("ForestFromProto: %d rows is too many", s.Rows)
+	}
+	rows := uint8(s.Rows)
+
+	if s.NumLeaves > 1<<rows {
+		return nil, fmt.Errorf("ForestFromProto: %d leaves don't fit in %d rows",
+			s.NumLeaves, rows)
+	}
+
+	numPositions := uint64(2<<rows) - 1
+	if uint64(len(s.Nodes)) != numPositions {
+		return nil, fmt.Errorf("ForestFromProto: %d rows needs %d nodes but "+
+			"got %d", rows, numPositions, len(s.Nodes))
+	}
+
+	f := NewForest(RamForest, nil, "", 0)
+	f.numLeaves = s.NumLeaves
+	f.rows = rows
+	f.data.resize(numPositions)
+
+	for pos, node := range s.Nodes {
+		switch len(node) {
+		case 0:
+			// empty, already zeroed by resize
+		case leafSize:
+			var h Hash
+			copy(h[:], node)
+			f.data.write(uint64(pos), h)
+		default:
+			return nil, fmt.Errorf("ForestFromProto: node at position %d "+
+				"is %d bytes", pos, len(node))
+		}
+	}
+
+	// rebuild positionMap from all leaves, same as RestoreForest
+	f.rebuildPositionMap()
+
+	return f, nil
+}
+
+// ToProto gives back the BatchProof as a proto.BatchProof.
+func (bp *BatchProof) ToProto() *proto.BatchProof {
+	p := &proto.BatchProof{
+		Targets: bp.Targets,
+		Proof:   make([][]byte, len(bp.Proof)),
+	}
+	for i, h := range bp.Proof {
+		p.Proof[i] = make([]byte, leafSize)
+		copy(p.Proof[i], h[:])
+	}
+
+	return p
+}
+
+// BatchProofFromProto turns a proto.BatchProof back into a BatchProof.
+func BatchProofFromProto(p *proto.BatchProof) (BatchProof, error) {
+	bp := BatchProof{
+		Targets: p.Targets,
+		Proof:   make([]Hash, len(p.Proof)),
+	}
+	for i, h := range p.Proof {
+		if len(h) != leafSize {
+			return BatchProof{}, fmt.Errorf("BatchProofFromProto: proof "+
+				"hash %d is %d bytes", i, len(h))
+		}
+		copy(bp.Proof[i][:], h)
+	}
+
+	return bp, nil
+}
@@ -0,0 +1,111 @@
+package accumulator
+
+import (
+	"reflect"
+	"testing"
+
+	protobuf "google.golang.org/protobuf/proto"
+
+	"github.com/mit-dci/utreexo/accumulator/proto"
+)
+
+func TestForestProtoRoundTrip(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x07)
+	for b := 0; b < 50; b++ {
+		adds, _, delHashes := sc.NextBlock(10)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// go through the actual encoding, not just the structs
+		enc, err := protobuf.Marshal(f.ToProto())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s proto.ForestState
+		err = protobuf.Unmarshal(enc, &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2, err := ForestFromProto(&s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = f.AssertEqual(f2)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+		if !reflect.DeepEqual(f.GetRoots(), f2.GetRoots()) {
+			t.Fatalf("block %d: roots don't match", b)
+		}
+
+		bp2, err := BatchProofFromProto(bp.ToProto())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bp.ToString() != bp2.ToString() {
+			t.Fatalf("block %d: batch proof doesn't match", b)
+		}
+	}
+}
+
+// A forest with just over a power of 2 leaves is mostly empty positions,
+// which the proto encoding should squeeze down.
+func TestForestProtoSparse(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(257)
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// what WriteForestToDisk and WriteMiscData would write
+	rawSize := int(f.data.size())*leafSize + 8 + 1
+	protoSize := protobuf.Size(f.ToProto())
+	if protoSize >= rawSize {
+		t.Fatalf("proto encoding is %d bytes but raw is only %d",
+			protoSize, rawSize)
+	}
+}
+
+func TestForestFromProtoBad(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(5)
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := f.ToProto()
+	s.Nodes = s.Nodes[1:]
+	_, err = ForestFromProto(s)
+	if err == nil {
+		t.Fatal("expected error for missing nodes")
+	}
+
+	s = f.ToProto()
+	s.Nodes[0] = s.Nodes[0][:31]
+	_, err = ForestFromProto(s)
+	if err == nil {
+		t.Fatal("expected error for short node")
+	}
+
+	s = f.ToProto()
+	s.NumLeaves = 1 << 10
+	_, err = ForestFromProto(s)
+	if err == nil {
+		t.Fatal("expected error for too many leaves")
+	}
+}
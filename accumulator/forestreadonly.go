@@ -0,0 +1,59 @@
+package accumulator
+
+import "errors"
+
+// ErrReadOnly is returned when something tries to change a forest opened
+// with the ReadOnly option.
+var ErrReadOnly = errors.New("forest is read only")
+
+// ReadOnly makes a forest that can be read and proved from but never
+// changed.  Everything that would change it returns ErrReadOnly, and a
+// write that gets past that to the ForestData panics.  Open the files given
+// to RestoreForest with os.O_RDONLY too, so not even a panic can write to
+// them.
+func ReadOnly() ForestOption {
+	return func(o *forestOptions) {
+		o.readOnly = true
+	}
+}
+
+// readOnlyData is a ForestData that can be read from, and panics with
+// ErrReadOnly for anything else.
+type readOnlyData struct {
+	ForestData
+}
+
+func (d *readOnlyData) write(pos uint64, h Hash) {
+	panic(ErrReadOnly)
+}
+
+func (d *readOnlyData) swapHash(a, b uint64) {
+	panic(ErrReadOnly)
+}
+
+func (d *readOnlyData) swapHashRange(a, b, w uint64) {
+	panic(ErrReadOnly)
+}
+
+func (d *readOnlyData) resize(newSize uint64) {
+	panic(ErrReadOnly)
+}
+
+// close does nothing, since closing the disk and cow forests writes out
+// whatever they're holding on to.
+func (d *readOnlyData) close() {}
+
+// isReadOnly says if the forest was opened with ReadOnly.
+func (f *Forest) isReadOnly() bool {
+	_, ok := f.data.(*readOnlyData)
+	return ok
+}
+
+// backingData gives the ForestData under a read only forest, for looking at
+// things particular to one kind of forest.
+func (f *Forest) backingData() ForestData {
+	if d, ok := f.data.(*readOnlyData); ok {
+		return d.ForestData
+	}
+	return f.data
+}
@@ -0,0 +1,142 @@
+package accumulator
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRestoreForestReadOnly(t *testing.T) {
+	// write out a forest like the bridge node does
+	memF := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 100)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), 0xee}
+	}
+	_, err := memF.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forestFile, err := ioutil.TempFile("", "readonlyforest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(forestFile.Name())
+	miscFile, err := ioutil.TempFile("", "readonlymisc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(miscFile.Name())
+	err = memF.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = memF.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forestFile.Close()
+	miscFile.Close()
+	before, err := ioutil.ReadFile(forestFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, forestType := range []ForestType{RamForest, DiskForest, CacheForest} {
+		forestFile, err := os.Open(forestFile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer forestFile.Close()
+		miscFile, err := os.Open(miscFile.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer miscFile.Close()
+
+		f, err := RestoreForest(miscFile, forestFile,
+			forestType == RamForest, forestType == CacheForest, "", 0,
+			ReadOnly())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// reading and proving still work
+		err = f.AssertEqual(memF)
+		if err != nil {
+			t.Fatalf("type %d: %s", forestType, err.Error())
+		}
+		_, err = f.ProveBatch([]Hash{adds[7].Hash})
+		if err != nil {
+			t.Fatalf("type %d: %s", forestType, err.Error())
+		}
+
+		// nothing that changes the forest does
+		_, err = f.Modify([]Leaf{{Hash: Hash{0xff}}}, []uint64{3})
+		if !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("type %d: Modify gave %v, expected ErrReadOnly",
+				forestType, err)
+		}
+		for _, change := range []func() error{
+			f.Rehash,
+			f.ShrinkFile,
+			func() error { return f.Add([]Leaf{{Hash: Hash{0xff}}}) },
+			func() error { return f.Undo(UndoBlock{}) },
+			func() error { return f.WriteMiscData(miscFile) },
+			func() error { return f.SetCacheFlushInterval(10) },
+			func() error { return f.SetCowMaxCache(1) },
+			f.MaintainCowForest,
+		} {
+			err = change()
+			if !errors.Is(err, ErrReadOnly) {
+				t.Fatalf("type %d: got %v, expected ErrReadOnly",
+					forestType, err)
+			}
+		}
+		err = f.AssertEqual(memF)
+		if err != nil {
+			t.Fatalf("type %d: changed by a failed write: %s",
+				forestType, err.Error())
+		}
+
+		// and writing to the data directly panics
+		func() {
+			defer func() {
+				if r := recover(); r != ErrReadOnly {
+					t.Fatalf("type %d: write panicked with %v", forestType, r)
+				}
+			}()
+			f.data.write(0, Hash{0xff})
+		}()
+
+		// closing writes nothing, but lets go of the file and stops
+		// filling the cache
+		cfd, _ := f.backingData().(*cacheForestData)
+		err = f.Close()
+		if err != nil {
+			t.Fatalf("type %d: %s", forestType, err.Error())
+		}
+		if forestType != RamForest && forestFile.Close() == nil {
+			t.Fatalf("type %d: forest file still open", forestType)
+		}
+		if cfd != nil && cfd.stopPrime != nil {
+			t.Fatal("cache forest still priming")
+		}
+	}
+
+	after, err := ioutil.ReadFile(forestFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("forest file changed")
+	}
+
+	_, err = RestoreForest(nil, nil, true, false, "", 0,
+		ReadOnly(), WithExpectedLeaves(1000))
+	if err == nil {
+		t.Fatal("restored a read only forest that has to grow")
+	}
+}
@@ -0,0 +1,88 @@
+package accumulator
+
+import "fmt"
+
+// SubForest gives a new RamForest with just the leaves in [fromLeaf, toLeaf)
+// of f, in the same order, and its own internal nodes and positionMap.
+// The leaves start at 0 in the sub forest, so leaf fromLeaf+i in f is leaf i
+// there, and their leaf data goes with them.
+// When the range is a whole subtree of f (toLeaf-fromLeaf is a power of 2
+// and fromLeaf is a multiple of it) the sub forest has one root, which is the
+// node above the range in f.  Then proving that node's position in f, like
+// any other, gives what ties the sub forest's root to f's roots.
+func (f *Forest) SubForest(fromLeaf, toLeaf uint64) (*Forest, error) {
+	if fromLeaf > toLeaf || toLeaf > f.numLeaves {
+		return nil, fmt.Errorf("SubForest: range [%d, %d) not in %d leaves",
+			fromLeaf, toLeaf, f.numLeaves)
+	}
+
+	adds := make([]Leaf, toLeaf-fromLeaf)
+	for i := range adds {
+		adds[i].Hash = f.data.read(fromLeaf + uint64(i))
+	}
+
+	sub := NewForest(RamForest, nil, "", 0)
+	_, err := sub.Modify(adds, nil)
+	if err != nil {
+		return nil, fmt.Errorf("SubForest: %s", err.Error())
+	}
+	for i := range adds {
+		if data, ok := f.leafData[fromLeaf+uint64(i)]; ok {
+			sub.SetLeafData(uint64(i), data)
+		}
+	}
+	return sub, nil
+}
+
+// MergeSubForest puts the leaves of sub back into f starting at fromLeaf,
+// replacing the leaves that were there, and rehashes everything above them.
+// It's the inverse of SubForest; sub can have been changed in between but
+// still has to fit over leaves f already has.  Nothing is changed if one of
+// sub's leaves is already somewhere else in f.
+func (f *Forest) MergeSubForest(sub *Forest, fromLeaf uint64) error {
+	toLeaf := fromLeaf + sub.numLeaves
+	if toLeaf < fromLeaf || toLeaf > f.numLeaves {
+		return fmt.Errorf("MergeSubForest: %d leaves at %d don't fit in %d",
+			sub.numLeaves, fromLeaf, f.numLeaves)
+	}
+
+	leaves := make([]Hash, sub.numLeaves)
+	for i := range leaves {
+		leaves[i] = sub.data.read(uint64(i))
+		pos, ok := f.leafPosition(leaves[i])
+		if ok && (pos < fromLeaf || pos >= toLeaf) &&
+			f.data.read(pos) == leaves[i] {
+			return fmt.Errorf("MergeSubForest: leaf %x already at %d",
+				leaves[i][:4], pos)
+		}
+	}
+
+	return f.trackDirty(func() error {
+		dirt := make([]uint64, len(leaves))
+		// take out all the old leaves first, since the new ones can be
+		// the same hashes at different positions
+		for i := range leaves {
+			pos := fromLeaf + uint64(i)
+			old := f.data.read(pos)
+			if oldPos, ok := f.leafPosition(old); ok && oldPos == pos {
+				f.removePosition(old)
+				f.presence.remove()
+			}
+			dirt[i] = pos
+		}
+		for i, h := range leaves {
+			f.data.write(dirt[i], h)
+			f.addPosition(h, dirt[i])
+			delete(f.leafData, dirt[i])
+			if data, ok := sub.leafData[uint64(i)]; ok {
+				if f.leafData == nil {
+					f.leafData = make(map[uint64][]byte)
+				}
+				f.leafData[dirt[i]] = data
+			}
+			f.presence.add(h.Mini())
+			f.recordAdd(h)
+		}
+		return f.reHash(dirt)
+	})
+}
@@ -0,0 +1,79 @@
+package accumulator
+
+import "testing"
+
+// TestSubForestSplitMerge splits 1024 leaves in half, deletes and adds 10 in
+// each half on its own, and merges them back.  The result has to be the same
+// as a forest made from both halves' leaves.
+func TestSubForestSplitMerge(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 1024)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), uint8(i >> 8), 0xff}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	halves := make([]*Forest, 2)
+	for i := range halves {
+		halves[i], err = f.SubForest(uint64(i)*512, uint64(i+1)*512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// each half is a whole subtree, so its root is the node above it
+		roots := halves[i].GetRoots()
+		top := f.data.read(parentMany(uint64(i)*512, 9, f.rows))
+		if len(roots) != 1 || roots[0] != top {
+			t.Fatalf("half %d has roots %s, expected %s", i, roots, top)
+		}
+
+		newLeaves := make([]Leaf, 10)
+		for j := range newLeaves {
+			newLeaves[j].Hash = Hash{uint8(j), uint8(i), 0xee}
+		}
+		_, err = halves[i].Modify(newLeaves,
+			[]uint64{0, 7, 8, 100, 101, 102, 300, 400, 510, 511})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, half := range halves {
+		err = f.MergeSubForest(half, uint64(i)*512)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = f.AssertInvariants()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := NewForest(RamForest, nil, "", 0)
+	for _, half := range halves {
+		merged := make([]Leaf, half.numLeaves)
+		for i := range merged {
+			merged[i].Hash = half.data.read(uint64(i))
+		}
+		_, err = expected.Modify(merged, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fRoots, expectedRoots := f.GetRoots(), expected.GetRoots()
+	if len(fRoots) != 1 || fRoots[0] != expectedRoots[0] {
+		t.Fatalf("merged roots %s, expected %s", fRoots, expectedRoots)
+	}
+
+	// a leaf can't be merged in twice
+	err = f.MergeSubForest(halves[0], 512)
+	if err == nil {
+		t.Fatal("merged the first half over the second")
+	}
+	_, err = f.SubForest(1000, 1025)
+	if err == nil {
+		t.Fatal("SubForest past the last leaf worked")
+	}
+}
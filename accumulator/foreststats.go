@@ -0,0 +1,29 @@
+package accumulator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// PrintStats writes a table to w of how full each row of the forest is,
+// from row 0 (the leaves) up.  Positions is how many the row has room for
+// and non-empty how many of those have a hash.  It reads every position in
+// the forest, so give maxRows to only do the rows below it.
+func (f *Forest) PrintStats(w io.Writer, maxRows ...int) error {
+	rows := int(f.rows) + 1
+	if len(maxRows) > 0 && maxRows[0] > 0 && maxRows[0] < rows {
+		rows = maxRows[0]
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%d leaves %d rows\n", f.numLeaves, f.rows)
+	fmt.Fprintf(bw, "row | positions | non-empty | empty %%\n")
+	for r := 0; r < rows; r++ {
+		populated, total := f.RowCount(uint8(r))
+		emptyPercent := 100 * float64(total-populated) / float64(total)
+		fmt.Fprintf(bw, "%3d | %9d | %9d | %7.2f\n",
+			r, total, populated, emptyPercent)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,47 @@
+package accumulator
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestForestPrintStats(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 7)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i + 1)
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 7 leaves make trees of 4, 2 and 1, so nothing's at row 3
+	expected := "7 leaves 3 rows\n" +
+		"row | positions | non-empty | empty %\n" +
+		"  0 |         8 |         7 |   12.50\n" +
+		"  1 |         4 |         3 |   25.00\n" +
+		"  2 |         2 |         1 |   50.00\n" +
+		"  3 |         1 |         0 |  100.00\n"
+	var buf bytes.Buffer
+	err = f.PrintStats(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != expected {
+		t.Fatalf("got\n%s\nexpected\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	err = f.PrintStats(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limited := "7 leaves 3 rows\n" +
+		"row | positions | non-empty | empty %\n" +
+		"  0 |         8 |         7 |   12.50\n" +
+		"  1 |         4 |         3 |   25.00\n"
+	if buf.String() != limited {
+		t.Fatalf("got\n%s\nexpected\n%s", buf.String(), limited)
+	}
+}
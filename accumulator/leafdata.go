@@ -0,0 +1,199 @@
+package accumulator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// MaxLeafDataSize is the most data SetLeafData will keep for one leaf.
+const MaxLeafDataSize = 1 << 10
+
+// leafDataFileName is where WriteMiscData saves the leaf data, in the same
+// directory as the misc file.
+const leafDataFileName = "leafdata.dat"
+
+// leafDataFileHeader starts the leaf data file.  Each entry after it is the
+// position as a uint64, the length as a uint16 and then the data.
+type leafDataFileHeader struct {
+	RootsHash Hash
+	Entries   uint64
+}
+
+// SetLeafData keeps data with the leaf at pos, like the amount and script
+// hash of the UTXO the leaf commits to.  The data moves with the leaf when
+// Modify moves it, and goes away when the leaf is deleted; Undo brings it
+// back with the leaf, but only for undo blocks that came from Modify, not
+// ones read back with Deserialize.  Nil or empty data removes what was
+// there.
+func (f *Forest) SetLeafData(pos uint64, data []byte) error {
+	if f.isReadOnly() {
+		return ErrReadOnly
+	}
+	if pos >= f.numLeaves {
+		return fmt.Errorf("SetLeafData: position %d but only %d leaves",
+			pos, f.numLeaves)
+	}
+	if len(data) > MaxLeafDataSize {
+		return fmt.Errorf("SetLeafData: %d bytes, max %d",
+			len(data), MaxLeafDataSize)
+	}
+	if len(data) == 0 {
+		delete(f.leafData, pos)
+		return nil
+	}
+	if f.leafData == nil {
+		f.leafData = make(map[uint64][]byte)
+	}
+	f.leafData[pos] = append([]byte(nil), data...)
+	return nil
+}
+
+// LeafData gives the data set with SetLeafData for the leaf at pos.  The
+// slice is the forest's own, so don't change it.
+func (f *Forest) LeafData(pos uint64) ([]byte, bool) {
+	data, ok := f.leafData[pos]
+	return data, ok
+}
+
+// swapLeafData swaps the data for the leaves at a and b, along with a
+// swapHash.
+func (f *Forest) swapLeafData(a, b uint64) {
+	if len(f.leafData) == 0 {
+		return
+	}
+	da, okA := f.leafData[a]
+	db, okB := f.leafData[b]
+	delete(f.leafData, a)
+	delete(f.leafData, b)
+	if okA {
+		f.leafData[b] = da
+	}
+	if okB {
+		f.leafData[a] = db
+	}
+}
+
+// takeDeletedLeafData moves the data for the leaves Modify just deleted,
+// which are past the right edge in the same order as ub.hashes, into ub.
+func (f *Forest) takeDeletedLeafData(ub *UndoBlock) {
+	if len(f.leafData) == 0 {
+		return
+	}
+	for i := range ub.hashes {
+		pos := f.numLeaves + uint64(i)
+		data, ok := f.leafData[pos]
+		if !ok {
+			continue
+		}
+		if ub.leafData == nil {
+			ub.leafData = make([][]byte, len(ub.hashes))
+		}
+		ub.leafData[i] = data
+		delete(f.leafData, pos)
+	}
+}
+
+// writeLeafData saves the leaf data to fileName, or removes the file if
+// there's no leaf data.
+func (f *Forest) writeLeafData(fileName string) error {
+	if len(f.leafData) == 0 {
+		err := os.Remove(fileName)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hdr := leafDataFileHeader{
+		RootsHash: f.rootsHash(),
+		Entries:   uint64(len(f.leafData)),
+	}
+	err = binary.Write(file, binary.BigEndian, hdr)
+	if err != nil {
+		return err
+	}
+	positions := make([]uint64, 0, len(f.leafData))
+	for pos := range f.leafData {
+		positions = append(positions, pos)
+	}
+	sort.Slice(positions, func(a, b int) bool {
+		return positions[a] < positions[b]
+	})
+	for _, pos := range positions {
+		data := f.leafData[pos]
+		err = binary.Write(file, binary.BigEndian, pos)
+		if err != nil {
+			return err
+		}
+		err = binary.Write(file, binary.BigEndian, uint16(len(data)))
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return file.Sync()
+}
+
+// readLeafData loads the leaf data saved by writeLeafData, if there is any.
+// Unlike the presence filter, leaf data can't be made again, so data saved
+// with a different forest is an error.
+func (f *Forest) readLeafData(fileName string) error {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var hdr leafDataFileHeader
+	err = binary.Read(file, binary.BigEndian, &hdr)
+	if err != nil {
+		return fmt.Errorf("readLeafData: %s", err.Error())
+	}
+	if hdr.RootsHash != f.rootsHash() {
+		return fmt.Errorf("readLeafData: %s was saved with a different forest",
+			fileName)
+	}
+	if hdr.Entries > f.numLeaves {
+		return fmt.Errorf("readLeafData: %d entries but only %d leaves",
+			hdr.Entries, f.numLeaves)
+	}
+
+	leafData := make(map[uint64][]byte, hdr.Entries)
+	for i := uint64(0); i < hdr.Entries; i++ {
+		var pos uint64
+		var size uint16
+		err = binary.Read(file, binary.BigEndian, &pos)
+		if err == nil {
+			err = binary.Read(file, binary.BigEndian, &size)
+		}
+		if err != nil {
+			return fmt.Errorf("readLeafData: entry %d: %s", i, err.Error())
+		}
+		if pos >= f.numLeaves || size == 0 || size > MaxLeafDataSize {
+			return fmt.Errorf("readLeafData: entry %d has %d bytes at "+
+				"position %d", i, size, pos)
+		}
+		data := make([]byte, size)
+		_, err = io.ReadFull(file, data)
+		if err != nil {
+			return fmt.Errorf("readLeafData: entry %d: %s", i, err.Error())
+		}
+		leafData[pos] = data
+	}
+	f.leafData = leafData
+	return nil
+}
@@ -0,0 +1,137 @@
+package accumulator
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLeafData sets data on a few leaves and makes sure it stays with them
+// as the leaves around them get deleted, through undo and through saving and
+// restoring the forest.
+func TestLeafData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leafdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 16)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0xdd}
+	}
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the data each of these leaves should have
+	withData := map[Hash][]byte{
+		adds[5].Hash:  []byte("amount 5"),
+		adds[12].Hash: []byte("amount 12"),
+		adds[15].Hash: []byte("amount 15"),
+	}
+	for h, data := range withData {
+		pos, _ := f.leafPosition(h)
+		err = f.SetLeafData(pos, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkData := func(f *Forest) {
+		t.Helper()
+		for h, data := range withData {
+			pos, ok := f.leafPosition(h)
+			if !ok {
+				t.Fatalf("leaf %s is gone", h)
+			}
+			got, ok := f.LeafData(pos)
+			if !ok || !bytes.Equal(got, data) {
+				t.Fatalf("leaf %s at %d has data %q, expected %q",
+					h, pos, got, data)
+			}
+		}
+		if len(f.leafData) != len(withData) {
+			t.Fatalf("%d leaves with data, expected %d",
+				len(f.leafData), len(withData))
+		}
+	}
+
+	// deleting the neighbors moves the leaves with data around
+	_, err = f.Modify(nil, []uint64{4, 6, 11, 13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkData(f)
+	_, err = f.Modify([]Leaf{{Hash: Hash{0xee}}}, []uint64{0, 1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkData(f)
+
+	// the data goes away with its leaf and undo brings it back
+	pos, _ := f.leafPosition(adds[15].Hash)
+	ub, err := f.Modify(nil, []uint64{pos})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(withData, adds[15].Hash)
+	checkData(f)
+	err = f.Undo(*ub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withData[adds[15].Hash] = []byte("amount 15")
+	checkData(f)
+
+	// saved with the forest
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer miscFile.Close()
+	forestFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forestFile.Close()
+	err = f.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile.Seek(0, 0)
+	forestFile.Seek(0, 0)
+	restored, err := RestoreForest(miscFile, forestFile, true, false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkData(restored)
+
+	// and in the JSON
+	b, err := f.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := new(Forest)
+	err = fromJSON.UnmarshalJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkData(fromJSON)
+
+	err = f.SetLeafData(f.numLeaves, []byte{1})
+	if err == nil {
+		t.Fatal("set leaf data past the last leaf")
+	}
+	err = f.SetLeafData(0, make([]byte, MaxLeafDataSize+1))
+	if err == nil {
+		t.Fatal("set too much leaf data")
+	}
+}
@@ -45,6 +45,11 @@ type Pollard struct {
 	// It is only used for fullPollard.
 	positionMap map[MiniHash]uint64
 
+	// numNodes is how many polNodes the pollard holds, roots included.
+	// maxNodes is the most it can hold before cached leaves get evicted,
+	// 0 for no cap.
+	numNodes, maxNodes uint64
+
 	// Below are for keeping statistics.
 	// hashesEver is all the hashes that have ever been performed.
 	// rememberEver is all the nodes that have ever been cached.
@@ -69,6 +74,7 @@ func (p *Pollard) Modify(adds []Leaf, delsUn []uint64) error {
 		return err
 	}
 
+	p.evict(nil)
 	return nil
 }
 
@@ -161,6 +167,7 @@ func (p *Pollard) addOne(add Hash, remember bool) error {
 	n := new(polNode)
 	n.data = add
 	n.remember = remember
+	p.numNodes++
 
 	if p.positionMap != nil {
 		p.positionMap[add.Mini()] = p.numLeaves
@@ -181,8 +188,9 @@ func (p *Pollard) addOne(add Hash, remember bool) error {
 		n = &polNode{data: nHash, niece: [2]*polNode{leftRoot, n}} // new
 		n.remember = remember
 		p.hashesEver++
+		p.numNodes++
 
-		n.prune()
+		p.numNodes -= n.prune()
 	}
 
 	// the new roots are all the 1 bits above where we got to, and nothing below where
@@ -340,6 +348,8 @@ func (p *Pollard) rem2(dels []uint64) error {
 	p.numLeaves = nextNumLeaves
 	reversePolNodeSlice(nextRoots)
 	p.roots = nextRoots
+	// whole subtrees go with the old roots, so count what's left
+	p.numNodes = uint64(p.GetTotalCount())
 	return nil
 }
 
@@ -471,6 +481,7 @@ func (p *Pollard) grabPos(
 		// if a sib doesn't exist, need to create it and hook it in
 		if n.niece[lrSib] == nil {
 			n.niece[lrSib] = &polNode{}
+			p.numNodes++
 		}
 		n, nsib = n.niece[lr], n.niece[lrSib]
 		if n == nil {
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -100,6 +101,127 @@ func TestPollardSimpleIngest(t *testing.T) {
 	}
 }
 
+// TestPollardIngestBadProof checks that a proof with a bit flipped is
+// caught naming the target, and doesn't change the pollard, so the right
+// proof still goes in after.
+func TestPollardIngestBadProof(t *testing.T) {
+	rand.Seed(5)
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+
+	sn := newSimChain(0x07)
+	sn.lookahead = 400
+	for b := 0; b < 20; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x3f)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b >= 10 && len(delHashes) > 0 {
+			ingestBadProofs(t, &p, delHashes, bp)
+		}
+		err = p.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+		checkPollards(t, f, []*Pollard{&p})
+	}
+
+	// the last leaf of an odd forest is its own root
+	f = NewForest(RamForest, nil, "", 0)
+	p = Pollard{}
+	adds := make([]Leaf, 7)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i + 1)
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delHashes := []Hash{adds[6].Hash}
+	bp, err := f.ProveBatch(delHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingestBadProofs(t, &p, delHashes, bp)
+	err = p.IngestBatchProof(delHashes, bp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ingestBadProofs flips a bit in each hash of bp and the targets' hashes in
+// turn, and checks p won't take it and is left as it was.
+func ingestBadProofs(t *testing.T, p *Pollard, delHashes []Hash, bp BatchProof) {
+	t.Helper()
+	roots := make([]*polNode, len(p.roots))
+	for i, r := range p.roots {
+		roots[i] = copyPolNode(r)
+	}
+	numNodes := p.numNodes
+
+	check := func(what string, toProve []Hash, bad BatchProof, target uint64) {
+		err := p.IngestBatchProof(toProve, bad, false)
+		if err == nil {
+			t.Fatalf("%s: bad proof ingested", what)
+		}
+		if target != ^uint64(0) &&
+			!strings.Contains(err.Error(), fmt.Sprintf("target %d (", target)) {
+			t.Fatalf("%s: error doesn't name target %d: %s",
+				what, target, err.Error())
+		}
+		if p.numNodes != numNodes || len(p.roots) != len(roots) {
+			t.Fatalf("%s: pollard changed by bad proof", what)
+		}
+		for i := range roots {
+			if !samePolNode(p.roots[i], roots[i]) {
+				t.Fatalf("%s: tree %d changed by bad proof", what, i)
+			}
+		}
+	}
+
+	// with one target, it's the one that fails.  With more, any of them
+	// sharing a path with the flipped hash could be first.
+	target := ^uint64(0)
+	if len(bp.Targets) == 1 {
+		target = bp.Targets[0]
+	}
+	for i := range bp.Proof {
+		bad := BatchProof{Targets: bp.Targets, Proof: make([]Hash, len(bp.Proof))}
+		copy(bad.Proof, bp.Proof)
+		bad.Proof[i][rand.Intn(32)] ^= 1 << uint(rand.Intn(8))
+		check(fmt.Sprintf("proof %d", i), delHashes, bad, target)
+	}
+	for i := range delHashes {
+		toProve := make([]Hash, len(delHashes))
+		copy(toProve, delHashes)
+		toProve[i][rand.Intn(32)] ^= 1 << uint(rand.Intn(8))
+		check(fmt.Sprintf("target %d", bp.Targets[i]), toProve, bp, target)
+	}
+}
+
+// samePolNode says if a and b have the same nodes under them.
+func samePolNode(a, b *polNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.data == b.data && a.remember == b.remember &&
+		samePolNode(a.niece[0], b.niece[0]) &&
+		samePolNode(a.niece[1], b.niece[1])
+}
+
 func pollardRandomRemember(blocks int32) error {
 	f := NewForest(RamForest, nil, "", 0)
 
@@ -443,12 +565,12 @@ func TestCache(t *testing.T) {
 
 		// remove deleted leaves from the leaf map
 		for _, del := range delHashes {
-			fmt.Printf("del %x\n", del.Mini())
+			fmt.Printf("del %s\n", del.Mini())
 			delete(leaves, del)
 		}
 		// add new leaves to the leaf map
 		for _, leaf := range adds {
-			fmt.Printf("add %x rem:%v\n", leaf.Hash.Mini(), leaf.Remember)
+			fmt.Printf("add %s rem:%v\n", leaf.Hash.Mini(), leaf.Remember)
 			leaves[leaf.Hash] = leaf
 		}
 
@@ -0,0 +1,188 @@
+package accumulator
+
+// SetMaxNodes caps how many polNodes p holds at n, 0 for no cap, so a CSN
+// on a small device can bound the memory the pollard takes.  Once p goes
+// over the cap, cached leaves are forgotten, leftmost first as those are
+// mostly the oldest, along with the proof nodes only they needed.  Roots
+// and whatever is needed to delete the targets of the proof being ingested
+// are never evicted, so p can stay over the cap if those alone take more.
+// Forgotten leaves just have to come with their whole proof when they're
+// deleted.  A full pollard keeps everything and ignores the cap.
+func (p *Pollard) SetMaxNodes(n uint64) {
+	p.maxNodes = n
+	p.evict(nil)
+}
+
+// NumNodes returns how many polNodes p holds, roots included.
+func (p *Pollard) NumNodes() uint64 {
+	return p.numNodes
+}
+
+// evict forgets cached leaves, leftmost first, until p is down to maxNodes
+// or there's nothing left to forget.  Leaves at the positions in keep,
+// and the proofs for them, are left alone.
+func (p *Pollard) evict(keep []uint64) {
+	if p.maxNodes == 0 || p.numNodes <= p.maxNodes || p.positionMap != nil {
+		return
+	}
+	kept := make(map[uint64]bool, len(keep))
+	for _, pos := range keep {
+		kept[pos] = true
+	}
+
+	// first drop what no leaf needs, like the empty nodes grabPos leaves,
+	// so that forgetLeaf only has to look at its own branch
+	rows := p.rows()
+	var rootPositions []uint64
+	rootRows := getRootsForwards(p.numLeaves, rows, &rootPositions)
+	for i, root := range p.roots {
+		if rootRows[i] != 0 && !sweepPair(&root.niece,
+			child(rootPositions[i], rows), rootRows[i]-1, rows, kept) {
+			root.chop()
+		}
+	}
+	p.numNodes = uint64(p.GetTotalCount())
+
+	for _, pos := range p.cachedLeaves() {
+		if p.numNodes <= p.maxNodes {
+			return
+		}
+		if kept[pos] {
+			continue
+		}
+		p.numNodes -= p.forgetLeaf(pos, kept)
+	}
+}
+
+// cachedLeaves returns the positions of all the remembered leaves in p that
+// aren't roots, in ascending order.
+func (p *Pollard) cachedLeaves() []uint64 {
+	rows := p.rows()
+	var rootPositions []uint64
+	rootRows := getRootsForwards(p.numLeaves, rows, &rootPositions)
+
+	var leaves []uint64
+	for i, root := range p.roots {
+		if rootRows[i] == 0 {
+			continue
+		}
+		cachedInPair(root.niece, child(rootPositions[i], rows), rootRows[i]-1,
+			rows, &leaves)
+	}
+	return leaves
+}
+
+// cachedInPair appends the positions of remembered leaves under the sibling
+// pair whose left node is at pos on row.  The children of each node in a
+// pair are the nieces of the other one.
+func cachedInPair(pair [2]*polNode, pos uint64, row, rows uint8,
+	leaves *[]uint64) {
+	if row == 0 {
+		for i, n := range pair {
+			if n != nil && n.remember {
+				*leaves = append(*leaves, pos|uint64(i))
+			}
+		}
+		return
+	}
+	if pair[1] != nil {
+		cachedInPair(pair[1].niece, child(pos, rows), row-1, rows, leaves)
+	}
+	if pair[0] != nil {
+		cachedInPair(pair[0].niece, child(pos|1, rows), row-1, rows, leaves)
+	}
+}
+
+// sweepPair drops everything under the sibling pair whose left node is at
+// pos on row that no remembered or kept leaf needs.  It returns whether
+// anything in the pair is needed.
+func sweepPair(pair *[2]*polNode, pos uint64, row, rows uint8,
+	kept map[uint64]bool) bool {
+	if row == 0 {
+		for i, n := range pair {
+			if n != nil && (n.remember || kept[pos|uint64(i)]) {
+				return true
+			}
+		}
+		return false
+	}
+	var needed bool
+	// the children of each node are the nieces of the other one
+	for i, n := range pair {
+		if n == nil {
+			continue
+		}
+		if sweepPair(&n.niece, child(pos|uint64(i^1), rows), row-1, rows,
+			kept) {
+			needed = true
+		} else {
+			n.chop()
+		}
+	}
+	return needed
+}
+
+// forgetLeaf stops remembering the leaf at pos, then drops its sibling pair
+// and each pair above it that nothing below needs any more.  Leaves in kept
+// don't get dropped.  It returns how many polNodes were dropped.
+func (p *Pollard) forgetLeaf(pos uint64, kept map[uint64]bool) uint64 {
+	rows := p.rows()
+	var rootPositions []uint64
+	rootRows := getRootsForwards(p.numLeaves, rows, &rootPositions)
+	tree := -1
+	for i, rootPos := range rootPositions {
+		if parentMany(pos, rootRows[i], rows) == rootPos {
+			tree = i
+			break
+		}
+	}
+	if tree == -1 || rootRows[tree] == 0 {
+		return 0
+	}
+
+	// holders[i] is the node whose nieces are the pair on the path to pos,
+	// i+1 rows below the root
+	holders := make([]*polNode, rootRows[tree])
+	holders[0] = p.roots[tree]
+	for i := 1; i < len(holders); i++ {
+		row := rootRows[tree] - uint8(i)
+		pair := holders[i-1].niece
+		// the children of a left node are its right sibling's nieces
+		holders[i] = pair[1^(parentMany(pos, row, rows)&1)]
+		if holders[i] == nil {
+			return 0
+		}
+	}
+
+	leafPair := &holders[len(holders)-1].niece
+	leaf := leafPair[pos&1]
+	if leaf == nil {
+		return 0
+	}
+	if leaf.remember {
+		leaf.remember = false
+		p.currentRemember--
+	}
+	for i, n := range leafPair {
+		if n != nil && (n.remember || kept[pos&^1|uint64(i)]) {
+			return 0
+		}
+	}
+
+	var dropped uint64
+	for i := len(holders) - 1; i >= 0; i-- {
+		pair := &holders[i].niece
+		for _, n := range pair {
+			if n != nil && !n.deadEnd() {
+				return dropped
+			}
+		}
+		for j, n := range pair {
+			if n != nil {
+				dropped++
+				pair[j] = nil
+			}
+		}
+	}
+	return dropped
+}
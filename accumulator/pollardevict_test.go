@@ -0,0 +1,109 @@
+package accumulator
+
+import (
+	"testing"
+)
+
+// A pollard capped well below what its remember schedule would cache still
+// keeps up with a forest block after block, it just has less of each proof
+// already.
+func TestPollardMaxNodes(t *testing.T) {
+	const (
+		numBlocks = 300
+		maxNodes  = 200
+	)
+
+	f := NewForest(RamForest, nil, "", 0)
+	var free, capped Pollard
+	capped.SetMaxNodes(maxNodes)
+
+	chain := newSimChain(0x3f)
+	chain.lookahead = 64
+	var freeNeeded, cappedNeeded, freeMost int
+	for b := 0; b < numBlocks; b++ {
+		adds, _, delHashes := chain.NextBlock(16)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range []*Pollard{&free, &capped} {
+			needed := proofNotCached(t, p, bp)
+			if p == &free {
+				freeNeeded += needed
+			} else {
+				cappedNeeded += needed
+			}
+
+			err = p.IngestBatchProof(delHashes, bp, false)
+			if err != nil {
+				t.Fatalf("block %d: %s", b, err.Error())
+			}
+			err = p.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatalf("block %d: %s", b, err.Error())
+			}
+			if p == &capped && p.NumNodes() > maxNodes {
+				t.Fatalf("block %d: %d nodes with a cap of %d",
+					b, p.NumNodes(), maxNodes)
+			}
+			if p == &free && p.NumNodes() > uint64(freeMost) {
+				freeMost = int(p.NumNodes())
+			}
+
+			// after checking the cap, as grabPos adds empty nodes
+			if !p.equalToForestIfThere(f) {
+				t.Fatalf("block %d: pollard and forest leaves differ", b)
+			}
+			fRoots, pRoots := f.GetRoots(), p.GetRoots()
+			if len(fRoots) != len(pRoots) {
+				t.Fatalf("block %d: forest has %d roots, pollard %d",
+					b, len(fRoots), len(pRoots))
+			}
+			for i := range fRoots {
+				if fRoots[i] != pRoots[i] {
+					t.Fatalf("block %d: root %d differs", b, i)
+				}
+			}
+			if p.NumNodes() != uint64(p.GetTotalCount()) {
+				t.Fatalf("block %d: NumNodes %d but there are %d",
+					b, p.NumNodes(), p.GetTotalCount())
+			}
+		}
+	}
+
+	if freeMost <= maxNodes {
+		t.Fatalf("uncapped pollard only got to %d nodes, cap of %d never hit",
+			freeMost, maxNodes)
+	}
+	if cappedNeeded <= freeNeeded {
+		t.Fatalf("capped pollard needed %d proof hashes, uncapped %d",
+			cappedNeeded, freeNeeded)
+	}
+}
+
+// proofNotCached returns how many of the hashes in bp p doesn't have
+// already, which are the ones it would need downloaded.
+func proofNotCached(t *testing.T, p *Pollard, bp BatchProof) int {
+	targets := make([]uint64, len(bp.Targets))
+	copy(targets, bp.Targets)
+	sortUint64s(targets)
+	var positions []uint64
+	ProofPositions(targets, p.numLeaves, p.rows(), &positions)
+
+	var needed int
+	for _, pos := range positions {
+		n, _, _, err := p.readPos(pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == nil || n.data == empty {
+			needed++
+		}
+	}
+	return needed
+}
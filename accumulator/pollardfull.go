@@ -61,7 +61,7 @@ func (p *Pollard) ProveBatch(hs []Hash) (BatchProof, error) {
 		pos, ok := p.positionMap[wanted.Mini()]
 		if !ok {
 			fmt.Print(p.ToString())
-			return bp, fmt.Errorf("hash %x not found", wanted)
+			return bp, fmt.Errorf("hash %s not found", wanted)
 		}
 
 		// should never happen
@@ -14,20 +14,7 @@ func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
 	// verify the batch proof.
 	rootHashes := p.rootHashesForward()
 	_, _, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
-		// pass a closure that checks the pollard for cached nodes.
-		// returns true and the hash value of the node if it exists.
-		// returns false if the node does not exist or the hash value is empty.
-		func(pos uint64) (bool, Hash) {
-			n, _, _, err := p.readPos(pos)
-			if err != nil {
-				return false, empty
-			}
-			if n != nil && n.data != empty {
-				return true, n.data
-			}
-
-			return false, empty
-		})
+		p.cachedHash)
 	return err
 }
 
@@ -35,52 +22,55 @@ func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
 // targets in the block proof. If rememberAll is true, pollard will mark all the
 // proofs given in the batchproof to be remembered.
 //
+// The whole proof is verified against the roots and cached nodes before
+// any of it goes in the pollard, so if it doesn't verify the pollard is left
+// as it was and the error says which target failed.
+//
 // NOTE: The order in which the hashes are given matter (aka permutation matters).
 // The hashes being verified should be in the same order as they were
 // proven.
 func (p *Pollard) IngestBatchProof(toProve []Hash, bp BatchProof, rememberAll bool) error {
-	// verify the batch proof.
+	// verify the batch proof.  The trees it gives back are only in memory
+	// until they're populated.
 	rootHashes := p.rootHashesForward()
 	trees, roots, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
-		// pass a closure that checks the pollard for cached nodes.
-		// returns true and the hash value of the node if it exists.
-		// returns false if the node does not exist or the hash value is empty.
-		func(pos uint64) (bool, Hash) {
-			n, _, _, err := p.readPos(pos)
-			if err != nil {
-				return false, empty
-			}
-			if n != nil && n.data != empty {
-				return true, n.data
-			}
-
-			return false, empty
-		})
+		p.cachedHash)
 	if err != nil {
 		return fmt.Errorf("Pollard IngestBatchProof: BatchProof verify failed. %s",
 			err.Error())
 	}
 
-	// rootIdx and rootIdxBackwards is needed because p.populate()
-	// expects the roots in a reverse order. Thus the need for two
-	// indexes. TODO fix this to have only one index
-	rootIdx := len(rootHashes) - 1
-	rootIdxBackwards := 0
+	// every root candidate matched the root of the tree it's in, so now
+	// populate those trees.
 	nodesAllocated := 0
 	rows := p.rows()
 	for _, root := range roots {
-		for root.Val != rootHashes[rootIdx] {
-			rootIdx--
-			rootIdxBackwards++
-		}
-		// populate the pollard
-		nodesAllocated += populate(rows, root.Pos, p.roots[(len(p.roots)-rootIdxBackwards)-1],
-			&trees[len(p.roots)-rootIdxBackwards-1], rememberAll)
+		tree, _, _ := detectOffset(root.Pos, p.numLeaves)
+		nodesAllocated += populate(rows, root.Pos, p.roots[tree],
+			&trees[tree], rememberAll)
 	}
+	p.numNodes += uint64(nodesAllocated)
 
+	// keep what's needed to delete the targets in this block
+	p.evict(bp.Targets)
 	return nil
 }
 
+// cachedHash is for verifyBatchProof to check the pollard for cached nodes.
+// returns true and the hash value of the node if it exists.
+// returns false if the node does not exist or the hash value is empty.
+func (p *Pollard) cachedHash(pos uint64) (bool, Hash) {
+	n, _, _, err := p.readPos(pos)
+	if err != nil {
+		return false, empty
+	}
+	if n != nil && n.data != empty {
+		return true, n.data
+	}
+
+	return false, empty
+}
+
 // nodesToFollow returns the positions of the nodes for the branch you want to go to,
 // that are needed to populate all of the given trees.
 //
@@ -202,10 +192,13 @@ type polNodeAndPos struct {
 //
 // curNodes and trees (by parent pos for trees) passed to this function MUST be
 // in ascending order. curNodes also must not start at the root.
-func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTree) []*polNodeAndPos {
+//
+// nextNodes also returns how many polNodes it had to allocate.
+func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos,
+	trees []miniTree) ([]*polNodeAndPos, int) {
 	// No nextNodes if there's no more trees to be populated
 	if len(trees) == 0 {
-		return []*polNodeAndPos{}
+		return []*polNodeAndPos{}, 0
 	}
 
 	// curBranch+1 as we want to go one row below. Branch is "how far down are we from
@@ -233,6 +226,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 	//  |---\   |---\   |---\   |---\
 	//  00  01  02  03  04  05  06  07
 	nextNodesIdx := 0
+	nodesAllocated := 0
 	for i := 0; i < len(curNodes); i++ {
 		if nextNodesIdx >= len(nextNodes) {
 			break
@@ -270,6 +264,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 				// for now
 				if curNode.node.niece[0] == nil {
 					curNode.node.niece[0] = &polNode{}
+					nodesAllocated++
 				}
 				nextCurNodes = append(nextCurNodes,
 					&polNodeAndPos{curNode.node.niece[0], lNiecePos})
@@ -280,6 +275,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 				// for now.
 				if curNode.node.niece[1] == nil {
 					curNode.node.niece[1] = &polNode{}
+					nodesAllocated++
 				}
 				nextCurNodes = append(nextCurNodes,
 					&polNodeAndPos{curNode.node.niece[1], rNiecePos})
@@ -292,7 +288,7 @@ func nextNodes(curBranch, rows uint8, curNodes []*polNodeAndPos, trees []miniTre
 		}
 	}
 
-	return nextCurNodes
+	return nextCurNodes, nodesAllocated
 }
 
 // Given a single miniTree and a single aunt (aka sibling of the miniTree.parent),
@@ -414,7 +410,9 @@ func populate(rows uint8, pos uint64, root *polNode, trees *[]miniTree, remember
 			curNodeIdx--
 		}
 
-		nextCurNodes := nextNodes(uint8(curBranchLen), rows, curNodes, *trees)
+		nextCurNodes, allocated := nextNodes(
+			uint8(curBranchLen), rows, curNodes, *trees)
+		nodesAllocated += allocated
 		curNodes = nextCurNodes
 	}
 
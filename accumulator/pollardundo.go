@@ -0,0 +1,171 @@
+package accumulator
+
+import "fmt"
+
+// PollardUndo is what Pollard.Undo needs to take back a ModifyWithUndo,
+// for when the chain reorgs.  Along with how many leaves the block added
+// and which ones it deleted, it keeps copies of the trees the block
+// changed as they were before, with everything that was cached in them.
+// That includes the proof for the deletions, which was ingested before the
+// modify.  The biggest trees are left alone by a block unless it deletes
+// from them, so those aren't copied.
+type PollardUndo struct {
+	numAdds   uint64
+	positions []uint64 // sorted positions of the deleted leaves
+	hashes    []Hash   // deleted leaves, same order as positions
+
+	// leaves before and after the modify
+	prevNumLeaves, numLeaves uint64
+
+	// untouched is how many of the biggest trees the modify didn't change,
+	// and trees are copies of the rest from before it
+	untouched int
+	trees     []*polNode
+}
+
+// Deleted gives the positions and hashes of the leaves the modify deleted,
+// so a reorged wallet can get them back.
+func (u *PollardUndo) Deleted() ([]uint64, []Hash) {
+	return u.positions, u.hashes
+}
+
+// ModifyWithUndo does the same as Modify, and also gives what Undo needs
+// to take it back.  It costs a copy of every node cached in the trees the
+// modify changes.
+func (p *Pollard) ModifyWithUndo(
+	adds []Leaf, delsUn []uint64) (*PollardUndo, error) {
+
+	dels := make([]uint64, len(delsUn))
+	copy(dels, delsUn)
+	sortUint64s(dels)
+
+	u := &PollardUndo{
+		numAdds:       uint64(len(adds)),
+		positions:     dels,
+		hashes:        make([]Hash, len(dels)),
+		prevNumLeaves: p.numLeaves,
+	}
+	for i, pos := range dels {
+		if pos >= p.numLeaves {
+			return nil, fmt.Errorf("ModifyWithUndo: deletion %d past %d leaves",
+				pos, p.numLeaves)
+		}
+		n, _, _, err := p.readPos(pos)
+		if err != nil {
+			return nil, fmt.Errorf("ModifyWithUndo: %s", err.Error())
+		}
+		if n == nil {
+			return nil, fmt.Errorf("ModifyWithUndo: leaf at %d not cached", pos)
+		}
+		u.hashes[i] = n.data
+	}
+	u.numLeaves = p.numLeaves - uint64(len(dels)) + u.numAdds
+
+	u.untouched = p.untouchedTrees(dels, u.numAdds)
+	u.trees = make([]*polNode, len(p.roots)-u.untouched)
+	for i, root := range p.roots[u.untouched:] {
+		u.trees[i] = copyPolNode(root)
+	}
+
+	err := p.Modify(adds, dels)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Undo takes back the ModifyWithUndo that gave u, which has to be the last
+// modify p had, so blocks get undone newest first.  The trees that modify
+// changed go back to how they were, with what was cached in them then.
+// The trees it didn't change keep what's cached in them now.  u can't be
+// used again after.
+func (p *Pollard) Undo(u *PollardUndo) error {
+	if u == nil || u.trees == nil {
+		return fmt.Errorf("Undo: nil or already used undo")
+	}
+	if u.numLeaves != p.numLeaves {
+		return fmt.Errorf("Undo: pollard has %d leaves but the undo leaves %d",
+			p.numLeaves, u.numLeaves)
+	}
+	if u.untouched > len(p.roots) {
+		return fmt.Errorf("Undo: %d untouched trees but pollard has %d",
+			u.untouched, len(p.roots))
+	}
+
+	before := p.rememberedLeaves()
+	firstLeaf := leavesInTrees(p.numLeaves, u.untouched)
+	if p.positionMap != nil {
+		for pos := firstLeaf; pos < p.numLeaves; pos++ {
+			delete(p.positionMap, p.read(pos).Mini())
+		}
+	}
+
+	p.roots = append(p.roots[:u.untouched:u.untouched], u.trees...)
+	p.numLeaves = u.prevNumLeaves
+	u.trees = nil
+
+	if p.positionMap != nil {
+		for pos := firstLeaf; pos < p.numLeaves; pos++ {
+			p.positionMap[p.read(pos).Mini()] = pos
+		}
+	}
+	p.numNodes = uint64(p.GetTotalCount())
+	// only the replaced trees count differently
+	p.currentRemember += p.rememberedLeaves()
+	p.currentRemember -= before
+	p.evict(nil)
+	return nil
+}
+
+// untouchedTrees returns how many of p's biggest trees a modify deleting
+// the sorted dels and adding numAdds leaves doesn't change.  Deleted leaves
+// only get filled in from smaller trees to their right, and adds only
+// merge trees below the highest row where the leaf count changes.
+func (p *Pollard) untouchedTrees(dels []uint64, numAdds uint64) int {
+	afterDels := p.numLeaves - uint64(len(dels))
+	changed := (p.numLeaves ^ afterDels) | (afterDels ^ (afterDels + numAdds))
+
+	var rootPositions []uint64
+	rootRows := getRootsForwards(p.numLeaves, p.rows(), &rootPositions)
+	var firstLeaf uint64
+	for i, row := range rootRows {
+		firstLeaf += 1 << row
+		if changed>>row != 0 || len(dels) != 0 && dels[0] < firstLeaf {
+			return i
+		}
+	}
+	return len(rootRows)
+}
+
+// leavesInTrees returns how many leaves are in the biggest numTrees trees
+// of a forest with numLeaves.
+func leavesInTrees(numLeaves uint64, numTrees int) uint64 {
+	var rootPositions []uint64
+	rootRows := getRootsForwards(numLeaves, treeRows(numLeaves), &rootPositions)
+	var leaves uint64
+	for _, row := range rootRows[:numTrees] {
+		leaves += 1 << row
+	}
+	return leaves
+}
+
+// rememberedLeaves returns how many leaves p remembers, roots included.
+func (p *Pollard) rememberedLeaves() uint64 {
+	n := uint64(len(p.cachedLeaves()))
+	if p.numLeaves&1 == 1 && p.roots[len(p.roots)-1].remember {
+		n++
+	}
+	return n
+}
+
+// copyPolNode gives a copy of n and everything under it.
+func copyPolNode(n *polNode) *polNode {
+	if n == nil {
+		return nil
+	}
+	return &polNode{
+		data:     n.data,
+		niece:    [2]*polNode{copyPolNode(n.niece[0]), copyPolNode(n.niece[1])},
+		remember: n.remember,
+	}
+}
@@ -0,0 +1,156 @@
+package accumulator
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// A pollard reorged 6 blocks deep comes back to the forest's roots, and
+// keeps up with it along the new chain.
+func TestPollardUndoReorg(t *testing.T) {
+	const (
+		numBlocks = 60
+		depth     = 6
+		newBlocks = 20
+	)
+
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+	full := NewFullPollard()
+	pollards := []*Pollard{&p, &full}
+
+	type block struct {
+		adds      []Leaf
+		durations []int32
+		delHashes []Hash
+		ub        *UndoBlock
+		undos     []*PollardUndo
+	}
+	var blocks []block
+
+	chain := newSimChain(0x1f)
+	chain.lookahead = 8
+	rnd := rand.New(rand.NewSource(5))
+	// next adds a block to f and the pollards, checking they agree after
+	next := func(numAdds uint32) {
+		var b block
+		b.adds, b.durations, b.delHashes = chain.NextBlock(numAdds)
+		bp, err := f.ProveBatch(b.delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.ub, err = f.Modify(b.adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pol := range pollards {
+			err = pol.IngestBatchProof(b.delHashes, bp, false)
+			if err != nil {
+				t.Fatalf("block %d: %s", chain.blockHeight, err.Error())
+			}
+			undo, err := pol.ModifyWithUndo(b.adds, bp.Targets)
+			if err != nil {
+				t.Fatalf("block %d: %s", chain.blockHeight, err.Error())
+			}
+			b.undos = append(b.undos, undo)
+		}
+		blocks = append(blocks, b)
+		checkPollards(t, f, pollards)
+	}
+
+	// the first block's leaves never get deleted, so there's a big tree
+	// that most blocks don't touch
+	next(256)
+	for i := 1; i < numBlocks; i++ {
+		next(rnd.Uint32() & 0x1f)
+	}
+
+	for i := 0; i < depth; i++ {
+		b := blocks[len(blocks)-1]
+		blocks = blocks[:len(blocks)-1]
+		chain.BackOne(b.adds, b.durations, b.delHashes)
+		err := f.Undo(*b.ub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, pol := range pollards {
+			err = pol.Undo(b.undos[j])
+			if err != nil {
+				t.Fatalf("undo %d: %s", i, err.Error())
+			}
+		}
+		checkPollards(t, f, pollards)
+	}
+
+	// the new chain adds different leaves
+	for i := 0; i < newBlocks; i++ {
+		next(rnd.Uint32() & 0x1f)
+	}
+	if f.numLeaves == 0 {
+		t.Fatal("forest emptied out")
+	}
+}
+
+// checkPollards checks that the pollards have f's roots, what they cache
+// matches f, and full ones have the right positions.
+func checkPollards(t *testing.T, f *Forest, pollards []*Pollard) {
+	t.Helper()
+	roots := f.GetRoots()
+	for i, p := range pollards {
+		polRoots := p.rootHashesForward()
+		if len(polRoots) != len(roots) {
+			t.Fatalf("pollard %d has %d roots, forest %d",
+				i, len(polRoots), len(roots))
+		}
+		for j := range roots {
+			if polRoots[j] != roots[j] {
+				t.Fatalf("pollard %d root %d is %x, forest %x",
+					i, j, polRoots[j][:4], roots[j][:4])
+			}
+		}
+		if !p.equalToForestIfThere(f) {
+			t.Fatalf("pollard %d and forest leaves differ", i)
+		}
+		if p.positionMap != nil {
+			err := p.PosMapSanity()
+			if err != nil {
+				t.Fatalf("pollard %d: %s", i, err.Error())
+			}
+		}
+		if p.NumNodes() != uint64(p.GetTotalCount()) {
+			t.Fatalf("pollard %d says %d nodes but has %d",
+				i, p.NumNodes(), p.GetTotalCount())
+		}
+	}
+}
+
+// Undo only takes back the last modify, and only once.
+func TestPollardUndoOrder(t *testing.T) {
+	var p Pollard
+	first, err := p.ModifyWithUndo([]Leaf{{Hash: Hash{1}}, {Hash: Hash{2}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.ModifyWithUndo([]Leaf{{Hash: Hash{3}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Undo(first) == nil {
+		t.Fatal("undid a modify that wasn't the last one")
+	}
+	err = p.Undo(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Undo(second) == nil {
+		t.Fatal("undid the same modify twice")
+	}
+	err = p.Undo(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.numLeaves != 0 || len(p.roots) != 0 {
+		t.Fatalf("%d leaves %d roots after undoing everything",
+			p.numLeaves, len(p.roots))
+	}
+}
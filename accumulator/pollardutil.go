@@ -65,6 +65,7 @@ func (p *Pollard) PruneAll() {
 	for _, root := range p.roots {
 		root.chop()
 	}
+	p.numNodes = uint64(len(p.roots))
 }
 
 // NumLeaves returns the number of leaves that the accumulator has.
@@ -72,16 +73,19 @@ func (p *Pollard) NumLeaves() uint64 {
 	return p.numLeaves
 }
 
-// prune prunes deadend children.
+// prune prunes deadend children, and returns how many it pruned.
 // don't prune at the bottom; use leaf prune instead at row 1
-func (n *polNode) prune() {
+func (n *polNode) prune() (pruned uint64) {
 	remember := n.niece[0].remember || n.niece[1].remember
 	if n.niece[0].deadEnd() && !remember {
 		n.niece[0] = nil
+		pruned++
 	}
 	if n.niece[1].deadEnd() && !remember {
 		n.niece[1] = nil
+		pruned++
 	}
+	return
 }
 
 // getCount returns the count of all the nieces below it and itself.
@@ -149,6 +153,7 @@ func (p *Pollard) RestorePollard(r io.Reader) error {
 	}
 
 	p.roots = make([]*polNode, numRoots(p.numLeaves))
+	p.numNodes = uint64(len(p.roots))
 	fmt.Printf("%d leaves %d roots ", p.numLeaves, len(p.roots))
 	for i, _ := range p.roots {
 		p.roots[i] = new(polNode)
@@ -196,6 +201,7 @@ func (p *Pollard) Deserialize(serialized []byte) error {
 	fmt.Println(p.numLeaves)
 
 	p.roots = make([]*polNode, numRoots(p.numLeaves))
+	p.numNodes = uint64(len(p.roots))
 
 	for i, _ := range p.roots {
 		p.roots[i] = new(polNode)
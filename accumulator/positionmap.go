@@ -0,0 +1,167 @@
+package accumulator
+
+import (
+	"context"
+	"fmt"
+)
+
+// The positionMap is keyed by MiniHash to save memory, so two different
+// leaves can end up with the same key.  When a leaf is added and its
+// MiniHash already belongs to a different leaf, the new leaf's position goes
+// in collidedLeaves instead, keyed by its full hash.  The leaf that got
+// there first keeps the positionMap entry.  collidedLeaves is almost always
+// empty, so all the helpers here check it first and are cheap without
+// collisions.
+
+// addPosition puts a new leaf h at pos in the positionMap, or in
+// collidedLeaves if another leaf already has h's MiniHash.  It reads the
+// leaf at the old position to tell, so the positionMap has to be right for
+// the leaves already in the forest.
+func (f *Forest) addPosition(h Hash, pos uint64) {
+	m := h.Mini()
+	if _, ok := f.collidedLeaves[h]; !ok {
+		old, ok := f.positionMap[m]
+		if !ok || old == pos || f.data.read(old) == h {
+			f.positionMap[m] = pos
+			return
+		}
+	}
+	if f.collidedLeaves == nil {
+		f.collidedLeaves = make(map[Hash]uint64)
+	}
+	f.collidedLeaves[h] = pos
+	f.miniCollisions++
+}
+
+// setPosition moves leaf h, which is already in the forest, to pos.
+func (f *Forest) setPosition(h Hash, pos uint64) {
+	if len(f.collidedLeaves) != 0 {
+		if _, ok := f.collidedLeaves[h]; ok {
+			f.collidedLeaves[h] = pos
+			return
+		}
+	}
+	f.positionMap[h.Mini()] = pos
+}
+
+// removePosition takes leaf h out.  If h had the positionMap entry and a
+// collided leaf shares its MiniHash, that leaf gets the entry.
+func (f *Forest) removePosition(h Hash) {
+	if len(f.collidedLeaves) == 0 {
+		delete(f.positionMap, h.Mini())
+		return
+	}
+	if _, ok := f.collidedLeaves[h]; ok {
+		delete(f.collidedLeaves, h)
+		return
+	}
+	m := h.Mini()
+	delete(f.positionMap, m)
+	for other, pos := range f.collidedLeaves {
+		if other.Mini() == m {
+			f.positionMap[m] = pos
+			delete(f.collidedLeaves, other)
+			return
+		}
+	}
+}
+
+// leafPosition gives where leaf h is.  A hash that isn't in the forest but
+// shares a MiniHash with a leaf that is gives that leaf's position, so
+// check the hash at the position when that matters.
+func (f *Forest) leafPosition(h Hash) (uint64, bool) {
+	if len(f.collidedLeaves) != 0 {
+		if pos, ok := f.collidedLeaves[h]; ok {
+			return pos, true
+		}
+	}
+	pos, ok := f.positionMap[h.Mini()]
+	return pos, ok
+}
+
+// numPositions is how many leaves the positionMap and collidedLeaves have
+// between them.
+func (f *Forest) numPositions() int {
+	return len(f.positionMap) + len(f.collidedLeaves)
+}
+
+// rebuildPositionMap makes the positionMap again from all the leaves.
+func (f *Forest) rebuildPositionMap() {
+	// can't stop without a ctx
+	f.rebuildPositionMapCtx(context.Background())
+}
+
+// rebuildPositionMapCtx is rebuildPositionMap, but stops with an error
+// wrapping ctx's error if it's done.  The positionMap is left half built
+// then.
+func (f *Forest) rebuildPositionMapCtx(ctx context.Context) error {
+	f.positionMap = make(map[MiniHash]uint64)
+	f.collidedLeaves = nil
+	for i := uint64(0); i < f.numLeaves; i++ {
+		if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return fmt.Errorf("stopped rebuilding positionMap at leaf %d "+
+				"of %d: %w", i, f.numLeaves, ctx.Err())
+		}
+		f.addPosition(f.data.read(i), i)
+	}
+	return nil
+}
+
+// MigratePositionMap moves leaves in the positionMap from old to new
+// positions, for when the forest's data was rearranged outside of Modify,
+// like by foresttool compact.  Leaf data moves with its leaf.  Leaves at
+// positions that aren't in positionRemap stay where they are.  If any new
+// position is past the end of the forest, or two leaves with leaf data end
+// up in the same place, nothing is changed.
+func (f *Forest) MigratePositionMap(positionRemap map[uint64]uint64) error {
+	size := f.data.size()
+	for from, to := range positionRemap {
+		if to >= size {
+			return fmt.Errorf("MigratePositionMap: %d remapped to %d but "+
+				"forest only has %d positions", from, to, size)
+		}
+	}
+	var leafData map[uint64][]byte
+	if len(f.leafData) != 0 {
+		leafData = make(map[uint64][]byte, len(f.leafData))
+		for pos, data := range f.leafData {
+			to, ok := positionRemap[pos]
+			if !ok {
+				to = pos
+			}
+			if _, ok := leafData[to]; ok {
+				return fmt.Errorf("MigratePositionMap: two leaves with leaf "+
+					"data remapped to %d", to)
+			}
+			leafData[to] = data
+		}
+		f.leafData = leafData
+	}
+	for m, pos := range f.positionMap {
+		if to, ok := positionRemap[pos]; ok {
+			f.positionMap[m] = to
+		}
+	}
+	for h, pos := range f.collidedLeaves {
+		if to, ok := positionRemap[pos]; ok {
+			f.collidedLeaves[h] = to
+		}
+	}
+	return nil
+}
+
+// RebuildPositionMap makes the positionMap again from the leaves, like
+// RestoreForest does.  Gives an error if the leaves don't all end up in it,
+// which happens when two of them are the same.
+func (f *Forest) RebuildPositionMap() error {
+	if f.numLeaves > f.data.size() {
+		return fmt.Errorf("RebuildPositionMap: %d leaves but forest only "+
+			"has %d positions", f.numLeaves, f.data.size())
+	}
+	f.rebuildPositionMap()
+	err := f.CheckConsistency()
+	if err != nil {
+		return fmt.Errorf("RebuildPositionMap: %s", err.Error())
+	}
+	return nil
+}
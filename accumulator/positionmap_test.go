@@ -0,0 +1,257 @@
+package accumulator
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestMiniHashCollision adds two leaves with the same MiniHash and makes sure
+// each one still gets its own proof, through deletes, undo and rebuilding
+// the positionMap.
+func TestMiniHashCollision(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i + 1), 0xcc}
+	}
+	// same MiniHash as leaf 3, different everywhere after that
+	collider := adds[3].Hash
+	collider[31] = 0xff
+	if collider.Mini() != adds[3].Mini() {
+		t.Fatal("collider doesn't share the MiniHash")
+	}
+	adds = append(adds, Leaf{Hash: collider})
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkProofs := func(leaves []Hash) {
+		t.Helper()
+		err := f.AssertInvariants()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.CheckConsistency()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range leaves {
+			pr, err := f.Prove(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pr.Payload != h || f.data.read(pr.Position) != h {
+				t.Fatalf("proof for %s is for %s at %d",
+					h, pr.Payload, pr.Position)
+			}
+			if !f.Verify(pr) {
+				t.Fatalf("proof for %s doesn't verify", h)
+			}
+		}
+	}
+	checkProofs([]Hash{adds[3].Hash, collider})
+	if !strings.Contains(f.Stats(), "minihash collisions: 1 ") {
+		t.Fatalf("Stats doesn't count the collision:\n%s", f.Stats())
+	}
+
+	// deleting the first leaf leaves the collider to take its place
+	ub, err := f.Modify(nil, []uint64{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProofs([]Hash{collider})
+	_, err = f.Prove(adds[3].Hash)
+	if err == nil {
+		t.Fatal("proved a deleted leaf")
+	}
+
+	// and putting it back makes it collide again
+	err = f.Undo(*ub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkProofs([]Hash{adds[3].Hash, collider})
+
+	f.rebuildPositionMap()
+	checkProofs([]Hash{adds[3].Hash, collider})
+	if f.miniCollisions != 3 {
+		t.Fatalf("%d collisions, expected 3", f.miniCollisions)
+	}
+
+	_, err = f.BulkDelete([]Hash{collider, adds[3].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.collidedLeaves) != 0 {
+		t.Fatalf("%d collided leaves left", len(f.collidedLeaves))
+	}
+	checkProofs([]Hash{adds[0].Hash, adds[7].Hash})
+}
+
+// PositionsOf finds every leaf that's there and gives back exactly the ones
+// that aren't, including one that only shares a leaf's MiniHash.
+func TestPositionsOf(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 100)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), 0x90}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lookup, absent []Hash
+	for i := range adds {
+		lookup = append(lookup, adds[i].Hash)
+		if i%10 == 0 {
+			h := Hash{uint8(i), 0x91}
+			if i == 50 {
+				// same MiniHash as adds[50]
+				h = adds[i].Hash
+				h[31] = 0xff
+			}
+			absent = append(absent, h)
+			lookup = append(lookup, h)
+		}
+	}
+
+	positions, missing := f.PositionsOf(lookup)
+	if len(positions) != len(adds) {
+		t.Fatalf("found %d positions, expected %d", len(positions), len(adds))
+	}
+	for i, pos := range positions {
+		if pos != uint64(i) {
+			t.Fatalf("leaf %d at %d, expected %d", i, pos, i)
+		}
+	}
+	if len(missing) != len(absent) {
+		t.Fatalf("%d missing, expected %d", len(missing), len(absent))
+	}
+	for i := range missing {
+		if missing[i] != absent[i] {
+			t.Fatalf("missing %d is %s, expected %s", i, missing[i], absent[i])
+		}
+	}
+
+	// positions move when leaves to the left go
+	_, err = f.Modify(nil, []uint64{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []Hash{adds[1].Hash, adds[99].Hash} {
+		pos, found := f.PositionOf(h)
+		if !found || f.data.read(pos) != h {
+			t.Fatalf("PositionOf %s gave %d %v", h, pos, found)
+		}
+	}
+	_, found := f.PositionOf(adds[0].Hash)
+	if found {
+		t.Fatal("found a deleted leaf")
+	}
+
+	// a positionMap entry past the leaves is missing instead of an error
+	f.positionMap[adds[1].Hash.Mini()] = f.numLeaves
+	positions, missing = f.PositionsOf([]Hash{adds[1].Hash, adds[2].Hash})
+	if len(positions) != 1 || f.data.read(positions[0]) != adds[2].Hash ||
+		len(missing) != 1 || missing[0] != adds[1].Hash {
+		t.Fatalf("PositionsOf with a bad entry gave %v missing %v",
+			positions, missing)
+	}
+}
+
+// Leaves swapped outside of Modify leave the positionMap stale until it's
+// migrated or rebuilt.
+func TestMigratePositionMap(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 12)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i + 1), 0x5e}
+	}
+	// collides with leaf 9, so it's in collidedLeaves
+	collider := adds[9].Hash
+	collider[31] = 0xff
+	adds = append(adds, Leaf{Hash: collider})
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the leaf data of each leaf is its hash
+	for _, pos := range []uint64{0, 1, 2, 5, 12} {
+		h := f.data.read(pos)
+		err = f.SetLeafData(pos, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// once 5 moves to 7
+	checkLeafData := func() {
+		t.Helper()
+		for _, pos := range []uint64{0, 1, 2, 7, 12} {
+			h := f.data.read(pos)
+			data, ok := f.LeafData(pos)
+			if !ok || !bytes.Equal(data, h[:]) {
+				t.Fatalf("leaf %d has leaf data %x, expected %s", pos, data, h)
+			}
+		}
+		if _, ok := f.LeafData(5); ok {
+			t.Fatal("leaf data stayed at 5")
+		}
+	}
+
+	swap := func(a, b uint64) {
+		f.data.swapHash(a, b)
+		if f.CheckConsistency() == nil {
+			t.Fatal("positionMap still right after swapping leaves")
+		}
+	}
+
+	swap(2, 12)
+	swap(5, 7)
+	err = f.MigratePositionMap(
+		map[uint64]uint64{2: 12, 12: 2, 5: 7, 7: 5, 100: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.CheckConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLeafData()
+
+	// nothing changes if a position is past the end, or leaf data would
+	// land on other leaf data
+	err = f.MigratePositionMap(map[uint64]uint64{0: 1, 1: f.data.size()})
+	if err == nil {
+		t.Fatal("migrated a leaf past the end of the forest")
+	}
+	err = f.MigratePositionMap(map[uint64]uint64{0: 1})
+	if err == nil {
+		t.Fatal("migrated leaf data onto other leaf data")
+	}
+	err = f.CheckConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLeafData()
+
+	swap(0, 9)
+	err = f.RebuildPositionMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.CheckConsistency()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two of the same leaf can't both be mapped
+	f.data.write(4, f.data.read(3))
+	err = f.RebuildPositionMap()
+	if err == nil {
+		t.Fatal("rebuilt the positionMap with a leaf in it twice")
+	}
+}
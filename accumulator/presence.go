@@ -0,0 +1,245 @@
+package accumulator
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	// presenceBitsPerLeaf is how big the presence filter gets for the number
+	// of leaves it's built with.  With 2 bits set per leaf, 16 bits per leaf
+	// gives about 1.4% false positives.
+	presenceBitsPerLeaf = 16
+
+	// presenceMinRows keeps small forests from rebuilding the filter all the
+	// time as they grow.  The filter has at least 1<<presenceMinRows bits.
+	presenceMinRows = 14
+
+	// bloomFileName is where WriteMiscData saves the presence filter, in the
+	// same directory as the misc file, once EnableBloomFilter was called.
+	bloomFileName = "bloom.dat"
+)
+
+// presenceFilter is a bloom filter over the MiniHashes in the positionMap.
+// Bits get set when leaves are added and are only cleared when the filter is
+// rebuilt, so a clear bit means the leaf definitely isn't in the forest and a
+// set bit still has to be checked in the positionMap.  The zero value is an
+// empty filter that gets built the first time it's used.
+type presenceFilter struct {
+	bits []uint64
+	// 64 - log2 of the number of bits, to take the top of a 64 bit hash
+	shift uint8
+
+	// entries is how many leaves have set bits since the filter was built,
+	// and stale is how many of those have been removed since.  When either
+	// gets big the filter fills up, so it's rebuilt from the positionMap.
+	entries, stale uint64
+
+	// bitsPerLeaf is set by EnableBloomFilter.  0 means presenceBitsPerLeaf.
+	bitsPerLeaf uint64
+	// enabled makes FindLeaf check the filter and WriteMiscData save it
+	enabled bool
+}
+
+// perLeaf is how many bits the filter gets for each leaf when it's built.
+func (pf *presenceFilter) perLeaf() uint64 {
+	if pf.bitsPerLeaf == 0 {
+		return presenceBitsPerLeaf
+	}
+	return pf.bitsPerLeaf
+}
+
+// indexes gives the 2 bits m sets.  Leaf hashes should be random, but the
+// ones in tests are often counters, so mix all of m into both.
+func (pf *presenceFilter) indexes(m MiniHash) (uint64, uint64) {
+	x := binary.BigEndian.Uint64(m[:8]) ^ uint64(binary.BigEndian.Uint32(m[8:]))
+	return (x * 0x9e3779b97f4a7c15) >> pf.shift,
+		(x * 0xc2b2ae3d27d4eb4f) >> pf.shift
+}
+
+// add sets the bits for m.  Does nothing before the filter is built.
+func (pf *presenceFilter) add(m MiniHash) {
+	if pf.bits == nil {
+		return
+	}
+	a, b := pf.indexes(m)
+	pf.bits[a>>6] |= 1 << (a & 63)
+	pf.bits[b>>6] |= 1 << (b & 63)
+	pf.entries++
+}
+
+// remove notes that a leaf is gone.  Its bits stay set until the next rebuild.
+func (pf *presenceFilter) remove() {
+	pf.stale++
+}
+
+// reset throws the filter away, for when the positionMap gets rebuilt.
+func (pf *presenceFilter) reset() {
+	*pf = presenceFilter{bitsPerLeaf: pf.bitsPerLeaf, enabled: pf.enabled}
+}
+
+// mightHave says whether m could be in the forest.  False means it's not.
+func (pf *presenceFilter) mightHave(m MiniHash) bool {
+	a, b := pf.indexes(m)
+	return pf.bits[a>>6]&(1<<(a&63)) != 0 && pf.bits[b>>6]&(1<<(b&63)) != 0
+}
+
+// needsBuild says if the filter hasn't been built, or is too full to be
+// useful.  After EnableBloomFilter, too full is anything over the false
+// positive rate asked for.
+func (pf *presenceFilter) needsBuild() bool {
+	maxBits := 2 * uint64(len(pf.bits)) * 64
+	if pf.enabled {
+		maxBits /= 2
+	}
+	return pf.bits == nil ||
+		pf.entries*pf.perLeaf() > maxBits ||
+		pf.stale*2 > pf.entries
+}
+
+// build makes the filter from scratch with every leaf in positionMap.
+func (pf *presenceFilter) build(positionMap map[MiniHash]uint64) {
+	size, shift := uint64(1<<presenceMinRows), uint8(64-presenceMinRows)
+	for size < uint64(len(positionMap))*pf.perLeaf() && size < 1<<32 {
+		size <<= 1
+		shift--
+	}
+	*pf = presenceFilter{bits: make([]uint64, size/64), shift: shift,
+		bitsPerLeaf: pf.bitsPerLeaf, enabled: pf.enabled}
+	for m := range positionMap {
+		pf.add(m)
+	}
+}
+
+// Exists says if a leaf is in the forest, like FindLeaf.  Most leaves that
+// aren't there are ruled out by the presence filter without touching the
+// positionMap.  The rest are checked against the full hash at the position
+// the positionMap gives, so there are no false positives.
+func (f *Forest) Exists(h Hash) bool {
+	if f.presence.needsBuild() {
+		f.presence.build(f.positionMap)
+	}
+	m := h.Mini()
+	if !f.presence.mightHave(m) {
+		return false
+	}
+	_, found := f.PositionOf(h)
+	return found && f.checkLookup(h) == nil
+}
+
+// EnableBloomFilter makes FindLeaf use the presence filter like Exists
+// does, and rebuilds the filter now.  The filter is sized so about
+// falsePositiveRate of the leaves that aren't in the forest still need a
+// positionMap lookup.  It sets 2 bits per leaf, so with b bits per leaf
+// that's (1 - e^(-2/b))^2.  WriteMiscData saves the filter to bloom.dat and
+// RestoreForest loads it back.
+func (f *Forest) EnableBloomFilter(falsePositiveRate float64) error {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		return fmt.Errorf("EnableBloomFilter: false positive rate %v "+
+			"not between 0 and 1", falsePositiveRate)
+	}
+	bits := math.Ceil(-2 / math.Log(1-math.Sqrt(falsePositiveRate)))
+	f.presence.bitsPerLeaf = uint64(bits)
+	f.presence.enabled = true
+	f.presence.build(f.positionMap)
+	return nil
+}
+
+// presenceFileHeader starts bloom.dat.  A saved filter is only used for the
+// forest it was saved with, so it has a hash of that forest's roots.
+type presenceFileHeader struct {
+	RootsHash   Hash
+	BitsPerLeaf uint64
+	Shift       uint8
+	Entries     uint64
+	Stale       uint64
+}
+
+// rootsHash commits to every leaf in f, to tell if a saved filter goes
+// with it.
+func (f *Forest) rootsHash() Hash {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, f.numLeaves)
+	for _, root := range f.GetRoots() {
+		h.Write(root[:])
+	}
+	var rh Hash
+	copy(rh[:], h.Sum(nil))
+	return rh
+}
+
+// writePresence saves the presence filter to fileName.
+func (f *Forest) writePresence(fileName string) error {
+	if f.presence.needsBuild() {
+		f.presence.build(f.positionMap)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hdr := presenceFileHeader{
+		RootsHash:   f.rootsHash(),
+		BitsPerLeaf: f.presence.bitsPerLeaf,
+		Shift:       f.presence.shift,
+		Entries:     f.presence.entries,
+		Stale:       f.presence.stale,
+	}
+	err = binary.Write(file, binary.BigEndian, hdr)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(file, binary.BigEndian, f.presence.bits)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// readPresence loads a filter saved by writePresence, if there is one.  A
+// filter saved with a different forest only keeps its size, and gets built
+// again the first time it's used.
+func (f *Forest) readPresence(fileName string) error {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var hdr presenceFileHeader
+	err = binary.Read(file, binary.BigEndian, &hdr)
+	if err != nil {
+		return fmt.Errorf("readPresence: %s", err.Error())
+	}
+	f.presence.reset()
+	f.presence.bitsPerLeaf = hdr.BitsPerLeaf
+	f.presence.enabled = true
+	if hdr.RootsHash != f.rootsHash() {
+		return nil
+	}
+
+	if hdr.Shift < 64-32 || hdr.Shift > 64-presenceMinRows {
+		return fmt.Errorf("readPresence: bad shift %d", hdr.Shift)
+	}
+	bits := make([]uint64, (uint64(1)<<(64-hdr.Shift))/64)
+	err = binary.Read(file, binary.BigEndian, bits)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return fmt.Errorf("readPresence: %s is cut off", fileName)
+	}
+	if err != nil {
+		return err
+	}
+	f.presence.bits = bits
+	f.presence.shift = hdr.Shift
+	f.presence.entries = hdr.Entries
+	f.presence.stale = hdr.Stale
+	return nil
+}
@@ -0,0 +1,240 @@
+package accumulator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestForestExists(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+
+	var everAdded []Hash
+	check := func(b int) {
+		for _, h := range everAdded {
+			if f.Exists(h) != f.FindLeaf(h) {
+				t.Fatalf("block %d: Exists says %v for %x, FindLeaf %v",
+					b, f.Exists(h), h[:6], f.FindLeaf(h))
+			}
+		}
+	}
+
+	for b := 0; b < 300; b++ {
+		adds, durations, delHashes := sc.NextBlock(20)
+		for _, a := range adds {
+			everAdded = append(everAdded, a.Hash)
+		}
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub, err := f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(b)
+
+		// undo every 3rd block, which brings back deleted leaves
+		if b%3 == 2 {
+			err = f.Undo(*ub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc.BackOne(adds, durations, delHashes)
+			everAdded = everAdded[:len(everAdded)-len(adds)]
+			check(b)
+		}
+	}
+	// things that were never there
+	for i := 0; i < 1000; i++ {
+		if f.Exists(Hash{0xee, uint8(i), uint8(i >> 8)}) {
+			t.Fatalf("leaf %d exists but was never added", i)
+		}
+	}
+}
+
+// TestExistsFullHash checks that a hash sharing a leaf's MiniHash isn't
+// taken for that leaf, with and without the presence filter.
+func TestExistsFullHash(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 50)
+	for i := range adds {
+		adds[i].Hash = Hash{2, uint8(i)}
+		adds[i].Hash[31] = 0x01
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bloom := range []bool{false, true} {
+		if bloom {
+			err = f.EnableBloomFilter(0.01)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, a := range adds {
+			if !f.FindLeaf(a.Hash) || !f.Exists(a.Hash) {
+				t.Fatalf("bloom %v: %x not found", bloom, a.Hash[:6])
+			}
+			other := a.Hash
+			other[31] = 0xff
+			if f.FindLeaf(other) || f.Exists(other) {
+				t.Fatalf("bloom %v: %x found with only its MiniHash in "+
+					"the forest", bloom, other[:6])
+			}
+		}
+	}
+}
+
+// benchmarkExistence looks up hashes in a forest with 100k leaves, half of
+// which are in the forest.
+func benchmarkExistence(b *testing.B, exists func(f *Forest, h Hash) bool) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 100000)
+	for i := range adds {
+		adds[i].Hash = Hash{1, uint8(i), uint8(i >> 8), uint8(i >> 16)}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	lookups := make([]Hash, 2*len(adds))
+	for i := range lookups {
+		lookups[i] = Hash{uint8(i & 1), uint8(i >> 1), uint8(i >> 9),
+			uint8(i >> 17)}
+	}
+	// build the presence filter before timing
+	f.Exists(lookups[0])
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		exists(f, lookups[i%len(lookups)])
+	}
+}
+
+func BenchmarkExists(b *testing.B) {
+	benchmarkExistence(b, (*Forest).Exists)
+}
+
+func BenchmarkFindLeaf(b *testing.B) {
+	benchmarkExistence(b, (*Forest).FindLeaf)
+}
+
+func TestEnableBloomFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bloomfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f := NewForest(RamForest, nil, "", 0)
+	err = f.EnableBloomFilter(0)
+	if err == nil {
+		t.Fatal("enabled a bloom filter with no false positives")
+	}
+	err = f.EnableBloomFilter(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the filter is added to as the forest changes
+	sc := newSimChain(0x07)
+	var everAdded []Hash
+	for b := 0; b < 100; b++ {
+		adds, _, delHashes := sc.NextBlock(200)
+		for _, a := range adds {
+			everAdded = append(everAdded, a.Hash)
+		}
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// no false negatives
+	for _, h := range everAdded {
+		_, inMap := f.positionMap[h.Mini()]
+		if inMap && !f.FindLeaf(h) {
+			t.Fatalf("FindLeaf missed %x", h[:6])
+		}
+	}
+	// false positives
+	var falsePositives int
+	const lookups = 100000
+	for i := 0; i < lookups; i++ {
+		if f.presence.mightHave(Hash{0xee, uint8(i), uint8(i >> 8),
+			uint8(i >> 16)}.Mini()) {
+			falsePositives++
+		}
+	}
+	rate := float64(falsePositives) / lookups
+	t.Logf("%d leaves, %d bits, %.4f false positive rate",
+		len(f.positionMap), len(f.presence.bits)*64, rate)
+	// the filter can fill right up to the rate before it's rebuilt, so
+	// leave some room for which hashes happened to be looked up
+	if rate > 0.0125 {
+		t.Fatalf("false positive rate %.4f, expected about 0.01", rate)
+	}
+
+	// the filter is saved and restored with the forest
+	miscFile, err := os.Create(filepath.Join(dir, "miscforestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer miscFile.Close()
+	forestFile, err := os.Create(filepath.Join(dir, "forestfile.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forestFile.Close()
+	err = f.WriteForestToDisk(forestFile, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile.Seek(0, 0)
+	forestFile.Seek(0, 0)
+	restored, err := RestoreForest(miscFile, forestFile, true, false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.presence.enabled ||
+		!reflect.DeepEqual(restored.presence.bits, f.presence.bits) {
+		t.Fatal("restored forest doesn't have the same filter")
+	}
+
+	// a filter saved with a different forest gets rebuilt
+	_, err = f.Modify([]Leaf{{Hash: Hash{0xee, 0xee}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherMiscFile, err := os.Create(filepath.Join(dir, "othermisc.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherMiscFile.Close()
+	err = f.WriteMiscData(otherMiscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile.Seek(0, 0)
+	forestFile.Seek(0, 0)
+	restored, err = RestoreForest(miscFile, forestFile, true, false, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored.presence.enabled || restored.presence.bits != nil {
+		t.Fatal("filter from a different forest wasn't thrown away")
+	}
+}
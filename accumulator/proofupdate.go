@@ -0,0 +1,182 @@
+package accumulator
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DeletedTargetsError is what UpdateProof gives when some of the targets it
+// was updating got deleted.  The proof is still updated for the rest.
+type DeletedTargetsError struct {
+	// Positions are where the deleted targets were before the modify
+	Positions []uint64
+}
+
+func (e *DeletedTargetsError) Error() string {
+	return fmt.Sprintf("UpdateProof: targets at %v deleted", e.Positions)
+}
+
+// UpdateProof changes bp, a proof from before f.Modify(adds, dels), into
+// one for the same leaves after it, so a wallet keeping proofs for its own
+// leaves doesn't have to prove them all again every block.  Call it after
+// the Modify.  The targets and the nodes in bp.Proof follow the same swaps
+// removev4 does, and the targets stay in the same order; any that were
+// deleted are dropped and given back in a DeletedTargetsError.  Proof
+// hashes for subtrees the modify didn't change are kept, and only the rest
+// are read from the forest.
+func (f *Forest) UpdateProof(bp *BatchProof, adds []Leaf, dels []uint64) error {
+	prevNumLeaves := f.numLeaves + uint64(len(dels)) - uint64(len(adds))
+	if uint64(len(adds)) > f.numLeaves+uint64(len(dels)) {
+		return fmt.Errorf("UpdateProof: %d adds but only %d leaves",
+			len(adds), f.numLeaves)
+	}
+	sorted := make([]uint64, len(dels))
+	copy(sorted, dels)
+	sortUint64s(sorted)
+	if !checkSortedNoDupes(sorted) {
+		return fmt.Errorf("UpdateProof: duplicate dels")
+	}
+	deleted := make(map[uint64]bool, len(sorted))
+	for _, d := range sorted {
+		if d >= prevNumLeaves {
+			return fmt.Errorf("UpdateProof: del at %d but only %d leaves "+
+				"before the modify", d, prevNumLeaves)
+		}
+		deleted[d] = true
+	}
+
+	var gone []uint64
+	targets := make([]*provenNode, 0, len(bp.Targets))
+	for _, target := range bp.Targets {
+		if target >= prevNumLeaves {
+			return fmt.Errorf("UpdateProof: target %d but only %d leaves "+
+				"before the modify", target, prevNumLeaves)
+		}
+		if deleted[target] {
+			gone = append(gone, target)
+			continue
+		}
+		targets = append(targets, &provenNode{lo: target})
+	}
+
+	// the nodes the old proof has hashes for, by the leaves under them
+	var nodes []*provenNode
+	if len(bp.Targets) != 0 && prevNumLeaves > 1 {
+		oldTargets := make([]uint64, len(bp.Targets))
+		copy(oldTargets, bp.Targets)
+		sortUint64s(oldTargets)
+		var positions []uint64
+		ProofPositions(oldTargets, prevNumLeaves, f.rows, &positions)
+		if len(positions) != len(bp.Proof) {
+			return fmt.Errorf("UpdateProof: %d proof hashes but the "+
+				"targets need %d", len(bp.Proof), len(positions))
+		}
+		nodes = make([]*provenNode, len(positions))
+		for i, pos := range positions {
+			row := detectRow(pos, f.rows)
+			n := &provenNode{
+				row: row, lo: childMany(pos, row, f.rows), hash: bp.Proof[i]}
+			// a deleted leaf under it changes its hash
+			j := sort.Search(len(sorted), func(j int) bool {
+				return sorted[j] >= n.lo
+			})
+			n.changed = j < len(sorted) && sorted[j] < n.lo+n.leaves()
+			nodes[i] = n
+		}
+	}
+
+	// move the targets and proof nodes along with the subtrees they're in,
+	// row by row
+	for r, row := range remTrans2(sorted, prevNumLeaves, f.rows) {
+		run := uint64(1) << uint8(r)
+		for _, swap := range row {
+			if swap.from == swap.to {
+				continue
+			}
+			a := childMany(swap.from, uint8(r), f.rows)
+			b := childMany(swap.to, uint8(r), f.rows)
+			for _, n := range targets {
+				n.swap(a, b, run)
+			}
+			for _, n := range nodes {
+				n.swap(a, b, run)
+			}
+		}
+	}
+
+	// anything reaching past the leaves that are left has new leaves under
+	// it now, or had deleted ones
+	kept := make(map[provenKey]Hash, len(nodes))
+	for _, n := range nodes {
+		if !n.changed && n.lo+n.leaves() <= prevNumLeaves-uint64(len(dels)) {
+			kept[provenKey{n.row, n.lo}] = n.hash
+		}
+	}
+
+	updated := BatchProof{Targets: make([]uint64, len(targets))}
+	for i, n := range targets {
+		updated.Targets[i] = n.lo
+	}
+	if len(targets) != 0 && f.numLeaves > 1 {
+		newTargets := make([]uint64, len(updated.Targets))
+		copy(newTargets, updated.Targets)
+		sortUint64s(newTargets)
+		var positions []uint64
+		ProofPositions(newTargets, f.numLeaves, f.rows, &positions)
+		updated.Proof = make([]Hash, len(positions))
+		for i, pos := range positions {
+			row := detectRow(pos, f.rows)
+			h, ok := kept[provenKey{row, childMany(pos, row, f.rows)}]
+			if !ok {
+				var err error
+				h, err = f.ReadAt(pos)
+				if err != nil {
+					return fmt.Errorf("UpdateProof: %s", err.Error())
+				}
+			}
+			updated.Proof[i] = h
+		}
+	}
+	*bp = updated
+	if len(gone) != 0 {
+		return &DeletedTargetsError{Positions: gone}
+	}
+	return nil
+}
+
+// provenKey is a node by its row and the first leaf under it, which stays
+// the same when the forest gets more rows.
+type provenKey struct {
+	row uint8
+	lo  uint64
+}
+
+// provenNode is a target or proof node UpdateProof is following through
+// the swaps of a modify.
+type provenNode struct {
+	row  uint8
+	lo   uint64
+	hash Hash
+	// changed is set once something under the node is deleted or swapped,
+	// so its hash can't be kept
+	changed bool
+}
+
+// leaves is how many leaves are under n
+func (n *provenNode) leaves() uint64 {
+	return uint64(1) << n.row
+}
+
+// swap moves n if it's in one of the run leaves starting at a or b, which
+// trade places.  If only part of n is, n has changed.
+func (n *provenNode) swap(a, b, run uint64) {
+	end := n.lo + n.leaves()
+	switch {
+	case n.lo >= a && end <= a+run:
+		n.lo = b + n.lo - a
+	case n.lo >= b && end <= b+run:
+		n.lo = a + n.lo - b
+	case n.lo < a+run && end > a, n.lo < b+run && end > b:
+		n.changed = true
+	}
+}
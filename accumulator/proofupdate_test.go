@@ -0,0 +1,156 @@
+package accumulator
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// A proof kept up with UpdateProof across modifies still verifies, and a
+// deleted target gets dropped from it.
+func TestUpdateProof(t *testing.T) {
+	rand.Seed(4)
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 100)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), 0xbb}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wanted := []Hash{adds[0].Hash, adds[5].Hash, adds[50].Hash,
+		adds[63].Hash, adds[64].Hash, adds[99].Hash}
+	bp, err := f.ProveBatch(wanted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for block := 0; block < 20; block++ {
+		blockAdds := make([]Leaf, rand.Intn(10))
+		for i := range blockAdds {
+			blockAdds[i].Hash = Hash{uint8(i), uint8(block), 0xcc}
+		}
+		var dels []uint64
+		for pos := uint64(0); pos < f.numLeaves; pos++ {
+			h := f.data.read(pos)
+			isWanted := false
+			for _, w := range wanted {
+				isWanted = isWanted || h == w
+			}
+			// the wanted leaves stay but one, which goes in block 10
+			if isWanted && !(block == 10 && h == wanted[2]) {
+				continue
+			}
+			if isWanted || rand.Intn(8) == 0 {
+				dels = append(dels, pos)
+			}
+		}
+		rand.Shuffle(len(dels), func(i, j int) {
+			dels[i], dels[j] = dels[j], dels[i]
+		})
+
+		_, err = f.Modify(blockAdds, dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.UpdateProof(&bp, blockAdds, dels)
+		if block == 10 {
+			var deletedErr *DeletedTargetsError
+			if !errors.As(err, &deletedErr) ||
+				len(deletedErr.Positions) != 1 {
+				t.Fatalf("block %d: got error %v, expected one target "+
+					"deleted", block, err)
+			}
+			wanted = append(wanted[:2], wanted[3:]...)
+		} else if err != nil {
+			t.Fatalf("block %d: %s", block, err.Error())
+		}
+
+		err = f.VerifyBatchProof(wanted, bp)
+		if err != nil {
+			t.Fatalf("block %d: updated proof doesn't verify: %s",
+				block, err.Error())
+		}
+		expected, err := f.ProveAtPositions(bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(bp, expected) {
+			t.Fatalf("block %d: updated proof differs from proving again",
+				block)
+		}
+		for i, w := range wanted {
+			pos, ok := f.leafPosition(w)
+			if !ok || pos != bp.Targets[i] {
+				t.Fatalf("block %d: target %d at %d, leaf is at %d",
+					block, i, bp.Targets[i], pos)
+			}
+		}
+	}
+}
+
+// Proof hashes for subtrees a modify didn't touch are carried over instead of
+// read from the forest again.
+func TestUpdateProofKeepsHashes(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	adds := make([]Leaf, 64)
+	for i := range adds {
+		adds[i].Hash = Hash{uint8(i), 0xbc}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := f.ProveAtPositions([]uint64{3, 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// swap every hash for one the forest doesn't have, so the ones that
+	// come through must have been kept
+	oldProof := append([]Hash{}, bp.Proof...)
+	marked := BatchProof{Targets: append([]uint64{}, bp.Targets...)}
+	for i := range bp.Proof {
+		marked.Proof = append(marked.Proof, Hash{0xee, uint8(i)})
+	}
+
+	// only the right half changes, along with the adds
+	blockAdds := []Leaf{{Hash: Hash{0xff, 0xbc}}}
+	dels := []uint64{60, 41}
+	_, err = f.Modify(blockAdds, dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.UpdateProof(&bp, blockAdds, dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.UpdateProof(&marked, blockAdds, dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bp.Targets, marked.Targets) {
+		t.Fatalf("targets %v and %v", bp.Targets, marked.Targets)
+	}
+
+	var kept int
+	for i, h := range marked.Proof {
+		if h[0] != 0xee {
+			if h != bp.Proof[i] {
+				t.Fatalf("proof hash %d is %s, expected %s", i, h, bp.Proof[i])
+			}
+			continue
+		}
+		kept++
+		// the hash it was marking has to be the right one
+		if oldProof[h[1]] != bp.Proof[i] {
+			t.Fatalf("kept proof hash %d as %d, but it changed", h[1], i)
+		}
+	}
+	// everything but 41, which got deleted, and 48-63, which had 60 in it
+	if kept != len(oldProof)-2 {
+		t.Fatalf("kept %d proof hashes, expected %d", kept, len(oldProof)-2)
+	}
+}
@@ -0,0 +1,322 @@
+// Protobuf definitions for the utreexo forest and proofs, so that other
+// languages can read them without knowing the custom binary format.
+//
+// To regenerate utreexo.pb.go, from this directory run:
+//   protoc --go_out=. --go_opt=paths=source_relative utreexo.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.31.0
+// 	protoc        (unknown)
+// source: utreexo.proto
+
+package proto
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// ForestState is a whole forest.
+type ForestState struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// number of leaves in the forest now, which goes down as they're deleted
+	NumLeaves uint64 `protobuf:"varint,1,opt,name=num_leaves,json=numLeaves,proto3" json:"num_leaves,omitempty"`
+	// rows in the forest.  The forest has (2 << rows) - 1 positions
+	Rows uint32 `protobuf:"varint,2,opt,name=rows,proto3" json:"rows,omitempty"`
+	// every hash in the forest, in position order.  Empty positions are
+	// zero length instead of 32 zero bytes.
+	Nodes [][]byte `protobuf:"bytes,3,rep,name=nodes,proto3" json:"nodes,omitempty"`
+}
+
+func (x *ForestState) Reset() {
+	*x = ForestState{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_utreexo_proto_msgTypes[0]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ForestState) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ForestState) ProtoMessage() {}
+
+func (x *ForestState) ProtoReflect() protoreflect.Message {
+	mi := &file_utreexo_proto_msgTypes[0]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ForestState.ProtoReflect.Descriptor instead.
+func (*ForestState) Descriptor() ([]byte, []int) {
+	return file_utreexo_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *ForestState) GetNumLeaves() uint64 {
+	if x != nil {
+		return x.NumLeaves
+	}
+	return 0
+}
+
+func (x *ForestState) GetRows() uint32 {
+	if x != nil {
+		return x.Rows
+	}
+	return 0
+}
+
+func (x *ForestState) GetNodes() [][]byte {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+// ForestNode is a single hash and where it is in the forest.
+type ForestNode struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Position uint64 `protobuf:"varint,1,opt,name=position,proto3" json:"position,omitempty"`
+	Hash     []byte `protobuf:"bytes,2,opt,name=hash,proto3" json:"hash,omitempty"`
+}
+
+func (x *ForestNode) Reset() {
+	*x = ForestNode{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_utreexo_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ForestNode) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ForestNode) ProtoMessage() {}
+
+func (x *ForestNode) ProtoReflect() protoreflect.Message {
+	mi := &file_utreexo_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ForestNode.ProtoReflect.Descriptor instead.
+func (*ForestNode) Descriptor() ([]byte, []int) {
+	return file_utreexo_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ForestNode) GetPosition() uint64 {
+	if x != nil {
+		return x.Position
+	}
+	return 0
+}
+
+func (x *ForestNode) GetHash() []byte {
+	if x != nil {
+		return x.Hash
+	}
+	return nil
+}
+
+// BatchProof is the inclusion proof for multiple leaves.
+type BatchProof struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// positions of the leaves being proven
+	Targets []uint64 `protobuf:"varint,1,rep,packed,name=targets,proto3" json:"targets,omitempty"`
+	// hashes needed to get from the targets to the roots
+	Proof [][]byte `protobuf:"bytes,2,rep,name=proof,proto3" json:"proof,omitempty"`
+}
+
+func (x *BatchProof) Reset() {
+	*x = BatchProof{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_utreexo_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *BatchProof) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BatchProof) ProtoMessage() {}
+
+func (x *BatchProof) ProtoReflect() protoreflect.Message {
+	mi := &file_utreexo_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BatchProof.ProtoReflect.Descriptor instead.
+func (*BatchProof) Descriptor() ([]byte, []int) {
+	return file_utreexo_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *BatchProof) GetTargets() []uint64 {
+	if x != nil {
+		return x.Targets
+	}
+	return nil
+}
+
+func (x *BatchProof) GetProof() [][]byte {
+	if x != nil {
+		return x.Proof
+	}
+	return nil
+}
+
+var File_utreexo_proto protoreflect.FileDescriptor
+
+var file_utreexo_proto_rawDesc = []byte{
+	0x0a, 0x0d, 0x75, 0x74, 0x72, 0x65, 0x65, 0x78, 0x6f, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12,
+	0x07, 0x75, 0x74, 0x72, 0x65, 0x65, 0x78, 0x6f, 0x22, 0x56, 0x0a, 0x0b, 0x46, 0x6f, 0x72, 0x65,
+	0x73, 0x74, 0x53, 0x74, 0x61, 0x74, 0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x6e, 0x75, 0x6d, 0x5f, 0x6c,
+	0x65, 0x61, 0x76, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x6e, 0x75, 0x6d,
+	0x4c, 0x65, 0x61, 0x76, 0x65, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x72, 0x6f, 0x77, 0x73, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x72, 0x6f, 0x77, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x6e, 0x6f,
+	0x64, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x05, 0x6e, 0x6f, 0x64, 0x65, 0x73,
+	0x22, 0x3c, 0x0a, 0x0a, 0x46, 0x6f, 0x72, 0x65, 0x73, 0x74, 0x4e, 0x6f, 0x64, 0x65, 0x12, 0x1a,
+	0x0a, 0x08, 0x70, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04,
+	0x52, 0x08, 0x70, 0x6f, 0x73, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x12, 0x0a, 0x04, 0x68, 0x61,
+	0x73, 0x68, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x04, 0x68, 0x61, 0x73, 0x68, 0x22, 0x3c,
+	0x0a, 0x0a, 0x42, 0x61, 0x74, 0x63, 0x68, 0x50, 0x72, 0x6f, 0x6f, 0x66, 0x12, 0x18, 0x0a, 0x07,
+	0x74, 0x61, 0x72, 0x67, 0x65, 0x74, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x04, 0x52, 0x07, 0x74,
+	0x61, 0x72, 0x67, 0x65, 0x74, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x18,
+	0x02, 0x20, 0x03, 0x28, 0x0c, 0x52, 0x05, 0x70, 0x72, 0x6f, 0x6f, 0x66, 0x42, 0x2e, 0x5a, 0x2c,
+	0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x6d, 0x69, 0x74, 0x2d, 0x64,
+	0x63, 0x69, 0x2f, 0x75, 0x74, 0x72, 0x65, 0x65, 0x78, 0x6f, 0x2f, 0x61, 0x63, 0x63, 0x75, 0x6d,
+	0x75, 0x6c, 0x61, 0x74, 0x6f, 0x72, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x06, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_utreexo_proto_rawDescOnce sync.Once
+	file_utreexo_proto_rawDescData = file_utreexo_proto_rawDesc
+)
+
+func file_utreexo_proto_rawDescGZIP() []byte {
+	file_utreexo_proto_rawDescOnce.Do(func() {
+		file_utreexo_proto_rawDescData = protoimpl.X.CompressGZIP(file_utreexo_proto_rawDescData)
+	})
+	return file_utreexo_proto_rawDescData
+}
+
+var file_utreexo_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_utreexo_proto_goTypes = []interface{}{
+	(*ForestState)(nil), // 0: utreexo.ForestState
+	(*ForestNode)(nil),  // 1: utreexo.ForestNode
+	(*BatchProof)(nil),  // 2: utreexo.BatchProof
+}
+var file_utreexo_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_utreexo_proto_init() }
+func file_utreexo_proto_init() {
+	if File_utreexo_proto != nil {
+		return
+	}
+	if !protoimpl.UnsafeEnabled {
+		file_utreexo_proto_msgTypes[0].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ForestState); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_utreexo_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ForestNode); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_utreexo_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*BatchProof); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_utreexo_proto_rawDesc,
+			NumEnums:      0,
+			NumMessages:   3,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_utreexo_proto_goTypes,
+		DependencyIndexes: file_utreexo_proto_depIdxs,
+		MessageInfos:      file_utreexo_proto_msgTypes,
+	}.Build()
+	File_utreexo_proto = out.File
+	file_utreexo_proto_rawDesc = nil
+	file_utreexo_proto_goTypes = nil
+	file_utreexo_proto_depIdxs = nil
+}
@@ -0,0 +1,63 @@
+package simutil
+
+import (
+	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// maxAddsMask caps how many leaves RunComparison adds per block.
+const maxAddsMask = 0x3f
+
+// RunComparison runs blocks blocks from s through a new Forest and a new
+// Pollard.  For every block the forest proves the deletions, the pollard
+// verifies and ingests that proof, and both apply the block.  Afterwards the
+// forest has to pass AssertInvariants and the roots have to match.  s has to
+// be new, since the accumulators start empty.
+func RunComparison(s *SimChain, blocks int) error {
+	if s.blockHeight != -1 {
+		return fmt.Errorf("RunComparison: chain already at height %d",
+			s.blockHeight)
+	}
+	f := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	var p accumulator.Pollard
+
+	for b := 0; b < blocks; b++ {
+		adds, _, delHashes := s.NextBlock(s.rnd.Uint32() & maxAddsMask)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return fmt.Errorf("block %d forest prove: %s", s.blockHeight, err)
+		}
+		err = p.IngestBatchProof(delHashes, bp, false)
+		if err != nil {
+			return fmt.Errorf("block %d pollard ingest: %s", s.blockHeight, err)
+		}
+
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return fmt.Errorf("block %d forest modify: %s", s.blockHeight, err)
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return fmt.Errorf("block %d pollard modify: %s", s.blockHeight, err)
+		}
+
+		err = f.AssertInvariants()
+		if err != nil {
+			return fmt.Errorf("block %d forest: %s", s.blockHeight, err)
+		}
+		forestRoots, pollardRoots := f.GetRoots(), p.GetRoots()
+		if len(forestRoots) != len(pollardRoots) {
+			return fmt.Errorf("block %d forest has %d roots, pollard %d",
+				s.blockHeight, len(forestRoots), len(pollardRoots))
+		}
+		for i := range forestRoots {
+			if forestRoots[i] != pollardRoots[i] {
+				return fmt.Errorf("block %d root %d forest %x pollard %x",
+					s.blockHeight, i, forestRoots[i][:4], pollardRoots[i][:4])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Package simutil makes deterministic fake chains for testing the
+// accumulator, and runs them through a Forest and a Pollard side by side to
+// check that they always agree.
+package simutil
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// SimChain makes blocks of new leaves, each with a random TTL, and deletes
+// them when their TTLs run out.  The same seed always gives the same blocks.
+type SimChain struct {
+	ttlSlices    [][]accumulator.Hash
+	blockHeight  int32
+	leafCounter  uint64
+	durationMask uint32
+	lookahead    int32
+	rnd          *rand.Rand
+}
+
+// NewSimChain gives a SimChain at height -1, so the first NextBlock is block
+// 0.  TTLs are random & durationMask, and 0 means the leaf is never deleted.
+// Leaves with TTLs under lookahead are marked to be remembered by pollards.
+func NewSimChain(seed int64, lookahead int32, durationMask uint32) *SimChain {
+	return &SimChain{
+		ttlSlices:    make([][]accumulator.Hash, durationMask+1),
+		blockHeight:  -1,
+		durationMask: durationMask,
+		lookahead:    lookahead,
+		rnd:          rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Height is the height of the last block NextBlock gave.
+func (s *SimChain) Height() int32 {
+	return s.blockHeight
+}
+
+// NextBlock makes the next block with numAdds new leaves.  It gives the
+// leaves, their TTLs, and the hashes of the leaves whose TTLs ran out in this
+// block, which need to be deleted.
+func (s *SimChain) NextBlock(numAdds uint32) (
+	[]accumulator.Leaf, []int32, []accumulator.Hash) {
+
+	s.blockHeight++
+	// the first block needs something in it
+	if s.blockHeight == 0 && numAdds == 0 {
+		numAdds = 1
+	}
+	adds := make([]accumulator.Leaf, numAdds)
+	durations := make([]int32, numAdds)
+
+	delHashes := s.ttlSlices[0]
+	s.ttlSlices = append(s.ttlSlices[1:], []accumulator.Hash{})
+
+	for i := range adds {
+		// unique for every leaf, and 0xff keeps it from being empty
+		binary.BigEndian.PutUint64(adds[i].Hash[:8], s.leafCounter)
+		adds[i].Hash[8] = 0xff
+		s.leafCounter++
+
+		durations[i] = int32(s.rnd.Uint32() & s.durationMask)
+		// leaves in the first block live forever, so the forest never
+		// goes back to 0 leaves
+		if s.blockHeight == 0 {
+			durations[i] = 0
+		}
+		if durations[i] == 0 {
+			continue
+		}
+		if durations[i] < s.lookahead {
+			adds[i].Remember = true
+		}
+		s.ttlSlices[durations[i]-1] =
+			append(s.ttlSlices[durations[i]-1], adds[i].Hash)
+	}
+
+	return adds, durations, delHashes
+}
+
+// BackOne takes what NextBlock gave and puts the chain back to where it was
+// before that block.
+func (s *SimChain) BackOne(
+	adds []accumulator.Leaf, durations []int32, dels []accumulator.Hash) {
+
+	// the deleted hashes come back on the left, and the rightmost go
+	s.ttlSlices = append(
+		[][]accumulator.Hash{dels}, s.ttlSlices[:len(s.ttlSlices)-1]...)
+
+	// take the block's adds back out of their TTL slices, which they're at
+	// the end of
+	for _, d := range durations {
+		if d == 0 {
+			continue
+		}
+		s.ttlSlices[d] = s.ttlSlices[d][:len(s.ttlSlices[d])-1]
+	}
+	s.leafCounter -= uint64(len(adds))
+	s.blockHeight--
+}
@@ -0,0 +1,63 @@
+package simutil
+
+import (
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// simBlocksEnv sets how many blocks TestRunComparison runs per seed, for
+// long runs like nightly builds.
+const simBlocksEnv = "UTREEXO_SIM_BLOCKS"
+
+func TestRunComparison(t *testing.T) {
+	blocks := 200
+	if testing.Short() {
+		blocks = 50
+	}
+	if env := os.Getenv(simBlocksEnv); env != "" {
+		var err error
+		blocks, err = strconv.Atoi(env)
+		if err != nil {
+			t.Fatalf("%s=%s: %s", simBlocksEnv, env, err.Error())
+		}
+	}
+
+	for seed := int64(0); seed < 4; seed++ {
+		// short TTLs make for lots of deletions, long ones for a big forest
+		for _, mask := range []uint32{0x07, 0x3f} {
+			err := RunComparison(NewSimChain(seed, 8, mask), blocks)
+			if err != nil {
+				t.Fatalf("seed %d mask %x: %s", seed, mask, err.Error())
+			}
+		}
+	}
+
+	s := NewSimChain(0, 8, 0x07)
+	s.NextBlock(1)
+	if RunComparison(s, 1) == nil {
+		t.Fatal("ran comparison on a used chain")
+	}
+}
+
+func TestSimChainDeterministic(t *testing.T) {
+	a, b := NewSimChain(7, 0, 0x0f), NewSimChain(7, 0, 0x0f)
+	for i := 0; i < 50; i++ {
+		addsA, durA, delsA := a.NextBlock(10)
+		addsB, durB, delsB := b.NextBlock(10)
+		if !reflect.DeepEqual(addsA, addsB) || !reflect.DeepEqual(durA, durB) ||
+			!reflect.DeepEqual(delsA, delsB) {
+			t.Fatalf("block %d differs with the same seed", i)
+		}
+	}
+
+	// BackOne gives back the same deletions
+	adds, durations, dels := a.NextBlock(10)
+	a.BackOne(adds, durations, dels)
+	_, _, dels2 := a.NextBlock(10)
+	if !reflect.DeepEqual(dels, dels2) {
+		t.Fatalf("deleted %d leaves, then %d after BackOne",
+			len(dels), len(dels2))
+	}
+}
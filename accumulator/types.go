@@ -3,6 +3,9 @@ package accumulator
 import (
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 )
@@ -30,6 +33,100 @@ func (h Hash) Mini() (m MiniHash) {
 	return
 }
 
+// String gives the whole hash in hex.
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// Short gives the first 2 bytes in hex, for printing lots of hashes.
+func (h Hash) Short() string {
+	return hex.EncodeToString(h[:2])
+}
+
+// MarshalJSON gives the hash as a hex string.
+func (h Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+// UnmarshalJSON reads a hex string from MarshalJSON.
+func (h *Hash) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	*h, err = ParseHash(s)
+	return err
+}
+
+// EqualConstantTime compares h to o in time that doesn't depend on where
+// they differ.
+func (h Hash) EqualConstantTime(o Hash) bool {
+	return subtle.ConstantTimeCompare(h[:], o[:]) == 1
+}
+
+// ParseHash reads a hash from 64 hex characters, like String gives.
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	err := decodeHex(h[:], s)
+	if err != nil {
+		return h, fmt.Errorf("ParseHash: %s", err.Error())
+	}
+	return h, nil
+}
+
+// String gives the whole MiniHash in hex.
+func (m MiniHash) String() string {
+	return hex.EncodeToString(m[:])
+}
+
+// Short gives the first 2 bytes in hex, the same as Hash.Short.
+func (m MiniHash) Short() string {
+	return hex.EncodeToString(m[:2])
+}
+
+// MarshalJSON gives the MiniHash as a hex string.
+func (m MiniHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+// UnmarshalJSON reads a hex string from MarshalJSON.
+func (m *MiniHash) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	*m, err = ParseMiniHash(s)
+	return err
+}
+
+// EqualConstantTime compares m to o in time that doesn't depend on where
+// they differ.
+func (m MiniHash) EqualConstantTime(o MiniHash) bool {
+	return subtle.ConstantTimeCompare(m[:], o[:]) == 1
+}
+
+// ParseMiniHash reads a MiniHash from 24 hex characters.
+func ParseMiniHash(s string) (MiniHash, error) {
+	var m MiniHash
+	err := decodeHex(m[:], s)
+	if err != nil {
+		return m, fmt.Errorf("ParseMiniHash: %s", err.Error())
+	}
+	return m, nil
+}
+
+// decodeHex fills b from s, which has to be exactly as long as b in hex.
+func decodeHex(b []byte, s string) error {
+	if len(s) != hex.EncodedLen(len(b)) {
+		return fmt.Errorf("%q is %d characters, expected %d",
+			s, len(s), hex.EncodedLen(len(b)))
+	}
+	_, err := hex.Decode(b, []byte(s))
+	return err
+}
+
 // HashFromString takes a string and hashes with sha256
 func HashFromString(s string) Hash {
 	return sha256.Sum256([]byte(s))
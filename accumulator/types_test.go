@@ -0,0 +1,74 @@
+package accumulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHashStrings(t *testing.T) {
+	h := HashFromString("utreexo")
+	s := h.String()
+	if len(s) != 64 || !strings.HasPrefix(s, h.Short()) || len(h.Short()) != 4 {
+		t.Fatalf("String %s Short %s", s, h.Short())
+	}
+	// %s and %v both give the hex
+	if fmt.Sprintf("%s %v", h, h) != s+" "+s {
+		t.Fatalf("printed as %s %v", h, h)
+	}
+
+	parsed, err := ParseHash(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != h || !parsed.EqualConstantTime(h) {
+		t.Fatalf("parsed %s, expected %s", parsed, h)
+	}
+	for _, bad := range []string{"", s[:62], s + "00", "zz" + s[2:]} {
+		_, err = ParseHash(bad)
+		if err == nil {
+			t.Fatalf("parsed %q", bad)
+		}
+	}
+	if h.EqualConstantTime(Hash{}) {
+		t.Fatal("hash equal to empty")
+	}
+
+	b, err := json.Marshal([]Hash{h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `["`+s+`"]` {
+		t.Fatalf("json %s", b)
+	}
+	var hs []Hash
+	err = json.Unmarshal(b, &hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hs) != 1 || hs[0] != h {
+		t.Fatalf("unmarshaled %v, expected [%s]", hs, h)
+	}
+
+	m := h.Mini()
+	if m.String() != s[:24] || m.Short() != h.Short() {
+		t.Fatalf("MiniHash String %s Short %s", m, m.Short())
+	}
+	b, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m2 MiniHash
+	err = json.Unmarshal(b, &m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m2.EqualConstantTime(m) {
+		t.Fatalf("unmarshaled %s, expected %s", m2, m)
+	}
+	_, err = ParseMiniHash(s)
+	if err == nil {
+		t.Fatal("parsed a whole hash as a MiniHash")
+	}
+}
@@ -20,6 +20,10 @@ type UndoBlock struct {
 	numAdds   uint32   // number of adds in the block
 	positions []uint64 // position of all deletions this block
 	hashes    []Hash   // hashes that were deleted
+
+	// leaf data the deleted leaves had, same order as hashes.  Not
+	// serialized.
+	leafData [][]byte
 }
 
 // ToString returns a string
@@ -129,6 +133,14 @@ func (u *UndoBlock) Deserialize(r io.Reader) error {
 
 // Undo reverts a Modify() with the given undoBlock.
 func (f *Forest) Undo(ub UndoBlock) error {
+	return f.trackDirty(func() error { return f.undo(ub) })
+}
+
+func (f *Forest) undo(ub UndoBlock) error {
+	err := f.flushDirt()
+	if err != nil {
+		return err
+	}
 	prevAdds := uint64(ub.numAdds)
 	prevDels := uint64(len(ub.hashes))
 	// how many leaves were there at the last block?
@@ -141,7 +153,9 @@ func (f *Forest) Undo(ub UndoBlock) error {
 
 	// remove everything between prevNumLeaves and numLeaves from positionMap
 	for p := f.numLeaves; p < f.numLeaves+prevAdds; p++ {
-		delete(f.positionMap, f.data.read(p).Mini())
+		f.removePosition(f.data.read(p))
+		f.presence.remove()
+		delete(f.leafData, p)
 	}
 
 	// also add everything past numleaves and prevnumleaves to dirt
@@ -156,12 +170,22 @@ func (f *Forest) Undo(ub UndoBlock) error {
 			return fmt.Errorf("hash %d in undoblock is empty", i)
 		}
 		f.data.write(f.numLeaves+uint64(i), h)
+		// nothing's moved yet so the positionMap is still right for telling
+		// if h collides with a leaf that's here
+		f.addPosition(h, f.numLeaves+uint64(i))
+		if ub.leafData != nil && ub.leafData[i] != nil {
+			if f.leafData == nil {
+				f.leafData = make(map[uint64][]byte)
+			}
+			f.leafData[f.numLeaves+uint64(i)] = ub.leafData[i]
+		}
 		dirt = append(dirt, f.numLeaves+uint64(i))
 	}
 
 	// go through swaps in reverse order
 	for i, a := range leafMoves {
 		f.data.swapHash(a.from, a.to)
+		f.swapLeafData(a.from, a.to)
 		dirt[2*i] = a.to       // this is wrong, it way over hashes
 		dirt[(2*i)+1] = a.from // also should be parents
 	}
@@ -169,26 +193,23 @@ func (f *Forest) Undo(ub UndoBlock) error {
 	// update positionMap.  The stuff we do want has been moved in to the forest,
 	// the stuff we don't want has been moved to the right past the edge
 	for p := f.numLeaves; p < prevNumLeaves; p++ {
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.setPosition(f.data.read(p), p)
+		f.presence.add(f.data.read(p).Mini())
 	}
 	for _, p := range ub.positions {
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.setPosition(f.data.read(p), p)
+		f.presence.add(f.data.read(p).Mini())
 	}
 	for _, d := range dirt {
 		// everything that moved needs to have its position updated in the map
 		// TODO does it..?
-		m := f.data.read(d).Mini()
-		oldpos := f.positionMap[m]
-		if oldpos != d {
-			delete(f.positionMap, m)
-			f.positionMap[m] = d
-		}
+		f.setPosition(f.data.read(d), d)
 	}
 
 	// rehash above all tos/froms
 	f.numLeaves = prevNumLeaves // change numLeaves before rehashing
 	sortUint64s(dirt)
-	err := f.reHash(dirt)
+	err = f.reHash(dirt)
 	if err != nil {
 		return err
 	}
@@ -196,6 +217,107 @@ func (f *Forest) Undo(ub UndoBlock) error {
 	return nil
 }
 
+// Rewind reverts the Modify that gave ub, same as Undo, but if it fails the
+// forest is left as it was before the call.  The leaves added by the Modify
+// come off the right edge and the deleted leaves in ub go back where they
+// were.  Everything Undo writes is saved first so it can be put back.
+func (f *Forest) Rewind(ub *UndoBlock) error {
+	if ub == nil {
+		return fmt.Errorf("Rewind: nil undo block")
+	}
+	if len(ub.positions) != len(ub.hashes) {
+		return fmt.Errorf("Rewind: %d positions but %d hashes",
+			len(ub.positions), len(ub.hashes))
+	}
+	prevAdds := uint64(ub.numAdds)
+	if prevAdds > f.numLeaves {
+		return fmt.Errorf("Rewind: %d adds to take off but only %d leaves",
+			prevAdds, f.numLeaves)
+	}
+	prevNumLeaves := f.numLeaves + uint64(len(ub.hashes)) - prevAdds
+	if prevNumLeaves > 1<<f.rows {
+		return fmt.Errorf("Rewind: %d leaves don't fit in %d rows",
+			prevNumLeaves, f.rows)
+	}
+	for i, pos := range ub.positions {
+		if pos >= prevNumLeaves {
+			return fmt.Errorf("Rewind: deleted position %d past %d leaves",
+				pos, prevNumLeaves)
+		}
+		if i > 0 && pos <= ub.positions[i-1] {
+			return fmt.Errorf("Rewind: deleted positions not sorted")
+		}
+		if ub.hashes[i] == empty {
+			return fmt.Errorf("Rewind: hash %d in undoblock is empty", i)
+		}
+	}
+
+	jd := &journalData{ForestData: f.data, saved: make(map[uint64]Hash)}
+	numLeaves := f.numLeaves
+	leafData := make(map[uint64][]byte, len(f.leafData))
+	for pos, data := range f.leafData {
+		leafData[pos] = data
+	}
+	f.data = jd
+	err := f.Undo(*ub)
+	f.data = jd.ForestData
+	if err != nil {
+		jd.restore()
+		f.numLeaves = numLeaves
+		// Undo changes positionMap as it goes, so build it again
+		f.rebuildPositionMap()
+		f.presence.reset()
+		f.leafData = leafData
+		return fmt.Errorf("Rewind: %s", err.Error())
+	}
+	return nil
+}
+
+// journalData is a ForestData that saves what was at every position before
+// it first gets written, so that restore can put it all back.
+type journalData struct {
+	ForestData
+	saved map[uint64]Hash
+}
+
+func (j *journalData) save(pos uint64) {
+	if _, ok := j.saved[pos]; !ok {
+		j.saved[pos] = j.ForestData.read(pos)
+	}
+}
+
+// zeroOnResize is the same as for the ForestData under it.  The journal
+// saves what swapHashRange moves, so reMap can use it here too.
+func (j *journalData) zeroOnResize() bool {
+	return zeroesOnResize(j.ForestData)
+}
+
+func (j *journalData) write(pos uint64, h Hash) {
+	j.save(pos)
+	j.ForestData.write(pos, h)
+}
+
+func (j *journalData) swapHash(a, b uint64) {
+	j.save(a)
+	j.save(b)
+	j.ForestData.swapHash(a, b)
+}
+
+func (j *journalData) swapHashRange(a, b, w uint64) {
+	for i := uint64(0); i < w; i++ {
+		j.save(a + i)
+		j.save(b + i)
+	}
+	j.ForestData.swapHashRange(a, b, w)
+}
+
+// restore writes back everything saved since the journalData was made.
+func (j *journalData) restore() {
+	for pos, h := range j.saved {
+		j.ForestData.write(pos, h)
+	}
+}
+
 // BuildUndoData makes an undoBlock from the same data that you'd give to Modify
 func (f *Forest) BuildUndoData(numadds uint64, dels []uint64) *UndoBlock {
 	ub := new(UndoBlock)
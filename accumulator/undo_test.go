@@ -141,6 +141,115 @@ func TestUndoTest(t *testing.T) {
 	}
 }
 
+func TestForestRewind(t *testing.T) {
+	rand.Seed(2)
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	sc.lookahead = 0
+
+	// roots before each block, starting with the empty forest
+	var rootsBefore [][]Hash
+	var undos []*UndoBlock
+	var dels int
+	for b := 0; b < 10; b++ {
+		adds, _, delHashes := sc.NextBlock(rand.Uint32()&0x07 + 1)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootsBefore = append(rootsBefore, f.GetRoots())
+		ub, err := f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		undos = append(undos, ub)
+		dels += len(bp.Targets)
+	}
+	if dels == 0 {
+		t.Fatal("no deletions to rewind")
+	}
+
+	// a bad undo block fails and leaves everything as it was
+	roots := f.GetRoots()
+	numLeaves := f.numLeaves
+	bad := *undos[9]
+	bad.positions = append([]uint64{}, bad.positions...)
+	bad.hashes = append([]Hash{}, bad.hashes...)
+	bad.positions = append(bad.positions, f.numLeaves+100)
+	bad.hashes = append(bad.hashes, Hash{1})
+	err := f.Rewind(&bad)
+	if err == nil {
+		t.Fatal("rewound with a deleted position past the leaves")
+	}
+	if f.numLeaves != numLeaves || !reflect.DeepEqual(f.GetRoots(), roots) {
+		t.Fatal("failed rewind changed the forest")
+	}
+
+	for b := 9; b >= 0; b-- {
+		err = f.Rewind(undos[b])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.PosMapSanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots := f.GetRoots()
+		if len(roots) != len(rootsBefore[b]) {
+			t.Fatalf("block %d has %d roots after rewind, expected %d",
+				b, len(roots), len(rootsBefore[b]))
+		}
+		for i := range roots {
+			if roots[i] != rootsBefore[b][i] {
+				t.Fatalf("block %d root %d is %s after rewind, expected %s",
+					b, i, roots[i], rootsBefore[b][i])
+			}
+		}
+	}
+	if f.numLeaves != 0 {
+		t.Fatalf("%d leaves left after rewinding everything", f.numLeaves)
+	}
+}
+
+// TestJournalDataRestore runs a whole Undo through journalData and checks
+// restore takes back everything it did, which is what Rewind does if Undo
+// fails part way.
+func TestJournalDataRestore(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	sc := newSimChain(0x07)
+	adds, _, _ := sc.NextBlock(12)
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := f.ProveBatch([]Hash{adds[2].Hash, adds[5].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ub, err := f.Modify(adds[:0], bp.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := f.GetRoots()
+
+	jd := &journalData{ForestData: f.data, saved: make(map[uint64]Hash)}
+	f.data = jd
+	err = f.Undo(*ub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.data = jd.ForestData
+	if len(jd.saved) == 0 {
+		t.Fatal("undo didn't write anything")
+	}
+
+	jd.restore()
+	f.numLeaves = 10
+	if !reflect.DeepEqual(f.GetRoots(), roots) {
+		t.Fatal("restore didn't put back the forest")
+	}
+}
+
 func undoOnceRandom(blocks int32) error {
 	f := NewForest(RamForest, nil, "", 0)
 
@@ -221,7 +330,7 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 	fmt.Printf(f.ToString())
 	beforeTops := f.GetRoots()
 	for i, h := range beforeTops {
-		fmt.Printf("beforeTops %d %x\n", i, h)
+		fmt.Printf("beforeTops %d %s\n", i, h)
 	}
 
 	// ---------------- block 1
@@ -249,7 +358,7 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 	fmt.Print(ub.ToString())
 	afterTops := f.GetRoots()
 	for i, h := range afterTops {
-		fmt.Printf("afterTops %d %x\n", i, h)
+		fmt.Printf("afterTops %d %s\n", i, h)
 	}
 
 	err = f.Undo(*ub)
@@ -259,7 +368,7 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 
 	undoneTops := f.GetRoots()
 	for i, h := range undoneTops {
-		fmt.Printf("undoneTops %d %x\n", i, h)
+		fmt.Printf("undoneTops %d %s\n", i, h)
 	}
 	for h, p := range f.positionMap {
 		fmt.Printf("%x@%d ", h[:4], p)
@@ -0,0 +1,126 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+/*
+Since v28, bitcoind obfuscates the blk and rev files in its blocks dir by
+xoring them with a key it keeps in blocks/xor.dat.  The key is 8 bytes and
+the byte at position p in a file is xored with key[p%8].  Blocks dirs made
+before then, or with -blocksxor=0, have no xor.dat or an all zero key, and
+are read as they are.
+*/
+
+// xorKeyFile is where bitcoind keeps the blk and rev file key
+const xorKeyFile = "xor.dat"
+
+// readXorKey gives the key the blk and rev files in blockDir are xored
+// with, or nil if they aren't.
+func readXorKey(blockDir string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filepath.Join(blockDir, xorKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 8 {
+		return nil, fmt.Errorf("%s is %d bytes, expected 8",
+			filepath.Join(blockDir, xorKeyFile), len(key))
+	}
+	for _, b := range key {
+		if b != 0 {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// xorBytes undoes the obfuscation of data read from pos in a blk or rev
+// file.  A nil key does nothing.
+func xorBytes(data, key []byte, pos int64) {
+	if len(key) == 0 {
+		return
+	}
+	k := int(pos % int64(len(key)))
+	for i := range data {
+		data[i] ^= key[k]
+		k++
+		if k == len(key) {
+			k = 0
+		}
+	}
+}
+
+// xorReader reads a blk or rev file from the start, undoing the
+// obfuscation as it goes.
+type xorReader struct {
+	r   io.Reader
+	key []byte
+	pos int64
+}
+
+func (x *xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	xorBytes(p[:n], x.key, x.pos)
+	x.pos += int64(n)
+	return n, err
+}
+
+// knownNets are the networks a blk file's magic can be from
+var knownNets = []*chaincfg.Params{
+	&chaincfg.MainNetParams,
+	&chaincfg.TestNet3Params,
+	&chaincfg.SigNetParams,
+	&chaincfg.RegressionNetParams,
+}
+
+// netName gives the name of the network with the btcnet magic.
+func netName(btcnet wire.BitcoinNet) string {
+	for _, known := range knownNets {
+		if btcnet == known.Net {
+			return known.Name
+		}
+	}
+	return btcnet.String()
+}
+
+// checkBlockMagic checks the 4 magic bytes in front of a block in a blk
+// file are for the params' network.  All zeros is fine, and means the end
+// of the blocks in a file bitcoind made bigger ahead of time; end says when
+// that's so.
+func checkBlockMagic(magic []byte, params *chaincfg.Params, fileName string,
+	xored bool) (end bool, err error) {
+
+	read := wire.BitcoinNet(binary.LittleEndian.Uint32(magic))
+	if read == params.Net {
+		return false, nil
+	}
+	if read == 0 {
+		return true, nil
+	}
+	for _, known := range knownNets {
+		if read == known.Net {
+			return false, errWrongBlockMagic(fileName, fmt.Sprintf(
+				"the blocks are for %s but we're on %s. Check -net and "+
+					"-datadir", known.Name, params.Name))
+		}
+	}
+	if xored {
+		return false, errWrongBlockMagic(fileName, fmt.Sprintf(
+			"%x isn't from any network even after applying %s",
+			magic, xorKeyFile))
+	}
+	return false, errWrongBlockMagic(fileName, fmt.Sprintf(
+		"%x isn't from any network. If bitcoind obfuscated its block "+
+			"files, %s should be in the same dir", magic, xorKeyFile))
+}
@@ -0,0 +1,252 @@
+package bridgenode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// xorTestBlockFiles obfuscates the blk and rev files in dir the way
+// bitcoind does, and writes the key to xor.dat.
+func xorTestBlockFiles(t *testing.T, dir string, key []byte) {
+	for _, name := range []string{"blk00000.dat", "rev00000.dat"} {
+		fileName := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xorBytes(data, key, 0)
+		err = ioutil.WriteFile(fileName, data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, xorKeyFile), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Blocks read from obfuscated blk and rev files are the same as from plain
+// ones.
+func TestReadXoredBlockFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blkxor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 5
+	cfg := writeTestBlockFiles(t, dir, n, 2)
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	plainBlocks, plainRevs, err := getRawBlockBytes(
+		1, n, offsetFile, cfg.BlockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xorTestBlockFiles(t, dir, []byte{1, 2, 3, 4, 0xf0, 0xe0, 0xd0, 0xc0})
+	xorBlocks, xorRevs, err := getRawBlockBytes(1, n, offsetFile, cfg.BlockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range plainBlocks {
+		if !bytes.Equal(plainBlocks[i], xorBlocks[i]) {
+			t.Fatalf("block %d differs when xored", i+1)
+		}
+		if !bytes.Equal(plainRevs[i], xorRevs[i]) {
+			t.Fatalf("rev block %d differs when xored", i+1)
+		}
+		b, err := GetBlockBytesFromFile(int32(i)+1,
+			cfg.UtreeDir.OffsetDir.OffsetFile, cfg.BlockDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plainBlocks[i], b) {
+			t.Fatalf("GetBlockBytesFromFile block %d differs when xored", i+1)
+		}
+	}
+}
+
+// Indexing an obfuscated blk file finds every block, and without xor.dat,
+// or on the wrong network, gives an error saying what's wrong.
+func TestReadXoredHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blkxor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 4
+	cfg := writeTestBlockFiles(t, dir, n, 1)
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, _, err := GetRawBlocksFromDisk(1, n, offsetFile, cfg.BlockDir)
+	offsetFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufMap := make(map[[32]byte]uint32)
+	for i := range blocks {
+		bufMap[blocks[i].BlockHash()] = uint32(i)
+	}
+
+	// bitcoind makes blk files bigger ahead of time, so there are zeros
+	// after the last block
+	blkFile := filepath.Join(dir, "blk00000.dat")
+	blkData, err := ioutil.ReadFile(blkFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(blkFile, append(blkData, make([]byte, 100)...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte{0x55, 0, 0xaa, 0x01, 0x02, 0x03, 0x04, 0x05}
+	xorTestBlockFiles(t, dir, key)
+
+	bufReader := bufio.NewReader(nil)
+	headers, err := readRawHeadersFromFile(bufReader, blkFile, 0, bufMap,
+		key, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != n {
+		t.Fatalf("read %d headers, expected %d", len(headers), n)
+	}
+	for i, h := range headers {
+		if h.CurrentHeaderHash != blocks[i].BlockHash() {
+			t.Fatalf("header %d hash %x, expected %s",
+				i, h.CurrentHeaderHash, blocks[i].BlockHash())
+		}
+	}
+
+	// the key from xor.dat
+	readKey, err := readXorKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readKey, key) {
+		t.Fatalf("read key %x, expected %x", readKey, key)
+	}
+
+	// no key
+	_, err = readRawHeadersFromFile(bufReader, blkFile, 0, bufMap,
+		nil, &chaincfg.RegressionNetParams)
+	if !errors.Is(err, ErrWrongBlockMagic) {
+		t.Fatalf("got error %v without the key, expected %s",
+			err, ErrWrongBlockMagic)
+	}
+	if !strings.Contains(err.Error(), xorKeyFile) {
+		t.Fatalf("error without the key doesn't mention %s: %s",
+			xorKeyFile, err.Error())
+	}
+
+	// wrong network
+	_, err = readRawHeadersFromFile(bufReader, blkFile, 0, bufMap,
+		key, &chaincfg.MainNetParams)
+	if !errors.Is(err, ErrWrongBlockMagic) {
+		t.Fatalf("got error %v on mainnet, expected %s",
+			err, ErrWrongBlockMagic)
+	}
+	if !strings.Contains(err.Error(), chaincfg.RegressionNetParams.Name) {
+		t.Fatalf("error on mainnet doesn't say the blocks are regtest: %s",
+			err.Error())
+	}
+}
+
+// An all zero key is the same as no xor.dat.
+func TestReadZeroXorKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blkxor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := readXorKey(dir)
+	if err != nil || key != nil {
+		t.Fatalf("got key %x error %v with no xor.dat", key, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFile), make([]byte, 8), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = readXorKey(dir)
+	if err != nil || key != nil {
+		t.Fatalf("got key %x error %v with a zero key", key, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFile), make([]byte, 3), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readXorKey(dir)
+	if err == nil {
+		t.Fatal("expected error with a 3 byte key")
+	}
+}
+
+// Plain blk files are read on their own network, and on any other the error
+// says which network they're for.
+func TestReadHeadersNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blknet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const n = 3
+	cfg := writeTestBlockFiles(t, dir, n, 1)
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, _, err := GetRawBlocksFromDisk(1, n, offsetFile, cfg.BlockDir)
+	offsetFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufMap := make(map[[32]byte]uint32)
+	for i := range blocks {
+		bufMap[blocks[i].BlockHash()] = uint32(i)
+	}
+
+	blkFile := filepath.Join(dir, "blk00000.dat")
+	bufReader := bufio.NewReader(nil)
+	headers, err := readRawHeadersFromFile(bufReader, blkFile, 0, bufMap,
+		nil, &chaincfg.RegressionNetParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != n {
+		t.Fatalf("read %d headers on regtest, expected %d", len(headers), n)
+	}
+
+	for _, params := range []*chaincfg.Params{&chaincfg.MainNetParams,
+		&chaincfg.TestNet3Params, &chaincfg.SigNetParams} {
+
+		_, err = readRawHeadersFromFile(bufReader, blkFile, 0, bufMap,
+			nil, params)
+		if !errors.Is(err, ErrWrongBlockMagic) {
+			t.Fatalf("got error %v on %s, expected %s",
+				err, params.Name, ErrWrongBlockMagic)
+		}
+		if !strings.Contains(err.Error(), "for regtest but we're on "+
+			params.Name) {
+			t.Fatalf("error on %s doesn't say the blocks are regtest: %s",
+				params.Name, err.Error())
+		}
+	}
+}
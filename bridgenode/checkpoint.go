@@ -0,0 +1,483 @@
+package bridgenode
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+A checkpoint is the bridge node's state in a tar stream, so it can be copied
+to another machine instead of building it all again there.  The first member
+is manifestName, which says what height the state is at, the forest
+commitment, and the size and sha256 of every other member.  The rest are the
+files in the bridge dir, named relative to it: the forest (forestfile.dat, or
+the cow dir for a cow forest), the misc forest file and height file, the
+offset files, and the proof, ttl and undo data that go with that height.
+
+The offset files point into the blk and rev files of the machine the state
+came from.  If the other machine's bitcoind has its blocks in different
+files, delete offsetdata after importing and they'll be made again.
+*/
+
+// checkpointVersion is the manifest version ExportState writes
+const checkpointVersion = 1
+
+// manifestName is the first member of a checkpoint
+const manifestName = "manifest.json"
+
+// checkpointManifest describes what's in a checkpoint
+type checkpointManifest struct {
+	Version int `json:"version"`
+
+	// Height is the last block in the forest
+	Height int32 `json:"height"`
+
+	// OffsetHeight is the last block in the offset file, 0 without one
+	OffsetHeight int32 `json:"offsetHeight"`
+
+	// Cow is true if the forest is a cow forest
+	Cow bool `json:"cow"`
+
+	NumLeaves uint64 `json:"numLeaves"`
+
+	// Commitment is forestCommitment of the forest, in hex
+	Commitment string `json:"commitment"`
+
+	Members []checkpointMember `json:"members"`
+}
+
+// checkpointMember is one file in a checkpoint
+type checkpointMember struct {
+	// Name is the path relative to the bridge dir, with / between dirs
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// forestCommitment is a hash of the number of leaves and all the roots,
+// which two forests only share if they hold the same leaves.
+func forestCommitment(forest *accumulator.Forest) accumulator.Hash {
+	h := sha256.New()
+	numLeaves, _ := forest.ReconstructStats()
+	binary.Write(h, binary.BigEndian, numLeaves)
+	for _, root := range forest.GetRoots() {
+		h.Write(root[:])
+	}
+	var commitment accumulator.Hash
+	copy(commitment[:], h.Sum(nil))
+	return commitment
+}
+
+// stateDirs are the dirs in the bridge dir that make up its state
+func stateDirs(dir utreeDir) []string {
+	return []string{dir.ForestDir.base, dir.OffsetDir.base, dir.ProofDir.base,
+		dir.TtlDir.base, dir.UndoDir.base, dir.NetDir.base}
+}
+
+// stateBase gives the bridge dir all of dir's paths are in.
+func stateBase(dir utreeDir) string {
+	return filepath.Dir(dir.ForestDir.base)
+}
+
+// stateFiles gives every file that makes up the state in dir, relative to
+// the bridge dir.  Only the forest files for forestType are included.
+func stateFiles(dir utreeDir, forestType forestType) ([]string, error) {
+	base := stateBase(dir)
+	var names []string
+	for _, stateDir := range stateDirs(dir) {
+		err := filepath.Walk(stateDir,
+			func(name string, info os.FileInfo, err error) error {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if !info.Mode().IsRegular() {
+					return nil
+				}
+				// a stale forest of the other kind isn't needed
+				inCow := strings.HasPrefix(name,
+					dir.ForestDir.cowForestDir+string(filepath.Separator))
+				if inCow != (forestType == cowForest) &&
+					(inCow || name == dir.ForestDir.forestFile) {
+					return nil
+				}
+				rel, err := filepath.Rel(base, name)
+				if err != nil {
+					return err
+				}
+				names = append(names, filepath.ToSlash(rel))
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// hashFile gives the size and sha256 of a file.
+func hashFile(name string) (int64, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ExportState writes the bridge node's state to w as a checkpoint that
+// ImportState can read.  Nothing else can be using the bridge dir while it
+// runs.
+func ExportState(cfg *Config, w io.Writer) error {
+	if !checkForestExists(cfg) {
+		return fmt.Errorf("ExportState: no forest in %s to export",
+			cfg.UtreeDir.ForestDir.base)
+	}
+	height, err := restoreHeight(cfg)
+	if err != nil {
+		return fmt.Errorf("ExportState: %w", err)
+	}
+	forest, err := restoreForestReadOnly(cfg)
+	if err != nil {
+		return fmt.Errorf("ExportState: restoreForest %w", err)
+	}
+	numLeaves, _ := forest.ReconstructStats()
+	commitment := forestCommitment(forest)
+	err = forest.Close()
+	if err != nil {
+		return fmt.Errorf("ExportState: %w", err)
+	}
+
+	manifest := checkpointManifest{
+		Version:    checkpointVersion,
+		Height:     height,
+		Cow:        cfg.forestType == cowForest,
+		NumLeaves:  numLeaves,
+		Commitment: hex.EncodeToString(commitment[:]),
+	}
+	offsetHeight, err := ioutil.ReadFile(
+		cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile)
+	if err == nil && len(offsetHeight) >= 4 {
+		manifest.OffsetHeight = int32(binary.BigEndian.Uint32(offsetHeight))
+	}
+
+	base := stateBase(cfg.UtreeDir)
+	names, err := stateFiles(cfg.UtreeDir, cfg.forestType)
+	if err != nil {
+		return fmt.Errorf("ExportState: %w", err)
+	}
+	for _, name := range names {
+		size, sum, err := hashFile(filepath.Join(base, filepath.FromSlash(name)))
+		if err != nil {
+			return fmt.Errorf("ExportState: %w", err)
+		}
+		manifest.Members = append(manifest.Members,
+			checkpointMember{Name: name, Size: size, SHA256: sum})
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return fmt.Errorf("ExportState: %w", err)
+	}
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{
+		Name: manifestName, Mode: 0600, Size: int64(len(manifestBytes))})
+	if err != nil {
+		return fmt.Errorf("ExportState: %w", err)
+	}
+	_, err = tw.Write(manifestBytes)
+	if err != nil {
+		return fmt.Errorf("ExportState: %w", err)
+	}
+	for _, member := range manifest.Members {
+		err = writeMember(tw, base, member)
+		if err != nil {
+			return fmt.Errorf("ExportState: %w", err)
+		}
+	}
+	return tw.Close()
+}
+
+// writeMember copies a file in the bridge dir to tw, and makes sure it's
+// still what the manifest says.
+func writeMember(tw *tar.Writer, base string, member checkpointMember) error {
+	f, err := os.Open(filepath.Join(base, filepath.FromSlash(member.Name)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name: member.Name, Mode: 0600, Size: member.Size})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tw, h), f, member.Size)
+	if err != nil {
+		return fmt.Errorf("%s changed while exporting: %w", member.Name, err)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != member.SHA256 {
+		return fmt.Errorf("%s changed while exporting", member.Name)
+	}
+	return nil
+}
+
+// ImportState replaces the bridge node's state with the checkpoint in r.
+// Every member is checked against the manifest and the forest against the
+// commitment before anything in the bridge dir is touched.  A local state
+// at a greater height than the checkpoint's is left alone, and so is the
+// local state if replacing it fails partway.
+func ImportState(cfg *Config, r io.Reader) error {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil {
+		return errBadCheckpoint(fmt.Sprintf("can't read manifest: %s", err))
+	}
+	if hdr.Name != manifestName {
+		return errBadCheckpoint(fmt.Sprintf(
+			"starts with %s instead of %s", hdr.Name, manifestName))
+	}
+	var manifest checkpointManifest
+	err = json.NewDecoder(tr).Decode(&manifest)
+	if err != nil {
+		return errBadCheckpoint(fmt.Sprintf("bad manifest: %s", err))
+	}
+	if manifest.Version != checkpointVersion {
+		return errBadCheckpoint(fmt.Sprintf(
+			"manifest version %d, expected %d",
+			manifest.Version, checkpointVersion))
+	}
+	if manifest.Cow != (cfg.forestType == cowForest) {
+		return errBadCheckpoint(
+			"cow forest checkpoints only go with -forest cow and the rest " +
+				"only with other forest types")
+	}
+
+	localHeight, err := restoreHeight(cfg)
+	if err == nil && localHeight > manifest.Height {
+		return errNewerLocalState(localHeight, manifest.Height)
+	}
+
+	base := stateBase(cfg.UtreeDir)
+	err = os.MkdirAll(base, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	// unpacked next to the state so it can be moved in without copying
+	staging, err := ioutil.TempDir(base, "import")
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	err = unpackMembers(tr, staging, manifest.Members)
+	if err != nil {
+		return err
+	}
+
+	stagedCfg := *cfg
+	stagedCfg.UtreeDir = initUtreeDir(staging)
+	stagedCfg.cowMaintain = false
+	err = makePaths(stagedCfg.UtreeDir)
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	err = checkStagedForest(&stagedCfg, manifest)
+	if err != nil {
+		return err
+	}
+
+	aside, err := ioutil.TempDir(base, "replaced")
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	defer os.RemoveAll(aside)
+	err = replaceStateDirs(
+		stateDirs(cfg.UtreeDir), stateDirs(stagedCfg.UtreeDir), aside)
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	return nil
+}
+
+// replaceStateDirs moves every staged dir to the state dir with the same
+// index.  The state dirs all get moved into aside first, and if anything
+// fails they go back to how they were.
+func replaceStateDirs(dirs, staged []string, aside string) (err error) {
+	// asideDirs has where each state dir went, or "" if it wasn't there
+	var asideDirs []string
+	var movedIn int
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := movedIn - 1; i >= 0; i-- {
+			undoErr := os.Rename(dirs[i], staged[i])
+			if undoErr != nil {
+				err = fmt.Errorf("%s, then moving %s back: %s",
+					err.Error(), dirs[i], undoErr.Error())
+				return
+			}
+		}
+		for i, asideDir := range asideDirs {
+			if asideDir == "" {
+				continue
+			}
+			undoErr := os.Rename(asideDir, dirs[i])
+			if undoErr != nil {
+				err = fmt.Errorf("%s, then putting back %s from %s: %s",
+					err.Error(), dirs[i], asideDir, undoErr.Error())
+				return
+			}
+		}
+	}()
+
+	for i, dir := range dirs {
+		asideDir := filepath.Join(aside, strconv.Itoa(i))
+		err = os.Rename(dir, asideDir)
+		if os.IsNotExist(err) {
+			asideDir, err = "", nil
+		}
+		if err != nil {
+			return err
+		}
+		asideDirs = append(asideDirs, asideDir)
+	}
+	for i, dir := range dirs {
+		err = os.Rename(staged[i], dir)
+		if err != nil {
+			return err
+		}
+		movedIn++
+	}
+	return nil
+}
+
+// unpackMembers writes every member in tr to dir, and checks they're all
+// there and match the manifest.
+func unpackMembers(tr *tar.Reader, dir string,
+	members []checkpointMember) error {
+
+	want := make(map[string]checkpointMember, len(members))
+	for _, member := range members {
+		want[member.Name] = member
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errBadCheckpoint(err.Error())
+		}
+		member, ok := want[hdr.Name]
+		if !ok {
+			return errBadCheckpoint(fmt.Sprintf(
+				"%s isn't in the manifest", hdr.Name))
+		}
+		delete(want, hdr.Name)
+		if hdr.Size != member.Size {
+			return errBadCheckpoint(fmt.Sprintf(
+				"%s is %d bytes, manifest says %d",
+				hdr.Name, hdr.Size, member.Size))
+		}
+		err = unpackMember(tr, dir, member)
+		if err != nil {
+			return err
+		}
+	}
+	for name := range want {
+		return errBadCheckpoint(fmt.Sprintf("%s is missing", name))
+	}
+	return nil
+}
+
+// unpackMember writes the current member in tr to dir.
+func unpackMember(tr *tar.Reader, dir string, member checkpointMember) error {
+	clean := path.Clean(member.Name)
+	if clean != member.Name || path.IsAbs(clean) ||
+		clean == ".." || strings.HasPrefix(clean, "../") {
+		return errBadCheckpoint(fmt.Sprintf(
+			"%s is outside the bridge dir", member.Name))
+	}
+	name := filepath.Join(dir, filepath.FromSlash(clean))
+	err := os.MkdirAll(filepath.Dir(name), os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), tr)
+	if err != nil {
+		return errBadCheckpoint(fmt.Sprintf("%s: %s", member.Name, err))
+	}
+	if hex.EncodeToString(h.Sum(nil)) != member.SHA256 {
+		return errBadCheckpoint(fmt.Sprintf(
+			"%s doesn't match its sha256", member.Name))
+	}
+	return f.Sync()
+}
+
+// checkStagedForest restores the unpacked forest and makes sure it's the
+// one the manifest is for.
+func checkStagedForest(cfg *Config, manifest checkpointManifest) error {
+	if !checkForestExists(cfg) {
+		return errBadCheckpoint("no forest in it")
+	}
+	height, err := restoreHeight(cfg)
+	if err != nil {
+		return errBadCheckpoint(err.Error())
+	}
+	if height != manifest.Height {
+		return errBadCheckpoint(fmt.Sprintf(
+			"forest at height %d, manifest says %d", height, manifest.Height))
+	}
+	if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) &&
+		manifest.OffsetHeight < height {
+		return errBadCheckpoint(fmt.Sprintf(
+			"offsets only go to block %d but the forest is at %d",
+			manifest.OffsetHeight, height))
+	}
+	forest, err := restoreForestReadOnly(cfg)
+	if err != nil {
+		return errBadCheckpoint(fmt.Sprintf("restoreForest %s", err))
+	}
+	commitment := forestCommitment(forest)
+	err = forest.Close()
+	if err != nil {
+		return fmt.Errorf("ImportState: %w", err)
+	}
+	if hex.EncodeToString(commitment[:]) != manifest.Commitment {
+		return errBadCheckpoint(fmt.Sprintf(
+			"forest commitment %s, manifest says %s",
+			commitment, manifest.Commitment))
+	}
+	return nil
+}
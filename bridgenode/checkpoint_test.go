@@ -0,0 +1,187 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A checkpoint imported on another bridge dir gives the same forest and
+// proofs, and a bad or older one leaves the local state alone.
+func TestExportImportState(t *testing.T) {
+	const numBlocks = 20
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, filepath.Join(dir, "from"), numBlocks)
+
+	var checkpoint bytes.Buffer
+	err = ExportState(cfg, &checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cache forest reads the same file, and leaves it as it was
+	cacheCfg := *cfg
+	cacheCfg.forestType = cacheForest
+	var fromCache bytes.Buffer
+	err = ExportState(&cacheCfg, &fromCache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromCache.Bytes(), checkpoint.Bytes()) {
+		t.Fatal("checkpoint exported as a cache forest differs")
+	}
+
+	toCfg := *cfg
+	toCfg.UtreeDir = initUtreeDir(filepath.Join(dir, "to"))
+	err = ImportState(&toCfg, bytes.NewReader(checkpoint.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, err := restoreHeight(&toCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != numBlocks {
+		t.Fatalf("imported height %d, expected %d", height, numBlocks)
+	}
+	fromForest, err := restoreForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toForest, err := restoreForest(&toCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forestCommitment(fromForest) != forestCommitment(toForest) {
+		t.Fatal("imported forest differs")
+	}
+	for h := int32(1); h <= numBlocks; h++ {
+		fromProof, err := GetUDataBytesFromFile(cfg.UtreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		toProof, err := GetUDataBytesFromFile(toCfg.UtreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatalf("h %d %s", h, err.Error())
+		}
+		if !bytes.Equal(fromProof, toProof) {
+			t.Fatalf("imported proof for block %d differs", h)
+		}
+	}
+
+	// a flipped byte in the forest file
+	corrupt := append([]byte{}, checkpoint.Bytes()...)
+	at := bytes.Index(corrupt, []byte("forestdata/forestfile.dat\x00"))
+	if at < 0 {
+		t.Fatal("no forest file in the checkpoint")
+	}
+	// the data starts at the next 512 byte block after the header
+	corrupt[at+512+10] ^= 1
+	err = ImportState(&toCfg, bytes.NewReader(corrupt))
+	if !errors.Is(err, ErrBadCheckpoint) {
+		t.Fatalf("got error %v importing a corrupt checkpoint, expected %s",
+			err, ErrBadCheckpoint)
+	}
+
+	// local state further along than the checkpoint
+	var newer [4]byte
+	binary.BigEndian.PutUint32(newer[:], numBlocks+1)
+	err = ioutil.WriteFile(toCfg.UtreeDir.ForestDir.forestLastSyncedBlockHeightFile,
+		newer[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ImportState(&toCfg, bytes.NewReader(checkpoint.Bytes()))
+	if !errors.Is(err, ErrNewerLocalState) {
+		t.Fatalf("got error %v importing over a newer state, expected %s",
+			err, ErrNewerLocalState)
+	}
+	height, err = restoreHeight(&toCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != numBlocks+1 {
+		t.Fatalf("newer local state was overwritten, at height %d", height)
+	}
+}
+
+// A staged dir that can't be moved in leaves the state dirs as they were.
+func TestReplaceStateDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replacestate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var dirs, staged []string
+	for _, name := range []string{"a", "b", "c"} {
+		dirs = append(dirs, filepath.Join(dir, name))
+		staged = append(staged, filepath.Join(dir, "staged", name))
+	}
+	for i := range dirs {
+		// c isn't there yet, and there's no staged b
+		if i != 2 {
+			writeDirFile(t, dirs[i], "old "+dirs[i])
+		}
+		if i != 1 {
+			writeDirFile(t, staged[i], "new "+dirs[i])
+		}
+	}
+	aside := filepath.Join(dir, "aside")
+	err = os.Mkdir(aside, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = replaceStateDirs(dirs, staged, aside)
+	if err == nil {
+		t.Fatal("replaced state dirs without a staged b")
+	}
+	for i := range dirs {
+		b, err := ioutil.ReadFile(filepath.Join(dirs[i], "file"))
+		if i == 2 {
+			if !os.IsNotExist(err) {
+				t.Fatalf("c is there after the failure, error %v", err)
+			}
+			continue
+		}
+		if err != nil || string(b) != "old "+dirs[i] {
+			t.Fatalf("%s has %q, error %v after the failure", dirs[i], b, err)
+		}
+	}
+	if _, err = os.Stat(staged[0]); err != nil {
+		t.Fatalf("staged a didn't go back: %s", err)
+	}
+
+	writeDirFile(t, staged[1], "new "+dirs[1])
+	err = replaceStateDirs(dirs, staged, aside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range dirs {
+		b, err := ioutil.ReadFile(filepath.Join(dirs[i], "file"))
+		if err != nil || string(b) != "new "+dirs[i] {
+			t.Fatalf("%s has %q, error %v", dirs[i], b, err)
+		}
+	}
+}
+
+// writeDirFile makes dir with a file in it holding s.
+func writeDirFile(t *testing.T, dir, s string) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte(s), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
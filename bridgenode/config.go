@@ -1,13 +1,19 @@
 package bridgenode
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"golang.org/x/time/rate"
 )
 
 var HelpMsg = `
@@ -23,6 +29,15 @@ OPTIONS:
   -net=signet                 configure whether to use signet. Optional.
   -forest                      select forest type to use (ram, cow, cache, disk). Defaults to disk
 
+  -cowmaintain                 check the copy-on-write forest's files on
+                               startup and remove the ones it doesn't use
+
+  -cacherows=20                how many rows of leaves the cache forest keeps
+                               in memory. Defaults to 20 (about 64MB)
+  -cacheflush=0                write the cache forest's cache to disk every
+                               this many thousand hashes written to it, so
+                               less is lost in a crash. 0 for only on exit
+
   -datadir="path/to/directory" set a custom DATADIR.
                                Defaults to the Bitcoin Core DATADIR path
   -datadir="path/to/directory" set a custom DATADIR.
@@ -31,6 +46,37 @@ OPTIONS:
   -cpuprof                     configure whether to use use cpu profiling
   -memprof                     configure whether to use use heap profiling
   -serve		       immediately serve whatever data is built
+  -ttldb=flat                  where to look up created txos for TTLs.
+                               flat is a sorted txid file, ram keeps the
+                               unspent txos in memory with a log on disk.
+                               An existing txid file is converted to ram.
+                               Defaults to flat
+  -ratelimit=1                 how many new connections per second the server
+                               takes from each IP. 0 for no limit
+  -burst=10                    how many connections an IP can make at once
+                               before -ratelimit applies
+  -prefetch=4                  how many blocks to read from disk ahead of
+                               the one being sent to each client
+  -paranoid                    check every proof against its block before
+                               serving it
+  -proxyprotocol               read a PROXY protocol header at the start of
+                               each connection for the client's address.
+                               Only for when the server is behind a proxy
+  -proofmagic=aaffaafe         4 bytes of hex that start every block in the
+                               proof file. Private networks can set their own
+  -maxproofsize=16777216       how many bytes a block's proof can be before
+                               the proof file is taken as corrupt
+  -parseworkers                how many goroutines parse blocks and hash
+                               leaves while building proofs.
+                               Defaults to the number of CPUs minus 1
+  -peer=host:port              download blocks from this bitcoin node instead
+                               of reading blk*.dat and rev*.dat files.
+                               Blocks are kept in netblocks/ in the bridgedir
+  -auditevery=0                check every hash in the forest every this many
+                               thousand blocks while building proofs.
+                               0 for never
+  -syncproofs=true             fsync the proof files when done building
+                               proofs. -syncproofs=false to skip it
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -49,12 +95,44 @@ var (
 		`quit generating proofs after the given block height. (meant for testing)`)
 	cowMaxCache = argCmd.Int("cowmaxcache", 4000,
 		`how much memory to use in MB for the copy-on-write forest`)
+	cowMaintainCmd = argCmd.Bool("cowmaintain", false,
+		`check the copy-on-write forest on startup and remove files it doesn't use`)
+	cacheRowsCmd = argCmd.Int("cacherows", accumulator.DefaultCacheRows,
+		`how many rows of leaves to keep in memory for the cache forest`)
+	cacheFlushCmd = argCmd.Int("cacheflush", 0,
+		`write the cache forest's cache to disk every this many thousand hashes written to it. 0 for only on exit`)
 	memTTL = argCmd.Bool("memttl", false,
 		`keep the ttls in memory instead of on disk. Uses lots of ram.`)
+	ttlDBCmd = argCmd.String("ttldb", "flat",
+		`Set where to look up txo positions for TTLs (flat, ram). Usage: "-ttldb=ram"`)
 	serve = argCmd.Bool("serve", false,
 		`immediately start server without building or checking proof data`)
 	noServeCmd = argCmd.Bool("noserve", false,
 		`don't serve proofs after finishing generating them`)
+	rateLimitCmd = argCmd.Float64("ratelimit", 1,
+		`how many new connections per second to allow from each IP. 0 for no limit`)
+	burstCmd = argCmd.Int("burst", 10,
+		`how many connections an IP can make at once before -ratelimit applies`)
+	prefetchCmd = argCmd.Int("prefetch", defaultPrefetchWindow,
+		`how many blocks to read from disk ahead of the one being sent to each client`)
+	proofCacheCmd = argCmd.Uint64("proofcache", 64,
+		`how much memory to use in MB for keeping recently served proofs. 0 for none`)
+	paranoidCmd = argCmd.Bool("paranoid", false,
+		`check every proof against its block before serving it`)
+	proxyProtocolCmd = argCmd.Bool("proxyprotocol", false,
+		`read a PROXY protocol v1 or v2 header at the start of every connection. Only use behind a proxy that sends one`)
+	parseWorkersCmd = argCmd.Int("parseworkers", runtime.NumCPU()-1,
+		`how many goroutines parse blocks and hash leaves while building proofs`)
+	auditEveryCmd = argCmd.Int("auditevery", 0,
+		`audit the forest every this many thousand blocks while building proofs. 0 for never`)
+	syncProofsCmd = argCmd.Bool("syncproofs", true,
+		`fsync the proof files when done building proofs, so they survive a power cut. Usage: "-syncproofs=false" to skip it`)
+	peerCmd = argCmd.String("peer", "",
+		`download blocks from the bitcoin node at this address instead of reading blk and rev files. Usage: "-peer=127.0.0.1:18444"`)
+	proofMagicCmd = argCmd.String("proofmagic", "",
+		`4 bytes of hex to start every block in the proof file with, for private networks. Usage: "-proofmagic=0a0b0c0d"`)
+	maxProofSizeCmd = argCmd.Uint("maxproofsize", defaultMaxProofSize,
+		`how many bytes a block's proof can be before the proof file is taken as corrupt`)
 	traceCmd = argCmd.String("trace", "",
 		`Enable trace. Usage: 'trace='path/to/file'`)
 	cpuProfCmd = argCmd.String("cpuprof", "",
@@ -82,6 +160,21 @@ type proofDir struct {
 	pFile       string
 	pOffsetFile string
 	lastPOffset string
+
+	// ProofMagic starts every block in the proof file
+	ProofMagic [4]byte
+
+	// MaxProofSize is the biggest a block's proof can be before it's taken
+	// as corrupt.  0 means defaultMaxProofSize.
+	MaxProofSize uint32
+}
+
+// maxSize gives MaxProofSize, or the default if it isn't set.
+func (pd proofDir) maxSize() int64 {
+	if pd.MaxProofSize == 0 {
+		return defaultMaxProofSize
+	}
+	return int64(pd.MaxProofSize)
 }
 
 type offsetDir struct {
@@ -95,10 +188,25 @@ type undoDir struct {
 	undoFile   string
 	offsetFile string
 }
+
+// netDir is where blocks downloaded from -peer are kept
+type netDir struct {
+	base        string
+	headerFile  string
+	blockFile   string
+	offsetFile  string
+	bigLeafFile string
+}
+
 type ttlDir struct {
-	base       string
-	ttlsetFile string
-	OffsetFile string
+	base           string
+	ttlsetFile     string
+	OffsetFile     string
+	txidFile       string
+	txidOffsetFile string
+	mapSnapFile    string
+	mapLogFile     string
+	versionFile    string
 }
 
 // All your utreexo bridgenode file paths in a nice and convinent struct
@@ -108,6 +216,7 @@ type utreeDir struct {
 	ForestDir forestDir
 	TtlDir    ttlDir
 	UndoDir   undoDir
+	NetDir    netDir
 }
 
 // init an utreeDir with a selected basepath. Has all the names for the forest
@@ -126,6 +235,7 @@ func initUtreeDir(basePath string) utreeDir {
 		pFile:       filepath.Join(proofBase, "proof.dat"),
 		pOffsetFile: filepath.Join(proofBase, "proofoffset.dat"),
 		lastPOffset: filepath.Join(proofBase, "lastproofoffset.dat"),
+		ProofMagic:  proofMagic,
 	}
 
 	forestBase := filepath.Join(basePath, "forestdata")
@@ -141,9 +251,14 @@ func initUtreeDir(basePath string) utreeDir {
 	}
 	ttlBase := filepath.Join(basePath, "ttldata")
 	ttl := ttlDir{
-		base:       ttlBase,
-		ttlsetFile: filepath.Join(ttlBase, "ttldata.dat"),
-		OffsetFile: filepath.Join(ttlBase, "offsetfile.dat"),
+		base:           ttlBase,
+		ttlsetFile:     filepath.Join(ttlBase, "ttldata.dat"),
+		OffsetFile:     filepath.Join(ttlBase, "offsetfile.dat"),
+		txidFile:       filepath.Join(ttlBase, "txidFile"),
+		txidOffsetFile: filepath.Join(ttlBase, "txidOffsetFile"),
+		mapSnapFile:    filepath.Join(ttlBase, "ttlmap.dat"),
+		mapLogFile:     filepath.Join(ttlBase, "ttlmaplog.dat"),
+		versionFile:    filepath.Join(ttlBase, "ttlversion.dat"),
 	}
 	undoBase := filepath.Join(basePath, "undoblockdata")
 	undo := undoDir{
@@ -151,6 +266,14 @@ func initUtreeDir(basePath string) utreeDir {
 		undoFile:   filepath.Join(undoBase, "undo.dat"),
 		offsetFile: filepath.Join(undoBase, "offset.dat"),
 	}
+	netBase := filepath.Join(basePath, "netblocks")
+	netBlocks := netDir{
+		base:        netBase,
+		headerFile:  filepath.Join(netBase, "headers.dat"),
+		blockFile:   filepath.Join(netBase, "blocks.dat"),
+		offsetFile:  filepath.Join(netBase, "offset.dat"),
+		bigLeafFile: filepath.Join(netBase, "bigleaves.dat"),
+	}
 
 	return utreeDir{
 		OffsetDir: off,
@@ -158,6 +281,7 @@ func initUtreeDir(basePath string) utreeDir {
 		ForestDir: forest,
 		TtlDir:    ttl,
 		UndoDir:   undo,
+		NetDir:    netBlocks,
 	}
 }
 
@@ -181,15 +305,19 @@ func makePaths(dir utreeDir) error {
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.UndoDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
+	}
+	err = os.MkdirAll(dir.NetDir.base, os.ModePerm)
+	if err != nil {
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	return nil
 }
@@ -220,9 +348,22 @@ type Config struct {
 	// the block path from bitcoind's datadir we'll be directly reading from
 	BlockDir string
 
+	// host:port of a bitcoin node to download blocks from.  When set,
+	// BlockDir isn't used.
+	peerAddr string
+
 	// where will the bridgenode data be saved to?
 	UtreeDir utreeDir
 
+	// ProofMagic starts every block in the proof file.  Private networks
+	// can use their own so their proofs can't be mixed up with anyone
+	// else's.  Defaults to aaffaafe
+	ProofMagic [4]byte
+
+	// MaxProofSize is the biggest a block's proof in the proof file can be
+	// before it's taken as corrupt.  Defaults to 16MB
+	MaxProofSize uint32
+
 	// type of the forest we're using
 	forestType forestType
 
@@ -232,8 +373,18 @@ type Config struct {
 	// how much cache to allow for cowforest
 	cowMaxCache int
 
-	// keep ttls in memory
-	memTTL bool
+	// how many hashes the cacheforest writes to its cache between
+	// flushes to disk.  0 only flushes on resize and exit.
+	cacheFlushEvery int
+
+	// check and compact the cowforest when restoring it
+	cowMaintain bool
+
+	// how many rows of leaves the cacheforest keeps in memory
+	cacheRows int
+
+	// where the TTL workers look up the position of spent txos
+	ttlDBType ttlDBType
 
 	// just immidiately start serving what you have on disk
 	serve bool
@@ -241,6 +392,44 @@ type Config struct {
 	// don't serve after generating proofs
 	noServe bool
 
+	// fsync the proof files once BuildProofs is done writing them
+	syncProofs bool
+
+	// check that the udata matches the block before serving it
+	paranoid bool
+
+	// every connection comes from a proxy and starts with a PROXY header
+	proxyProtocol bool
+
+	// RateLimit is how many new connections per second the server takes
+	// from each IP, with up to Burst at once.  0 means no limit.
+	RateLimit rate.Limit
+	Burst     int
+
+	// PrefetchWindow is how many blocks each connection to the server
+	// reads from disk ahead of the one it's sending.  0 means 4.
+	PrefetchWindow int
+
+	// ProofCacheSize is how many bytes of recently served proofs the
+	// server keeps in memory for all connections.  0 means none are kept.
+	ProofCacheSize uint64
+
+	// ServerLog is where the server logs what it does for each
+	// connection.  nil means stdout.
+	ServerLog *log.Logger
+
+	// how many goroutines parse blocks and hash leaves for BuildProofs
+	parseWorkers int
+
+	// run forest.Audit every this many blocks in BuildProofs. 0 for never
+	auditEvery int32
+
+	// ProgressCallback hears how far BuildProofs has gotten about every
+	// ProgressInterval blocks (1000 if it's 0).  Without one, BuildProofs
+	// prints a line every 1000 blocks.
+	ProgressCallback ProgressFunc
+	ProgressInterval int32
+
 	// enable tracing
 	TraceProf string
 
@@ -312,21 +501,59 @@ func Parse(args []string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	cfg.ProofMagic = proofMagic
+	if *proofMagicCmd != "" {
+		magic, err := hex.DecodeString(*proofMagicCmd)
+		if err != nil || len(magic) != 4 {
+			return nil, errInvalidProofMagic(*proofMagicCmd)
+		}
+		copy(cfg.ProofMagic[:], magic)
+		// old proofs are recognized by the v1 magic
+		if cfg.ProofMagic == proofMagicV1 {
+			return nil, errInvalidProofMagic(*proofMagicCmd)
+		}
+	}
+	cfg.UtreeDir.ProofDir.ProofMagic = cfg.ProofMagic
+	// sizes are 4 bytes in the proof file so they can't go past that anyway
+	cfg.MaxProofSize = math.MaxUint32
+	if *maxProofSizeCmd < math.MaxUint32 {
+		cfg.MaxProofSize = uint32(*maxProofSizeCmd)
+	}
+	cfg.UtreeDir.ProofDir.MaxProofSize = cfg.MaxProofSize
 	// set profiling
 	cfg.CpuProf = *cpuProfCmd
 	cfg.MemProf = *memProfCmd
 	cfg.TraceProf = *traceCmd
 	cfg.ProfServer = *profServerCmd
-	cfg.memTTL = *memTTL
+
+	switch *ttlDBCmd {
+	case "flat":
+		cfg.ttlDBType = flatTTLDB
+	case "ram":
+		cfg.ttlDBType = ramTTLDB
+	default:
+		return nil, errWrongTTLDBType(*ttlDBCmd)
+	}
+	// -memttl is the old way of asking for the ram TTL db
+	if *memTTL {
+		cfg.ttlDBType = ramTTLDB
+	}
 
 	switch *forestTypeCmd {
 	case "disk":
 		cfg.forestType = diskForest
 	case "cache":
 		cfg.forestType = cacheForest
+		if *cacheRowsCmd < 1 || *cacheRowsCmd > accumulator.MaxCacheRows {
+			return nil, errInvalidCacheRows(*cacheRowsCmd)
+		}
+		cfg.cacheRows = *cacheRowsCmd
+		cfg.cacheFlushEvery = *cacheFlushCmd * 1000
 	case "cow":
 		cfg.forestType = cowForest
 		cfg.cowMaxCache = *cowMaxCache
+		cfg.cowMaintain = *cowMaintainCmd
 	case "ram":
 		cfg.forestType = ramForest
 	default:
@@ -335,6 +562,23 @@ func Parse(args []string) (*Config, error) {
 
 	cfg.quitAfter = int32(*quitAfterCmd)
 	cfg.noServe = *noServeCmd
+	cfg.paranoid = *paranoidCmd
+	cfg.syncProofs = *syncProofsCmd
+	cfg.proxyProtocol = *proxyProtocolCmd
+	cfg.RateLimit = rate.Limit(*rateLimitCmd)
+	cfg.Burst = *burstCmd
+	// a bucket that can't hold a token turns everyone away
+	if cfg.RateLimit > 0 && cfg.Burst < 1 {
+		return nil, errInvalidBurst(cfg.Burst)
+	}
+	cfg.PrefetchWindow = *prefetchCmd
+	cfg.ProofCacheSize = *proofCacheCmd * 1000 * 1000
+	cfg.parseWorkers = *parseWorkersCmd
+	if cfg.parseWorkers < 1 {
+		cfg.parseWorkers = 1
+	}
+	cfg.auditEvery = int32(*auditEveryCmd) * 1000
+	cfg.peerAddr = *peerCmd
 	cfg.serve = *serve
 
 	return &cfg, nil
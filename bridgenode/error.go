@@ -3,33 +3,158 @@ package bridgenode
 import (
 	"errors"
 	"fmt"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
 )
 
 var (
-	ErrNoDataDir       = errors.New("No bitcoind datadir")
-	ErrWrongForestType = errors.New("Invalid forest type of")
-	ErrInvalidNetwork  = errors.New("Invalid/not supported net flag given")
-	ErrBuildProofs     = errors.New("BuildProofs error")
-	ErrArchiveServer   = errors.New("ArchiveServer error")
+	ErrNoDataDir         = errors.New("No bitcoind datadir")
+	ErrWrongForestType   = errors.New("Invalid forest type of")
+	ErrInvalidNetwork    = errors.New("Invalid/not supported net flag given")
+	ErrBuildProofs       = errors.New("BuildProofs error")
+	ErrArchiveServer     = errors.New("ArchiveServer error")
+	ErrInvalidCacheRows  = errors.New("Invalid cache rows of")
+	ErrLeafHashVersion   = errors.New("Forest built with a different leaf hash version")
+	ErrPastIndexedTip    = errors.New("Requested blocks past the indexed tip")
+	ErrWrongTTLDBType    = errors.New("Invalid TTL db type of")
+	ErrInvalidProofMagic = errors.New("Invalid proof magic of")
+	ErrWrongProofMagic   = errors.New("Proof file made with a different proof magic")
+	ErrProofFileBehind   = errors.New("Proof file doesn't have every block in the forest")
+	ErrWrongBlockMagic   = errors.New("Block file has the wrong network magic")
+	ErrCorruptProof      = errors.New("Proof file is corrupt")
+	ErrBadCheckpoint     = errors.New("Checkpoint doesn't check out")
+	ErrNewerLocalState   = errors.New("Local state is newer than the checkpoint")
+	ErrTTLVersion        = errors.New("TTL files are a version we can't read")
+	ErrInvalidBurst      = errors.New("Invalid burst of")
 )
 
+// ConfigError is a bridgenode error caused by settings or existing data that
+// won't get any better by trying again.  Kind is one of the Err values above,
+// so errors.Is(err, ErrInvalidNetwork) and friends work.
+type ConfigError struct {
+	Kind   error
+	Detail string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Detail)
+}
+
+// Is matches the Err value the ConfigError was made from.
+func (e *ConfigError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// RunError is a bridgenode error from something failing while running.
+// Cause says what went wrong; if there's no ConfigError under it, it's
+// usually I/O and can be retried.  Kind is one of the Err values above.
+type RunError struct {
+	Kind  error
+	Cause error
+}
+
+func (e *RunError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Kind, e.Cause)
+}
+
+// Is matches the Err value the RunError was made from.
+func (e *RunError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap gives the cause, so errors.As can find a ConfigError under it.
+func (e *RunError) Unwrap() error {
+	return e.Cause
+}
+
+// IsFatal says whether err, or anything it wraps, is a ConfigError.  Those
+// need the user to change something; anything else may work if retried.
+func IsFatal(err error) bool {
+	var cfgErr *ConfigError
+	return errors.As(err, &cfgErr)
+}
+
 func errNoDataDir(path string) error {
-	str := "in path: " + path
-	return fmt.Errorf("%s: %s", ErrNoDataDir, str)
+	return &ConfigError{Kind: ErrNoDataDir, Detail: "in path: " + path}
 }
 
 func errWrongForestType(fType string) error {
-	return fmt.Errorf("%s: %s", ErrWrongForestType, fType)
+	return &ConfigError{Kind: ErrWrongForestType, Detail: fType}
+}
+
+func errWrongTTLDBType(dbType string) error {
+	return &ConfigError{Kind: ErrWrongTTLDBType, Detail: dbType}
 }
 
 func errInvalidNetwork(nType string) error {
-	return fmt.Errorf("%s: %s", ErrInvalidNetwork, nType)
+	return &ConfigError{Kind: ErrInvalidNetwork, Detail: nType}
 }
 
 func errBuildProofs(s error) error {
-	return fmt.Errorf("%s: %s", ErrBuildProofs, s)
+	return &RunError{Kind: ErrBuildProofs, Cause: s}
 }
 
 func errArchiveServer(s error) error {
-	return fmt.Errorf("%s: %s", ErrArchiveServer, s)
+	return &RunError{Kind: ErrArchiveServer, Cause: s}
+}
+
+func errInvalidCacheRows(rows int) error {
+	return &ConfigError{Kind: ErrInvalidCacheRows, Detail: fmt.Sprintf(
+		"%d. Should be 1 to %d", rows, accumulator.MaxCacheRows)}
+}
+
+func errInvalidBurst(burst int) error {
+	return &ConfigError{Kind: ErrInvalidBurst, Detail: fmt.Sprintf(
+		"%d. Should be at least 1 with a rate limit", burst)}
+}
+
+func errLeafHashVersion(version uint8) error {
+	return &ConfigError{Kind: ErrLeafHashVersion, Detail: fmt.Sprintf(
+		"forest has %d but we use %d", version, btcacc.LeafHashVersion)}
+}
+
+func errInvalidProofMagic(magic string) error {
+	return &ConfigError{Kind: ErrInvalidProofMagic, Detail: magic +
+		". Should be 4 bytes of hex and not the v1 magic"}
+}
+
+func errWrongProofMagic(expected, read [4]byte, height int32) error {
+	return &ConfigError{Kind: ErrWrongProofMagic, Detail: fmt.Sprintf(
+		"expected %x but block %d has %x", expected, height, read)}
+}
+
+func errPastIndexedTip(start, end, tip int32) error {
+	return &RunError{Kind: ErrPastIndexedTip, Cause: fmt.Errorf(
+		"asked for %d to %d but offset file ends at %d", start, end, tip)}
+}
+
+func errProofFileBehind(lastGood, height int32) error {
+	return &ConfigError{Kind: ErrProofFileBehind, Detail: fmt.Sprintf(
+		"proofs good to block %d but the forest is at %d. Check -proofmagic, "+
+			"or remove the bridge dir to start over", lastGood, height)}
+}
+
+func errWrongBlockMagic(fileName, detail string) error {
+	return &ConfigError{Kind: ErrWrongBlockMagic, Detail: fileName + ": " + detail}
+}
+
+func errCorruptProof(height int32, offset int64, detail string) error {
+	return &ConfigError{Kind: ErrCorruptProof, Detail: fmt.Sprintf(
+		"block %d at offset %d %s", height, offset, detail)}
+}
+
+func errBadCheckpoint(detail string) error {
+	return &ConfigError{Kind: ErrBadCheckpoint, Detail: detail}
+}
+
+func errTTLVersion(version uint8) error {
+	return &ConfigError{Kind: ErrTTLVersion, Detail: fmt.Sprintf(
+		"TTL files are version %d but we use %d", version, ttlFileVersion)}
+}
+
+func errNewerLocalState(localHeight, height int32) error {
+	return &ConfigError{Kind: ErrNewerLocalState, Detail: fmt.Sprintf(
+		"local state at block %d, checkpoint at %d. Remove the bridge dir "+
+			"to import it anyway", localHeight, height)}
 }
@@ -0,0 +1,92 @@
+package bridgenode
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+func TestErrorTypes(t *testing.T) {
+	ioErr := &os.PathError{Op: "open", Path: "/nope", Err: os.ErrNotExist}
+
+	tests := []struct {
+		name  string
+		err   error
+		kind  error
+		msg   string
+		fatal bool
+	}{
+		{"no datadir", errNoDataDir("/x"), ErrNoDataDir,
+			"No bitcoind datadir: in path: /x", true},
+		{"forest type", errWrongForestType("tree"), ErrWrongForestType,
+			"Invalid forest type of: tree", true},
+		{"network", errInvalidNetwork("moonnet"), ErrInvalidNetwork,
+			"Invalid/not supported net flag given: moonnet", true},
+		{"cache rows", errInvalidCacheRows(40), ErrInvalidCacheRows,
+			fmt.Sprintf("Invalid cache rows of: 40. Should be 1 to %d",
+				accumulator.MaxCacheRows), true},
+		{"leaf hash", errLeafHashVersion(9), ErrLeafHashVersion,
+			fmt.Sprintf("Forest built with a different leaf hash version: "+
+				"forest has 9 but we use %d", btcacc.LeafHashVersion), true},
+		{"proof magic", errInvalidProofMagic("aaff"), ErrInvalidProofMagic,
+			"Invalid proof magic of: aaff. Should be 4 bytes of hex and not " +
+				"the v1 magic", true},
+		{"wrong proof magic", errWrongProofMagic(proofMagic,
+			[4]byte{1, 2, 3, 4}, 7), ErrWrongProofMagic,
+			"Proof file made with a different proof magic: expected aaffaafe " +
+				"but block 7 has 01020304", true},
+		{"past tip", errPastIndexedTip(5, 10, 8), ErrPastIndexedTip,
+			"Requested blocks past the indexed tip: asked for 5 to 10 but " +
+				"offset file ends at 8", false},
+		{"burst", errInvalidBurst(0), ErrInvalidBurst,
+			"Invalid burst of: 0. Should be at least 1 with a rate limit", true},
+		{"ttl version", errTTLVersion(3), ErrTTLVersion,
+			"TTL files are a version we can't read: TTL files are " +
+				"version 3 but we use 2", true},
+		{"build proofs io", errBuildProofs(ioErr), ErrBuildProofs,
+			"BuildProofs error: open /nope: file does not exist", false},
+		{"archive server io", errArchiveServer(ioErr), ErrArchiveServer,
+			"ArchiveServer error: open /nope: file does not exist", false},
+		// a config error under a run error is still fatal
+		{"build proofs config", errBuildProofs(fmt.Errorf(
+			"initialization error: %w", errLeafHashVersion(2))),
+			ErrBuildProofs, fmt.Sprintf("BuildProofs error: initialization "+
+				"error: Forest built with a different leaf hash version: "+
+				"forest has 2 but we use %d", btcacc.LeafHashVersion), true},
+	}
+
+	for _, test := range tests {
+		if test.err.Error() != test.msg {
+			t.Errorf("%s: message %q, expected %q",
+				test.name, test.err.Error(), test.msg)
+		}
+		if !errors.Is(test.err, test.kind) {
+			t.Errorf("%s: not %s", test.name, test.kind)
+		}
+		if IsFatal(test.err) != test.fatal {
+			t.Errorf("%s: IsFatal %v, expected %v",
+				test.name, !test.fatal, test.fatal)
+		}
+
+		var cfgErr *ConfigError
+		var runErr *RunError
+		isCfg := errors.As(test.err, &cfgErr)
+		isRun := errors.As(test.err, &runErr)
+		if !isCfg && !isRun {
+			t.Errorf("%s: neither a ConfigError nor a RunError", test.name)
+		}
+	}
+
+	// the io cause can be pulled back out
+	var pathErr *os.PathError
+	if !errors.As(errBuildProofs(ioErr), &pathErr) || pathErr != ioErr {
+		t.Error("couldn't get the PathError back out of errBuildProofs")
+	}
+	if errors.Is(errNoDataDir("/x"), ErrInvalidNetwork) {
+		t.Error("errNoDataDir matched ErrInvalidNetwork")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 
@@ -16,8 +17,11 @@ Proof file format is somewhat like the blk.dat and rev.dat files.  But it's
 always in order!  The offset file is in 8 byte chunks, so to find the proof
 data for block 100 (really 101), seek to byte 800 and read 8 bytes.
 
-The proof file is: 4 bytes empty (zeros for now, could do something else later)
-4 bytes proof length, then the proof data.
+The proof file is: 4 bytes magic, 4 bytes proof length, then the proof data.
+The magic says which version the proof data is in.  v1 (aaffaaff) has 4 byte
+TTLs, v2 (aaffaafe) has 3 byte TTLs.  New blocks are always written as v2 but
+v1 blocks can still be read.  Private networks can set their own magic with
+-proofmagic, which is then used instead of the v2 one.
 
 Offset file is: 8 byte int64 offset.  Right now it's all 1 big file, can
 change to 4 byte which file and 4 byte offset within file like the blk/rev but
@@ -42,10 +46,20 @@ and send it over to the ttl worker.
 also gets offset values from flatFileBlockWorker so it knows it's safe to write
 to those locations.
 Then it writes all the TTL values to the correct places in by checking all the
-offsetInRam values and writing to the correct 4-byte location in the proof file.
+offsetInRam values and writing to the correct 3-byte location in the TTL file.
+TTL files made back when TTLs were 4 bytes get rewritten by checkTTLFiles
+before the worker starts.
 
 */
 
+var (
+	// proofMagicV1 starts every proof block that has 4 byte TTLs
+	proofMagicV1 = [4]byte{0xaa, 0xff, 0xaa, 0xff}
+
+	// proofMagic starts every proof block that has 3 byte TTLs (v2)
+	proofMagic = [4]byte{0xaa, 0xff, 0xaa, 0xfe}
+)
+
 // shared state for the flat file worker methods
 type flatFileState struct {
 	heightOffsets         []int64
@@ -53,6 +67,13 @@ type flatFileState struct {
 	finishedHeight        int32
 	currentOffset         int64
 	fileWait              *sync.WaitGroup
+
+	// magic starts every proof block written
+	magic [4]byte
+
+	// the offset file has where each block ends instead of where it starts,
+	// and the blocks don't have a magic & size header (TTL files)
+	endOffsets bool
 }
 
 func flatFileWorkerProof(
@@ -70,17 +91,19 @@ func flatFileWorkerProof(
 	}
 
 	pf.proofFile, err = os.OpenFile(
-		utreeDir.ProofDir.pFile, os.O_CREATE|os.O_WRONLY, 0600)
+		utreeDir.ProofDir.pFile, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		panic(err)
 	}
 
 	pf.fileWait = fileWait
+	pf.magic = utreeDir.ProofDir.ProofMagic
 
 	err = pf.ffInit()
 	if err != nil {
 		panic(err)
 	}
+	onShutdown.add("proof files", pf.sync)
 
 	for {
 		ud := <-proofChan
@@ -106,7 +129,7 @@ func flatFileWorkerUndo(
 	}
 
 	uf.proofFile, err = os.OpenFile(
-		utreeDir.UndoDir.undoFile, os.O_CREATE|os.O_WRONLY, 0600)
+		utreeDir.UndoDir.undoFile, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		panic(err)
 	}
@@ -117,6 +140,7 @@ func flatFileWorkerUndo(
 	if err != nil {
 		panic(err)
 	}
+	onShutdown.add("undo files", uf.sync)
 	for {
 		undo := <-undoChan
 		err = uf.writeUndoBlock(undo)
@@ -149,48 +173,68 @@ func flatFileWorkerTTL(
 		panic(err)
 	}
 	tf.fileWait = fileWait
+	tf.endOffsets = true
 
 	err = tf.ffInit()
 	if err != nil {
 		panic(err)
 	}
+	onShutdown.add("ttl files", tf.sync)
 
 	for {
-		// expand TTL file by 4 byte for every utxo in this block
 		allocNSkip := <-numOutputsChan
-		numOutputs := allocNSkip.totalOut
-		// fmt.Printf("h %d %d utxos truncating from %d to %d\n",
-		// len(tf.heightOffsets), size,
-		// tf.currentOffset, tf.currentOffset+int64(size*4))
-
-		err = tf.proofFile.Truncate(tf.currentOffset + int64(numOutputs*4))
-		if err != nil {
-			panic(err)
-		}
-
-		// mark the TTLs which are unspendable.  Much easier than skipping them.
-		err = tf.writeSkipped(tf.currentOffset, allocNSkip.outskip)
-		if err != nil {
-			panic(err)
-		}
 		// get the TTL resutls for this block and write to previously
 		// allocated locations
 		ttlRes := <-ttlResultChan
-		err = tf.writeTTLs(ttlRes)
+		err = tf.writeTTLBlock(allocNSkip, ttlRes)
 		if err != nil {
 			panic(err)
 		}
-		// append tf offsets after writing ttl data
-		tf.heightOffsets = append(tf.heightOffsets, tf.currentOffset)
-		// increment currentoffset value
-		tf.currentOffset = tf.currentOffset + int64(numOutputs*4)
+	}
 
-		err = binary.Write(tf.offsetFile, binary.BigEndian, tf.currentOffset)
-		if err != nil {
-			panic(err)
-		}
+}
+
+// writeTTLBlock allocates TTL space for a block's outputs, marks the skipped
+// ones, and writes the TTLs the block's inputs give to earlier blocks.
+func (tf *flatFileState) writeTTLBlock(
+	allocNSkip allocNSkipTTL, ttlRes ttlResultBlock) error {
+
+	// expand TTL file by 3 bytes for every utxo in this block
+	numOutputs := allocNSkip.totalOut
+	// fmt.Printf("h %d %d utxos truncating from %d to %d\n",
+	// len(tf.heightOffsets), size,
+	// tf.currentOffset, tf.currentOffset+int64(size*btcacc.TTLSize))
+
+	err := tf.proofFile.Truncate(
+		tf.currentOffset + int64(numOutputs*btcacc.TTLSize))
+	if err != nil {
+		return err
+	}
+
+	// mark the TTLs which are unspendable.  Much easier than skipping them.
+	err = tf.writeSkipped(tf.currentOffset, allocNSkip.outskip)
+	if err != nil {
+		return err
+	}
+	err = tf.writeTTLs(ttlRes)
+	if err != nil {
+		return err
 	}
+	// append tf offsets after writing ttl data
+	tf.heightOffsets = append(tf.heightOffsets, tf.currentOffset)
+	// increment currentoffset value
+	tf.currentOffset = tf.currentOffset + int64(numOutputs*btcacc.TTLSize)
+
+	return binary.Write(tf.offsetFile, binary.BigEndian, tf.currentOffset)
+}
 
+// sync gets what's been written to the files onto disk.
+func (ff *flatFileState) sync() error {
+	err := ff.proofFile.Sync()
+	if err != nil {
+		return err
+	}
+	return ff.offsetFile.Sync()
 }
 
 func (ff *flatFileState) ffInit() error {
@@ -205,31 +249,31 @@ func (ff *flatFileState) ffInit() error {
 
 	// resume setup -- read all existing offsets to ram
 	if offsetFileSize > 0 {
-		// offsetFile already exists so read the whole thing and send over the
-		// channel to the ttl worker.
-		savedHeight := int32(offsetFileSize/8) - 1
-		// TODO I'm not really sure why theres a -1 there
-		// seek back to the file start / block "0"
+		// offsetFile already exists so read the whole thing.
+		// The first offset is for block 0, so there's 1 more offset than
+		// there are blocks.
+		offsets := make([]int64, offsetFileSize/8)
 		_, err := ff.offsetFile.Seek(0, 0)
 		if err != nil {
 			return err
 		}
-		ff.heightOffsets = make([]int64, savedHeight)
-		for ff.finishedHeight < savedHeight {
-			err = binary.Read(ff.offsetFile, binary.BigEndian, &ff.currentOffset)
-			if err != nil {
-				fmt.Printf("couldn't populate in-ram offsets on startup")
-				return err
-			}
-			ff.heightOffsets[ff.finishedHeight] = ff.currentOffset
-			ff.finishedHeight++
-		}
-
-		// set currentOffset to the end of the proof file
-		ff.currentOffset, err = ff.proofFile.Seek(0, 2)
+		err = binary.Read(ff.offsetFile, binary.BigEndian, offsets)
 		if err != nil {
+			fmt.Printf("couldn't populate in-ram offsets on startup")
 			return err
 		}
+		ff.finishedHeight = int32(len(offsets)) - 1
+
+		if ff.endOffsets {
+			// offsets[h] is where block h ends, which is where block h+1
+			// starts.  Block 1 starts at offsets[0], which is 0.
+			ff.heightOffsets = append([]int64{0}, offsets[:len(offsets)-1]...)
+			ff.currentOffset = offsets[len(offsets)-1]
+			return nil
+		}
+
+		ff.heightOffsets = offsets
+		return ff.resumeAtEnd()
 
 	} else { // first time startup
 		// there is no block 0 so leave that empty
@@ -247,6 +291,50 @@ func (ff *flatFileState) ffInit() error {
 	return nil
 }
 
+// resumeAtEnd sets currentOffset to the end of the last block in the file,
+// going by the size written in front of it.  The offset is written before
+// the block, so if the last block didn't make it to disk in full it's
+// dropped from both files and will be written again.
+func (ff *flatFileState) resumeAtEnd() error {
+	for ff.finishedHeight > 0 {
+		start := ff.heightOffsets[ff.finishedHeight]
+		var header [8]byte
+		_, err := ff.proofFile.ReadAt(header[:], start)
+		if err == nil {
+			// 4B magic & 4B size comes first
+			end := start + 8 + int64(binary.BigEndian.Uint32(header[4:]))
+			fileEnd, err := ff.proofFile.Seek(0, 2)
+			if err != nil {
+				return err
+			}
+			if end <= fileEnd {
+				ff.currentOffset = end
+				break
+			}
+		} else if err != io.EOF {
+			return err
+		}
+		fmt.Printf("block %d at offset %d incomplete, dropping it\n",
+			ff.finishedHeight, start)
+		ff.finishedHeight--
+		ff.heightOffsets = ff.heightOffsets[:ff.finishedHeight+1]
+	}
+	if ff.finishedHeight == 0 {
+		ff.currentOffset = 0
+	}
+
+	// anything past the last full block is from a write that didn't finish
+	err := ff.offsetFile.Truncate(int64(8 * (ff.finishedHeight + 1)))
+	if err != nil {
+		return err
+	}
+	_, err = ff.offsetFile.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	return ff.proofFile.Truncate(ff.currentOffset)
+}
+
 func (uf *flatFileState) writeUndoBlock(ub accumulator.UndoBlock) error {
 	undoSize := ub.SerializeSize()
 	buf := make([]byte, undoSize)
@@ -320,7 +408,7 @@ func (pf *flatFileState) writeProofBlock(ud btcacc.UData) error {
 	}
 
 	// write to proof file
-	_, err = pf.proofFile.WriteAt([]byte{0xaa, 0xff, 0xaa, 0xff}, pf.currentOffset)
+	_, err = pf.proofFile.WriteAt(pf.magic[:], pf.currentOffset)
 	if err != nil {
 		return err
 	}
@@ -362,6 +450,30 @@ func (pf *flatFileState) writeProofBlock(ud btcacc.UData) error {
 	return nil
 }
 
+// What EstimateProofFileSize takes the average txo to be.  Most pkScripts
+// are p2pkh (25B) or smaller, and batch proofs on mainnet take about 15
+// hashes per target.
+const (
+	estPkScriptSize      = 25
+	estProofHashesPerTxo = 15
+)
+
+// EstimateProofFileSize gives about how many bytes the proof file takes
+// for blocks blocks with avgTxosPerBlock txos each, for planning storage.
+// Each txo is counted as created and spent in a block, as if the utxo set
+// wasn't growing.  The offset file is another 8 bytes a block on top.
+func EstimateProofFileSize(blocks int32, avgTxosPerBlock int) uint64 {
+	if blocks <= 0 || avgTxosPerBlock < 0 {
+		return 0
+	}
+	// 4B magic & 4B size, 8B height & numTTLs, 8B numTargets & numHashes
+	perBlock := uint64(8 + 8 + 8)
+	// a TTL, a target, its proof hashes, and the leaf data
+	perTxo := uint64(btcacc.TTLSize + 8 + estProofHashesPerTxo*32 +
+		82 + estPkScriptSize)
+	return uint64(blocks) * (perBlock + uint64(avgTxosPerBlock)*perTxo)
+}
+
 type allocNSkipTTL struct {
 	totalOut uint32
 	outskip  []uint32
@@ -374,11 +486,12 @@ type allocNSkipTTL struct {
 func (tf *flatFileState) writeSkipped(
 	startOffset int64, outskip []uint32) error {
 
-	skipBytes := [4]byte{0x7f, 0xff, 0xff, 0xff}
+	var skipBytes [btcacc.TTLSize]byte
+	btcacc.PutTTL(skipBytes[:], btcacc.MaxTTL)
 
 	for _, idxInBlock := range outskip {
-		_, err := tf.proofFile.WriteAt(
-			skipBytes[:], startOffset+(int64(idxInBlock)*4))
+		_, err := tf.proofFile.WriteAt(skipBytes[:],
+			startOffset+(int64(idxInBlock)*btcacc.TTLSize))
 		if err != nil {
 			return err
 		}
@@ -388,7 +501,7 @@ func (tf *flatFileState) writeSkipped(
 
 func (tf *flatFileState) writeTTLs(ttlRes ttlResultBlock) error {
 
-	var ttlArr, readEmpty, expectedEmpty [4]byte
+	var ttlArr, readEmpty, expectedEmpty [btcacc.TTLSize]byte
 
 	// for all the TTLs, seek and overwrite the empty values there
 	for _, c := range ttlRes.results {
@@ -398,25 +511,24 @@ func (tf *flatFileState) writeTTLs(ttlRes ttlResultBlock) error {
 				ttlRes.destroyHeight, len(tf.heightOffsets), tf.finishedHeight)
 		}
 
-		binary.BigEndian.PutUint32(
-			ttlArr[:], uint32(ttlRes.destroyHeight-c.createHeight))
+		btcacc.PutTTL(ttlArr[:], ttlRes.destroyHeight-c.createHeight)
 
-		// calculate location of that txo's ttl value in the proof file:
-		// write it's lifespan as a 4 byte int32 (bit of a waste as
-		// 2 or 3 bytes would work)
-		loc := tf.heightOffsets[c.createHeight] + int64(c.indexWithinBlock)*4
+		// calculate location of that txo's ttl value in the ttl file:
+		// write it's lifespan as a 3 byte int (saturates at btcacc.MaxTTL)
+		loc := tf.heightOffsets[c.createHeight] +
+			int64(c.indexWithinBlock)*btcacc.TTLSize
 
 		// first, read the data there to make sure it's empty.
 		// If there's something already there, we messed up & should panic.
 		// TODO once everything works great can remove this
 
 		n, err := tf.proofFile.ReadAt(readEmpty[:], loc)
-		if n != 4 && err != nil {
+		if n != btcacc.TTLSize && err != nil {
 			fmt.Printf("ttl destroyH %d createH %d idxinblock %d\n",
 				ttlRes.destroyHeight, c.createHeight, c.indexWithinBlock)
-			fmt.Printf("want to read byte %d = hO[%d]=%d + %d * 4\n",
-				loc, c.createHeight,
-				tf.heightOffsets[c.createHeight], c.indexWithinBlock)
+			fmt.Printf("want to read byte %d = hO[%d]=%d + %d * %d\n",
+				loc, c.createHeight, tf.heightOffsets[c.createHeight],
+				c.indexWithinBlock, btcacc.TTLSize)
 			s, _ := tf.proofFile.Stat()
 			return fmt.Errorf("proofFile.ReadAt %d size %d %s",
 				loc, s.Size(), err.Error())
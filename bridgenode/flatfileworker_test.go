@@ -0,0 +1,539 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// Write block 1 as a v2 proof and block 2 as an old v1 proof, then make sure
+// both come back out of GetUDataBytesFromFile as v2.
+func TestProofFileVersions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prooffile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pf flatFileState
+	pf.offsetFile, err = os.OpenFile(
+		utreeDir.ProofDir.pOffsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.proofFile, err = os.OpenFile(
+		utreeDir.ProofDir.pFile, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.fileWait = new(sync.WaitGroup)
+	pf.magic = utreeDir.ProofDir.ProofMagic
+	err = pf.ffInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uds := []btcacc.UData{
+		{
+			Height: 1,
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{2},
+				Proof:   []accumulator.Hash{{1}, {2}},
+			},
+			Stxos: []btcacc.LeafData{{TxHash: btcacc.Hash{3}, Amt: 10,
+				PkScript: []byte{1, 2}}},
+			TxoTTLs: []int32{0, 5, btcacc.MaxTTL},
+		},
+		{
+			Height: 2,
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{},
+				Proof:   []accumulator.Hash{},
+			},
+			Stxos:   []btcacc.LeafData{},
+			TxoTTLs: []int32{7, 0x7fffffff},
+		},
+	}
+
+	// block 1 is written by the normal proof worker code
+	pf.fileWait.Add(1)
+	err = pf.writeProofBlock(uds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block 2 is written by hand as a v1 proof
+	var v1 bytes.Buffer
+	err = uds[1].SerializeV1(&v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block []byte
+	block = append(block, proofMagicV1[:]...)
+	var sizeBytes [4]byte
+	binary.BigEndian.PutUint32(sizeBytes[:], uint32(v1.Len()))
+	block = append(block, sizeBytes[:]...)
+	block = append(block, v1.Bytes()...)
+	_, err = pf.proofFile.WriteAt(block, pf.currentOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsetBytes [8]byte
+	binary.BigEndian.PutUint64(offsetBytes[:], uint64(pf.currentOffset))
+	_, err = pf.offsetFile.WriteAt(offsetBytes[:], 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.proofFile.Close()
+	pf.offsetFile.Close()
+
+	// v1 TTLs above MaxTTL saturate once converted
+	uds[1].TxoTTLs[1] = btcacc.MaxTTL
+
+	for _, ud := range uds {
+		udb, err := GetUDataBytesFromFile(utreeDir.ProofDir, ud.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var check btcacc.UData
+		err = check.Deserialize(bytes.NewReader(udb))
+		if err != nil {
+			t.Fatalf("h %d %s", ud.Height, err.Error())
+		}
+		if !reflect.DeepEqual(ud, check) {
+			t.Fatalf("h %d mismatch\nwrote %v\nread  %v",
+				ud.Height, ud, check)
+		}
+	}
+}
+
+// A proof file written with a private network's magic can only be read
+// with that magic.
+func TestProofMagic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proofmagic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utreeDir.ProofDir.ProofMagic = [4]byte{0x0a, 0x0b, 0x0c, 0x0d}
+	pf := openTestProofFiles(t, utreeDir)
+	ud := btcacc.UData{
+		Height: 1,
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{},
+			Proof:   []accumulator.Hash{},
+		},
+		Stxos:   []btcacc.LeafData{},
+		TxoTTLs: []int32{3},
+	}
+	pf.fileWait.Add(1)
+	err = pf.writeProofBlock(ud)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.proofFile.Close()
+	pf.offsetFile.Close()
+
+	udb, err := GetUDataBytesFromFile(utreeDir.ProofDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var check btcacc.UData
+	err = check.Deserialize(bytes.NewReader(udb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ud, check) {
+		t.Fatalf("wrote %v read %v", ud, check)
+	}
+
+	// the default magic doesn't match
+	_, err = GetUDataBytesFromFile(initUtreeDir(dir).ProofDir, 1)
+	if !errors.Is(err, ErrWrongProofMagic) {
+		t.Fatalf("got error %v reading with the default magic, expected %s",
+			err, ErrWrongProofMagic)
+	}
+}
+
+// openTestProofFiles opens the proof files the same way flatFileWorkerProof
+// does.
+func openTestProofFiles(t *testing.T, utreeDir utreeDir) flatFileState {
+	var pf flatFileState
+	var err error
+	pf.offsetFile, err = os.OpenFile(
+		utreeDir.ProofDir.pOffsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.proofFile, err = os.OpenFile(
+		utreeDir.ProofDir.pFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.fileWait = new(sync.WaitGroup)
+	pf.magic = utreeDir.ProofDir.ProofMagic
+	err = pf.ffInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pf
+}
+
+// Write some proofs, restart, write some more, and make sure they all read
+// back at the right heights.  The restart happens after a half written block
+// which should get dropped and written again.
+func TestProofFileRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prooffilerestart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, m := int32(5), int32(4)
+	uds := make([]btcacc.UData, n+m)
+	for i := range uds {
+		h := int32(i) + 1
+		uds[i] = btcacc.UData{
+			Height: h,
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{uint64(h)},
+				Proof:   make([]accumulator.Hash, i%3+1),
+			},
+			Stxos: []btcacc.LeafData{{Height: h, Amt: int64(h),
+				PkScript: []byte{byte(h)}}},
+			TxoTTLs: make([]int32, i%4+1),
+		}
+		for j := range uds[i].AccProof.Proof {
+			uds[i].AccProof.Proof[j] = accumulator.Hash{byte(h), byte(j)}
+		}
+	}
+
+	pf := openTestProofFiles(t, utreeDir)
+	for _, ud := range uds[:n] {
+		pf.fileWait.Add(1)
+		err = pf.writeProofBlock(ud)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// crash part way through block n+1; the offset made it but only some of
+	// the proof did
+	var offsetBytes [8]byte
+	binary.BigEndian.PutUint64(offsetBytes[:], uint64(pf.currentOffset))
+	_, err = pf.offsetFile.WriteAt(offsetBytes[:], int64(8*(n+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pf.proofFile.WriteAt(
+		append(proofMagic[:], 0, 0, 1, 0, 7), pf.currentOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pf.proofFile.Close()
+	pf.offsetFile.Close()
+
+	pf = openTestProofFiles(t, utreeDir)
+	if pf.finishedHeight != n {
+		t.Fatalf("restarted at height %d, expected %d", pf.finishedHeight, n)
+	}
+	if int32(len(pf.heightOffsets)) != n+1 {
+		t.Fatalf("%d offsets in ram after restart, expected %d",
+			len(pf.heightOffsets), n+1)
+	}
+	for _, ud := range uds[n:] {
+		pf.fileWait.Add(1)
+		err = pf.writeProofBlock(ud)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pf.proofFile.Close()
+	pf.offsetFile.Close()
+
+	for _, ud := range uds {
+		udb, err := GetUDataBytesFromFile(utreeDir.ProofDir, ud.Height)
+		if err != nil {
+			t.Fatalf("h %d %s", ud.Height, err.Error())
+		}
+		var check btcacc.UData
+		err = check.Deserialize(bytes.NewReader(udb))
+		if err != nil {
+			t.Fatalf("h %d %s", ud.Height, err.Error())
+		}
+		if !reflect.DeepEqual(ud, check) {
+			t.Fatalf("h %d mismatch\nwrote %v\nread  %v",
+				ud.Height, ud, check)
+		}
+	}
+}
+
+// Write blocks made of average txos and check they take what
+// EstimateProofFileSize says.
+func TestEstimateProofFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "estimateprooffile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, txos := int32(6), 40
+	pf := openTestProofFiles(t, utreeDir)
+	start := pf.currentOffset
+	for h := int32(1); h <= blocks; h++ {
+		ud := btcacc.UData{
+			Height:  h,
+			TxoTTLs: make([]int32, txos),
+			Stxos:   make([]btcacc.LeafData, txos),
+			AccProof: accumulator.BatchProof{
+				Targets: make([]uint64, txos),
+				Proof:   make([]accumulator.Hash, txos*estProofHashesPerTxo),
+			},
+		}
+		for i := range ud.Stxos {
+			ud.Stxos[i].PkScript = make([]byte, estPkScriptSize)
+		}
+		pf.fileWait.Add(1)
+		err = pf.writeProofBlock(ud)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pf.proofFile.Close()
+	pf.offsetFile.Close()
+
+	written := uint64(pf.currentOffset - start)
+	estimate := EstimateProofFileSize(blocks, txos)
+	if written != estimate {
+		t.Fatalf("estimated %d bytes for %d blocks of %d txos, wrote %d",
+			estimate, blocks, txos, written)
+	}
+	if EstimateProofFileSize(0, txos) != 0 {
+		t.Fatal("estimated bytes for no blocks")
+	}
+}
+
+// Write a few blocks of TTLs the way flatFileWorkerTTL does and read them
+// back with GetTTLsFromFile.
+func TestGetTTLsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ttlfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tf flatFileState
+	tf.offsetFile, err = os.OpenFile(
+		utreeDir.TtlDir.OffsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.proofFile, err = os.OpenFile(
+		utreeDir.TtlDir.ttlsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.fileWait = new(sync.WaitGroup)
+	tf.endOffsets = true
+	err = tf.ffInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := []struct {
+		alloc allocNSkipTTL
+		spent []ttlResult
+	}{
+		// block 1: 3 outputs, the 2nd is an op_return
+		{alloc: allocNSkipTTL{totalOut: 3, outskip: []uint32{1}}},
+		// block 2: 2 outputs, spends block 1's first output
+		{alloc: allocNSkipTTL{totalOut: 2},
+			spent: []ttlResult{{createHeight: 1, indexWithinBlock: 0}}},
+		// block 3: no outputs
+		{},
+		// block 4: 1 output, spends outputs from blocks 1 and 2
+		{alloc: allocNSkipTTL{totalOut: 1},
+			spent: []ttlResult{{createHeight: 2, indexWithinBlock: 1},
+				{createHeight: 1, indexWithinBlock: 2}}},
+	}
+	for i, b := range blocks {
+		tf.fileWait.Add(1)
+		err = tf.writeTTLBlock(b.alloc,
+			ttlResultBlock{destroyHeight: int32(i + 1), results: b.spent})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tf.offsetFile.Close()
+	tf.proofFile.Close()
+
+	expect := [][]int32{
+		{1, btcacc.MaxTTL, 3},
+		{0, 2},
+		{},
+		{0},
+	}
+	for i, exp := range expect {
+		ttls, err := GetTTLsFromFile(utreeDir.TtlDir, int32(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ttls, exp) {
+			t.Fatalf("block %d ttls %v, expected %v", i+1, ttls, exp)
+		}
+	}
+
+	_, err = GetTTLsFromFile(utreeDir.TtlDir, 5)
+	if err == nil {
+		t.Fatal("expected error reading past the last block")
+	}
+}
+
+// Write TTL files the way they were before the version file, with 4 byte
+// TTLs, and make sure checkTTLFiles rewrites them so GetTTLsFromFile reads
+// the same TTLs.  Then make sure an unknown version is refused.
+func TestCheckTTLFilesV1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ttlversion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the v1 skip marker was 0x7fffffff
+	blocks := [][]uint32{
+		{1, 0x7fffffff, 3},
+		{0, 2},
+		{},
+		{btcacc.MaxTTL + 5},
+	}
+	var ttlBuf, offsetBuf bytes.Buffer
+	binary.Write(&offsetBuf, binary.BigEndian, int64(0))
+	for _, ttls := range blocks {
+		binary.Write(&ttlBuf, binary.BigEndian, ttls)
+		binary.Write(&offsetBuf, binary.BigEndian, int64(ttlBuf.Len()))
+	}
+	// a block that was being written when the old version stopped
+	binary.Write(&ttlBuf, binary.BigEndian, uint32(7))
+	err = ioutil.WriteFile(utreeDir.TtlDir.ttlsetFile, ttlBuf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		utreeDir.TtlDir.OffsetFile, offsetBuf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkTTLFiles(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// checking again leaves the rewritten files alone
+	err = checkTTLFiles(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := [][]int32{
+		{1, btcacc.MaxTTL, 3},
+		{0, 2},
+		{},
+		{btcacc.MaxTTL},
+	}
+	for i, exp := range expect {
+		ttls, err := GetTTLsFromFile(utreeDir.TtlDir, int32(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ttls, exp) {
+			t.Fatalf("block %d ttls %v, expected %v", i+1, ttls, exp)
+		}
+	}
+	info, err := os.Stat(utreeDir.TtlDir.ttlsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 6*btcacc.TTLSize {
+		t.Fatalf("TTL file is %d bytes, expected %d",
+			info.Size(), 6*btcacc.TTLSize)
+	}
+
+	err = ioutil.WriteFile(utreeDir.TtlDir.versionFile, []byte{3}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkTTLFiles(utreeDir.TtlDir)
+	if !errors.Is(err, ErrTTLVersion) {
+		t.Fatalf("expected ErrTTLVersion, got %v", err)
+	}
+}
+
+// A new TTL dir just gets the version file.
+func TestCheckTTLFilesNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ttlversion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkTTLFiles(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(utreeDir.TtlDir.versionFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{ttlFileVersion}) {
+		t.Fatalf("version file has %x, expected %x", b, ttlFileVersion)
+	}
+}
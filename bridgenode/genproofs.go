@@ -2,6 +2,8 @@ package bridgenode
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"runtime/pprof"
@@ -35,8 +37,9 @@ the block up into inputs and outputs; inputs go to the TTLLookupWorker() and
 outputs go to the TxidSortWriterWorker() (barely even outputs; just TXIDs and
 number of outputs)
 
-TxidSortWriterWorker() builds a flat file of per-block sorted, truncated TXIDs.
-TTLLookupWorker() looks up inputs in this sorted TXID file, and obtains position
+TxidSortWriterWorker() puts the TXIDs into the TTL db, which by default is a
+flat file of per-block sorted, truncated TXIDs (see ttldb.go for the others).
+TTLLookupWorker() looks up inputs in the TTL db, and obtains position
 data for the TTL value of a UTXO.  We already have the TTL data for the UTXO
 from the current block height and the rev data which tells the utxo creation
 height.  We want to write the TTL into the TTL area of the proof block, but
@@ -74,20 +77,43 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	// Channel for stopBuildProofs() to wait
 	haltAccept := make(chan bool, 1)
 
+	// Cancelled by stopBuildProofs() so restoring or auditing the forest
+	// doesn't hold up exiting
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// Handle user interruptions
-	go stopBuildProofs(cfg, sig, offsetFinished, haltRequest, haltAccept)
+	go stopBuildProofs(
+		cfg, sig, cancel, offsetFinished, haltRequest, haltAccept)
 
 	// Init forest and variables. Resumes if the data directory exists
-	forest, finishedHeight, err := InitBridgeNodeState(cfg, offsetFinished)
+	forest, finishedHeight, err := InitBridgeNodeState(
+		ctx, cfg, offsetFinished)
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("stopped before the forest was restored: %w", err)
+	}
 	if err != nil {
-		err := fmt.Errorf("initialization error: %s.  If your .blk and .dat "+
+		err := fmt.Errorf("initialization error: %w.  If your .blk and .dat "+
 			"files are not in %s, specify alternate path with -datadir\n.",
-			err.Error(), cfg.BlockDir)
+			err, cfg.BlockDir)
 		return err
 	}
 
 	fmt.Printf("Starting forest: %s\n", forest.ToString())
 
+	err = checkTTLFiles(cfg.UtreeDir.TtlDir)
+	if err != nil {
+		return err
+	}
+	ttlDB, err := openTTLDB(cfg)
+	if err != nil {
+		return fmt.Errorf("opening TTL db: %w", err)
+	}
+	// TTLLookupWorker closes the db when it's done, but on a signal it
+	// might not get there
+	ttlDB = &onceTTLDB{ttlDB: ttlDB}
+	onShutdown.add("ttl db", ttlDB.close)
+
 	// BlockAndRevReader will push blocks into here
 	blockAndRevProofChan := make(chan blockAndRev, 10) // blocks for accumulator
 	blockAndRevTTLChan := make(chan blockAndRev, 10)   // same thing, but for TTL
@@ -98,20 +124,66 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 
 	fileWait := new(sync.WaitGroup)
 
-	// Reads block asynchronously from .dat files
-	// Reads util the lastIndexOffsetHeight
-
-	go BlockAndRevReader(
-		blockAndRevProofChan, blockAndRevTTLChan,
-		haltRequest, fileWait, cfg, finishedHeight)
+	// With a peer, the leaf data of everything added goes in the forest so
+	// the UTXO set can be rebuilt on restart.  Otherwise leafStore is nil.
+	var leafStore *netLeafStore
+	if cfg.peerAddr != "" {
+		leafStore, err = loadNetLeafStore(cfg.UtreeDir.NetDir.bigLeafFile)
+		if err != nil {
+			return err
+		}
+		view, err := leafStore.utxoView(forest)
+		if err != nil {
+			return err
+		}
+		// Downloads blocks from the peer, or reads the ones it already has
+		go netBlockReader(
+			blockAndRevProofChan, blockAndRevTTLChan,
+			haltRequest, fileWait, cfg, finishedHeight, view)
+	} else {
+		// Reads block asynchronously from .dat files
+		// Reads util the lastIndexOffsetHeight
+		go BlockAndRevReader(
+			blockAndRevProofChan, blockAndRevTTLChan,
+			haltRequest, fileWait, cfg, finishedHeight)
+	}
 
 	go flatFileWorkerProof(proofChan, cfg.UtreeDir, fileWait)
 	go flatFileWorkerUndo(undoChan, cfg.UtreeDir, fileWait)
 	go flatFileWorkerTTL(ttlResultChan, skipChan, cfg.UtreeDir, fileWait)
 
-	go BNRTTLSpliter(blockAndRevTTLChan, ttlResultChan, cfg.UtreeDir)
+	go BNRTTLSpliter(blockAndRevTTLChan, ttlResultChan, ttlDB)
+
+	// forestMtx keeps the shutdown hook from saving the forest in the
+	// middle of a block.  Whichever of the hook and the end of BuildProofs
+	// gets there first saves the forest at finishedHeight and closes it.
+	var forestMtx sync.Mutex
+	var forestClosed bool
+	closeForest := func() error {
+		forestMtx.Lock()
+		defer forestMtx.Unlock()
+		if forestClosed {
+			return nil
+		}
+		forestClosed = true
+		err := saveBridgeNodeData(forest, finishedHeight, cfg)
+		if err != nil {
+			return err
+		}
+		err = leafStore.save()
+		if err != nil {
+			return err
+		}
+		return forest.Close()
+	}
+	removeForestHook := onShutdown.add("forest", closeForest)
+	defer removeForestHook()
 
 	fmt.Println("Building Proofs and ttls...")
+	startHeight := finishedHeight
+	progress := startProgress(cfg.ProgressCallback, cfg.ProgressInterval,
+		cfg.quitAfter-startHeight)
+	defer progress.stop()
 
 	for {
 		// fmt.Printf("block on blockAndRevProofChan read?\n")
@@ -129,63 +201,103 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 		// send number of outputs, including skipped, to allocate TTL space
 		skipChan <- allocNSkipTTL{bnr.outCount, bnr.outSkipList}
 
-		// Get the add and remove data needed from the block & undo block
-		// wants the skiplist to omit proofs
-		blockAdds, delLeaves, err := bnr.toAddDel()
-		if err != nil {
-			return err
+		// The add and remove data from the block & undo block, along with
+		// the leaf hashes, were already built by the parse workers
+		forestMtx.Lock()
+		if forestClosed {
+			forestMtx.Unlock()
+			return fmt.Errorf("forest closed for shutdown at h %d",
+				finishedHeight)
 		}
 
 		// use the accumulator to get inclusion proofs, and produce a block
 		// proof with all data needed to verify the block
-		ud, err := btcacc.GenUData(delLeaves, forest, bnr.Height)
+		ud, err := btcacc.GenUDataFromHashes(
+			bnr.delLeaves, bnr.delHashes, forest, bnr.Height)
 		if err != nil {
+			forestMtx.Unlock()
 			return err
 		}
 		// We don't know the TTL values, but know how many spots to allocate
 		ud.TxoTTLs = make([]int32, bnr.outCount)
 
+		undoblock, err := forest.Modify(bnr.adds, ud.AccProof.Targets)
+		if err != nil {
+			forestMtx.Unlock()
+			return err
+		}
+		err = leafStore.record(forest, &bnr)
+		if err != nil {
+			forestMtx.Unlock()
+			return err
+		}
+		finishedHeight = bnr.Height
+		forestMtx.Unlock()
+
 		// fmt.Printf("block on proofchan?\n")
 		// send proof udata to channel to be written to disk
 		proofChan <- ud
 
-		undoblock, err := forest.Modify(blockAdds, ud.AccProof.Targets)
-		if err != nil {
-			return err
-		}
 		undoblock.Height = bnr.Height // set undoBlocks Height
 		// send undoBlock data to undo channel to be written to the disk
 		// fmt.Printf("block on undochan?\n")
 		undoChan <- *undoblock
 
-		finishedHeight = bnr.Height
-		if finishedHeight%1000 == 0 {
+		progress.setProcessed(finishedHeight - startHeight)
+		if cfg.ProgressCallback == nil && finishedHeight%1000 == 0 {
 			fmt.Printf("Finished block %d of max %d\n",
 				finishedHeight, cfg.quitAfter)
 		}
+		if cfg.auditEvery > 0 && finishedHeight%cfg.auditEvery == 0 {
+			auditStart := time.Now()
+			forestMtx.Lock()
+			if !forestClosed {
+				err = forest.AuditCtx(ctx)
+			}
+			forestMtx.Unlock()
+			if errors.Is(err, context.Canceled) {
+				// exiting, so the blocks left go without an audit
+				fmt.Printf("Stopped auditing forest at h %d\n", finishedHeight)
+			} else if err != nil {
+				return fmt.Errorf("forest audit at h %d: %s",
+					finishedHeight, err.Error())
+			} else {
+				fmt.Printf("Audited forest at h %d in %s\n",
+					finishedHeight, time.Since(auditStart))
+			}
+		}
 
 	}
 
 	// Wait for the file workers to finish
 	fileWait.Wait()
+	if cfg.syncProofs {
+		err = syncProofFiles(cfg.UtreeDir.ProofDir)
+		if err != nil {
+			return fmt.Errorf("syncProofFiles: %s", err.Error())
+		}
+	}
+
+	fmt.Printf("Done writing. Height %d Forest: %s",
+		finishedHeight, forest.ToString())
 
 	// Save the current state so genproofs can be resumed
-	err = saveBridgeNodeData(forest, finishedHeight, cfg)
+	err = closeForest()
 	if err != nil {
 		panic(err)
 	}
-
-	fmt.Printf("Done writing. Height %d Forest: %s",
-		finishedHeight, forest.ToString())
+	removeForestHook()
 
 	// Tell stopBuildProofs that it's ok to exit
 	haltAccept <- true
 	return nil
 }
 
-// stopBuildProofs listens for the signal from the OS and initiates an exit sequence
-func stopBuildProofs(
-	cfg *Config, sig, offsetfinished, haltRequest, haltAccept chan bool) {
+// stopBuildProofs listens for the signal from the OS and initiates an exit
+// sequence.  cancel stops whatever BuildProofs() is doing with the forest
+// that can be stopped.
+func stopBuildProofs(cfg *Config, sig chan bool, cancel context.CancelFunc,
+	offsetfinished, haltRequest, haltAccept chan bool) {
 
 	// Listen for SIGINT, SIGQUIT, SIGTERM
 	// Also listen for an unrequested haltAccept which means upstream is finshed
@@ -209,6 +321,7 @@ func stopBuildProofs(
 
 	// Tell the user that the sig is received
 	fmt.Println("User exit signal received. Exiting...")
+	cancel()
 
 	select {
 	// If offsetfile is there or was built, don't remove it
@@ -223,15 +336,25 @@ func stopBuildProofs(
 		if err != nil {
 			fmt.Println("ERR. offsetdata/ directory not removed. Please manually remove it.")
 		}
+		runShutdownHooks()
 		fmt.Println("Exiting...")
 		os.Exit(0)
 	}
 
 	// Wait until BuildProofs() or buildOffsetFile() says it's ok to exit
 	<-haltAccept
+	runShutdownHooks()
 	os.Exit(0)
 }
 
+// runShutdownHooks runs the hooks in onShutdown before the bridge exits.
+func runShutdownHooks() {
+	err := onShutdown.run(shutdownTimeout)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
 // go through all the proofs and just try to deserialize them
 func VerifyProofs(cfg *Config) error {
 
@@ -1,18 +1,22 @@
 package bridgenode
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
 )
 
 // initBridgeNodeState attempts to load and initialize the chain state from the disk.
 // If a chain state is not present, chain is initialized to the genesis
 // returns forest, height, lastIndexOffsetHeight, pOffset and error
-func InitBridgeNodeState(
+// Restoring the forest stops with ctx's error if ctx is done.
+func InitBridgeNodeState(ctx context.Context,
 	cfg *Config, offsetFinished chan bool) (forest *accumulator.Forest,
 	height int32, err error) {
 
@@ -25,11 +29,20 @@ func InitBridgeNodeState(
 	// anew
 	// Check if the offsetfiles for both rev*.dat and blk*.dat are present
 	var knownTipHeight int32
-	if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) {
+	if cfg.peerAddr != "" {
+		// blocks come from the peer, so there's no offset file to make
+		knownTipHeight, err = syncPeerHeaders(cfg)
+		if err != nil {
+			err = fmt.Errorf("syncPeerHeaders error: %w", err)
+			return
+		}
+		fmt.Printf("peer tip height %d\n", knownTipHeight)
+		offsetFinished <- true
+	} else if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) {
 		knownTipHeight, err = restoreLastIndexOffsetHeight(
 			cfg.UtreeDir.OffsetDir, offsetFinished)
 		if err != nil {
-			err = fmt.Errorf("restoreLastIndexOffsetHeight error: %s", err.Error())
+			err = fmt.Errorf("restoreLastIndexOffsetHeight error: %w", err)
 			return
 		}
 	} else {
@@ -37,7 +50,7 @@ func InitBridgeNodeState(
 			"Indexing offset for blocks blk*.dat files...")
 		knownTipHeight, err = createOffsetData(cfg, offsetFinished)
 		if err != nil {
-			err = fmt.Errorf("createOffsetData error: %s", err.Error())
+			err = fmt.Errorf("createOffsetData error: %w", err)
 			return
 		}
 		fmt.Printf("known tip height %d\n", knownTipHeight)
@@ -45,14 +58,14 @@ func InitBridgeNodeState(
 
 	if checkForestExists(cfg) {
 		fmt.Println("Has access to forest, resuming")
-		forest, err = restoreForest(cfg)
+		forest, err = restoreForestCtx(ctx, cfg)
 		if err != nil {
-			err = fmt.Errorf("restoreForest error: %s", err.Error())
+			err = fmt.Errorf("restoreForest error: %w", err)
 			return
 		}
 		height, err = restoreHeight(cfg)
 		if err != nil {
-			err = fmt.Errorf("restoreHeight error: %s", err.Error())
+			err = fmt.Errorf("restoreHeight error: %w", err)
 			return
 		}
 		fmt.Printf("restore height %d\n", height)
@@ -62,11 +75,41 @@ func InitBridgeNodeState(
 		forest, err = createForest(cfg)
 		height = 0 // note that blocks start at 1, but we haven't read 1 yet
 		if err != nil {
-			err = fmt.Errorf("createForest error: %s", err.Error())
+			err = fmt.Errorf("createForest error: %w", err)
 			return
 		}
 	}
 
+	// the offset file can be made again if only the proof file is left
+	_, offsetErr := os.Stat(cfg.UtreeDir.ProofDir.pOffsetFile)
+	_, proofErr := os.Stat(cfg.UtreeDir.ProofDir.pFile)
+	if os.IsNotExist(offsetErr) && proofErr == nil {
+		fmt.Println("Proof offset file missing, rebuilding it")
+		err = RebuildOffsetFile(cfg.UtreeDir.ProofDir)
+		if err != nil {
+			err = fmt.Errorf("RebuildOffsetFile error: %w", err)
+			return
+		}
+	}
+
+	// a crash can leave a half written proof at the end, which gets
+	// dropped.  Proofs missing for blocks already in the forest can't be
+	// made again without starting over.
+	lastGood, err := ScanProofFile(cfg.UtreeDir.ProofDir)
+	if err != nil {
+		err = fmt.Errorf("ScanProofFile error: %w", err)
+		return
+	}
+	if lastGood < height {
+		err = errProofFileBehind(lastGood, height)
+		return
+	}
+	_, err = repairProofFile(cfg.UtreeDir.ProofDir)
+	if err != nil {
+		err = fmt.Errorf("repairProofFile error: %w", err)
+		return
+	}
+
 	if cfg.quitAfter < 1 { // quitafter not assigned, go to tip
 		cfg.quitAfter = knownTipHeight
 	}
@@ -129,6 +172,11 @@ func saveBridgeNodeData(
 	if err != nil {
 		return err
 	}
+	// leaf hash version goes right after the forest's misc data
+	err = binary.Write(miscForestFile, binary.BigEndian, btcacc.LeafHashVersion)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -181,7 +229,12 @@ func createForest(cfg *Config) (
 
 		// Restores all the forest data
 		if cfg.forestType == cacheForest {
-			forest = accumulator.NewForest(accumulator.CacheForest, forestFile, "", 0)
+			forest = accumulator.NewForest(accumulator.CacheForest,
+				forestFile, "", cfg.cacheRows)
+			err = forest.SetCacheFlushInterval(cfg.cacheFlushEvery)
+			if err != nil {
+				return nil, err
+			}
 		} else {
 			forest = accumulator.NewForest(accumulator.DiskForest, forestFile, "", 0)
 		}
@@ -192,21 +245,65 @@ func createForest(cfg *Config) (
 
 // restoreForest restores forest fields based off the existing forestdata
 // on disk.
-func restoreForest(cfg *Config) (
+func restoreForest(cfg *Config) (*accumulator.Forest, error) {
+	return restoreForestCtx(context.Background(), cfg)
+}
+
+// restoreForestCtx is restoreForest, but stops with ctx's error if ctx is
+// done while the forest is being restored.
+func restoreForestCtx(ctx context.Context, cfg *Config) (
+	*accumulator.Forest, error) {
+
+	return openForest(ctx, cfg, false)
+}
+
+// restoreForestReadOnly restores the forest without changing anything on
+// disk, for looking at a bridge dir nothing is running in.  The forest has
+// to be closed after.
+func restoreForestReadOnly(cfg *Config) (*accumulator.Forest, error) {
+	return openForest(context.Background(), cfg, true)
+}
+
+// openForest restores the forest in cfg's bridge dir.  A read only forest
+// gets its files opened read only, and a cow forest isn't maintained.
+func openForest(ctx context.Context, cfg *Config, readOnly bool) (
 	forest *accumulator.Forest, err error) {
 
+	fileFlag := os.O_RDWR
+	var opts []accumulator.ForestOption
+	if readOnly {
+		fileFlag = os.O_RDONLY
+		opts = append(opts, accumulator.ReadOnly())
+	}
+	// Where the misc forest data exists
+	miscForestFile, err := os.OpenFile(
+		cfg.UtreeDir.ForestDir.miscForestFile, os.O_RDONLY, 0400)
+	if err != nil {
+		return nil, err
+	}
+	defer miscForestFile.Close()
+	defer func() {
+		if err != nil && forest != nil {
+			forest.Close()
+			forest = nil
+		}
+	}()
+
 	switch cfg.forestType {
 	case cowForest:
-		var miscForestFile *os.File
-		// Where the misc forest data exists
-		miscForestFile, err = os.OpenFile(
-			cfg.UtreeDir.ForestDir.miscForestFile, os.O_RDONLY, 0400)
+		forest, err = accumulator.RestoreForestCtx(ctx,
+			miscForestFile, nil, false, false,
+			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache, opts...)
 		if err != nil {
-			return nil, err
+			return
+		}
+		if cfg.cowMaintain && !readOnly {
+			err = forest.MaintainCowForest()
+			if err != nil {
+				return
+			}
+			fmt.Println("Checked and compacted the cow forest")
 		}
-		forest, err = accumulator.RestoreForest(
-			miscForestFile, nil, false, false,
-			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
 
 	default:
 		var (
@@ -221,28 +318,53 @@ func restoreForest(cfg *Config) (
 		}
 
 		var forestFile *os.File
-		var miscForestFile *os.File
 		// Where the forestfile exists
 		forestFile, err = os.OpenFile(
-			cfg.UtreeDir.ForestDir.forestFile, os.O_RDWR, 0400)
+			cfg.UtreeDir.ForestDir.forestFile, fileFlag, 0400)
 		if err != nil {
 			return
 		}
-		// Where the misc forest data exists
-		miscForestFile, err = os.OpenFile(
-			cfg.UtreeDir.ForestDir.miscForestFile, os.O_RDONLY, 0400)
+		// a ram forest is read into memory, and the rest keep the file
+		if inRam {
+			defer forestFile.Close()
+		}
+
+		forest, err = accumulator.RestoreForestCtx(ctx, miscForestFile,
+			forestFile, inRam, cache, "", cfg.cacheRows, opts...)
 		if err != nil {
+			if !inRam {
+				forestFile.Close()
+			}
 			return
 		}
-
-		forest, err = accumulator.RestoreForest(
-			miscForestFile, forestFile, inRam, cache, "", 0)
-
+		if cache && !readOnly {
+			err = forest.SetCacheFlushInterval(cfg.cacheFlushEvery)
+			if err != nil {
+				return
+			}
+		}
 	}
-
+	err = checkLeafHashVersion(miscForestFile)
 	return
 }
 
+// checkLeafHashVersion reads the leaf hash version saved after the forest's
+// misc data and makes sure it's the one we use.  Misc files from before the
+// version was saved are version 1 as that's all there was.
+func checkLeafHashVersion(miscForestFile io.Reader) error {
+	var version uint8
+	err := binary.Read(miscForestFile, binary.BigEndian, &version)
+	if err == io.EOF {
+		version = 1
+	} else if err != nil {
+		return err
+	}
+	if version != btcacc.LeafHashVersion {
+		return errLeafHashVersion(version)
+	}
+	return nil
+}
+
 // restoreHeight restores height from util.ForestLastSyncedBlockHeightFileName
 func restoreHeight(cfg *Config) (height int32, err error) {
 	// if there is a heightfile, get the height from that
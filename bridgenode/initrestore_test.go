@@ -0,0 +1,28 @@
+package bridgenode
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+func TestCheckLeafHashVersion(t *testing.T) {
+	// old misc files don't have a version
+	err := checkLeafHashVersion(bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkLeafHashVersion(
+		bytes.NewReader([]byte{btcacc.LeafHashVersion}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkLeafHashVersion(
+		bytes.NewReader([]byte{btcacc.LeafHashVersion + 1}))
+	if err == nil {
+		t.Fatal("expected error for a different leaf hash version")
+	}
+}
@@ -0,0 +1,151 @@
+package bridgenode
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// TestBuildServeVerify builds proofs for 200 regtest blocks, serves them,
+// and checks every proof with a pollard on the client side, like a CSN
+// would.  At the end the pollard's roots have to match the bridge's forest.
+func TestBuildServeVerify(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping build / serve / verify in short mode")
+	}
+	const numBlocks = 200
+
+	dir, err := ioutil.TempDir("", "buildserveverify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := buildTestProofs(t, dir, numBlocks)
+	err = VerifyProofs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forest, err := restoreForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endHeight, err := restoreHeight(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endHeight != numBlocks {
+		t.Fatalf("built proofs to %d, expected %d", endHeight, numBlocks)
+	}
+
+	// ---------------- server, on whatever port is free
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{})
+	go func() {
+		newBlockServer(cfg, endHeight).serve(ctx, listener)
+		close(served)
+	}()
+	defer func() {
+		cancel()
+		<-served
+	}()
+
+	// ---------------- client
+	ublocks := make(chan uwire.UBlock, 10)
+	go uwire.UblockNetworkReader(
+		ublocks, listener.Addr().String(), 1, 0, cfg.params.Net)
+
+	var p accumulator.Pollard
+	height := int32(1)
+	for ub := range ublocks {
+		if ub.UtreexoData.Height != height {
+			t.Fatalf("got udata for h %d, expected %d",
+				ub.UtreexoData.Height, height)
+		}
+		err = ub.UtreexoData.CheckBlock(ub.Block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nl, h := p.ReconstructStats()
+		err = ub.ProofSanity(nl, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delHashes := make([]accumulator.Hash, len(ub.UtreexoData.Stxos))
+		for i, stxo := range ub.UtreexoData.Stxos {
+			delHashes[i], err = stxo.LeafHash(btcacc.LeafHashVersion)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = p.IngestBatchProof(delHashes, ub.UtreexoData.AccProof, false)
+		if err != nil {
+			t.Fatalf("h %d: %s", height, err.Error())
+		}
+
+		_, outCount, _, outskip := util.DedupeBlock(ub.Block)
+		adds, err := uwire.BlockToAddLeaves(ub.Block,
+			make([]bool, outCount), outskip, height, outCount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Modify(adds, ub.UtreexoData.AccProof.Targets)
+		if err != nil {
+			t.Fatalf("h %d: %s", height, err.Error())
+		}
+		height++
+	}
+	if height != numBlocks+1 {
+		t.Fatalf("client stopped at h %d, expected %d", height, numBlocks+1)
+	}
+
+	bridgeRoots, clientRoots := forest.GetRoots(), p.GetRoots()
+	if len(bridgeRoots) != len(clientRoots) {
+		t.Fatalf("bridge has %d roots, client has %d",
+			len(bridgeRoots), len(clientRoots))
+	}
+	for i := range bridgeRoots {
+		if bridgeRoots[i] != clientRoots[i] {
+			t.Fatalf("root %d: bridge %s client %s",
+				i, bridgeRoots[i], clientRoots[i])
+		}
+	}
+}
+
+// buildTestProofs writes numBlocks regtest blocks in dir and builds proofs
+// for all of them.  The blocks are the same every time; after the first, each
+// block spends 5 outputs from the coinbase before it.
+func buildTestProofs(t testing.TB, dir string, numBlocks int) *Config {
+	cfg := writeTestBlockFiles(t, dir, numBlocks, 5)
+	cfg.forestType = ramForest
+	cfg.quitAfter = -1
+	// blocks are small, so audit often
+	cfg.auditEvery = 50
+	// writeTestBlockFiles made the offset file, so say it's all indexed
+	var tip [4]byte
+	binary.BigEndian.PutUint32(tip[:], uint32(numBlocks))
+	err := ioutil.WriteFile(
+		cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile, tip[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = BuildProofs(cfg, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
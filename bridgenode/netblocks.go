@@ -0,0 +1,585 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+Blocks from a peer:
+
+With -peer the bridge node gets blocks from a bitcoin node over the P2P
+protocol instead of reading blk*.dat files.  Headers come first and go into
+headers.dat; then blocks get downloaded in order, a batch at a time, and
+appended to blocks.dat so a restart doesn't download them again.
+
+There are no rev*.dat files, so the spent outputs of each block have to come
+from somewhere else.  The block reader keeps the whole UTXO set in a
+utxoView and makes a RevBlock from it for every block, so everything after
+that is the same as for blocks from files.  The view isn't saved: the main
+loop puts the leaf data of every leaf it adds into the forest with
+SetLeafData, where it moves around with the leaf and is saved with the
+forest.  On restart the view gets built again from that.  Leaf data too big
+for SetLeafData goes in bigleaves.dat instead.
+*/
+
+// netBlockBatch is how many blocks get asked for at once
+const netBlockBatch = 16
+
+// netBlockStore keeps the headers and blocks downloaded from the peer.
+// Headers are 80 bytes each starting at height 1; blocks are a 4 byte size
+// then the block, with an 8 byte offset per height in the offset file.
+type netBlockStore struct {
+	// hashes has the hash of the header at every height, starting with
+	// the genesis block
+	hashes []chainhash.Hash
+
+	headerFile, blockFile, offsetFile *os.File
+
+	// blockTip is the height of the last block stored
+	blockTip int32
+	// blockEnd is where the next block goes in blockFile
+	blockEnd int64
+}
+
+// openNetBlockStore opens the headers and blocks in dir, making them if
+// they're not there.  Anything half written when the bridge node stopped is
+// cut off.
+func openNetBlockStore(dir netDir, params *chaincfg.Params) (
+	*netBlockStore, error) {
+
+	s := &netBlockStore{hashes: []chainhash.Hash{*params.GenesisHash}}
+	var err error
+	s.headerFile, err = os.OpenFile(dir.headerFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err == nil {
+		s.blockFile, err = os.OpenFile(
+			dir.blockFile, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	if err == nil {
+		s.offsetFile, err = os.OpenFile(
+			dir.offsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	}
+	if err == nil {
+		err = s.readHeaders()
+	}
+	if err == nil {
+		err = s.findBlockTip()
+	}
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("openNetBlockStore: %s", err.Error())
+	}
+	return s, nil
+}
+
+// readHeaders reads all the saved headers to get their hashes.
+func (s *netBlockStore) readHeaders() error {
+	headerBytes, err := ioutil.ReadAll(s.headerFile)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(headerBytes)
+	for r.Len() >= wire.MaxBlockHeaderPayload {
+		var hdr wire.BlockHeader
+		err = hdr.Deserialize(r)
+		if err != nil {
+			return err
+		}
+		if hdr.PrevBlock != s.hashes[len(s.hashes)-1] {
+			return fmt.Errorf("header %d doesn't follow header %d",
+				len(s.hashes), len(s.hashes)-1)
+		}
+		s.hashes = append(s.hashes, hdr.BlockHash())
+	}
+	return s.headerFile.Truncate(int64(s.headerTip()) * wire.MaxBlockHeaderPayload)
+}
+
+// findBlockTip works out how many blocks are saved from the offset file.
+func (s *netBlockStore) findBlockTip() error {
+	info, err := s.offsetFile.Stat()
+	if err != nil {
+		return err
+	}
+	s.blockTip = int32(info.Size() / 8)
+	if s.blockTip > s.headerTip() {
+		s.blockTip = s.headerTip()
+	}
+	err = s.offsetFile.Truncate(int64(s.blockTip) * 8)
+	if err != nil {
+		return err
+	}
+	if s.blockTip > 0 {
+		var size uint32
+		s.blockEnd, size, err = s.blockOffset(s.blockTip)
+		if err != nil {
+			return err
+		}
+		s.blockEnd += 4 + int64(size)
+	}
+	return s.blockFile.Truncate(s.blockEnd)
+}
+
+// headerTip is the height of the last header saved.
+func (s *netBlockStore) headerTip() int32 {
+	return int32(len(s.hashes) - 1)
+}
+
+// locator gives hashes going back from the header tip, closer together near
+// the tip, for asking the peer where our chains meet.
+func (s *netBlockStore) locator() []*chainhash.Hash {
+	var locator []*chainhash.Hash
+	step := int32(1)
+	for h := s.headerTip(); h > 0; h -= step {
+		locator = append(locator, &s.hashes[h])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, &s.hashes[0])
+}
+
+// addHeaders saves headers that go on the end of the ones we have.
+func (s *netBlockStore) addHeaders(hdrs []wire.BlockHeader) error {
+	var buf bytes.Buffer
+	for _, hdr := range hdrs {
+		if hdr.PrevBlock != s.hashes[len(s.hashes)-1] {
+			return fmt.Errorf("header %s at %d doesn't follow %s; the peer "+
+				"is on a different chain and reorgs aren't handled",
+				hdr.BlockHash(), len(s.hashes), s.hashes[len(s.hashes)-1])
+		}
+		err := hdr.Serialize(&buf)
+		if err != nil {
+			return err
+		}
+		s.hashes = append(s.hashes, hdr.BlockHash())
+	}
+	_, err := s.headerFile.WriteAt(buf.Bytes(),
+		int64(s.headerTip()-int32(len(hdrs)))*wire.MaxBlockHeaderPayload)
+	return err
+}
+
+// blockOffset reads where the block at height is, and how big it is.
+func (s *netBlockStore) blockOffset(height int32) (int64, uint32, error) {
+	var offset int64
+	var size uint32
+	err := binary.Read(io.NewSectionReader(
+		s.offsetFile, int64(height-1)*8, 8), binary.BigEndian, &offset)
+	if err != nil {
+		return 0, 0, fmt.Errorf("offset of block %d: %s", height, err.Error())
+	}
+	err = binary.Read(io.NewSectionReader(
+		s.blockFile, offset, 4), binary.BigEndian, &size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("size of block %d: %s", height, err.Error())
+	}
+	return offset, size, nil
+}
+
+// readBlock gives the serialized block at height, which must be saved.
+func (s *netBlockStore) readBlock(height int32) ([]byte, error) {
+	if height < 1 || height > s.blockTip {
+		return nil, fmt.Errorf("readBlock: block %d not saved, have 1 to %d",
+			height, s.blockTip)
+	}
+	offset, size, err := s.blockOffset(height)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, size)
+	_, err = s.blockFile.ReadAt(b, offset+4)
+	if err != nil {
+		return nil, fmt.Errorf("readBlock %d: %s", height, err.Error())
+	}
+	return b, nil
+}
+
+// addBlock saves the next block.  The offset goes in after the block, so
+// an offset always points at a whole block.
+func (s *netBlockStore) addBlock(b []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+	_, err := s.blockFile.WriteAt(append(size[:], b...), s.blockEnd)
+	if err != nil {
+		return err
+	}
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(s.blockEnd))
+	_, err = s.offsetFile.WriteAt(offset[:], int64(s.blockTip)*8)
+	if err != nil {
+		return err
+	}
+	s.blockTip++
+	s.blockEnd += int64(len(b)) + 4
+	return nil
+}
+
+// download gets the blocks from the block tip up to and including end from
+// the peer and saves them.
+func (s *netBlockStore) download(peer *peerConn, end int32) error {
+	for s.blockTip < end {
+		count := end - s.blockTip
+		if count > netBlockBatch {
+			count = netBlockBatch
+		}
+		blocks, err := peer.getBlocks(
+			s.hashes[s.blockTip+1 : s.blockTip+1+count])
+		if err != nil {
+			return err
+		}
+		for _, b := range blocks {
+			err = s.addBlock(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *netBlockStore) close() {
+	for _, f := range []*os.File{s.headerFile, s.blockFile, s.offsetFile} {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
+
+// syncPeerHeaders gets all the headers the peer at cfg.peerAddr has past the
+// ones saved, and gives the height of the last one.
+func syncPeerHeaders(cfg *Config) (int32, error) {
+	store, err := openNetBlockStore(cfg.UtreeDir.NetDir, &cfg.params)
+	if err != nil {
+		return 0, err
+	}
+	defer store.close()
+
+	peer, err := dialPeer(cfg.peerAddr, &cfg.params, store.headerTip())
+	if err != nil {
+		return 0, err
+	}
+	defer peer.close()
+
+	for {
+		hdrs, err := peer.getHeaders(store.locator())
+		if err != nil {
+			return 0, fmt.Errorf("syncPeerHeaders: %s", err.Error())
+		}
+		err = store.addHeaders(hdrs)
+		if err != nil {
+			return 0, fmt.Errorf("syncPeerHeaders: %s", err.Error())
+		}
+		if len(hdrs) < wire.MaxBlockHeadersPerMsg {
+			break
+		}
+		fmt.Printf("Got headers to %d\n", store.headerTip())
+	}
+	return store.headerTip(), nil
+}
+
+// utxoView is every unspent output, for making RevBlocks.
+type utxoView map[wire.OutPoint]btcacc.LeafData
+
+// blockAndRev makes a blockAndRev for a serialized block, with the spent
+// outputs from the view, and updates the view for the block.  addData gets
+// the serialized leaf data of each of the adds.
+func (v utxoView) blockAndRev(height int32, b []byte) (
+	bnr blockAndRev, err error) {
+
+	var blk wire.MsgBlock
+	err = blk.Deserialize(bytes.NewReader(b))
+	if err != nil {
+		err = fmt.Errorf("block %d: %s", height, err.Error())
+		return
+	}
+	bnr.Height = height
+	bnr.Blk = btcutil.NewBlock(&blk)
+	bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+		util.DedupeBlock(bnr.Blk)
+
+	outSkip := bnr.outSkipList
+	var txonum uint32
+	for txInBlock, tx := range bnr.Blk.Transactions() {
+		if txInBlock > 0 {
+			txUndo := &TxUndo{TxIn: make([]*TxInUndo, len(tx.MsgTx().TxIn))}
+			for i, in := range tx.MsgTx().TxIn {
+				l, ok := v[in.PreviousOutPoint]
+				if !ok {
+					err = fmt.Errorf("block %d spends %s which isn't in "+
+						"the UTXO set", height, in.PreviousOutPoint)
+					return
+				}
+				delete(v, in.PreviousOutPoint)
+				txUndo.TxIn[i] = &TxInUndo{
+					Height:   l.Height,
+					PKScript: l.PkScript,
+					Amount:   l.Amt,
+					Coinbase: l.Coinbase,
+				}
+			}
+			bnr.Rev.Txs = append(bnr.Rev.Txs, txUndo)
+		}
+
+		txid := tx.Hash()
+		for i, out := range tx.MsgTx().TxOut {
+			// same skipping as uwire.BlockToAddLeaves, so addData lines
+			// up with adds
+			if util.IsUnspendable(out) {
+				txonum++
+				continue
+			}
+			l := btcacc.LeafData{
+				TxHash:   btcacc.Hash(*txid),
+				Index:    uint32(i),
+				Height:   height,
+				Coinbase: txInBlock == 0,
+				Amt:      out.Value,
+				PkScript: out.PkScript,
+			}
+			v[wire.OutPoint{Hash: *txid, Index: uint32(i)}] = l
+			if len(outSkip) > 0 && outSkip[0] == txonum {
+				outSkip = outSkip[1:]
+				txonum++
+				continue
+			}
+			var buf bytes.Buffer
+			err = l.Serialize(&buf)
+			if err != nil {
+				return
+			}
+			bnr.addData = append(bnr.addData, buf.Bytes())
+			txonum++
+		}
+	}
+
+	err = bnr.prepare()
+	if err == nil && len(bnr.addData) != len(bnr.adds) {
+		err = fmt.Errorf("block %d: %d adds but leaf data for %d",
+			height, len(bnr.adds), len(bnr.addData))
+	}
+	return
+}
+
+// netLeafStore keeps the leaf data for the leaves added from peer blocks,
+// so the utxoView can be built again on restart.  Most of it goes in the
+// forest; what's too big for SetLeafData goes in big, which is saved to
+// its own file.  A nil netLeafStore does nothing, for blocks from files.
+type netLeafStore struct {
+	fileName string
+	big      map[accumulator.Hash][]byte
+}
+
+// loadNetLeafStore reads the big leaf data saved in fileName, if any.
+func loadNetLeafStore(fileName string) (*netLeafStore, error) {
+	s := &netLeafStore{
+		fileName: fileName,
+		big:      make(map[accumulator.Hash][]byte),
+	}
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var count uint64
+	err = binary.Read(f, binary.BigEndian, &count)
+	for i := uint64(0); err == nil && i < count; i++ {
+		var h accumulator.Hash
+		var size uint32
+		_, err = io.ReadFull(f, h[:])
+		if err == nil {
+			err = binary.Read(f, binary.BigEndian, &size)
+		}
+		if err == nil {
+			data := make([]byte, size)
+			_, err = io.ReadFull(f, data)
+			s.big[h] = data
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadNetLeafStore %s: %s", fileName, err.Error())
+	}
+	return s, nil
+}
+
+// save writes the big leaf data to the store's file.
+func (s *netLeafStore) save() error {
+	if s == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint64(len(s.big)))
+	for h, data := range s.big {
+		buf.Write(h[:])
+		binary.Write(&buf, binary.BigEndian, uint32(len(data)))
+		buf.Write(data)
+	}
+	f, err := os.Create(s.fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// record keeps the leaf data of a block's adds, after it's been added to
+// the forest, and drops the big leaf data of its dels.
+func (s *netLeafStore) record(
+	forest *accumulator.Forest, bnr *blockAndRev) error {
+
+	if s == nil {
+		return nil
+	}
+	for _, h := range bnr.delHashes {
+		delete(s.big, h)
+	}
+	hashes := make([]accumulator.Hash, len(bnr.adds))
+	for i, add := range bnr.adds {
+		hashes[i] = add.Hash
+	}
+	positions, missing, err := forest.Positions(hashes)
+	if err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("block %d: %d added leaves not in the forest",
+			bnr.Height, len(missing))
+	}
+	for i, pos := range positions {
+		if len(bnr.addData[i]) > accumulator.MaxLeafDataSize {
+			s.big[hashes[i]] = bnr.addData[i]
+			continue
+		}
+		err = forest.SetLeafData(pos, bnr.addData[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// utxoView builds the view from the leaf data of every leaf in the forest.
+func (s *netLeafStore) utxoView(forest *accumulator.Forest) (utxoView, error) {
+	numLeaves, _ := forest.ReconstructStats()
+	v := make(utxoView, numLeaves)
+	for pos := uint64(0); pos < numLeaves; pos++ {
+		data, ok := forest.LeafData(pos)
+		if !ok {
+			h, err := forest.ReadAt(pos)
+			if err != nil {
+				return nil, err
+			}
+			data, ok = s.big[h]
+		}
+		if !ok {
+			return nil, fmt.Errorf("utxoView: no leaf data for leaf %d. "+
+				"Was the forest built from block files?", pos)
+		}
+		var l btcacc.LeafData
+		err := l.Deserialize(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("utxoView: leaf %d: %s", pos, err.Error())
+		}
+		v[wire.OutPoint{Hash: chainhash.Hash(l.TxHash), Index: l.Index}] = l
+	}
+	return v, nil
+}
+
+// netBlockReader is BlockAndRevReader for blocks from the peer at
+// cfg.peerAddr.  Blocks already saved are read from disk, and the rest are
+// downloaded as they're needed.  If the peer drops, it's dialed again a
+// few times before giving up.
+func netBlockReader(
+	aChan, bChan chan blockAndRev, haltRequest chan bool, wg *sync.WaitGroup,
+	cfg *Config, finishedHeight int32, view utxoView) {
+
+	defer func() {
+		fmt.Printf("finished reading blocks, last height %d\n", finishedHeight)
+		close(aChan)
+		close(bChan)
+	}()
+
+	store, err := openNetBlockStore(cfg.UtreeDir.NetDir, &cfg.params)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	defer store.close()
+
+	var peer *peerConn
+	defer func() {
+		if peer != nil {
+			peer.close()
+		}
+	}()
+
+	for height := finishedHeight + 1; height <= cfg.quitAfter; height++ {
+		for tries := 0; height > store.blockTip; tries++ {
+			if peer == nil {
+				peer, err = dialPeer(
+					cfg.peerAddr, &cfg.params, store.headerTip())
+			}
+			if err == nil {
+				end := store.blockTip + netBlockBatch
+				if end > cfg.quitAfter {
+					end = cfg.quitAfter
+				}
+				err = store.download(peer, end)
+			}
+			if err == nil {
+				break
+			}
+			fmt.Printf("\tWARNING!! downloading block %d: %s\n",
+				height, err.Error())
+			if peer != nil {
+				peer.close()
+				peer = nil
+			}
+			if tries == 3 {
+				return
+			}
+			time.Sleep(time.Second)
+		}
+
+		b, err := store.readBlock(height)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		bnr, err := view.blockAndRev(height, b)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		wg.Add(3) // Undo, TTL, Proof
+		aChan <- bnr
+		bChan <- bnr
+		finishedHeight = height
+		select {
+		case <-haltRequest: // receives true from stopBuildProofs()
+			return
+		default:
+		}
+	}
+}
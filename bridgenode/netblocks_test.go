@@ -0,0 +1,301 @@
+package bridgenode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// testPeer serves blocks over the P2P protocol, enough for a bridge node to
+// sync from.  blocks[i] is at height i+1, on top of an all zero genesis hash
+// like the blocks from writeTestBlockFiles.
+type testPeer struct {
+	listener net.Listener
+	params   *chaincfg.Params
+	blocks   []wire.MsgBlock
+	heights  map[chainhash.Hash]int32
+
+	mtx sync.Mutex
+	// asked counts how many times each block was asked for
+	asked map[int32]int
+	// locators has the height of the first locator hash of each getheaders
+	locators []int32
+}
+
+func newTestPeer(t *testing.T, params *chaincfg.Params,
+	blocks []wire.MsgBlock) *testPeer {
+
+	listener, err := net.ListenTCP(
+		"tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPeer{
+		listener: listener,
+		params:   params,
+		blocks:   blocks,
+		heights:  map[chainhash.Hash]int32{*params.GenesisHash: 0},
+		asked:    make(map[int32]int),
+	}
+	for i := range blocks {
+		p.heights[blocks[i].BlockHash()] = int32(i + 1)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+func (p *testPeer) write(conn net.Conn, msg wire.Message) error {
+	_, err := wire.WriteMessageWithEncodingN(conn, msg, wire.ProtocolVersion,
+		p.params.Net, wire.WitnessEncoding)
+	return err
+}
+
+func (p *testPeer) serve(conn net.Conn) {
+	defer conn.Close()
+	me := wire.NewNetAddressIPPort(net.IPv4(127, 0, 0, 1), 0, wire.SFNodeWitness)
+	ver := wire.NewMsgVersion(me, me, 1, int32(len(p.blocks)))
+	ver.Services = wire.SFNodeNetwork | wire.SFNodeWitness
+	if p.write(conn, ver) != nil || p.write(conn, wire.NewMsgVerAck()) != nil ||
+		p.write(conn, wire.NewMsgPing(7)) != nil {
+		return
+	}
+	for {
+		_, msg, _, err := wire.ReadMessageWithEncodingN(conn,
+			wire.ProtocolVersion, p.params.Net, wire.WitnessEncoding)
+		if err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *wire.MsgGetHeaders:
+			start := int32(-1)
+			for _, h := range m.BlockLocatorHashes {
+				if height, ok := p.heights[*h]; ok {
+					start = height
+					break
+				}
+			}
+			p.mtx.Lock()
+			p.locators = append(p.locators, start)
+			p.mtx.Unlock()
+			headers := wire.NewMsgHeaders()
+			for h := start; h >= 0 && h < int32(len(p.blocks)) &&
+				len(headers.Headers) < wire.MaxBlockHeadersPerMsg; h++ {
+				headers.AddBlockHeader(&p.blocks[h].Header)
+			}
+			err = p.write(conn, headers)
+		case *wire.MsgGetData:
+			for _, inv := range m.InvList {
+				height := p.heights[inv.Hash]
+				p.mtx.Lock()
+				p.asked[height]++
+				p.mtx.Unlock()
+				err = p.write(conn, &p.blocks[height-1])
+				if err != nil {
+					return
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Build proofs from blocks off a peer, stopping halfway and resuming, and
+// check they're the same as proofs built from block files.
+func TestBuildProofsFromPeer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping building proofs from a peer in short mode")
+	}
+	const numBlocks = 60
+
+	dir, err := ioutil.TempDir("", "buildfrompeer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileCfg := buildTestProofs(t, filepath.Join(dir, "files"), numBlocks)
+	offsetFile, err := os.Open(fileCfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, _, err := GetRawBlocksFromDisk(
+		1, numBlocks, offsetFile, fileCfg.BlockDir)
+	offsetFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params := chaincfg.RegressionNetParams
+	params.GenesisHash = &chainhash.Hash{}
+	peer := newTestPeer(t, &params, blocks)
+	defer peer.listener.Close()
+
+	peerCfg := &Config{
+		params:       params,
+		UtreeDir:     initUtreeDir(filepath.Join(dir, "peer")),
+		peerAddr:     peer.listener.Addr().String(),
+		forestType:   ramForest,
+		quitAfter:    numBlocks / 2,
+		parseWorkers: 1,
+		auditEvery:   10,
+	}
+	err = makePaths(peerCfg.UtreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = BuildProofs(peerCfg, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the UTXO set has to come back from the forest's leaf data for the
+	// second half to find what it spends
+	peerCfg.quitAfter = numBlocks
+	err = BuildProofs(peerCfg, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer.mtx.Lock()
+	defer peer.mtx.Unlock()
+	for height := int32(1); height <= numBlocks; height++ {
+		if peer.asked[height] != 1 {
+			t.Fatalf("block %d asked for %d times", height, peer.asked[height])
+		}
+	}
+	// the second run starts from the saved headers
+	if len(peer.locators) != 2 || peer.locators[0] != 0 ||
+		peer.locators[1] != numBlocks {
+		t.Fatalf("getheaders from %v, expected [0 %d]",
+			peer.locators, numBlocks)
+	}
+
+	for _, name := range []string{"proof.dat", "proofoffset.dat"} {
+		fileProofs, err := ioutil.ReadFile(
+			filepath.Join(fileCfg.UtreeDir.ProofDir.base, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		peerProofs, err := ioutil.ReadFile(
+			filepath.Join(peerCfg.UtreeDir.ProofDir.base, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fileProofs, peerProofs) {
+			t.Fatalf("%s from the peer differs from the one from files", name)
+		}
+	}
+
+	fileForest, err := restoreForest(fileCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peerForest, err := restoreForest(peerCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = peerForest.AssertEqual(fileForest)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A peer can't give transactions that aren't under a block's merkle root,
+// or headers without the work they claim.
+func TestPeerChecksBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peerchecks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := writeTestBlockFiles(t, dir, 3, 1)
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, _, err := GetRawBlocksFromDisk(1, 3, offsetFile, cfg.BlockDir)
+	offsetFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same header, different transaction
+	blocks[1].Transactions[1].TxOut[0].Value = 21
+	// mainnet difficulty that the regtest nonce doesn't meet
+	blocks[2].Header.Bits = chaincfg.MainNetParams.PowLimitBits
+
+	params := chaincfg.RegressionNetParams
+	params.GenesisHash = &chainhash.Hash{}
+	peer := newTestPeer(t, &params, blocks)
+	defer peer.listener.Close()
+	conn, err := dialPeer(peer.listener.Addr().String(), &params, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.close()
+
+	_, err = conn.getHeaders([]*chainhash.Hash{params.GenesisHash})
+	if err == nil || !strings.Contains(err.Error(), "block hash of") {
+		t.Fatalf("getHeaders gave error %v, expected a bad proof of work", err)
+	}
+	_, err = conn.getBlocks([]chainhash.Hash{blocks[0].BlockHash()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.getBlocks([]chainhash.Hash{blocks[1].BlockHash()})
+	if err == nil || !strings.Contains(err.Error(), "merkle root") {
+		t.Fatalf("getBlocks gave error %v, expected a bad merkle root", err)
+	}
+}
+
+func TestNetLeafStoreSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netleafstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "bigleaves.dat")
+	s, err := loadNetLeafStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.big[accumulator.Hash{1}] = bytes.Repeat([]byte{0xaa},
+		accumulator.MaxLeafDataSize+1)
+	s.big[accumulator.Hash{2}] = []byte{0xbb}
+	err = s.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadNetLeafStore(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.big) != len(s.big) {
+		t.Fatalf("loaded %d entries, saved %d", len(loaded.big), len(s.big))
+	}
+	for h, data := range s.big {
+		if !bytes.Equal(loaded.big[h], data) {
+			t.Fatalf("entry %s changed", h)
+		}
+	}
+}
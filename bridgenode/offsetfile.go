@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/mit-dci/utreexo/util"
 )
 
@@ -56,6 +57,12 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 	bufDB := BufferDB(lvdb)
 	lvdb.Close()
 
+	// newer bitcoinds obfuscate the blk files
+	xorKey, err := readXorKey(cfg.BlockDir)
+	if err != nil {
+		return 0, err
+	}
+
 	var lastOffsetHeight int32
 
 	// Allocate buffered reader for readRawHeadersFromFile
@@ -75,10 +82,10 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 			break
 		}
 		// grab headers from the .dat file as RawHeaderData type
-		rawheaders, err :=
-			readRawHeadersFromFile(bufReader, filePath, uint32(fileNum), bufDB)
+		rawheaders, err := readRawHeadersFromFile(bufReader, filePath,
+			uint32(fileNum), bufDB, xorKey, &cfg.params)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		tip, lastOffsetHeight, err = writeBlockOffset(
 			rawheaders, nextMap, wr, offsetFile, lastOffsetHeight, tip)
@@ -126,10 +133,13 @@ func buildOffsetFile(cfg *Config, tip util.Hash,
 	return lastOffsetHeight, nil
 }
 
-// readRawHeadersFromFile reads only the headers from the given .dat file
+// readRawHeadersFromFile reads only the headers from the given .dat file.
+// The file is xored with xorKey if it isn't nil, and every block in it has
+// to be for the params' network.
 func readRawHeadersFromFile(
-	bufReader *bufio.Reader, fileDir string,
-	fileNum uint32, bufMap map[[32]byte]uint32) ([]RawHeaderData, error) {
+	bufReader *bufio.Reader, fileDir string, fileNum uint32,
+	bufMap map[[32]byte]uint32, xorKey []byte, params *chaincfg.Params) (
+	[]RawHeaderData, error) {
 	var blockHeaders []RawHeaderData
 
 	f, err := os.Open(fileDir)
@@ -144,7 +154,7 @@ func readRawHeadersFromFile(
 	}
 	fSize := fStat.Size()
 
-	bufReader.Reset(f)
+	bufReader.Reset(&xorReader{r: f, key: xorKey})
 
 	var buf [88]byte    // buffer for magicbytes, size, and 80 byte header
 	offset := uint32(0) // where the block is located from the beginning of the file
@@ -160,7 +170,12 @@ func readRawHeadersFromFile(
 			panic(err)
 		}
 		// check if Bitcoin magic bytes were read
-		if !util.CheckMagicByte(buf[:4]) {
+		end, err := checkBlockMagic(buf[:4], params,
+			filepath.Base(fileDir), xorKey != nil)
+		if err != nil {
+			return nil, err
+		}
+		if end {
 			break
 		}
 
@@ -0,0 +1,258 @@
+package bridgenode
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// peerDialTimeout is how long connecting to the peer can take
+	peerDialTimeout = 10 * time.Second
+
+	// peerTimeout is how long the peer gets to send each message we're
+	// waiting on.  Big blocks over slow links take a while.
+	peerTimeout = 2 * time.Minute
+
+	// peerUserAgent is what the bridge node calls itself in its version
+	peerUserAgent = "utreexo-bridgenode"
+)
+
+// peerConn is a connection to a bitcoin node speaking the P2P protocol.  It
+// only does what the bridge node needs to sync: the version handshake, then
+// asking for headers and blocks.  It answers pings while it waits, and
+// ignores everything else the peer sends.  Headers have to have the work
+// they claim and blocks have to match their headers, so a peer can't make
+// up transactions.  Nothing needing the chain before a block is checked,
+// like the difficulty or whether the outputs it spends exist.
+type peerConn struct {
+	conn    net.Conn
+	btcnet  wire.BitcoinNet
+	witness bool // peer can send blocks with witnesses
+
+	powLimit   *big.Int
+	timeSource blockchain.MedianTimeSource
+}
+
+// dialPeer connects to addr and does the version handshake.  lastBlock is
+// the height of the best header we have, to put in our version message.
+func dialPeer(addr string, params *chaincfg.Params, lastBlock int32) (
+	*peerConn, error) {
+
+	conn, err := net.DialTimeout("tcp", addr, peerDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dialPeer: %s", err.Error())
+	}
+	p := &peerConn{
+		conn:       conn,
+		btcnet:     params.Net,
+		powLimit:   params.PowLimit,
+		timeSource: blockchain.NewMedianTime(),
+	}
+	err = p.handshake(lastBlock)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dialPeer %s: %s", addr, err.Error())
+	}
+	return p, nil
+}
+
+// handshake sends our version and waits for both the peer's version and its
+// verack.  Their version gets a verack back.
+func (p *peerConn) handshake(lastBlock int32) error {
+	nonce, err := wire.RandomUint64()
+	if err != nil {
+		return err
+	}
+	you := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+	if tcpAddr, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+		you = wire.NewNetAddress(tcpAddr, 0)
+	}
+	me := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+	ver := wire.NewMsgVersion(me, you, nonce, lastBlock)
+	ver.DisableRelayTx = true
+	err = ver.AddUserAgent(peerUserAgent, "0.1")
+	if err != nil {
+		return err
+	}
+	err = p.write(ver)
+	if err != nil {
+		return err
+	}
+
+	var gotVersion, gotVerAck bool
+	for !gotVersion || !gotVerAck {
+		msg, _, err := p.read()
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *wire.MsgVersion:
+			if m.Nonce == nonce {
+				return fmt.Errorf("connected to ourselves")
+			}
+			p.witness = m.HasService(wire.SFNodeWitness)
+			gotVersion = true
+			err = p.write(wire.NewMsgVerAck())
+			if err != nil {
+				return err
+			}
+		case *wire.MsgVerAck:
+			gotVerAck = true
+		}
+	}
+	return nil
+}
+
+func (p *peerConn) write(msg wire.Message) error {
+	err := p.conn.SetWriteDeadline(time.Now().Add(peerTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = wire.WriteMessageWithEncodingN(p.conn, msg,
+		wire.ProtocolVersion, p.btcnet, wire.WitnessEncoding)
+	return err
+}
+
+// read gives the next message from the peer we care about, along with its
+// raw payload.  Pings get answered and messages btcd doesn't know about are
+// skipped.
+func (p *peerConn) read() (wire.Message, []byte, error) {
+	for {
+		err := p.conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		if err != nil {
+			return nil, nil, err
+		}
+		_, msg, payload, err := wire.ReadMessageWithEncodingN(p.conn,
+			wire.ProtocolVersion, p.btcnet, wire.WitnessEncoding)
+		if _, ok := err.(*wire.MessageError); ok {
+			// the payload was already read past, so keep going
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if ping, ok := msg.(*wire.MsgPing); ok {
+			err = p.write(wire.NewMsgPong(ping.Nonce))
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		return msg, payload, nil
+	}
+}
+
+// getHeaders asks for the headers after the first locator hash the peer
+// knows, and gives back up to wire.MaxBlockHeadersPerMsg of them.  It's an
+// error if any of them don't have the proof of work they claim.
+func (p *peerConn) getHeaders(locator []*chainhash.Hash) (
+	[]wire.BlockHeader, error) {
+
+	msg := wire.NewMsgGetHeaders()
+	for _, h := range locator {
+		err := msg.AddBlockLocatorHash(h)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := p.write(msg)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		reply, _, err := p.read()
+		if err != nil {
+			return nil, err
+		}
+		headers, ok := reply.(*wire.MsgHeaders)
+		if !ok {
+			continue
+		}
+		hdrs := make([]wire.BlockHeader, len(headers.Headers))
+		for i, h := range headers.Headers {
+			err = blockchain.CheckProofOfWork(
+				btcutil.NewBlock(&wire.MsgBlock{Header: *h}), p.powLimit)
+			if err != nil {
+				return nil, fmt.Errorf("getHeaders: header %s: %s",
+					h.BlockHash(), err.Error())
+			}
+			hdrs[i] = *h
+		}
+		return hdrs, nil
+	}
+}
+
+// getBlocks asks for the blocks with the given hashes and gives back their
+// serialized bytes in the same order.  Every block has to come back, in the
+// order asked for, with the transactions its merkle root and witness
+// commitment say it has.
+func (p *peerConn) getBlocks(hashes []chainhash.Hash) ([][]byte, error) {
+	invType := wire.InvTypeBlock
+	if p.witness {
+		invType = wire.InvTypeWitnessBlock
+	}
+	msg := wire.NewMsgGetDataSizeHint(uint(len(hashes)))
+	for i := range hashes {
+		err := msg.AddInvVect(wire.NewInvVect(invType, &hashes[i]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := p.write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([][]byte, 0, len(hashes))
+	for len(blocks) < len(hashes) {
+		reply, payload, err := p.read()
+		if err != nil {
+			return nil, err
+		}
+		switch m := reply.(type) {
+		case *wire.MsgBlock:
+			want := hashes[len(blocks)]
+			if m.BlockHash() != want {
+				return nil, fmt.Errorf("getBlocks: asked for %s, got %s",
+					want, m.BlockHash())
+			}
+			err = p.checkBlock(m)
+			if err != nil {
+				return nil, fmt.Errorf("getBlocks: block %s: %s",
+					want, err.Error())
+			}
+			blocks = append(blocks, payload)
+		case *wire.MsgNotFound:
+			return nil, fmt.Errorf("getBlocks: peer doesn't have %d blocks",
+				len(m.InvList))
+		}
+	}
+	return blocks, nil
+}
+
+// checkBlock does the checks on blk that don't need the chain before it.
+// Blocks from peers without witnesses come stripped, so their witness
+// commitment can't be checked.
+func (p *peerConn) checkBlock(blk *wire.MsgBlock) error {
+	b := btcutil.NewBlock(blk)
+	err := blockchain.CheckBlockSanity(b, p.powLimit, p.timeSource)
+	if err != nil {
+		return err
+	}
+	if !p.witness {
+		return nil
+	}
+	return blockchain.ValidateWitnessCommitment(b)
+}
+
+func (p *peerConn) close() error {
+	return p.conn.Close()
+}
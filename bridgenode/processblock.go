@@ -48,6 +48,7 @@ down further if needed.
 type ttlWriteBlock struct {
 	createHeight int32    // height of this block, creating txos
 	mTxids       []miniTx // one for tx
+	outSkipList  []uint32 // outputs that won't ever get a TTL looked up
 }
 
 // ttlLookupBlock is the data from a block about txo creation and deletion
@@ -81,6 +82,7 @@ func miniBytesToUint64(b [6]byte) uint64 {
 type miniTx struct {
 	txid     *chainhash.Hash
 	startsAt uint16 // the 0th output in this tx is the _th input in the block
+	outputs  uint16 // how many outputs this tx has
 	// note that there COULD BE more than 65K outputs in a block and
 	// this should probably deal with that.  They'd be "silly" outputs though
 	// TODO move to 32 bits, or really 17 would be plenty
@@ -160,7 +162,7 @@ func (bnr *blockAndRev) toAddDel() (
 	}
 
 	// this is bridgenode, so don't need to deal with memorable leaves
-	blockAdds = uwire.BlockToAddLeaves(
+	blockAdds, err = uwire.BlockToAddLeaves(
 		bnr.Blk, nil, bnr.outSkipList, bnr.Height, bnr.outCount)
 
 	// if bnr.Height == 106 {
@@ -170,6 +172,25 @@ func (bnr *blockAndRev) toAddDel() (
 
 }
 
+// prepare does all the work on a block that doesn't need the forest, so that
+// it can happen before the block gets to the forest: it builds the adds and
+// the del leaves, and hashes the del leaves.
+func (bnr *blockAndRev) prepare() (err error) {
+	bnr.adds, bnr.delLeaves, err = bnr.toAddDel()
+	if err != nil {
+		return
+	}
+	bnr.delHashes = make([]accumulator.Hash, len(bnr.delLeaves))
+	for i := range bnr.delLeaves {
+		bnr.delHashes[i], err = bnr.delLeaves[i].LeafHash(
+			btcacc.LeafHashVersion)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
 // blockNRevToDelLeaves turns a block's inputs into delLeaves to be removed from the
 // accumulator
 func (bnr *blockAndRev) toDelLeaves() (
@@ -0,0 +1,121 @@
+package bridgenode
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProgressFunc hears how far BuildProofs has gotten: processed of total
+// blocks done since it started, elapsed time in.
+type ProgressFunc func(processed, total int32, elapsed time.Duration)
+
+// defaultProgressInterval is how many blocks go by between progress reports
+// when cfg.ProgressInterval isn't set.
+const defaultProgressInterval = 1000
+
+// progressTick is how often the progress goroutine looks at how far
+// BuildProofs has gotten.
+var progressTick = time.Second
+
+// ProgressToStdout gives a ProgressFunc that prints a line for every report,
+// with a guess at how long is left.
+func ProgressToStdout() ProgressFunc {
+	return func(processed, total int32, elapsed time.Duration) {
+		if total <= 0 {
+			fmt.Printf("Processed %d blocks in %s\n",
+				processed, elapsed.Round(time.Second))
+			return
+		}
+		s := fmt.Sprintf("Processed %d of %d blocks (%.1f%%) in %s",
+			processed, total, 100*float64(processed)/float64(total),
+			elapsed.Round(time.Second))
+		if processed > 0 && processed < total {
+			left := elapsed / time.Duration(processed) *
+				time.Duration(total-processed)
+			s += fmt.Sprintf(", about %s left", left.Round(time.Second))
+		}
+		fmt.Println(s)
+	}
+}
+
+// progressReporter calls a ProgressFunc from its own goroutine, so a slow
+// callback never holds up BuildProofs.  BuildProofs only stores how many
+// blocks it's done; every progressTick the goroutine checks if another
+// interval of blocks has gone by and reports the count it sees then.
+type progressReporter struct {
+	callback ProgressFunc
+	interval int32
+	total    int32
+	start    time.Time
+
+	processed int32 // atomic
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// startProgress starts reporting to callback every interval blocks, or
+// every defaultProgressInterval if interval isn't positive.  Returns nil for
+// a nil callback; a nil progressReporter does nothing.
+func startProgress(
+	callback ProgressFunc, interval, total int32) *progressReporter {
+
+	if callback == nil {
+		return nil
+	}
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	pr := &progressReporter{
+		callback: callback,
+		interval: interval,
+		total:    total,
+		start:    time.Now(),
+		done:     make(chan struct{}),
+	}
+	pr.wg.Add(1)
+	go pr.run()
+	return pr
+}
+
+func (pr *progressReporter) run() {
+	defer pr.wg.Done()
+	ticker := time.NewTicker(progressTick)
+	defer ticker.Stop()
+
+	var lastReported int32
+	for {
+		select {
+		case <-ticker.C:
+			processed := atomic.LoadInt32(&pr.processed)
+			if processed/pr.interval > lastReported/pr.interval {
+				pr.callback(processed, pr.total, time.Since(pr.start))
+				lastReported = processed
+			}
+		case <-pr.done:
+			processed := atomic.LoadInt32(&pr.processed)
+			if processed != lastReported || processed == 0 {
+				pr.callback(processed, pr.total, time.Since(pr.start))
+			}
+			return
+		}
+	}
+}
+
+// setProcessed records that n blocks are done.
+func (pr *progressReporter) setProcessed(n int32) {
+	if pr == nil {
+		return
+	}
+	atomic.StoreInt32(&pr.processed, n)
+}
+
+// stop sends the last report and waits for the callback to return.
+func (pr *progressReporter) stop() {
+	if pr == nil {
+		return
+	}
+	close(pr.done)
+	pr.wg.Wait()
+}
@@ -0,0 +1,80 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBuildProofsProgress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping building proofs in short mode")
+	}
+	const numBlocks = 200
+
+	dir, err := ioutil.TempDir("", "buildproofsprogress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldTick := progressTick
+	progressTick = time.Millisecond
+	defer func() { progressTick = oldTick }()
+
+	cfg := writeTestBlockFiles(t, dir, numBlocks, 5)
+	cfg.forestType = ramForest
+	cfg.quitAfter = -1
+	var tip [4]byte
+	binary.BigEndian.PutUint32(tip[:], uint32(numBlocks))
+	err = ioutil.WriteFile(
+		cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile, tip[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type event struct {
+		processed, total int32
+		elapsed          time.Duration
+	}
+	var mtx sync.Mutex
+	var events []event
+	cfg.ProgressInterval = 10
+	cfg.ProgressCallback = func(processed, total int32, elapsed time.Duration) {
+		mtx.Lock()
+		events = append(events, event{processed, total, elapsed})
+		mtx.Unlock()
+		// slow callbacks don't hold up BuildProofs; they just see fewer
+		// reports
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	err = BuildProofs(cfg, make(chan bool, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if len(events) == 0 {
+		t.Fatal("no progress reported")
+	}
+	for i, e := range events {
+		if e.total != numBlocks {
+			t.Fatalf("event %d has total %d, expected %d",
+				i, e.total, numBlocks)
+		}
+		if i > 0 && (e.processed <= events[i-1].processed ||
+			e.elapsed < events[i-1].elapsed) {
+			t.Fatalf("event %d %+v doesn't come after %+v",
+				i, e, events[i-1])
+		}
+	}
+	last := events[len(events)-1]
+	if last.processed != last.total {
+		t.Fatalf("last event processed %d of %d", last.processed, last.total)
+	}
+}
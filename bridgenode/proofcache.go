@@ -0,0 +1,104 @@
+package bridgenode
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockProofCache keeps the udata bytes of recently served blocks in
+// memory, so clients syncing around the same height don't each read the
+// same proofs off disk.  It holds up to maxBytes of proofs and drops the
+// least recently used ones to make room.  A cache is only for the one
+// proof dir it's always given.  A nil *BlockProofCache reads from disk
+// every time.
+type BlockProofCache struct {
+	// HitCount and MissCount are how many Gets found the proof already
+	// in the cache, and how many had to read it.  Read them atomically.
+	HitCount, MissCount uint64
+
+	maxBytes uint64
+
+	mtx    sync.Mutex
+	size   uint64
+	proofs map[int32][]byte
+	// heights, least recently used at the back
+	lru   *list.List
+	elems map[int32]*list.Element
+	// closed once the proof at that height is read off disk
+	loading map[int32]chan struct{}
+}
+
+// NewBlockProofCache makes a BlockProofCache holding up to maxBytes of
+// proofs.
+func NewBlockProofCache(maxBytes uint64) *BlockProofCache {
+	return &BlockProofCache{
+		maxBytes: maxBytes,
+		proofs:   make(map[int32][]byte),
+		lru:      list.New(),
+		elems:    make(map[int32]*list.Element),
+		loading:  make(map[int32]chan struct{}),
+	}
+}
+
+// Get gives the udata bytes for height like GetUDataBytesFromFile does,
+// from the cache if they're there.  If another connection is already
+// reading them, Get waits for it instead of reading them again.  The
+// bytes are shared, so don't change them.
+func (pc *BlockProofCache) Get(proofDir proofDir, height int32) ([]byte, error) {
+	if pc == nil {
+		return GetUDataBytesFromFile(proofDir, height)
+	}
+	for {
+		pc.mtx.Lock()
+		udb, ok := pc.proofs[height]
+		if ok {
+			pc.lru.MoveToFront(pc.elems[height])
+			pc.mtx.Unlock()
+			atomic.AddUint64(&pc.HitCount, 1)
+			return udb, nil
+		}
+		loaded, ok := pc.loading[height]
+		if !ok {
+			break
+		}
+		pc.mtx.Unlock()
+		// if that read failed, this one tries again
+		<-loaded
+	}
+	loaded := make(chan struct{})
+	pc.loading[height] = loaded
+	pc.mtx.Unlock()
+	atomic.AddUint64(&pc.MissCount, 1)
+
+	udb, err := GetUDataBytesFromFile(proofDir, height)
+
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	delete(pc.loading, height)
+	close(loaded)
+	if err != nil {
+		return nil, err
+	}
+	pc.add(height, udb)
+	return udb, nil
+}
+
+// add puts udb in the cache, dropping the least recently used proofs to
+// make room.  Proofs bigger than the whole cache aren't kept.  Call with
+// mtx held.
+func (pc *BlockProofCache) add(height int32, udb []byte) {
+	size := uint64(len(udb))
+	if size > pc.maxBytes {
+		return
+	}
+	for pc.size+size > pc.maxBytes {
+		oldest := pc.lru.Remove(pc.lru.Back()).(int32)
+		pc.size -= uint64(len(pc.proofs[oldest]))
+		delete(pc.proofs, oldest)
+		delete(pc.elems, oldest)
+	}
+	pc.proofs[height] = udb
+	pc.elems[height] = pc.lru.PushFront(height)
+	pc.size += size
+}
@@ -0,0 +1,261 @@
+package bridgenode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// defaultMaxProofSize is the biggest a block's proof can say it is before
+// it's taken as corrupt, unless proofDir.MaxProofSize says otherwise
+const defaultMaxProofSize = 1 << 24
+
+// ScanProofFile walks the proof offset file and checks every block in the
+// proof file: it has to start where the block before it ended, start with
+// the right magic, and have a sane size that fits in the file.  It gives
+// the last height where every block up to it is good.  An unclean shutdown
+// can leave a half written block at the end, and everything past the last
+// good height can be dropped and built again.  No proof files gives 0.
+func ScanProofFile(proofDir proofDir) (lastGoodHeight int32, err error) {
+	lastGoodHeight, _, err = scanProofFile(proofDir)
+	return
+}
+
+// scanProofFile is ScanProofFile, also giving where the last good block
+// ends in the proof file.
+func scanProofFile(proofDir proofDir) (lastGood int32, end int64, err error) {
+	offsetFile, err := os.Open(proofDir.pOffsetFile)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("scanProofFile: %s", err.Error())
+	}
+	defer offsetFile.Close()
+	proofFile, err := os.Open(proofDir.pFile)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("scanProofFile: %s", err.Error())
+	}
+	defer proofFile.Close()
+
+	proofFileInfo, err := proofFile.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("scanProofFile: %s", err.Error())
+	}
+	proofFileSize := proofFileInfo.Size()
+
+	// the offset for block 0 is first, and is always 0
+	offsets := bufio.NewReader(offsetFile)
+	var offset [8]byte
+	_, err = io.ReadFull(offsets, offset[:])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, 0, nil
+		}
+		return 0, 0, fmt.Errorf("scanProofFile: %s", err.Error())
+	}
+
+	var header [8]byte
+	for {
+		_, err = io.ReadFull(offsets, offset[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// a partly written offset at the end doesn't count
+			return lastGood, end, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("scanProofFile h %d: %s",
+				lastGood+1, err.Error())
+		}
+		start := int64(binary.BigEndian.Uint64(offset[:]))
+		if start != end || start+8 > proofFileSize {
+			return lastGood, end, nil
+		}
+		_, err = proofFile.ReadAt(header[:], start)
+		if err != nil {
+			return 0, 0, fmt.Errorf("scanProofFile h %d: %s",
+				lastGood+1, err.Error())
+		}
+		var magic [4]byte
+		copy(magic[:], header[:4])
+		// v1 proofs only exist with the default magic
+		isV1 := magic == proofMagicV1 && proofDir.ProofMagic == proofMagic
+		if magic != proofDir.ProofMagic && !isV1 {
+			return lastGood, end, nil
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if size > proofDir.maxSize() || start+8+size > proofFileSize {
+			return lastGood, end, nil
+		}
+		lastGood++
+		end = start + 8 + size
+	}
+}
+
+// repairProofFile scans the proof files and cuts off everything after the
+// last good block, so the flat file worker picks up right after it.  It
+// gives the last good height.
+func repairProofFile(proofDir proofDir) (int32, error) {
+	lastGood, end, err := scanProofFile(proofDir)
+	if err != nil {
+		return 0, err
+	}
+	offsetInfo, err := os.Stat(proofDir.pOffsetFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	proofInfo, err := os.Stat(proofDir.pFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	offsetEnd := int64(8 * (lastGood + 1))
+	if offsetInfo.Size() <= offsetEnd && proofInfo.Size() <= end {
+		// nothing bad after the last good block
+		return lastGood, nil
+	}
+
+	fmt.Printf("\tWARNING!! proof file bad after block %d, "+
+		"dropping %d offset bytes and %d proof bytes\n", lastGood,
+		offsetInfo.Size()-offsetEnd, proofInfo.Size()-end)
+	if offsetInfo.Size() > offsetEnd {
+		err = os.Truncate(proofDir.pOffsetFile, offsetEnd)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if proofInfo.Size() > end {
+		err = os.Truncate(proofDir.pFile, end)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return lastGood, nil
+}
+
+// RebuildOffsetFile writes the proof offset file again from just the proof
+// file, for when the offset file is lost.  It walks the proof file block by
+// block, checking each starts with the right magic and that the size after
+// it fits in the file.  A half written block at the end is left out, and
+// gets dropped and written again on the next start.  The old offset file is
+// only replaced once the new one is all written.
+func RebuildOffsetFile(proofDir proofDir) error {
+	proofFile, err := os.Open(proofDir.pFile)
+	if err != nil {
+		return fmt.Errorf("RebuildOffsetFile: %s", err.Error())
+	}
+	defer proofFile.Close()
+	proofFileInfo, err := proofFile.Stat()
+	if err != nil {
+		return fmt.Errorf("RebuildOffsetFile: %s", err.Error())
+	}
+	proofFileSize := proofFileInfo.Size()
+
+	tmpName := proofDir.pOffsetFile + ".rebuild"
+	offsetFile, err := os.OpenFile(
+		tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("RebuildOffsetFile: %s", err.Error())
+	}
+	defer os.Remove(tmpName)
+	offsets := bufio.NewWriter(offsetFile)
+
+	// there is no block 0, so its offset is 0
+	var offset [8]byte
+	_, err = offsets.Write(offset[:])
+	if err != nil {
+		offsetFile.Close()
+		return fmt.Errorf("RebuildOffsetFile: %s", err.Error())
+	}
+
+	var height int32
+	var start int64
+	var header [8]byte
+	for start+8 <= proofFileSize {
+		_, err = proofFile.ReadAt(header[:], start)
+		if err != nil {
+			offsetFile.Close()
+			return fmt.Errorf("RebuildOffsetFile h %d: %s",
+				height+1, err.Error())
+		}
+		var magic [4]byte
+		copy(magic[:], header[:4])
+		// v1 proofs only exist with the default magic
+		isV1 := magic == proofMagicV1 && proofDir.ProofMagic == proofMagic
+		if magic != proofDir.ProofMagic && !isV1 {
+			offsetFile.Close()
+			return fmt.Errorf("RebuildOffsetFile h %d: magic %x at offset %d",
+				height+1, magic, start)
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if size > proofDir.maxSize() {
+			offsetFile.Close()
+			return fmt.Errorf("RebuildOffsetFile h %d: size %d at offset %d",
+				height+1, size, start)
+		}
+		if start+8+size > proofFileSize {
+			break
+		}
+
+		binary.BigEndian.PutUint64(offset[:], uint64(start))
+		_, err = offsets.Write(offset[:])
+		if err != nil {
+			offsetFile.Close()
+			return fmt.Errorf("RebuildOffsetFile: %s", err.Error())
+		}
+		height++
+		start += 8 + size
+	}
+	if start != proofFileSize {
+		fmt.Printf("\tWARNING!! proof file has %d bytes after block %d "+
+			"that aren't a whole block\n", proofFileSize-start, height)
+	}
+
+	err = offsets.Flush()
+	if err == nil {
+		err = offsetFile.Sync()
+	}
+	closeErr := offsetFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("RebuildOffsetFile: %s", err.Error())
+	}
+	err = os.Rename(tmpName, proofDir.pOffsetFile)
+	if err != nil {
+		return fmt.Errorf("RebuildOffsetFile: %s", err.Error())
+	}
+	fmt.Printf("rebuilt proof offsets for %d blocks\n", height)
+	return nil
+}
+
+// syncProofFiles makes sure everything written to the proof files is on
+// disk and not just in the OS's cache.
+func syncProofFiles(proofDir proofDir) error {
+	for _, name := range []string{proofDir.pFile, proofDir.pOffsetFile} {
+		f, err := os.OpenFile(name, os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		err = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
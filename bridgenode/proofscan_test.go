@@ -0,0 +1,266 @@
+package bridgenode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// writeTestProofs writes proofs for blocks 1 to n and gives where each one
+// starts in the proof file.
+func writeTestProofs(t *testing.T, utreeDir utreeDir, n int32) []int64 {
+	pf := openTestProofFiles(t, utreeDir)
+	for h := int32(1); h <= n; h++ {
+		ud := btcacc.UData{
+			Height: h,
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{uint64(h)},
+				Proof:   make([]accumulator.Hash, h),
+			},
+			Stxos:   []btcacc.LeafData{{Height: h, Amt: int64(h)}},
+			TxoTTLs: make([]int32, h),
+		}
+		pf.fileWait.Add(1)
+		err := pf.writeProofBlock(ud)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pf.proofFile.Close()
+	pf.offsetFile.Close()
+	return pf.heightOffsets
+}
+
+// Cut the last proof short like a crash would, and make sure the scan stops
+// before it and the repair lets the proofs be written again from there.
+func TestScanTruncatedProofFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanprooffile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing written yet
+	lastGood, err := ScanProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != 0 {
+		t.Fatalf("last good height %d with no proof files", lastGood)
+	}
+
+	const n = 6
+	offsets := writeTestProofs(t, utreeDir, n)
+	lastGood, err = ScanProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != n {
+		t.Fatalf("last good height %d, expected %d", lastGood, n)
+	}
+
+	err = os.Truncate(utreeDir.ProofDir.pFile, offsets[n]+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastGood, err = ScanProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != n-1 {
+		t.Fatalf("last good height %d with block %d cut short, expected %d",
+			lastGood, n, n-1)
+	}
+
+	lastGood, err = repairProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != n-1 {
+		t.Fatalf("repaired to height %d, expected %d", lastGood, n-1)
+	}
+	for h := int32(1); h < n; h++ {
+		_, err = GetUDataBytesFromFile(utreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatalf("h %d %s", h, err.Error())
+		}
+	}
+	pf := openTestProofFiles(t, utreeDir)
+	defer pf.proofFile.Close()
+	defer pf.offsetFile.Close()
+	if pf.finishedHeight != n-1 || pf.currentOffset != offsets[n] {
+		t.Fatalf("resumed at height %d offset %d, expected %d offset %d",
+			pf.finishedHeight, pf.currentOffset, n-1, offsets[n])
+	}
+}
+
+// A block in the middle with a bad magic or size stops the scan before it.
+func TestScanCorruptProofFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scanprooffile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets := writeTestProofs(t, utreeDir, 8)
+
+	proofFile, err := os.OpenFile(utreeDir.ProofDir.pFile, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proofFile.Close()
+
+	// too big a size on block 6
+	_, err = proofFile.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, offsets[6]+4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastGood, err := ScanProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != 5 {
+		t.Fatalf("last good height %d with a bad size on block 6", lastGood)
+	}
+
+	// wrong magic on block 3
+	_, err = proofFile.WriteAt([]byte{0, 0, 0, 0}, offsets[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastGood, err = ScanProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != 2 {
+		t.Fatalf("last good height %d with a bad magic on block 3", lastGood)
+	}
+
+	// a different magic doesn't match any block
+	otherMagic := utreeDir.ProofDir
+	otherMagic.ProofMagic = [4]byte{0x0a, 0x0b, 0x0c, 0x0d}
+	lastGood, err = ScanProofFile(otherMagic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != 0 {
+		t.Fatalf("last good height %d with a different magic", lastGood)
+	}
+}
+
+// Lose the offset file and get it back from the proof file, with the last
+// block cut short like a crash would leave it.
+func TestRebuildOffsetFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuildoffsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	offsets := writeTestProofs(t, utreeDir, n)
+	proofs := make([][]byte, n+1)
+	for h := int32(1); h <= n; h++ {
+		proofs[h], err = GetUDataBytesFromFile(utreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldOffsets, err := ioutil.ReadFile(utreeDir.ProofDir.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(utreeDir.ProofDir.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RebuildOffsetFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOffsets, err := ioutil.ReadFile(utreeDir.ProofDir.pOffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(newOffsets, oldOffsets) {
+		t.Fatalf("rebuilt offsets\n%x\nexpected\n%x", newOffsets, oldOffsets)
+	}
+	for h := int32(1); h <= n; h++ {
+		b, err := GetUDataBytesFromFile(utreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatalf("h %d: %s", h, err.Error())
+		}
+		if !bytes.Equal(b, proofs[h]) {
+			t.Fatalf("h %d proof differs after rebuilding offsets", h)
+		}
+	}
+
+	// a half written last block is left out
+	err = os.Truncate(utreeDir.ProofDir.pFile, offsets[n]+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RebuildOffsetFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastGood, err := ScanProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != n-1 {
+		t.Fatalf("last good height %d after rebuilding, expected %d",
+			lastGood, n-1)
+	}
+
+	// a block that doesn't start with the magic is corruption
+	_, err = writeAtFile(utreeDir.ProofDir.pFile, []byte{0, 0}, offsets[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = RebuildOffsetFile(utreeDir.ProofDir)
+	if err == nil {
+		t.Fatal("rebuilt offsets with a bad magic in the proof file")
+	}
+	// and the offset file from before is still there
+	lastGood, err = ScanProofFile(utreeDir.ProofDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastGood != 2 {
+		t.Fatalf("last good height %d with block 3 corrupt, expected 2",
+			lastGood)
+	}
+}
+
+// writeAtFile writes b at off in the file called name.
+func writeAtFile(name string, b []byte, off int64) (int, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return f.WriteAt(b, off)
+}
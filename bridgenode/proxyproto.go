@@ -0,0 +1,169 @@
+package bridgenode
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When the server is behind a proxy like HAProxy, every connection comes from
+// the proxy.  The PROXY protocol has the proxy start each connection with a
+// header saying where the client really is, either as a line of text (v1) or
+// in binary (v2).  Described at
+// https://www.haproxy.org/download/2.4/doc/proxy-protocol.txt
+
+// proxyV2Sig starts every v2 header
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLen is the longest a v1 header can be, including the \r\n
+const proxyV1MaxLen = 107
+
+// proxyHeaderTimeout is how long the proxy gets to send the header.  Each
+// connection waits on its own header, but one that never sends it still
+// holds on to a goroutine and a socket until then.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyConn is a connection that came through a proxy.  RemoteAddr gives
+// the client's address from the PROXY header.
+type proxyConn struct {
+	net.Conn
+	// r has whatever was read past the header
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.r.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// readProxyHeader reads a v1 or v2 PROXY header from the start of c and
+// gives back a connection with the client's address as its RemoteAddr.
+// Headers that don't say who the client is, like health checks from the
+// proxy itself, leave it as the proxy's address.  It's an error if c doesn't
+// start with a header, so this should only be used when everything
+// connecting is a proxy.
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	err := c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{Conn: c, r: bufio.NewReader(c), remote: c.RemoteAddr()}
+	start, err := pc.r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("readProxyHeader: %s", err.Error())
+	}
+	var addr net.Addr
+	switch {
+	case bytes.Equal(start, proxyV2Sig):
+		addr, err = readProxyV2(pc.r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		addr, err = readProxyV1(pc.r)
+	default:
+		err = fmt.Errorf("readProxyHeader: no PROXY header from %s",
+			c.RemoteAddr().String())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if addr != nil {
+		pc.remote = addr
+	}
+
+	// no deadline for the rest of the connection, same as without a proxy
+	err = c.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readProxyV1 reads a line like "PROXY TCP4 1.2.3.4 5.6.7.8 1234 8338\r\n"
+// and gives the source address.  The address is nil for "PROXY UNKNOWN".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLen {
+			return nil, fmt.Errorf("readProxyV1: header over %d bytes",
+				proxyV1MaxLen)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("readProxyV1: %s", err.Error())
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("readProxyV1: bad header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("readProxyV1: bad %s address %q",
+			fields[1], fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("readProxyV1: bad port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header and gives the source address.  The
+// address is nil for LOCAL connections and anything that isn't TCP.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, fmt.Errorf("readProxyV2: %s", err.Error())
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("readProxyV2: version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, fmt.Errorf("readProxyV2: %s", err.Error())
+	}
+
+	// command 0 is LOCAL, where the proxy connected on its own
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	if hdr[12]&0xf != 1 {
+		return nil, fmt.Errorf("readProxyV2: command %d", hdr[12]&0xf)
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	// source and destination addresses, then source and destination ports
+	if len(body) < 2*ipLen+4 {
+		return nil, fmt.Errorf("readProxyV2: %d bytes of addresses, need %d",
+			len(body), 2*ipLen+4)
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,67 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Sig...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, // PROXY, TCP4, 12 bytes
+		203, 0, 113, 7, 10, 0, 0, 1)
+	v2 = binary.BigEndian.AppendUint16(v2, 51234)
+	v2 = binary.BigEndian.AppendUint16(v2, 8338)
+
+	tests := []struct {
+		name   string
+		header []byte
+		remote string // empty for the proxy's own address
+	}{
+		{"v1 tcp4",
+			[]byte("PROXY TCP4 198.51.100.22 10.0.0.1 40000 8338\r\n"),
+			"198.51.100.22:40000"},
+		{"v1 tcp6",
+			[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 40001 8338\r\n"),
+			"[2001:db8::1]:40001"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", v2, "203.0.113.7:51234"},
+		{"v2 local", append(append([]byte{}, proxyV2Sig...),
+			0x20, 0x00, 0, 0), ""},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		// the client's first bytes have to come through after the header
+		go client.Write(append(test.header, 0xaa, 0xbb))
+
+		con, err := readProxyHeader(server)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		remote := con.RemoteAddr().String()
+		if test.remote == "" {
+			test.remote = server.RemoteAddr().String()
+		}
+		if remote != test.remote {
+			t.Fatalf("%s: remote address %s, expected %s",
+				test.name, remote, test.remote)
+		}
+		var rest [2]byte
+		_, err = io.ReadFull(con, rest[:])
+		if err != nil || rest != [2]byte{0xaa, 0xbb} {
+			t.Fatalf("%s: read %x %v after the header", test.name, rest, err)
+		}
+		client.Close()
+		server.Close()
+	}
+
+	// connections without a header get hung up on
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("\x00\x00\x00\x01\x7f\xff\xff\xff____"))
+	_, err := readProxyHeader(server)
+	if err == nil {
+		t.Fatal("read a PROXY header from a connection without one")
+	}
+}
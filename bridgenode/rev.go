@@ -3,6 +3,7 @@ package bridgenode
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -10,6 +11,8 @@ import (
 	"path/filepath"
 	"sync"
 
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
 
 	"github.com/btcsuite/btcd/wire"
@@ -58,49 +61,234 @@ func BlockAndRevReader(
 
 	// finishedHeight is the height we're finsihed reading & sending out.
 
-	var offsetFilePath = cfg.UtreeDir.OffsetDir.OffsetFile
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blockChan, errChan := blockAndRevStream(cfg, finishedHeight+1, ctx)
+
 	stop := false
-	offsetFile, err := os.Open(offsetFilePath)
+	for bnr := range blockChan {
+		wg.Add(3) // Undo, TTL, Proof
+		aChan <- bnr
+		bChan <- bnr
+		finishedHeight = bnr.Height
+		select {
+		case stop = <-haltRequest: // receives true from stopBuildProofs()
+		default:
+		}
+		if stop {
+			cancel()
+			break
+		}
+	}
+	if !stop {
+		err := <-errChan
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+	fmt.Printf("finished reading blocks, last height %d\n", finishedHeight)
+	close(aChan)
+	close(bChan)
+}
+
+// blockAndRevStream reads blocks and rev blocks from start up to and
+// including cfg.quitAfter, sending them in order on the returned block
+// channel.  The raw bytes are read sequentially, then deserialized and turned
+// into leaves by cfg.parseWorkers workers; the results are put back in height
+// order before being sent.  Reading stays at most one blk file batch plus a
+// few blocks per worker ahead of the consumer.  The block channel is closed
+// when reading stops; after that the error channel gives nil if every block
+// was sent, or the error that stopped the read.  Cancelling ctx stops the
+// read early.
+func blockAndRevStream(cfg *Config, start int32, ctx context.Context) (
+	<-chan blockAndRev, <-chan error) {
+
+	workers := cfg.parseWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	blockChan := make(chan blockAndRev, 10)
+	errChan := make(chan error, 1)
+
+	// jobs go out to the workers in any order, and every job's result
+	// channel goes into ordered in height order
+	jobs := make(chan parseJob, workers)
+	ordered := make(chan chan parseResult, 10+2*workers)
+	readErr := make(chan error, 1)
+
+	// stops the reader if a block fails to parse
+	ctx, cancel := context.WithCancel(ctx)
+
+	for i := 0; i < workers; i++ {
+		go parseWorker(jobs)
+	}
+
+	go func() {
+		err := readBlockBytes(cfg, start, ctx, jobs, ordered)
+		close(jobs)
+		close(ordered)
+		readErr <- err
+	}()
+
+	go func() {
+		var err error
+		defer func() {
+			cancel()
+			close(blockChan)
+			errChan <- err
+			close(errChan)
+		}()
+
+	sendLoop:
+		for resChan := range ordered {
+			res := <-resChan
+			if res.err != nil {
+				err = res.err
+				break
+			}
+			select {
+			case blockChan <- res.bnr:
+			case <-ctx.Done():
+				err = ctx.Err()
+				break sendLoop
+			}
+		}
+		if err != nil {
+			cancel()
+			// let the reader see the cancel and finish up
+			for range ordered {
+			}
+			<-readErr
+			return
+		}
+		err = <-readErr
+	}()
+
+	return blockChan, errChan
+}
+
+// parseJob is the raw bytes for a block & rev block, and where to send the
+// parsed blockAndRev
+type parseJob struct {
+	height   int32
+	blkBytes []byte
+	revBytes []byte
+	result   chan parseResult
+}
+
+type parseResult struct {
+	bnr blockAndRev
+	err error
+}
+
+// parseWorker deserializes blocks and builds their leaves until jobs is closed
+func parseWorker(jobs <-chan parseJob) {
+	for job := range jobs {
+		var res parseResult
+		res.bnr, res.err = parseBlockAndRev(job.height, job.blkBytes, job.revBytes)
+		job.result <- res
+	}
+}
+
+// parseBlockAndRev turns raw block & rev bytes into a blockAndRev with the
+// adds and dels already worked out
+func parseBlockAndRev(
+	height int32, blkBytes, revBytes []byte) (bnr blockAndRev, err error) {
+
+	var blk wire.MsgBlock
+	err = blk.Deserialize(bytes.NewReader(blkBytes))
 	if err != nil {
-		panic(err)
+		err = fmt.Errorf("block %d: %s", height, err.Error())
+		return
 	}
-	defer offsetFile.Close() // file always closes
+	err = bnr.Rev.Deserialize(bytes.NewReader(revBytes))
+	if err != nil {
+		err = fmt.Errorf("rev block %d: %s", height, err.Error())
+		return
+	}
+	bnr.Height = height
+	bnr.Blk = btcutil.NewBlock(&blk)
+	bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+		util.DedupeBlock(bnr.Blk)
+
+	err = bnr.prepare()
+	return
+}
 
-	for finishedHeight < cfg.quitAfter && !stop {
+// readBlockBytes sends the raw bytes of blocks start to cfg.quitAfter to
+// jobs, and their result channels to ordered, until done or ctx is cancelled.
+func readBlockBytes(cfg *Config, start int32, ctx context.Context,
+	jobs chan<- parseJob, ordered chan<- chan parseResult) error {
+
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+
+	tip, err := offsetFileTip(offsetFile)
+	if err != nil {
+		return err
+	}
+	end := cfg.quitAfter
+	if start > end {
+		return nil
+	}
+	if end > tip {
+		return errPastIndexedTip(start, end, tip)
+	}
+
+	height := start
+	for height <= end {
 		blocksToRead := int32(1000)
-		if finishedHeight+blocksToRead >= cfg.quitAfter {
-			blocksToRead = cfg.quitAfter - finishedHeight
+		if height+blocksToRead > end {
+			blocksToRead = end - height + 1
 		}
-		blocks, revs, err :=
-			GetRawBlocksFromDisk(
-				finishedHeight+1, blocksToRead, offsetFile, cfg.BlockDir)
+		blks, revs, err := getRawBlockBytes(
+			height, blocksToRead, offsetFile, cfg.BlockDir)
 		if err != nil {
-			fmt.Printf(err.Error())
-			// close(blockChan)
-			return
+			return err
+		}
+		if len(blks) == 0 {
+			return fmt.Errorf("blockAndRevStream: no blocks read at %d",
+				height)
 		}
 
-		for i := 0; i < len(blocks) && !stop; i++ {
-			bnr := blockAndRev{
-				Height: finishedHeight + 1,
-				Blk:    btcutil.NewBlock(&blocks[i]),
-				Rev:    revs[i],
+		for i := range blks {
+			job := parseJob{
+				height:   height,
+				blkBytes: blks[i],
+				revBytes: revs[i],
+				result:   make(chan parseResult, 1),
 			}
-			bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
-				util.DedupeBlock(bnr.Blk)
-			wg.Add(3) // Undo, TTL, Proof
-			aChan <- bnr
-			bChan <- bnr
-			finishedHeight++
 			select {
-			case stop = <-haltRequest: // receives true from stopBuildProofs()
-			default:
+			case ordered <- job.result:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				// the result channel is already in ordered, so fill it
+				job.result <- parseResult{err: ctx.Err()}
+				return ctx.Err()
+			}
+			height++
 		}
 	}
-	fmt.Printf("finished reading blocks, last height %d\n", finishedHeight)
-	close(aChan)
-	close(bChan)
+	return nil
+}
+
+// offsetFileTip returns the height of the last block in the offset file.
+func offsetFileTip(offsetFile *os.File) (int32, error) {
+	info, err := offsetFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// 12 bytes per block
+	return int32(info.Size() / 12), nil
 }
 
 // GetRawBlocksFromDisk retrives multiple consecutive blocks starting at height `startAt`.
@@ -108,16 +296,54 @@ func BlockAndRevReader(
 // Only blocks that are contained in the same blk file are returned.
 func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 	blockDir string) (blocks []wire.MsgBlock, revs []RevBlock, err error) {
+
+	blkBytes, revBytes, err := getRawBlockBytes(
+		startAt, count, offsetFile, blockDir)
+	if err != nil {
+		return
+	}
+
+	blocks = make([]wire.MsgBlock, len(blkBytes))
+	revs = make([]RevBlock, len(blkBytes))
+	for i := range blkBytes {
+		// TODO this is probably expensive. fix
+		err = blocks[i].Deserialize(bytes.NewReader(blkBytes[i]))
+		if err != nil {
+			return
+		}
+		err = revs[i].Deserialize(bytes.NewReader(revBytes[i]))
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// getRawBlockBytes is GetRawBlocksFromDisk without the deserialization.  It
+// returns the serialized blocks and rev blocks, without the magic bytes and
+// sizes in front of them.
+func getRawBlockBytes(startAt int32, count int32, offsetFile *os.File,
+	blockDir string) (blocks, revs [][]byte, err error) {
 	if startAt == 0 {
 		err = fmt.Errorf("GetRawBlocksFromDisk: Block 0 is not not a thing")
 		return
 	}
-	startAt--
 
 	if count <= 0 {
 		return
 	}
 
+	tip, err := offsetFileTip(offsetFile)
+	if err != nil {
+		return
+	}
+	if startAt+count-1 > tip {
+		err = errPastIndexedTip(startAt, startAt+count-1, tip)
+		return
+	}
+	startAt--
+
 	// offset file consists of 12 bytes per block
 	// tipnum * 12 gives us the correct position for that block
 	_, err = offsetFile.Seek(int64(12*startAt), 0)
@@ -153,57 +379,47 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 			return
 		}
 	}
+	// running into the next blk file isn't an error
+	err = nil
 
 	if offsetsRead == 0 {
 		return
 	}
 
-	blockFile, err := os.Open(filepath.Join(blockDir,
-		fmt.Sprintf("blk%05d.dat", datFileNum)))
+	xorKey, err := readXorKey(blockDir)
 	if err != nil {
 		return
 	}
-	defer blockFile.Close()
 
 	// Read all block data needed for the blocks into memory.
-	// 1<<27 = 128MB
-	blockData := make([]byte, 1<<27)
-	_, err = blockFile.Read(blockData)
+	blockData, err := readDatFile(filepath.Join(blockDir,
+		fmt.Sprintf("blk%05d.dat", datFileNum)), xorKey)
 	if err != nil {
 		return
 	}
 
-	revFile, err := os.Open(filepath.Join(blockDir,
-		fmt.Sprintf("rev%05d.dat", datFileNum)))
-	if err != nil {
-		return
-	}
-	defer revFile.Close()
-
 	// Read all rev data needed for the blocks into memory.
-	// 1<<27 = 128MB
-	revData := make([]byte, 1<<27)
-	_, err = revFile.Read(revData)
+	revData, err := readDatFile(filepath.Join(blockDir,
+		fmt.Sprintf("rev%05d.dat", datFileNum)), xorKey)
 	if err != nil {
 		return
 	}
 
-	blocks = make([]wire.MsgBlock, offsetsRead)
-	revs = make([]RevBlock, offsetsRead)
-	skip := make([]byte, 8)
+	blocks = make([][]byte, offsetsRead)
+	revs = make([][]byte, offsetsRead)
 	for i := uint32(0); i < offsetsRead; i++ {
-		blockBuf := bytes.NewBuffer(blockData[offsets[i]:])
-		// skip 8 bytes, magic bytes + load size.
-		blockBuf.Read(skip)
-		// TODO this is probably expensive. fix
-		err = blocks[i].Deserialize(blockBuf)
+		// blocks start with 4 magic bytes & 4 bytes of size.
+		// the offset points to the magic bytes
+		blocks[i], err = sizedRecord(blockData, uint64(offsets[i])+8)
 		if err != nil {
+			err = fmt.Errorf("block %d: %s", int32(i)+startAt+1, err.Error())
 			return
 		}
-
-		revBuf := bytes.NewBuffer(revData[revOffsets[i]:])
-		err = revs[i].Deserialize(revBuf)
+		// rev offsets come from bitcoind's index and point past the size
+		revs[i], err = sizedRecord(revData, uint64(revOffsets[i]))
 		if err != nil {
+			err = fmt.Errorf("rev block %d: %s",
+				int32(i)+startAt+1, err.Error())
 			return
 		}
 	}
@@ -211,6 +427,40 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 	return
 }
 
+// readDatFile reads up to 128MB of a blk or rev file, which is as big as
+// bitcoind makes them, undoing any obfuscation with xorKey.
+func readDatFile(name string, xorKey []byte) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// 1<<27 = 128MB
+	data := make([]byte, 1<<27)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	xorBytes(data[:n], xorKey, 0)
+	return data[:n], nil
+}
+
+// sizedRecord returns the record at pos in data, where the 4 bytes before pos
+// are the little endian size of the record.
+func sizedRecord(data []byte, pos uint64) ([]byte, error) {
+	if pos < 4 || pos > uint64(len(data)) {
+		return nil, fmt.Errorf("offset %d out of range of %d byte file",
+			pos, len(data))
+	}
+	size := uint64(binary.LittleEndian.Uint32(data[pos-4 : pos]))
+	if pos+size > uint64(len(data)) {
+		return nil, fmt.Errorf("%d byte record at %d runs past %d byte file",
+			size, pos, len(data))
+	}
+	return data[pos : pos+size], nil
+}
+
 // FetchBlockHeight returns a height given a block header
 // returns error if block header was not found
 func FetchBlockHeightFromDB(header [32]byte, db *leveldb.DB) (int32, error) {
@@ -281,6 +531,11 @@ func GetBlockBytesFromFile(
 	}
 	// fmt.Printf("block %d in file %d offset %d\n", height+1, datFile, offset)
 
+	xorKey, err := readXorKey(blockDir)
+	if err != nil {
+		return
+	}
+
 	blockFName := fmt.Sprintf("blk%05d.dat", datFile)
 	bDir := filepath.Join(blockDir, blockFName)
 	blockFile, err := os.Open(bDir)
@@ -296,10 +551,13 @@ func GetBlockBytesFromFile(
 	}
 
 	// read the 4 byte length before the block itself
-	err = binary.Read(blockFile, binary.LittleEndian, &blklen)
+	var blklenBytes [4]byte
+	_, err = io.ReadFull(blockFile, blklenBytes[:])
 	if err != nil {
 		return
 	}
+	xorBytes(blklenBytes[:], xorKey, int64(offset)+4)
+	blklen = binary.LittleEndian.Uint32(blklenBytes[:])
 
 	b = make([]byte, blklen)
 
@@ -307,6 +565,7 @@ func GetBlockBytesFromFile(
 	if uint32(n) != blklen {
 		fmt.Printf("%d byte block but only read %d bytes\n", blklen, n)
 	}
+	xorBytes(b[:n], xorKey, int64(offset)+8)
 	return
 }
 
@@ -318,6 +577,15 @@ type blockAndRev struct {
 	Blk                     *btcutil.Block
 	inSkipList, outSkipList []uint32
 	inCount, outCount       uint32 // includes skipped
+
+	// filled in by prepare()
+	adds      []accumulator.Leaf
+	delLeaves []btcacc.LeafData
+	delHashes []accumulator.Hash
+
+	// serialized leaf data for each of adds.  Only for blocks from a peer,
+	// where it's kept in place of rev files.
+	addData [][]byte
 }
 
 /*
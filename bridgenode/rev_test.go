@@ -0,0 +1,253 @@
+package bridgenode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// mineTestBlock sets blk's merkle root and finds a nonce that gives it
+// regtest proof of work, so it passes the checks on blocks from peers.
+func mineTestBlock(blk *wire.MsgBlock) {
+	b := btcutil.NewBlock(blk)
+	merkles := blockchain.BuildMerkleTreeStore(b.Transactions(), false)
+	blk.Header.MerkleRoot = *merkles[len(merkles)-1]
+	blk.Header.Bits = chaincfg.RegressionNetParams.PowLimitBits
+	for blockchain.CheckProofOfWork(
+		b, chaincfg.RegressionNetParams.PowLimit) != nil {
+		blk.Header.Nonce++
+	}
+}
+
+// writeTestBlockFiles writes n blocks into blk00000.dat and rev00000.dat in
+// dir, along with an offset file indexing them.  After the first block, each
+// block has txs transactions spending the previous block's coinbase outputs.
+func writeTestBlockFiles(t testing.TB, dir string, n, txs int) *Config {
+	utreeDir := initUtreeDir(filepath.Join(dir, "utree"))
+	err := makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkScript := append([]byte{0x76, 0xa9, 0x14}, make([]byte, 20)...)
+	pkScript = append(pkScript, 0x88, 0xac)
+	magic := []byte{0xfa, 0xbf, 0xb5, 0xda}
+
+	var blkBuf, revBuf, offBuf bytes.Buffer
+	var prev, prevCoinbase [32]byte
+	for i := 0; i < n; i++ {
+		height := int32(i + 1)
+		var blk wire.MsgBlock
+		var rev bytes.Buffer
+		blk.Header.PrevBlock = prev
+		blk.Header.Timestamp = time.Unix(1296688602+int64(i)*600, 0)
+		cb := wire.NewMsgTx(1)
+		cb.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{byte(i), byte(i >> 8), 1},
+		})
+		for j := 0; j <= txs; j++ {
+			cb.AddTxOut(&wire.TxOut{Value: 50, PkScript: pkScript})
+		}
+		blk.AddTransaction(cb)
+
+		if i > 0 {
+			wire.WriteVarInt(&rev, 0, uint64(txs))
+			for j := 0; j < txs; j++ {
+				tx := wire.NewMsgTx(1)
+				tx.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{
+					Hash: prevCoinbase, Index: uint32(j)}})
+				tx.AddTxOut(&wire.TxOut{Value: 20, PkScript: pkScript})
+				tx.AddTxOut(&wire.TxOut{Value: 30, PkScript: pkScript})
+				blk.AddTransaction(tx)
+
+				// one input, from a coinbase one block back
+				wire.WriteVarInt(&rev, 0, 1)
+				undo := make([]byte, 64)
+				l := putVLQ(undo, uint64(height-1)*2+1)
+				rev.Write(undo[:l])
+				wire.WriteVarInt(&rev, 0, 0)
+				l = putCompressedTxOut(undo, 50, pkScript)
+				rev.Write(undo[:l])
+			}
+		} else {
+			wire.WriteVarInt(&rev, 0, 0)
+		}
+		mineTestBlock(&blk)
+		prev = blk.BlockHash()
+		prevCoinbase = cb.TxHash()
+
+		// rev offsets point past the magic bytes and size
+		revBuf.Write(magic)
+		binary.Write(&revBuf, binary.LittleEndian, uint32(rev.Len()))
+		binary.Write(&offBuf, binary.BigEndian, uint32(0))
+		binary.Write(&offBuf, binary.BigEndian, uint32(blkBuf.Len()))
+		binary.Write(&offBuf, binary.BigEndian, uint32(revBuf.Len()))
+		revBuf.Write(rev.Bytes())
+
+		// block offsets point at the magic bytes
+		blkBuf.Write(magic)
+		binary.Write(&blkBuf, binary.LittleEndian,
+			uint32(blk.SerializeSize()))
+		err = blk.Serialize(&blkBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "blk00000.dat"), blkBuf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "rev00000.dat"), revBuf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		utreeDir.OffsetDir.OffsetFile, offBuf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Config{
+		params:       chaincfg.RegressionNetParams,
+		BlockDir:     dir,
+		UtreeDir:     utreeDir,
+		quitAfter:    int32(n),
+		parseWorkers: 1,
+	}
+}
+
+func TestGetRawBlocksFromDiskRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockrange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := writeTestBlockFiles(t, dir, 20, 3)
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+
+	blocks, _, err := GetRawBlocksFromDisk(1, 20, offsetFile, cfg.BlockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 20 {
+		t.Fatalf("read %d blocks, expected 20", len(blocks))
+	}
+
+	_, _, err = GetRawBlocksFromDisk(15, 10, offsetFile, cfg.BlockDir)
+	if err == nil {
+		t.Fatal("expected error reading past the indexed tip")
+	}
+}
+
+func TestBlockAndRevStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := writeTestBlockFiles(t, dir, 50, 3)
+	// more workers than CPUs, so blocks finish out of order
+	cfg.parseWorkers = 4
+
+	// read everything from height 5
+	blockChan, errChan := blockAndRevStream(cfg, 5, context.Background())
+	expect := int32(5)
+	var prev [32]byte
+	for bnr := range blockChan {
+		if bnr.Height != expect {
+			t.Fatalf("got height %d, expected %d", bnr.Height, expect)
+		}
+		if expect > 5 && bnr.Blk.MsgBlock().Header.PrevBlock != prev {
+			t.Fatalf("block %d out of order", bnr.Height)
+		}
+		// 4 coinbase outputs and 3 txs with 2 outputs each,
+		// spending 3 of the last coinbase's outputs
+		if len(bnr.adds) != 10 || len(bnr.delLeaves) != 3 ||
+			len(bnr.delHashes) != 3 {
+			t.Fatalf("block %d: %d adds %d dels %d del hashes", bnr.Height,
+				len(bnr.adds), len(bnr.delLeaves), len(bnr.delHashes))
+		}
+		prev = *bnr.Blk.Hash()
+		expect++
+	}
+	err = <-errChan
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect != 51 {
+		t.Fatalf("stream stopped at %d, expected 51", expect)
+	}
+
+	// cancel part way through
+	ctx, cancel := context.WithCancel(context.Background())
+	blockChan, errChan = blockAndRevStream(cfg, 1, ctx)
+	<-blockChan
+	<-blockChan
+	cancel()
+	for range blockChan {
+	}
+	err = <-errChan
+	if err != nil && err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	// asking for more than the offset file has
+	cfg.quitAfter = 60
+	blockChan, errChan = blockAndRevStream(cfg, 1, context.Background())
+	for range blockChan {
+		t.Fatal("got a block from a range past the tip")
+	}
+	err = <-errChan
+	if err == nil {
+		t.Fatal("expected error streaming past the indexed tip")
+	}
+}
+
+// BenchmarkBlockAndRevStream reads, parses and hashes a few thousand blocks
+// with different numbers of parse workers.
+func BenchmarkBlockAndRevStream(b *testing.B) {
+	dir, err := ioutil.TempDir("", "blockstreambench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := writeTestBlockFiles(b, dir, 3000, 20)
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("Workers%d", workers), func(b *testing.B) {
+			cfg.parseWorkers = workers
+			for i := 0; i < b.N; i++ {
+				blockChan, errChan :=
+					blockAndRevStream(cfg, 1, context.Background())
+				for range blockChan {
+				}
+				err := <-errChan
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,17 +2,28 @@ package bridgenode
 
 import (
 	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"os"
 	"runtime/pprof"
 	"runtime/trace"
-	"time"
+	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+	"golang.org/x/time/rate"
 )
 
 func Start(cfg *Config, sig chan bool) error {
@@ -65,14 +76,20 @@ func Start(cfg *Config, sig chan bool) error {
 }
 
 func ArchiveServer(cfg *Config, sig chan bool) error {
-	// Channel to alert the tell the main loop it's ok to exit
-	haltRequest := make(chan bool, 1)
+	// Cancelled by stopServer() to stop serving
+	ctx, cancel := context.WithCancel(context.Background())
 
-	// Channel for ServeBlock() to wait
-	haltAccept := make(chan bool, 1)
-
-	// Handle user interruptions
-	go stopServer(sig, haltRequest, haltAccept)
+	// Handle user interruptions.  Once the server's done, wait for the
+	// shutdown hooks if there was a signal.
+	stopped := make(chan struct{})
+	go func() {
+		stopServer(ctx, sig, cancel, &onShutdown)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
 
 	if !util.HasAccess(cfg.BlockDir) {
 		return errNoDataDir(cfg.BlockDir)
@@ -83,36 +100,73 @@ func ArchiveServer(cfg *Config, sig chan bool) error {
 	if err != nil {
 		return err
 	}
+	err = checkTTLFiles(cfg.UtreeDir.TtlDir)
+	if err != nil {
+		return err
+	}
+	// don't serve anything past a bad block in the proof file
+	lastGood, err := ScanProofFile(cfg.UtreeDir.ProofDir)
+	if err != nil {
+		return err
+	}
+	if lastGood < maxHeight {
+		fmt.Printf("\tWARNING!! proof file only good to block %d, "+
+			"serving up to there instead of %d\n", lastGood, maxHeight)
+		maxHeight = lastGood
+	}
 
-	blockServer(maxHeight, cfg, haltRequest, haltAccept)
+	newBlockServer(cfg, maxHeight).listen(ctx)
 	return nil
 }
 
-// stopServer listens for the signal from the OS and initiates an exit sequence
-func stopServer(sig, haltRequest, haltAccept chan bool) {
+// stopServer listens for the signal from the OS and cancels the server's
+// ctx, so ArchiveServer() stops taking connections and returns.  Then it
+// runs the shutdown hooks, giving them up to shutdownTimeout.  It gives up
+// listening once ctx is done some other way.
+func stopServer(ctx context.Context, sig chan bool,
+	cancel context.CancelFunc, hooks *shutdownHooks) {
+
 	// Listen for SIGINT, SIGQUIT, SIGTERM
-	<-sig
-	haltRequest <- true
-	// Sometimes there are bugs that make the program run forever.
-	// Utreexo binary should never take more than 10 seconds to exit
-	go func() {
-		time.Sleep(2 * time.Second)
-		fmt.Println("Exit timed out. Force quitting.")
-		os.Exit(1)
-	}()
+	select {
+	case <-sig:
+	case <-ctx.Done():
+		return
+	}
 
 	// Tell the user that the sig is received
 	fmt.Println("User exit signal received. Exiting...")
+	cancel()
+	err := hooks.run(shutdownTimeout)
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// blockServer gives ublocks up to endHeight to whoever connects, with each
+// IP held to cfg's rate limit.
+type blockServer struct {
+	// RateLimitedConns is how many connections were hung up on for going
+	// over the limit.  Use atomic to read it.  It's first so it's 64 bit
+	// aligned on 32 bit platforms.
+	RateLimitedConns uint64
+
+	cfg       *Config
+	endHeight int32
+	limiter   *connLimiter
+}
 
-	// Wait until server says it's ok to exit
-	<-haltAccept
-	os.Exit(0)
+// newBlockServer makes a blockServer serving up to endHeight.
+func newBlockServer(cfg *Config, endHeight int32) *blockServer {
+	return &blockServer{
+		cfg:       cfg,
+		endHeight: endHeight,
+		limiter:   newConnLimiter(cfg.RateLimit, cfg.Burst),
+	}
 }
 
-// blockServer listens on a TCP port for incoming connections, then gives
-// ublocks blocks over that connection
-func blockServer(
-	endHeight int32, cfg *Config, haltRequest, haltAccept chan bool) {
+// listen listens on a TCP port for incoming connections, then gives
+// ublocks blocks over that connection until ctx is done
+func (s *blockServer) listen(ctx context.Context) {
 
 	// before doing anything... this breaks
 	/*
@@ -137,8 +191,13 @@ func blockServer(
 	*/
 	// --------------
 
-	fmt.Printf("serving up to & including block height %d\n", endHeight)
-	listenAdr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:8338")
+	fmt.Printf("serving up to & including block height %d\n", s.endHeight)
+	port, err := util.DefaultServerPort(s.cfg.params)
+	if err != nil {
+		fmt.Printf(err.Error())
+		return
+	}
+	listenAdr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort("0.0.0.0", port))
 	if err != nil {
 		fmt.Printf(err.Error())
 		return
@@ -150,59 +209,275 @@ func blockServer(
 		return
 	}
 
+	s.serve(ctx, listener)
+}
+
+// serve hands each connection made to listener off to a
+// serveBlocksWorker, until ctx is done.  Then it closes the listener and
+// returns.
+func (s *blockServer) serve(ctx context.Context, listener *net.TCPListener) {
+	cfg := s.cfg
+	var proofCache *BlockProofCache
+	if cfg.ProofCacheSize != 0 {
+		proofCache = NewBlockProofCache(cfg.ProofCacheSize)
+	}
 	cons := make(chan net.Conn)
-	go acceptConnections(listener, cons)
+	go s.acceptConnections(ctx, listener, cons)
 	for {
 		select {
-		case <-haltRequest:
+		case <-ctx.Done():
 			listener.Close()
-			haltAccept <- true
-			close(cons)
 			return
 		case con := <-cons:
-			go serveBlocksWorker(cfg.UtreeDir, con, endHeight, cfg.BlockDir)
+			go serveBlocksWorker(cfg.UtreeDir, con, s.endHeight, cfg.BlockDir,
+				cfg.paranoid, cfg.PrefetchWindow, proofCache, cfg.params.Net,
+				cfg.ServerLog)
 		}
 	}
 }
 
-func acceptConnections(listener *net.TCPListener, cons chan net.Conn) {
+// acceptConnections sends connections made to listener on cons, hanging up
+// on ones over the rate limit.  With the proxy protocol on, each connection
+// starts with a PROXY header, and the limit goes by the address in that.
+// It returns once listener is closed.  Connections that get through after
+// ctx is done are hung up on instead of sent.
+func (s *blockServer) acceptConnections(ctx context.Context,
+	listener *net.TCPListener, cons chan net.Conn) {
 	fmt.Printf("listening for connections on %s\n", listener.Addr().String())
 	for {
-		select {
-		case <-cons:
-			// cons got closed, stop accepting new connections
-			fmt.Printf("dropped con\n")
+		con, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+			default:
+				fmt.Printf("blockServer accept error: %s\n", err.Error())
+			}
 			return
-		default:
 		}
+		// a slow PROXY header only holds up its own connection
+		go s.admitConnection(ctx, con, cons)
+	}
+}
 
-		con, err := listener.Accept()
+// admitConnection reads con's PROXY header if the proxy protocol is on,
+// then sends con on cons if it's under the rate limit, hanging up on it
+// otherwise.
+func (s *blockServer) admitConnection(ctx context.Context, con net.Conn,
+	cons chan net.Conn) {
+	if s.cfg.proxyProtocol {
+		pcon, err := readProxyHeader(con)
 		if err != nil {
-			fmt.Printf("blockServer accept error: %s\n", err.Error())
+			fmt.Printf("WARNING %s, hanging up\n", err.Error())
+			con.Close()
 			return
 		}
+		con = pcon
+	}
 
-		cons <- con
+	if !s.limiter.allow(con.RemoteAddr()) {
+		atomic.AddUint64(&s.RateLimitedConns, 1)
+		fmt.Printf("WARNING %s over connection rate limit, hanging up\n",
+			con.RemoteAddr().String())
+		con.Close()
+		return
+	}
+
+	select {
+	case cons <- con:
+	case <-ctx.Done():
+		con.Close()
 	}
 }
 
+// connLimiter keeps a token bucket for each IP that connects to the block
+// server, so one client can't keep the server busy with new connections.
+type connLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mtx      sync.Mutex
+	limiters map[string]*list.Element
+	// ipLimiters, least recently seen at the back
+	lru *list.List
+}
+
+type ipLimiter struct {
+	*rate.Limiter
+	ip string
+}
+
+// maxIPLimiters is how many IPs connLimiter keeps track of.  Past that it
+// forgets the one it's seen least recently, which gets a full bucket if it
+// comes back.
+const maxIPLimiters = 1000
+
+// newConnLimiter makes a connLimiter allowing limit connections per second
+// from each IP, with up to burst at once.  A limit of 0 or less means no
+// limit.
+func newConnLimiter(limit rate.Limit, burst int) *connLimiter {
+	if limit <= 0 {
+		limit = rate.Inf
+	}
+	return &connLimiter{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// allow says whether a new connection from addr is under the limit, and
+// takes a token from its IP's bucket if so.
+func (cl *connLimiter) allow(addr net.Addr) bool {
+	if cl.limit == rate.Inf {
+		return true
+	}
+	ip := addr.String()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP.String()
+	}
+
+	cl.mtx.Lock()
+	defer cl.mtx.Unlock()
+
+	elem, ok := cl.limiters[ip]
+	if ok {
+		cl.lru.MoveToFront(elem)
+	} else {
+		if cl.lru.Len() >= maxIPLimiters {
+			oldest := cl.lru.Remove(cl.lru.Back()).(*ipLimiter)
+			delete(cl.limiters, oldest.ip)
+		}
+		elem = cl.lru.PushFront(&ipLimiter{
+			Limiter: rate.NewLimiter(cl.limit, cl.burst), ip: ip})
+		cl.limiters[ip] = elem
+	}
+	return elem.Value.(*ipLimiter).Allow()
+}
+
+// defaultPrefetchWindow is how many blocks serveBlocksWorker reads ahead
+// when Config.PrefetchWindow isn't set
+const defaultPrefetchWindow = 4
+
+// servedBlock is a block and its udata read off disk by prefetchBlocks.
+// Height 0 has neither.
+type servedBlock struct {
+	height int32
+	udb    []byte
+	blk    []byte
+
+	// udbErr and blkErr are from reading the udata and the block.  The
+	// block isn't read if the udata couldn't be.
+	udbErr, blkErr error
+}
+
+// prefetchBlocks reads the blocks and udata from fromHeight to toHeight,
+// stepping by direction, and sends them in order.  Up to window of them are
+// read before they're taken, so reading the next blocks happens while the
+// ones before are being sent.  It stops after the first one it couldn't
+// read, or when quit is closed, and closes the channel it gives.  The
+// udata comes from proofCache, which can be nil.
+func prefetchBlocks(utreeDir utreeDir, blockDir string,
+	fromHeight, toHeight, direction int32, window int,
+	proofCache *BlockProofCache, quit chan struct{}) chan servedBlock {
+
+	blocks := make(chan servedBlock, window)
+	go func() {
+		defer close(blocks)
+		for curHeight := fromHeight; ; curHeight += direction {
+			if direction == 1 && curHeight > toHeight {
+				// forwards request of height above toHeight
+				return
+			} else if direction == -1 && curHeight < toHeight {
+				// backwards request of height below toHeight
+				return
+			}
+
+			sb := servedBlock{height: curHeight}
+			// there's no proof for genesis
+			if curHeight != 0 {
+				sb.udb, sb.udbErr = proofCache.Get(
+					utreeDir.ProofDir, curHeight)
+				if sb.udbErr == nil {
+					sb.blk, sb.blkErr = GetBlockBytesFromFile(
+						curHeight, utreeDir.OffsetDir.OffsetFile, blockDir)
+				}
+			}
+			select {
+			case blocks <- sb:
+			case <-quit:
+				return
+			}
+			if sb.udbErr != nil || sb.blkErr != nil {
+				return
+			}
+		}
+	}()
+	return blocks
+}
+
+// connLog logs for one connection.  Every line starts with a random
+// request ID and the client's address, so lines from connections being
+// served at the same time can be told apart.
+type connLog struct {
+	l      *log.Logger
+	prefix string
+}
+
+// newConnLog makes a connLog for a connection from remote that logs to l,
+// or to stdout if l is nil.
+func newConnLog(l *log.Logger, remote net.Addr) *connLog {
+	if l == nil {
+		l = log.New(os.Stdout, "", 0)
+	}
+	var id [4]byte
+	// a repeated ID only makes the logs a bit more confusing
+	rand.Read(id[:])
+	return &connLog{l: l, prefix: fmt.Sprintf("[%x %s] ", id, remote)}
+}
+
+// Printf logs like log.Printf.  Messages over several lines, like proofs,
+// get the prefix on each line.
+func (cl *connLog) Printf(format string, args ...interface{}) {
+	msg := strings.TrimRight(fmt.Sprintf(format, args...), "\n")
+	cl.l.Output(2, cl.prefix+strings.Replace(msg, "\n", "\n"+cl.prefix, -1))
+}
+
 // serveBlocksWorker gets height requests from client and sends out the ublock
-// for that height
-func serveBlocksWorker(UtreeDir utreeDir,
-	c net.Conn, endHeight int32, blockDir string) {
+// for that height.  If paranoid is set, the udata is checked against the
+// block before it's sent.  Up to prefetch blocks are read from disk ahead of
+// the one being sent; 0 means defaultPrefetchWindow.  Proofs are read
+// through proofCache, which can be shared between connections or nil.
+// Clients that say they're on a network other than btcnet get told so and
+// hung up on.
+// Everything about the connection is logged to logger, nil for stdout,
+// ending with a line giving the range asked for and what was sent.
+func serveBlocksWorker(UtreeDir utreeDir, c net.Conn, endHeight int32,
+	blockDir string, paranoid bool, prefetch int,
+	proofCache *BlockProofCache, btcnet wire.BitcoinNet, logger *log.Logger) {
 	defer c.Close()
-	fmt.Printf("start serving %s\n", c.RemoteAddr().String())
-	var fromHeight, toHeight int32
+	cl := newConnLog(logger, c.RemoteAddr())
+	cl.Printf("start serving")
 
-	err := binary.Read(c, binary.BigEndian, &fromHeight)
+	clientNet, fromHeight, toHeight, err := uwire.ReadRequest(c)
 	if err != nil {
-		fmt.Printf("pushBlocks Read %s\n", err.Error())
+		cl.Printf("hung up without a request: %s", err.Error())
 		return
 	}
-
-	err = binary.Read(c, binary.BigEndian, &toHeight)
-	if err != nil {
-		fmt.Printf("pushBlocks Read %s\n", err.Error())
+	var blocksSent int
+	var bytesSent int64
+	defer func(wantTo int32) {
+		cl.Printf("hung up from=%d to=%d blocks=%d bytes=%d",
+			fromHeight, wantTo, blocksSent, bytesSent)
+	}(toHeight)
+
+	if clientNet != 0 && clientNet != btcnet {
+		cl.Printf("on network %s, we're on %s. Hanging up",
+			netName(clientNet), netName(btcnet))
+		err = uwire.WriteWrongNetwork(c, btcnet)
+		if err != nil {
+			cl.Printf("pushBlocks WriteWrongNetwork %s", err.Error())
+		}
 		return
 	}
 
@@ -217,23 +492,42 @@ func serveBlocksWorker(UtreeDir utreeDir,
 	}
 
 	if fromHeight > endHeight {
-		fmt.Printf("%s wanted %d but have %d\n",
-			c.LocalAddr().String(), fromHeight, endHeight)
+		cl.Printf("wanted %d but have %d", fromHeight, endHeight)
+		err = uwire.WriteNoProof(c, fromHeight)
+		if err != nil {
+			cl.Printf("pushBlocks WriteNoProof %s", err.Error())
+		}
 		return
 	}
 
-	for curHeight := fromHeight; ; curHeight += direction {
-		if direction == 1 && curHeight > toHeight {
-			// forwards request of height above toHeight
-			break
-		} else if direction == -1 && curHeight < toHeight {
-			// backwards request of height below toHeight
-			break
+	if prefetch < 1 {
+		prefetch = defaultPrefetchWindow
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	blocks := prefetchBlocks(UtreeDir, blockDir,
+		fromHeight, toHeight, direction, prefetch, proofCache, quit)
+
+	for sb := range blocks {
+		curHeight := sb.height
+
+		// there's no proof for genesis, so say so and go on to the next one
+		if curHeight == 0 {
+			err = uwire.WriteNoProof(c, curHeight)
+			if err != nil {
+				cl.Printf("pushBlocks WriteNoProof %s", err.Error())
+				break
+			}
+			continue
 		}
 
-		udb, err := GetUDataBytesFromFile(UtreeDir.ProofDir, curHeight)
-		if err != nil {
-			fmt.Printf("pushBlocks GetUDataBytesFromFile %s\n", err.Error())
+		udb := sb.udb
+		if sb.udbErr != nil {
+			cl.Printf("pushBlocks GetUDataBytesFromFile %s", sb.udbErr.Error())
+			err = uwire.WriteNoProof(c, curHeight)
+			if err != nil {
+				cl.Printf("pushBlocks WriteNoProof %s", err.Error())
+			}
 			break
 		}
 
@@ -243,40 +537,57 @@ func serveBlocksWorker(UtreeDir utreeDir,
 		var ud btcacc.UData
 		err = ud.Deserialize(buf)
 		if err != nil {
-			fmt.Printf("serveBlocksWorker h %d deser error %s\n", curHeight, err.Error())
-			fmt.Printf("ttls: %v targets %s\n", ud.TxoTTLs, ud.AccProof.ToString())
-			fmt.Printf("udb: %x\n", udb)
+			cl.Printf("serveBlocksWorker h %d deser error %s", curHeight, err.Error())
+			cl.Printf("ttls: %v targets %s", ud.TxoTTLs, ud.AccProof.ToString())
+			cl.Printf("udb: %x", udb)
 			break
 		}
 		if len(ud.AccProof.Targets) != 0 {
-			fmt.Printf("h %d proof %s\n", curHeight, ud.AccProof.ToString())
+			cl.Printf("h %d proof %s", curHeight, ud.AccProof.ToString())
 		}
 
-		blkbytes, err := GetBlockBytesFromFile(
-			curHeight, UtreeDir.OffsetDir.OffsetFile, blockDir)
-		if err != nil {
-			fmt.Printf("pushBlocks GetRawBlockFromFile %s\n", err.Error())
+		blkbytes := sb.blk
+		if sb.blkErr != nil {
+			cl.Printf("pushBlocks GetRawBlockFromFile %s", sb.blkErr.Error())
 			break
 		}
 
+		if paranoid {
+			blk, err := btcutil.NewBlockFromBytes(blkbytes)
+			if err != nil {
+				cl.Printf("serveBlocksWorker h %d block deser error %s",
+					curHeight, err.Error())
+				break
+			}
+			err = ud.CheckBlock(blk)
+			if err != nil {
+				cl.Printf("serveBlocksWorker h %d %s", curHeight, err.Error())
+				break
+			}
+		}
+
 		// send
-		_, err = c.Write(append(blkbytes, udb...))
+		n, err := c.Write(append(blkbytes, udb...))
+		bytesSent += int64(n)
 		if err != nil {
-			fmt.Printf("pushBlocks blkbytes write %s\n", err.Error())
+			cl.Printf("pushBlocks blkbytes write %s", err.Error())
 			break
 		}
+		blocksSent++
 	}
 	err = c.Close()
 	if err != nil {
-		fmt.Print(err.Error())
+		cl.Printf("close %s", err.Error())
 	}
-	fmt.Printf("hung up on %s\n", c.RemoteAddr().String())
 }
 
 // GetUDataBytesFromFile reads the proof data from proof.dat and proofoffset.dat
 // and gives the proof & utxo data back.
 // Don't ask for block 0, there is no proof for that.
 // But there is an offset for block 0, which is 0, so it collides with block 1
+// Proofs saved in the v1 format are converted, so the bytes returned are
+// always v2.  A proof that says it's over proofDir's max size, or runs past
+// the end of the file, gives an ErrCorruptProof.
 func GetUDataBytesFromFile(proofDir proofDir, height int32) (b []byte, err error) {
 	if height == 0 {
 		err = fmt.Errorf("GetUDataBytesFromFile: Block 0 is not not a thing")
@@ -286,16 +597,17 @@ func GetUDataBytesFromFile(proofDir proofDir, height int32) (b []byte, err error
 	var offset int64
 	var size uint32
 	var readMagic [4]byte
-	realMagic := [4]byte{0xaa, 0xff, 0xaa, 0xff}
 	offsetFile, err := os.OpenFile(proofDir.pOffsetFile, os.O_RDONLY, 0600)
 	if err != nil {
 		return
 	}
+	defer offsetFile.Close()
 
 	proofFile, err := os.OpenFile(proofDir.pFile, os.O_RDONLY, 0600)
 	if err != nil {
 		return
 	}
+	defer proofFile.Close()
 
 	// offset file consists of 8 bytes per block
 	// tipnum * 8 gives us the correct position for that block
@@ -318,43 +630,110 @@ func GetUDataBytesFromFile(proofDir proofDir, height int32) (b []byte, err error
 		return
 	}
 	// first read 4-byte magic aaffaaff
-	n, err := proofFile.Read(readMagic[:])
+	_, err = io.ReadFull(proofFile, readMagic[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errCorruptProof(height, offset, "is past the end of the file")
+	}
 	if err != nil {
 		return nil, err
 	}
-	if n != 4 {
-		return nil, fmt.Errorf("only read %d bytes from proof file", n)
-	}
-	if readMagic != realMagic {
-		return nil, fmt.Errorf("expect magic %x but read %x h %d offset %d",
-			realMagic, readMagic, height, offset)
+	// v1 proofs only exist with the default magic
+	isV1 := readMagic == proofMagicV1 && proofDir.ProofMagic == proofMagic
+	if readMagic != proofDir.ProofMagic && !isV1 {
+		return nil, errWrongProofMagic(proofDir.ProofMagic, readMagic, height)
 	}
 
 	err = binary.Read(proofFile, binary.BigEndian, &size)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errCorruptProof(height, offset, "has no size")
+	}
 	if err != nil {
 		return
 	}
 	// fmt.Printf("height %d offset %d says size %d\n", height, offset, size)
-	if size > 1<<24 {
-		return nil, fmt.Errorf(
-			"size at offest %d says %d which is too big", offset, size)
+	if int64(size) > proofDir.maxSize() {
+		return nil, errCorruptProof(height, offset, fmt.Sprintf(
+			"says it's %d bytes, over the %d byte limit",
+			size, proofDir.maxSize()))
 	}
 	// fmt.Printf("GetUDataBytesFromFile read size %d ", size)
 	b = make([]byte, size)
 
-	_, err = proofFile.Read(b)
+	n, err := io.ReadFull(proofFile, b)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errCorruptProof(height, offset, fmt.Sprintf(
+			"says it's %d bytes but the file only has %d", size, n))
+	}
 	if err != nil {
 		err = fmt.Errorf("proofFile.Read(ubytes) %s", err.Error())
 		return
 	}
 
-	err = offsetFile.Close()
+	// v1 proofs get converted so callers only ever see the current format
+	if isV1 {
+		var ud btcacc.UData
+		err = ud.DeserializeV1(bytes.NewReader(b))
+		if err != nil {
+			err = fmt.Errorf("h %d v1 proof %s", height, err.Error())
+			return
+		}
+		var buf bytes.Buffer
+		err = ud.Serialize(&buf)
+		if err != nil {
+			return
+		}
+		b = buf.Bytes()
+	}
+	return
+}
+
+// GetTTLsFromFile reads the TTLs for every output created in a block from
+// the TTL file.  Outputs that haven't been spent yet are 0, and outputs that
+// were skipped (unspendable or spent in the same block) are btcacc.MaxTTL.
+func GetTTLsFromFile(ttlDir ttlDir, height int32) ([]int32, error) {
+	if height == 0 {
+		return nil, fmt.Errorf("GetTTLsFromFile: Block 0 is not not a thing")
+	}
+
+	offsetFile, err := os.Open(ttlDir.OffsetFile)
 	if err != nil {
-		return
+		return nil, err
 	}
-	err = proofFile.Close()
+	defer offsetFile.Close()
+
+	// the TTL offset file has where each block ends, starting with a 0 for
+	// where block 1 starts.  So block h goes from entry h-1 to entry h.
+	var startEnd [2]int64
+	_, err = offsetFile.Seek(int64(8*(height-1)), 0)
 	if err != nil {
-		return
+		return nil, err
 	}
-	return
+	err = binary.Read(offsetFile, binary.BigEndian, &startEnd)
+	if err != nil {
+		return nil, fmt.Errorf("GetTTLsFromFile h %d offsets %s",
+			height, err.Error())
+	}
+	size := startEnd[1] - startEnd[0]
+	if size < 0 || size%btcacc.TTLSize != 0 {
+		return nil, fmt.Errorf("GetTTLsFromFile h %d bad offsets %d to %d",
+			height, startEnd[0], startEnd[1])
+	}
+
+	ttlFile, err := os.Open(ttlDir.ttlsetFile)
+	if err != nil {
+		return nil, err
+	}
+	defer ttlFile.Close()
+
+	b := make([]byte, size)
+	_, err = ttlFile.ReadAt(b, startEnd[0])
+	if err != nil {
+		return nil, fmt.Errorf("GetTTLsFromFile h %d %s", height, err.Error())
+	}
+
+	ttls := make([]int32, size/btcacc.TTLSize)
+	for i := range ttls {
+		ttls[i] = btcacc.TTLFromBytes(b[i*btcacc.TTLSize:])
+	}
+	return ttls, nil
 }
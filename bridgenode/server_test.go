@@ -0,0 +1,607 @@
+package bridgenode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	uwire "github.com/mit-dci/utreexo/wire"
+	"golang.org/x/time/rate"
+)
+
+func TestConnRateLimit(t *testing.T) {
+	const attempts, burst = 200, 5
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// slow enough that no tokens come back during the test
+	server := newBlockServer(
+		&Config{RateLimit: rate.Every(time.Hour), Burst: burst}, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cons := make(chan net.Conn)
+	go server.acceptConnections(ctx, listener, cons)
+
+	var accepted uint64
+	go func() {
+		for {
+			select {
+			case con := <-cons:
+				con.Close()
+				atomic.AddUint64(&accepted, 1)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < attempts; i++ {
+		con, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		con.Close()
+	}
+
+	// wait for the server to get through them all
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadUint64(&server.RateLimitedConns) < attempts-burst ||
+		atomic.LoadUint64(&accepted) < burst {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d connections rate limited and %d accepted, "+
+				"expected %d and %d",
+				atomic.LoadUint64(&server.RateLimitedConns),
+				atomic.LoadUint64(&accepted), attempts-burst, burst)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	listener.Close()
+	if n := atomic.LoadUint64(&accepted); n != burst {
+		t.Fatalf("%d connections got through, expected %d", n, burst)
+	}
+	if limited := atomic.LoadUint64(&server.RateLimitedConns); limited !=
+		attempts-burst {
+		t.Fatalf("%d connections rate limited, expected %d",
+			limited, attempts-burst)
+	}
+
+	// no limit lets everything through
+	if !newConnLimiter(0, 0).allow(listener.Addr()) {
+		t.Fatal("limit of 0 rate limited a connection")
+	}
+}
+
+// connLimiter only keeps maxIPLimiters IPs, forgetting the one it's seen
+// least recently.
+func TestConnLimiterEvicts(t *testing.T) {
+	limiter := newConnLimiter(rate.Every(time.Hour), 1)
+	addr := func(i int) net.Addr {
+		return &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))}
+	}
+
+	if !limiter.allow(addr(0)) || limiter.allow(addr(0)) {
+		t.Fatal("expected 1 connection from 10.0.0.0 to get through")
+	}
+	for i := 1; i < maxIPLimiters; i++ {
+		limiter.allow(addr(i))
+	}
+	// seeing 10.0.0.0 again makes 10.0.0.1 the oldest
+	if limiter.allow(addr(0)) {
+		t.Fatal("10.0.0.0 got another connection through")
+	}
+	limiter.allow(addr(maxIPLimiters))
+	if len(limiter.limiters) != maxIPLimiters {
+		t.Fatalf("limiter has %d IPs, expected %d",
+			len(limiter.limiters), maxIPLimiters)
+	}
+	if limiter.allow(addr(0)) {
+		t.Fatal("10.0.0.0 was forgotten before 10.0.0.1")
+	}
+	if !limiter.allow(addr(1)) {
+		t.Fatal("10.0.0.1 wasn't forgotten")
+	}
+
+	for i := 0; i < maxIPLimiters; i++ {
+		limiter.allow(addr(maxIPLimiters + 1 + i))
+	}
+	if len(limiter.limiters) != maxIPLimiters ||
+		limiter.lru.Len() != maxIPLimiters {
+		t.Fatalf("limiter has %d IPs and %d in its lru, expected %d",
+			len(limiter.limiters), limiter.lru.Len(), maxIPLimiters)
+	}
+	if !limiter.allow(addr(0)) {
+		t.Fatal("10.0.0.0 wasn't forgotten")
+	}
+}
+
+// A proxy that's slow to send its PROXY header doesn't hold up the
+// connections after it.
+func TestSlowProxyHeader(t *testing.T) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cons := make(chan net.Conn)
+	server := newBlockServer(&Config{proxyProtocol: true}, 0)
+	go server.acceptConnections(ctx, listener, cons)
+
+	slow, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fast, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	_, err = fast.Write(
+		[]byte("PROXY TCP4 198.51.100.22 10.0.0.1 40000 8338\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case con := <-cons:
+		defer con.Close()
+		if con.RemoteAddr().String() != "198.51.100.22:40000" {
+			t.Fatalf("got connection from %s, expected 198.51.100.22:40000",
+				con.RemoteAddr().String())
+		}
+	case <-time.After(proxyHeaderTimeout / 2):
+		t.Fatal("connection with a header waited on the one without")
+	}
+}
+
+func TestServeFromGenesis(t *testing.T) {
+	const numBlocks = 5
+
+	dir, err := ioutil.TempDir("", "servegenesis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, numBlocks)
+
+	// ask for everything from genesis on
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveBlocksWorker(cfg.UtreeDir, server, numBlocks, cfg.BlockDir, true, 0,
+		nil, cfg.params.Net, nil)
+	go func() {
+		binary.Write(client, binary.BigEndian, int32(0))
+		binary.Write(client, binary.BigEndian, int32(math.MaxInt32))
+	}()
+
+	_, err = uwire.ReadUBlock(client)
+	noProof, ok := err.(*uwire.NoProofError)
+	if !ok || noProof.Height != 0 {
+		t.Fatalf("got error %v for genesis, expected no proof for height 0", err)
+	}
+	for h := int32(1); h <= numBlocks; h++ {
+		ub, err := uwire.ReadUBlock(client)
+		if err != nil {
+			t.Fatalf("h %d: %s", h, err.Error())
+		}
+		if ub.UtreexoData.Height != h {
+			t.Fatalf("got udata for h %d, expected %d",
+				ub.UtreexoData.Height, h)
+		}
+	}
+
+	// past the end there's an explicit no proof too
+	client, server = net.Pipe()
+	defer client.Close()
+	go serveBlocksWorker(cfg.UtreeDir, server, numBlocks, cfg.BlockDir, true, 0,
+		nil, cfg.params.Net, nil)
+	go func() {
+		binary.Write(client, binary.BigEndian, int32(numBlocks+1))
+		binary.Write(client, binary.BigEndian, int32(math.MaxInt32))
+	}()
+	_, err = uwire.ReadUBlock(client)
+	noProof, ok = err.(*uwire.NoProofError)
+	if !ok || noProof.Height != numBlocks+1 {
+		t.Fatalf("got error %v past the tip, expected no proof for height %d",
+			err, numBlocks+1)
+	}
+}
+
+// Blocks come out in order going backwards too, whatever the prefetch
+// window.
+func TestServeBackwards(t *testing.T) {
+	const numBlocks = 6
+
+	dir, err := ioutil.TempDir("", "servebackwards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, numBlocks)
+
+	for _, window := range []int{1, 2, numBlocks * 2} {
+		client, server := net.Pipe()
+		go serveBlocksWorker(
+			cfg.UtreeDir, server, numBlocks, cfg.BlockDir, true, window,
+			nil, cfg.params.Net, nil)
+		go func() {
+			binary.Write(client, binary.BigEndian, int32(numBlocks))
+			binary.Write(client, binary.BigEndian, int32(1))
+		}()
+		for h := int32(numBlocks); h >= 1; h-- {
+			ub, err := uwire.ReadUBlock(client)
+			if err != nil {
+				t.Fatalf("window %d h %d: %s", window, h, err.Error())
+			}
+			if ub.UtreexoData.Height != h {
+				t.Fatalf("window %d got udata for h %d, expected %d",
+					window, ub.UtreexoData.Height, h)
+			}
+		}
+		client.Close()
+	}
+}
+
+// BenchmarkServeBlocks serves blocks over a pipe to a client that takes a
+// little while with each one, so reading ahead has something to overlap
+// with.
+func BenchmarkServeBlocks(b *testing.B) {
+	const numBlocks = 200
+
+	dir, err := ioutil.TempDir("", "benchserve")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(b, dir, numBlocks)
+	quiet := log.New(ioutil.Discard, "", 0)
+
+	for _, window := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("prefetch%d", window), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				client, server := net.Pipe()
+				go serveBlocksWorker(
+					cfg.UtreeDir, server, numBlocks, cfg.BlockDir, false, window,
+					nil, cfg.params.Net, quiet)
+				go func() {
+					binary.Write(client, binary.BigEndian, int32(1))
+					binary.Write(client, binary.BigEndian, int32(numBlocks))
+				}()
+				for h := 1; h <= numBlocks; h++ {
+					_, err := uwire.ReadUBlock(client)
+					if err != nil {
+						b.Fatal(err)
+					}
+					time.Sleep(20 * time.Microsecond)
+				}
+				client.Close()
+			}
+		})
+	}
+}
+
+// A client on another network gets told which network the server is on,
+// and one that doesn't say gets served like before.
+func TestServeWrongNetwork(t *testing.T) {
+	const numBlocks = 3
+
+	dir, err := ioutil.TempDir("", "servewrongnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, numBlocks)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go serveBlocksWorker(cfg.UtreeDir, server, numBlocks, cfg.BlockDir, true, 0,
+		nil, cfg.params.Net, nil)
+	go uwire.WriteRequest(client, chaincfg.TestNet3Params.Net, 1, numBlocks)
+	_, err = uwire.ReadUBlock(client)
+	wrongNet, ok := err.(*uwire.WrongNetworkError)
+	if !ok || wrongNet.Net != chaincfg.RegressionNetParams.Net {
+		t.Fatalf("got error %v from a testnet client, expected the server "+
+			"to be on regtest", err)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go serveBlocksWorker(cfg.UtreeDir, server, numBlocks, cfg.BlockDir, true, 0,
+		nil, cfg.params.Net, nil)
+	go uwire.WriteRequest(client, 0, 1, numBlocks)
+	for h := int32(1); h <= numBlocks; h++ {
+		ub, err := uwire.ReadUBlock(client)
+		if err != nil {
+			t.Fatalf("h %d: %s", h, err.Error())
+		}
+		if ub.UtreexoData.Height != h {
+			t.Fatalf("got udata for h %d, expected %d",
+				ub.UtreexoData.Height, h)
+		}
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that can be read while a log.Logger is
+// still writing to it.
+type lockedBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	return lb.buf.String()
+}
+
+// Two connections served at once log with their own request IDs, and each
+// ends with a line saying what it asked for and got.
+func TestServeLogRequestID(t *testing.T) {
+	const numBlocks = 4
+
+	dir, err := ioutil.TempDir("", "servelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, numBlocks)
+
+	var logged lockedBuffer
+	logger := log.New(&logged, "", 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveBlocksWorker(cfg.UtreeDir, server, numBlocks, cfg.BlockDir,
+				false, 0, nil, cfg.params.Net, logger)
+		}()
+		go uwire.WriteRequest(client, 0, 2, numBlocks)
+		for h := 2; h <= numBlocks; h++ {
+			_, err = uwire.ReadUBlock(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+
+	// lines by request ID
+	lines := make(map[string][]string)
+	for _, line := range strings.Split(strings.TrimSpace(logged.String()), "\n") {
+		if !strings.HasPrefix(line, "[") || !strings.Contains(line, "] ") {
+			t.Fatalf("log line without a request ID: %s", line)
+		}
+		id := line[1:strings.IndexByte(line, ' ')]
+		lines[id] = append(lines[id], line[strings.Index(line, "] ")+2:])
+	}
+	if len(lines) != 2 {
+		t.Fatalf("%d request IDs in the log, expected 2:\n%s",
+			len(lines), logged.String())
+	}
+	for id, idLines := range lines {
+		if idLines[0] != "start serving" {
+			t.Fatalf("%s starts with %q", id, idLines[0])
+		}
+		last := idLines[len(idLines)-1]
+		var from, to, blocks, bytes int
+		_, err = fmt.Sscanf(last, "hung up from=%d to=%d blocks=%d bytes=%d",
+			&from, &to, &blocks, &bytes)
+		if err != nil {
+			t.Fatalf("%s ends with %q: %s", id, last, err.Error())
+		}
+		if from != 2 || to != numBlocks || blocks != numBlocks-1 || bytes == 0 {
+			t.Fatalf("%s ends with %q", id, last)
+		}
+	}
+}
+
+func TestGetUDataBytesCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "corruptproof")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 4
+	offsets := writeTestProofs(t, utreeDir, n)
+
+	// valid
+	info, err := os.Stat(utreeDir.ProofDir.pFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ends := append(offsets[2:], info.Size())
+	for h := int32(1); h <= n; h++ {
+		udb, err := GetUDataBytesFromFile(utreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatalf("h %d %s", h, err.Error())
+		}
+		if int64(len(udb)) != ends[h-1]-offsets[h]-8 {
+			t.Fatalf("h %d read %d bytes, expected %d",
+				h, len(udb), ends[h-1]-offsets[h]-8)
+		}
+	}
+
+	// over a lower limit
+	small := utreeDir.ProofDir
+	small.MaxProofSize = uint32(offsets[2] - offsets[1] - 8)
+	_, err = GetUDataBytesFromFile(small, 1)
+	if err != nil {
+		t.Fatalf("proof right at the limit: %s", err.Error())
+	}
+	small.MaxProofSize--
+	_, err = GetUDataBytesFromFile(small, 1)
+	if !errors.Is(err, ErrCorruptProof) {
+		t.Fatalf("got error %v over the limit, expected %s",
+			err, ErrCorruptProof)
+	}
+
+	// a size that's way too big
+	proofFile, err := os.OpenFile(utreeDir.ProofDir.pFile, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = proofFile.WriteAt([]byte{0x7f, 0, 0, 0}, offsets[2]+4)
+	proofFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetUDataBytesFromFile(utreeDir.ProofDir, 2)
+	if !errors.Is(err, ErrCorruptProof) {
+		t.Fatalf("got error %v with an oversize proof, expected %s",
+			err, ErrCorruptProof)
+	}
+
+	// the last proof cut short
+	err = os.Truncate(utreeDir.ProofDir.pFile, offsets[n]+12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetUDataBytesFromFile(utreeDir.ProofDir, n)
+	if !errors.Is(err, ErrCorruptProof) {
+		t.Fatalf("got error %v with a short read, expected %s",
+			err, ErrCorruptProof)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("block %d at offset %d",
+		n, offsets[n])) {
+		t.Fatalf("error doesn't say where the proof is: %s", err.Error())
+	}
+}
+
+// Clients all syncing the same blocks at once mostly get their proofs from
+// the cache instead of off disk.
+func TestServeProofCache(t *testing.T) {
+	const numBlocks, numClients = 20, 5
+
+	dir, err := ioutil.TempDir("", "serveproofcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, numBlocks)
+
+	proofCache := NewBlockProofCache(1 << 20)
+	quiet := log.New(ioutil.Discard, "", 0)
+	errs := make(chan error, numClients)
+	for i := 0; i < numClients; i++ {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serveBlocksWorker(cfg.UtreeDir, server, numBlocks, cfg.BlockDir,
+			true, 0, proofCache, cfg.params.Net, quiet)
+		go func() {
+			uwire.WriteRequest(client, 0, 1, numBlocks)
+			for h := int32(1); h <= numBlocks; h++ {
+				ub, err := uwire.ReadUBlock(client)
+				if err != nil {
+					errs <- fmt.Errorf("h %d: %s", h, err.Error())
+					return
+				}
+				if ub.UtreexoData.Height != h {
+					errs <- fmt.Errorf("got udata for h %d, expected %d",
+						ub.UtreexoData.Height, h)
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < numClients; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hits := atomic.LoadUint64(&proofCache.HitCount)
+	misses := atomic.LoadUint64(&proofCache.MissCount)
+	if misses != numBlocks {
+		t.Fatalf("%d misses, expected each of the %d blocks read once",
+			misses, numBlocks)
+	}
+	if hits != numBlocks*(numClients-1) {
+		t.Fatalf("%d hits, expected %d", hits, numBlocks*(numClients-1))
+	}
+}
+
+// The cache drops the least recently used proofs once it's full, and a
+// nil one still reads from disk.
+func TestBlockProofCacheEvict(t *testing.T) {
+	const numBlocks = 4
+
+	dir, err := ioutil.TempDir("", "proofcacheevict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, numBlocks)
+	proofDir := cfg.UtreeDir.ProofDir
+
+	var nilCache *BlockProofCache
+	sizes := make(map[int32]uint64)
+	for h := int32(1); h <= numBlocks; h++ {
+		udb, err := nilCache.Get(proofDir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[h] = uint64(len(udb))
+	}
+
+	// room for blocks 1 and 2 only
+	pc := NewBlockProofCache(sizes[1] + sizes[2])
+	for _, h := range []int32{1, 2, 1} {
+		if _, err := pc.Get(proofDir, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if pc.HitCount != 1 || pc.MissCount != 2 {
+		t.Fatalf("%d hits %d misses, expected 1 and 2",
+			pc.HitCount, pc.MissCount)
+	}
+	// 3 pushes out 2, which was used longest ago, as long as it fits
+	if _, err := pc.Get(proofDir, 3); err != nil {
+		t.Fatal(err)
+	}
+	if pc.size > pc.maxBytes {
+		t.Fatalf("cache holds %d bytes, more than its %d", pc.size, pc.maxBytes)
+	}
+	if _, ok := pc.proofs[2]; ok && sizes[3] <= sizes[2] {
+		t.Fatal("block 2 still cached after block 3 was added")
+	}
+	if _, ok := pc.proofs[3]; !ok && sizes[3] <= pc.maxBytes {
+		t.Fatal("block 3 not cached")
+	}
+}
@@ -0,0 +1,92 @@
+package bridgenode
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout is how long the shutdown hooks get before the bridge
+// exits without them.
+const shutdownTimeout = 10 * time.Second
+
+// shutdownHooks are what has to happen before the bridge exits on a signal,
+// like getting open files onto disk.  Components add a hook when they start
+// and remove it if they close by themselves.
+type shutdownHooks struct {
+	mtx   sync.Mutex
+	hooks []*shutdownHook
+}
+
+type shutdownHook struct {
+	name string
+	fn   func() error
+}
+
+// onShutdown are the hooks stopServer() and stopBuildProofs() run.
+var onShutdown shutdownHooks
+
+// add registers fn to run on shutdown, and gives back a func that takes it
+// out again.
+func (s *shutdownHooks) add(name string, fn func() error) (remove func()) {
+	hook := &shutdownHook{name: name, fn: fn}
+	s.mtx.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.mtx.Unlock()
+
+	return func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		for i, h := range s.hooks {
+			if h == hook {
+				s.hooks = append(s.hooks[:i], s.hooks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// run runs the hooks newest first, since things started later can depend on
+// things started earlier, and takes them all out.  A hook that fails doesn't
+// stop the ones after it, and the error says which ones failed.  If they
+// aren't done after timeout, run gives up on them and says which one it was
+// waiting on.
+func (s *shutdownHooks) run(timeout time.Duration) error {
+	s.mtx.Lock()
+	hooks := s.hooks
+	s.hooks = nil
+	s.mtx.Unlock()
+
+	var mtx sync.Mutex
+	var running string
+	done := make(chan error, 1)
+	go func() {
+		var failed []string
+		for i := len(hooks) - 1; i >= 0; i-- {
+			mtx.Lock()
+			running = hooks[i].name
+			mtx.Unlock()
+
+			err := hooks[i].fn()
+			if err != nil {
+				failed = append(failed, hooks[i].name+": "+err.Error())
+			}
+		}
+		if len(failed) != 0 {
+			done <- fmt.Errorf("shutdown failed: %s", strings.Join(failed, ", "))
+			return
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		mtx.Lock()
+		defer mtx.Unlock()
+		return fmt.Errorf("shutdown timed out after %s waiting on %s",
+			timeout, running)
+	}
+}
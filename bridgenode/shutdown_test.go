@@ -0,0 +1,91 @@
+package bridgenode
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A signal stops the server, then runs the hooks that are still there,
+// newest first, before stopServer returns.
+func TestStopServerShutdownHooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hooks := new(shutdownHooks)
+	var ran []string
+	hooks.add("first", func() error {
+		ran = append(ran, "first")
+		return nil
+	})
+	remove := hooks.add("removed", func() error {
+		ran = append(ran, "removed")
+		return nil
+	})
+	hooks.add("second", func() error {
+		if ctx.Err() == nil {
+			t.Error("hook ran while the server was still going")
+		}
+		ran = append(ran, "second")
+		return errors.New("disk full")
+	})
+	remove()
+
+	sig := make(chan bool, 1)
+	stopped := make(chan struct{})
+	go func() {
+		stopServer(ctx, sig, cancel, hooks)
+		close(stopped)
+	}()
+	sig <- true
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopServer didn't return after the signal")
+	}
+	err := hooks.run(time.Second)
+	if err != nil {
+		t.Fatalf("hooks left to run: %s", err.Error())
+	}
+	if !reflect.DeepEqual(ran, []string{"second", "first"}) {
+		t.Fatalf("hooks ran %v, expected [second first]", ran)
+	}
+
+	// without a signal nothing runs
+	ctx, cancel = context.WithCancel(context.Background())
+	hooks.add("no signal", func() error {
+		t.Error("hook ran without a signal")
+		return nil
+	})
+	cancel()
+	stopServer(ctx, make(chan bool), cancel, hooks)
+}
+
+func TestShutdownHooksErrors(t *testing.T) {
+	var hooks shutdownHooks
+	hooks.add("ok", func() error { return nil })
+	hooks.add("proof files", func() error { return errors.New("disk full") })
+	hooks.add("ttl files", func() error { return errors.New("bad fd") })
+	err := hooks.run(time.Second)
+	if err == nil || err.Error() !=
+		"shutdown failed: ttl files: bad fd, proof files: disk full" {
+		t.Fatalf("run gave error %v", err)
+	}
+}
+
+func TestShutdownHooksTimeout(t *testing.T) {
+	var hooks shutdownHooks
+	unblock := make(chan struct{})
+	defer close(unblock)
+	hooks.add("stuck", func() error {
+		<-unblock
+		return nil
+	})
+	hooks.add("quick", func() error { return nil })
+
+	err := hooks.run(10 * time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "waiting on stuck") {
+		t.Fatalf("run gave error %v, expected to time out on stuck", err)
+	}
+}
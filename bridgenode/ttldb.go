@@ -0,0 +1,560 @@
+package bridgenode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// ttlDB keeps track of where in their creation block outputs are, so that
+// when they're spent the TTL lookup worker knows which TTL slot to write.
+// TxidSortWriterWorker calls putBlock and TTLLookupWorker calls lookup, from
+// different goroutines.
+type ttlDB interface {
+	// putBlock records the txids created in a block, and the position in
+	// the block of each tx's first output.
+	putBlock(wb ttlWriteBlock) error
+
+	// lookup gives the position within its creation block of the txo
+	// a miniIn spends.  The txo is spent, so the db can forget it.
+	lookup(mi miniIn) (uint16, error)
+
+	close() error
+}
+
+type ttlDBType int
+
+const (
+	// flatTTLDB is the per block sorted txid file.  It's never deleted
+	// from, but it doesn't take any ram.
+	flatTTLDB ttlDBType = iota
+
+	// ramTTLDB keeps every unspent output in a map in ram.  Changes go to
+	// an append-only log, and the whole map is snapshotted every so often.
+	ramTTLDB
+)
+
+// openTTLDB opens whichever TTL db the config says to use.
+func openTTLDB(cfg *Config) (ttlDB, error) {
+	switch cfg.ttlDBType {
+	case ramTTLDB:
+		return openMapTTLDB(cfg.UtreeDir.TtlDir)
+	default:
+		return openFlatTxidDB(cfg.UtreeDir.TtlDir)
+	}
+}
+
+// onceTTLDB is a ttlDB that only gets closed once, so it can be closed by
+// whoever gets to it first.
+type onceTTLDB struct {
+	ttlDB
+	once sync.Once
+	err  error
+}
+
+func (db *onceTTLDB) close() error {
+	db.once.Do(func() {
+		db.err = db.ttlDB.close()
+	})
+	return db.err
+}
+
+// flatTxidDB is the sorted txid file.  Each block's txids are truncated to
+// 6 bytes, sorted and appended to txidFile along with where the tx's outputs
+// start.  txidOffsetFile says where each block starts in txidFile, counted in
+// 8 byte miniTxids and starting at height 1.
+type flatTxidDB struct {
+	txidFile, txidOffsetFile *os.File
+
+	// where the next block's txids start, in miniTxids
+	startOffset int64
+
+	// the block lookup last read the offsets for
+	seekHeight               int32
+	heightOffset, nextOffset int64
+}
+
+func openFlatTxidDB(ttl ttlDir) (*flatTxidDB, error) {
+	var db flatTxidDB
+	var err error
+	db.txidFile, err = os.OpenFile(ttl.txidFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	db.txidOffsetFile, err = os.OpenFile(
+		ttl.txidOffsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	db.startOffset, err = db.txidFile.Seek(0, 2)
+	if err != nil {
+		return nil, err
+	}
+	db.startOffset >>= 3 // divide by 8 to get the offset in miniTxids
+
+	// putBlock appends to the offset file
+	_, err = db.txidOffsetFile.Seek(0, 2)
+	if err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+func (db *flatTxidDB) putBlock(wb ttlWriteBlock) error {
+	// first write the current start offset, then increment it for next time
+	err := binary.Write(db.txidOffsetFile, binary.BigEndian, db.startOffset)
+	if err != nil {
+		return err
+	}
+	db.startOffset += int64(len(wb.mTxids))
+	sortTxids(wb.mTxids)
+	return wb.serialize(db.txidFile)
+}
+
+func (db *flatTxidDB) lookup(mi miniIn) (uint16, error) {
+	if mi.createHeight != db.seekHeight { // height change, get byte offsets
+		var startOffsetBytes, nextOffsetBytes [8]byte
+		// subtract 1 from stxo height because this file starts at height 1
+		_, err := db.txidOffsetFile.ReadAt(
+			startOffsetBytes[:], int64(mi.createHeight-1)*8)
+		if err != nil {
+			return 0, fmt.Errorf("txid offset for h %d: %s",
+				mi.createHeight, err.Error())
+		}
+		heightOffset := int64(binary.BigEndian.Uint64(startOffsetBytes[:]))
+
+		// TODO: make sure this is OK.  If we always have a
+		// block after the one we're seeking this will not error.
+		_, err = db.txidOffsetFile.ReadAt(
+			nextOffsetBytes[:], int64(mi.createHeight)*8)
+		if err != nil {
+			return 0, fmt.Errorf("next txid offset for h %d: %s",
+				mi.createHeight, err.Error())
+		}
+		nextOffset := int64(binary.BigEndian.Uint64(nextOffsetBytes[:]))
+		if nextOffset < heightOffset {
+			return 0, fmt.Errorf("h %d nextOffset %d < start %d",
+				mi.createHeight, nextOffset, heightOffset)
+		}
+		db.heightOffset, db.nextOffset = heightOffset, nextOffset
+		db.seekHeight = mi.createHeight
+	}
+	return binSearch(mi, db.heightOffset, db.nextOffset, db.txidFile), nil
+}
+
+func (db *flatTxidDB) close() error {
+	err := db.txidFile.Close()
+	if err != nil {
+		return err
+	}
+	return db.txidOffsetFile.Close()
+}
+
+// ttlSnapshotInterval is how many blocks mapTTLDB puts between snapshots
+const ttlSnapshotInterval = 1000
+
+// ttlKey is an outpoint, shortened the same way miniIn is.  The creation
+// height is in there so that 6 byte prefixes only need to be unique within
+// a block, same as in the txid file.
+type ttlKey struct {
+	createHeight int32
+	hashprefix   [6]byte
+	idx          uint16
+}
+
+// log records are a 1 byte op, then the 12 byte key, then for puts the 2 byte
+// position in block.  Snapshot records are the key and position.
+const (
+	ttlLogPut byte = 0x01
+	ttlLogDel byte = 0x02
+
+	ttlKeySize    = 12
+	ttlRecordSize = ttlKeySize + 2
+)
+
+func (k ttlKey) bytes() (b [ttlKeySize]byte) {
+	binary.BigEndian.PutUint32(b[:4], uint32(k.createHeight))
+	copy(b[4:10], k.hashprefix[:])
+	binary.BigEndian.PutUint16(b[10:], k.idx)
+	return
+}
+
+func ttlKeyFromBytes(b []byte) (k ttlKey) {
+	k.createHeight = int32(binary.BigEndian.Uint32(b[:4]))
+	copy(k.hashprefix[:], b[4:10])
+	k.idx = binary.BigEndian.Uint16(b[10:])
+	return
+}
+
+// mapTTLDB keeps the position in block of every unspent output in ram.
+// Every put and delete is appended to logFile, and every
+// ttlSnapshotInterval blocks the map is written to snapFile and the log
+// starts over.  Replaying the log on top of the snapshot is fine even if the
+// log was from before the snapshot, so a crash between writing the snapshot
+// and truncating the log doesn't lose anything.
+type mapTTLDB struct {
+	mtx       sync.Mutex
+	positions map[ttlKey]uint16
+
+	snapPath string
+	logFile  *os.File
+	log      *bufio.Writer
+
+	blocksSinceSnap int
+}
+
+func openMapTTLDB(ttl ttlDir) (*mapTTLDB, error) {
+	// a txid file without a snapshot is from before there was a map db
+	_, err := os.Stat(ttl.mapSnapFile)
+	if os.IsNotExist(err) {
+		txidInfo, err := os.Stat(ttl.txidFile)
+		if err == nil && txidInfo.Size() > 0 {
+			fmt.Printf("converting txid file to TTL map...\n")
+			err = migrateTxidFileToMap(ttl)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	db := mapTTLDB{
+		positions: make(map[ttlKey]uint16),
+		snapPath:  ttl.mapSnapFile,
+	}
+	err = db.readSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	db.logFile, err = os.OpenFile(ttl.mapLogFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = db.replayLog()
+	if err != nil {
+		return nil, err
+	}
+	db.log = bufio.NewWriter(db.logFile)
+	return &db, nil
+}
+
+// readSnapshot fills the map from the snapshot file, if there is one.
+func (db *mapTTLDB) readSnapshot() error {
+	snap, err := os.Open(db.snapPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer snap.Close()
+
+	r := bufio.NewReader(snap)
+	var count uint64
+	err = binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return fmt.Errorf("TTL snapshot: %s", err.Error())
+	}
+	var rec [ttlRecordSize]byte
+	for i := uint64(0); i < count; i++ {
+		_, err = io.ReadFull(r, rec[:])
+		if err != nil {
+			return fmt.Errorf("TTL snapshot record %d of %d: %s",
+				i, count, err.Error())
+		}
+		db.positions[ttlKeyFromBytes(rec[:ttlKeySize])] =
+			binary.BigEndian.Uint16(rec[ttlKeySize:])
+	}
+	return nil
+}
+
+// replayLog applies the log to the map.  A record cut off at the end is from
+// a write that didn't finish, so it's dropped from the file.
+func (db *mapTTLDB) replayLog() error {
+	_, err := db.logFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(db.logFile)
+	var good int64
+	var rec [1 + ttlRecordSize]byte
+	for {
+		_, err = io.ReadFull(r, rec[:1])
+		if err != nil {
+			break
+		}
+		var n int
+		switch rec[0] {
+		case ttlLogPut:
+			n = ttlRecordSize
+		case ttlLogDel:
+			n = ttlKeySize
+		default:
+			return fmt.Errorf("TTL log: bad op %x at byte %d", rec[0], good)
+		}
+		_, err = io.ReadFull(r, rec[1:1+n])
+		if err != nil {
+			break
+		}
+		k := ttlKeyFromBytes(rec[1 : 1+ttlKeySize])
+		if rec[0] == ttlLogPut {
+			db.positions[k] = binary.BigEndian.Uint16(rec[1+ttlKeySize:])
+		} else {
+			delete(db.positions, k)
+		}
+		good += int64(1 + n)
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	err = db.logFile.Truncate(good)
+	if err != nil {
+		return err
+	}
+	_, err = db.logFile.Seek(good, 0)
+	return err
+}
+
+func (db *mapTTLDB) putBlock(wb ttlWriteBlock) error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	skip := wb.outSkipList
+	var rec [1 + ttlRecordSize]byte
+	rec[0] = ttlLogPut
+	for _, mt := range wb.mTxids {
+		k := ttlKey{createHeight: wb.createHeight}
+		copy(k.hashprefix[:], mt.txid[:6])
+		for i := uint16(0); i < mt.outputs; i++ {
+			pos := mt.startsAt + i
+			// skipped outputs are never looked up, so don't keep them
+			s := sort.Search(len(skip), func(j int) bool {
+				return skip[j] >= uint32(pos)
+			})
+			if s < len(skip) && skip[s] == uint32(pos) {
+				continue
+			}
+			k.idx = i
+			db.positions[k] = pos
+			kb := k.bytes()
+			copy(rec[1:], kb[:])
+			binary.BigEndian.PutUint16(rec[1+ttlKeySize:], pos)
+			_, err := db.log.Write(rec[:])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := db.log.Flush()
+	if err != nil {
+		return err
+	}
+	db.blocksSinceSnap++
+	if db.blocksSinceSnap >= ttlSnapshotInterval {
+		return db.snapshot()
+	}
+	return nil
+}
+
+func (db *mapTTLDB) lookup(mi miniIn) (uint16, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	k := ttlKey{createHeight: mi.createHeight, hashprefix: mi.hashprefix,
+		idx: mi.idx}
+	pos, ok := db.positions[k]
+	if !ok {
+		return 0, fmt.Errorf("no txo %x:%d from h %d in TTL map",
+			mi.hashprefix, mi.idx, mi.createHeight)
+	}
+	delete(db.positions, k)
+
+	kb := k.bytes()
+	err := db.log.WriteByte(ttlLogDel)
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.log.Write(kb[:])
+	return pos, err
+}
+
+// snapshot writes the whole map to the snapshot file and empties the log.
+// The caller holds mtx.
+func (db *mapTTLDB) snapshot() error {
+	err := db.log.Flush()
+	if err != nil {
+		return err
+	}
+	err = writeTTLSnapshot(db.snapPath, db.positions)
+	if err != nil {
+		return err
+	}
+	err = db.logFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = db.logFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	db.blocksSinceSnap = 0
+	return nil
+}
+
+func (db *mapTTLDB) close() error {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+
+	err := db.snapshot()
+	if err != nil {
+		return err
+	}
+	return db.logFile.Close()
+}
+
+// writeTTLSnapshot writes positions to a temp file and then moves it over
+// path, so there's always a whole snapshot on disk.
+func writeTTLSnapshot(path string, positions map[ttlKey]uint16) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = binary.Write(w, binary.BigEndian, uint64(len(positions)))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	var rec [ttlRecordSize]byte
+	for k, pos := range positions {
+		kb := k.bytes()
+		copy(rec[:], kb[:])
+		binary.BigEndian.PutUint16(rec[ttlKeySize:], pos)
+		_, err = w.Write(rec[:])
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// migrateTxidFileToMap builds a mapTTLDB snapshot out of an existing txid
+// file, so switching to the map db doesn't need a resync.  The txid file
+// doesn't say how many outputs each tx has or whether they're spent, so
+// that comes from the TTL file: every output in a block has a TTL, and the
+// ones still 0 haven't been spent.  Both files need to cover the same blocks.
+func migrateTxidFileToMap(ttl ttlDir) error {
+	txidFile, err := os.Open(ttl.txidFile)
+	if err != nil {
+		return err
+	}
+	defer txidFile.Close()
+	txidInfo, err := txidFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	offsetBytes, err := ioutil.ReadFile(ttl.txidOffsetFile)
+	if err != nil {
+		return err
+	}
+	// the txid offset file starts at height 1; add where the last block ends
+	txidOffsets := make([]int64, len(offsetBytes)/8, len(offsetBytes)/8+1)
+	for i := range txidOffsets {
+		txidOffsets[i] = int64(binary.BigEndian.Uint64(offsetBytes[i*8:]))
+	}
+	txidOffsets = append(txidOffsets, txidInfo.Size()/8)
+
+	ttlOffsetBytes, err := ioutil.ReadFile(ttl.OffsetFile)
+	if err != nil {
+		return err
+	}
+	// the TTL offset file has a 0 for where block 1 starts, then the ends
+	if len(ttlOffsetBytes)/8 != len(txidOffsets) {
+		return fmt.Errorf("migrateTxidFileToMap: txid file has %d blocks "+
+			"but TTL file has %d, resync needed",
+			len(txidOffsets)-1, len(ttlOffsetBytes)/8-1)
+	}
+	ttlFile, err := os.Open(ttl.ttlsetFile)
+	if err != nil {
+		return err
+	}
+	defer ttlFile.Close()
+
+	positions := make(map[ttlKey]uint16)
+	for h := int32(1); int(h) < len(txidOffsets); h++ {
+		numTxs := txidOffsets[h] - txidOffsets[h-1]
+		txids := make([]byte, numTxs*8)
+		_, err = txidFile.ReadAt(txids, txidOffsets[h-1]*8)
+		if err != nil {
+			return fmt.Errorf("migrateTxidFileToMap h %d txids: %s",
+				h, err.Error())
+		}
+
+		ttlStart := int64(binary.BigEndian.Uint64(ttlOffsetBytes[(h-1)*8:]))
+		ttlEnd := int64(binary.BigEndian.Uint64(ttlOffsetBytes[h*8:]))
+		ttlBytes := make([]byte, ttlEnd-ttlStart)
+		_, err = ttlFile.ReadAt(ttlBytes, ttlStart)
+		if err != nil {
+			return fmt.Errorf("migrateTxidFileToMap h %d TTLs: %s",
+				h, err.Error())
+		}
+		numOutputs := uint16(len(ttlBytes) / btcacc.TTLSize)
+
+		// the txids are sorted by hash, so sort where they start to
+		// see where each one ends
+		starts := make([]uint16, numTxs)
+		for i := range starts {
+			starts[i] = binary.BigEndian.Uint16(txids[i*8+6:])
+		}
+		sorted := append([]uint16{}, starts...)
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+
+		for i, start := range starts {
+			end := numOutputs
+			next := sort.Search(len(sorted), func(j int) bool {
+				return sorted[j] > start
+			})
+			if next < len(sorted) {
+				end = sorted[next]
+			}
+			k := ttlKey{createHeight: h}
+			copy(k.hashprefix[:], txids[i*8:i*8+6])
+			for pos := start; pos < end; pos++ {
+				if btcacc.TTLFromBytes(ttlBytes[int(pos)*btcacc.TTLSize:]) != 0 {
+					continue // spent or skipped
+				}
+				k.idx = pos - start
+				positions[k] = pos
+			}
+		}
+	}
+
+	return writeTTLSnapshot(ttl.mapSnapFile, positions)
+}
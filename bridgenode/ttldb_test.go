@@ -0,0 +1,263 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// ttlTestBlock makes a block with 3 txs, with 2, 1 and 3 outputs.  The last
+// output is unspendable.
+func ttlTestBlock(height int32) ttlWriteBlock {
+	wb := ttlWriteBlock{createHeight: height, outSkipList: []uint32{5}}
+	var startsAt uint16
+	for i, outputs := range []uint16{2, 1, 3} {
+		txid := chainhash.HashH([]byte{byte(height), byte(i)})
+		wb.mTxids = append(wb.mTxids,
+			miniTx{txid: &txid, startsAt: startsAt, outputs: outputs})
+		startsAt += outputs
+	}
+	return wb
+}
+
+// ttlTestSpends gives the txos block h spends: the 2nd output of the 1st tx
+// and the 1st output of the 3rd tx from the block before it.  These are at
+// positions 1 and 3 in the block.
+func ttlTestSpends(height int32) []miniIn {
+	if height == 1 {
+		return nil
+	}
+	spends := make([]miniIn, 2)
+	for i, out := range []struct{ tx, idx int }{{0, 1}, {2, 0}} {
+		txid := chainhash.HashH([]byte{byte(height - 1), byte(out.tx)})
+		copy(spends[i].hashprefix[:], txid[:6])
+		spends[i].idx = uint16(out.idx)
+		spends[i].createHeight = height - 1
+	}
+	return spends
+}
+
+func newTTLTestDir(t *testing.T) (utreeDir, func()) {
+	dir, err := ioutil.TempDir("", "ttldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return utreeDir, func() { os.RemoveAll(dir) }
+}
+
+// runTTLTestBlocks puts blocks from through to into db, looking up what each
+// block spends and checking the positions it gets.
+func runTTLTestBlocks(t *testing.T, db ttlDB, from, to int32) {
+	for h := from; h <= to; h++ {
+		err := db.putBlock(ttlTestBlock(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, mi := range ttlTestSpends(h) {
+			pos, err := db.lookup(mi)
+			if err != nil {
+				t.Fatalf("h %d spend %d: %s", h, i, err.Error())
+			}
+			if pos != []uint16{1, 3}[i] {
+				t.Fatalf("h %d spend %d at position %d, expected %d",
+					h, i, pos, []uint16{1, 3}[i])
+			}
+		}
+	}
+}
+
+func TestTTLDB(t *testing.T) {
+	for _, dbType := range []ttlDBType{flatTTLDB, ramTTLDB} {
+		utreeDir, cleanup := newTTLTestDir(t)
+		defer cleanup()
+		cfg := &Config{UtreeDir: utreeDir, ttlDBType: dbType}
+
+		db, err := openTTLDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTTLTestBlocks(t, db, 1, 10)
+		err = db.close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// pick up where it left off
+		db, err = openTTLDB(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runTTLTestBlocks(t, db, 11, 20)
+
+		// the lookup worker and the shutdown hook can both close it
+		db = &onceTTLDB{ttlDB: db}
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				errs[i] = db.close()
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestMapTTLDB(t *testing.T) {
+	utreeDir, cleanup := newTTLTestDir(t)
+	defer cleanup()
+
+	db, err := openMapTTLDB(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTTLTestBlocks(t, db, 1, 5)
+
+	// spent, skipped and never created txos aren't there
+	spent := ttlTestSpends(5)[0]
+	skipped := ttlTestSpends(5)[1]
+	skipped.idx = 2
+	missing := ttlTestSpends(5)[0]
+	missing.createHeight = 6
+	for _, mi := range []miniIn{spent, skipped, missing} {
+		_, err = db.lookup(mi)
+		if err == nil {
+			t.Fatalf("found txo %x:%d from h %d",
+				mi.hashprefix, mi.idx, mi.createHeight)
+		}
+	}
+	// 5 blocks of 5 spendable outputs, 2 spent from each of 4 blocks
+	if len(db.positions) != 17 {
+		t.Fatalf("%d txos in map, expected 17", len(db.positions))
+	}
+
+	// reopen without closing, so everything comes from the log
+	err = db.log.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := openMapTTLDB(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db2.positions) != 17 {
+		t.Fatalf("%d txos in map from log, expected 17", len(db2.positions))
+	}
+
+	// a partial record at the end of the log gets dropped
+	_, err = db2.logFile.Write([]byte{ttlLogPut, 0, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2.logFile.Close()
+	db2, err = openMapTTLDB(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTTLTestBlocks(t, db2, 6, 6)
+
+	// after closing, it's all in the snapshot and the log is empty
+	err = db2.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logInfo, err := os.Stat(utreeDir.TtlDir.mapLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logInfo.Size() != 0 {
+		t.Fatalf("log has %d bytes after snapshot", logInfo.Size())
+	}
+	db2, err = openMapTTLDB(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db2.positions) != 20 {
+		t.Fatalf("%d txos in snapshot, expected 20", len(db2.positions))
+	}
+	runTTLTestBlocks(t, db2, 7, 7)
+	db2.close()
+}
+
+func TestMigrateTxidFileToMap(t *testing.T) {
+	utreeDir, cleanup := newTTLTestDir(t)
+	defer cleanup()
+
+	flat, err := openFlatTxidDB(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tf flatFileState
+	tf.offsetFile, err = os.OpenFile(
+		utreeDir.TtlDir.OffsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.proofFile, err = os.OpenFile(
+		utreeDir.TtlDir.ttlsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tf.fileWait = new(sync.WaitGroup)
+	tf.endOffsets = true
+	err = tf.ffInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// build blocks 1 to 10 with the flat db, writing TTLs as they're found
+	for h := int32(1); h <= 10; h++ {
+		wb := ttlTestBlock(h)
+		err = flat.putBlock(wb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := ttlResultBlock{destroyHeight: h}
+		for _, mi := range ttlTestSpends(h) {
+			pos, err := flat.lookup(mi)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.results = append(res.results,
+				ttlResult{createHeight: mi.createHeight, indexWithinBlock: pos})
+		}
+		tf.fileWait.Add(1)
+		err = tf.writeTTLBlock(allocNSkipTTL{6, wb.outSkipList}, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	flat.close()
+	tf.offsetFile.Close()
+	tf.proofFile.Close()
+
+	// opening the map db converts the txid file
+	db, err := openMapTTLDB(utreeDir.TtlDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10 blocks of 5 spendable outputs, 2 spent from each of 9 blocks
+	if len(db.positions) != 32 {
+		t.Fatalf("%d txos after migration, expected 32", len(db.positions))
+	}
+	_, err = db.lookup(ttlTestSpends(5)[0])
+	if err == nil {
+		t.Fatal("spent txo is in the map after migration")
+	}
+	runTTLTestBlocks(t, db, 11, 15)
+	db.close()
+}
@@ -0,0 +1,166 @@
+package bridgenode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// ttlFileVersion is the layout of the TTL file and its offset file, which
+// is saved in the TTL dir's version file.  Version 1 had 4 byte TTLs and no
+// version file.  Version 2 has btcacc.TTLSize byte TTLs.
+const ttlFileVersion = 2
+
+// checkTTLFiles makes sure the TTL files in dir are in the ttlFileVersion
+// layout.  A new TTL dir gets the version file, and TTL files from before
+// there was one get rewritten.  A rewrite that was stopped partway is
+// finished, or done again if the new files weren't all written yet.
+func checkTTLFiles(dir ttlDir) error {
+	b, err := ioutil.ReadFile(dir.versionFile)
+	if err == nil {
+		if len(b) != 1 {
+			return fmt.Errorf("checkTTLFiles: %s is %d bytes, expected 1",
+				dir.versionFile, len(b))
+		}
+		if b[0] != ttlFileVersion {
+			return errTTLVersion(b[0])
+		}
+		return finishTTLRewrite(dir)
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("checkTTLFiles: %s", err.Error())
+	}
+
+	info, err := os.Stat(dir.OffsetFile)
+	if os.IsNotExist(err) || err == nil && info.Size() == 0 {
+		return writeTTLVersion(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("checkTTLFiles: %s", err.Error())
+	}
+	fmt.Printf("Rewriting the TTL files in %s with %d byte TTLs\n",
+		dir.base, btcacc.TTLSize)
+	err = rewriteTTLFilesV1(dir)
+	if err != nil {
+		return fmt.Errorf("checkTTLFiles: rewriting version 1 TTL files: %s",
+			err.Error())
+	}
+	// the new files count once the version says so
+	err = writeTTLVersion(dir)
+	if err != nil {
+		return err
+	}
+	return finishTTLRewrite(dir)
+}
+
+// writeTTLVersion saves ttlFileVersion as the TTL files' version.
+func writeTTLVersion(dir ttlDir) error {
+	f, err := os.Create(dir.versionFile)
+	if err != nil {
+		return fmt.Errorf("writeTTLVersion: %s", err.Error())
+	}
+	defer f.Close()
+	_, err = f.Write([]byte{ttlFileVersion})
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("writeTTLVersion: %s", err.Error())
+	}
+	return nil
+}
+
+// ttlRewriteName is where a TTL file's rewrite goes until it's done
+func ttlRewriteName(name string) string {
+	return name + ".rewrite"
+}
+
+// finishTTLRewrite moves the rewritten TTL files over the old ones, if
+// they're still there.
+func finishTTLRewrite(dir ttlDir) error {
+	for _, name := range []string{dir.ttlsetFile, dir.OffsetFile} {
+		err := os.Rename(ttlRewriteName(name), name)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("finishTTLRewrite: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// rewriteTTLFilesV1 writes the TTLs in the version 1 TTL files in dir as
+// btcacc.TTLSize byte TTLs, and the offset file to go with them, to their
+// rewrite names.  TTLs too big for the new size, like the version 1 skip
+// marker, become btcacc.MaxTTL.
+func rewriteTTLFilesV1(dir ttlDir) error {
+	offsetBytes, err := ioutil.ReadFile(dir.OffsetFile)
+	if err != nil {
+		return err
+	}
+	if len(offsetBytes)%8 != 0 {
+		return fmt.Errorf("%s is %d bytes, not a multiple of 8",
+			dir.OffsetFile, len(offsetBytes))
+	}
+	offsets := make([]byte, len(offsetBytes))
+	var end uint64
+	for i := 0; i < len(offsetBytes); i += 8 {
+		offset := binary.BigEndian.Uint64(offsetBytes[i:])
+		if offset%btcacc.TTLSizeV1 != 0 || offset < end {
+			return fmt.Errorf("%s has bad offset %d for block %d",
+				dir.OffsetFile, offset, i/8)
+		}
+		end = offset
+		binary.BigEndian.PutUint64(offsets[i:],
+			offset/btcacc.TTLSizeV1*btcacc.TTLSize)
+	}
+
+	oldFile, err := os.Open(dir.ttlsetFile)
+	if err != nil {
+		return err
+	}
+	defer oldFile.Close()
+	newFile, err := os.Create(ttlRewriteName(dir.ttlsetFile))
+	if err != nil {
+		return err
+	}
+	defer newFile.Close()
+
+	r := bufio.NewReader(io.LimitReader(oldFile, int64(end)))
+	w := bufio.NewWriter(newFile)
+	var old [btcacc.TTLSizeV1]byte
+	var ttl [btcacc.TTLSize]byte
+	for i := uint64(0); i < end/btcacc.TTLSizeV1; i++ {
+		_, err = io.ReadFull(r, old[:])
+		if err != nil {
+			return fmt.Errorf("%s TTL %d of %d: %s",
+				dir.ttlsetFile, i, end/btcacc.TTLSizeV1, err.Error())
+		}
+		btcacc.PutTTL(ttl[:], int32(binary.BigEndian.Uint32(old[:])))
+		_, err = w.Write(ttl[:])
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = newFile.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	offsetFile, err := os.Create(ttlRewriteName(dir.OffsetFile))
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	_, err = offsetFile.Write(offsets)
+	if err != nil {
+		return err
+	}
+	return offsetFile.Sync()
+}
@@ -4,8 +4,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"sort"
 )
 
@@ -13,45 +11,16 @@ import (
 // sends the output side to the txid sorter, and the input side to the
 // ttl lookup worker
 func BNRTTLSpliter(
-	bnrChan chan blockAndRev, ttlResultChan chan ttlResultBlock,
-	utdir utreeDir) {
+	bnrChan chan blockAndRev, ttlResultChan chan ttlResultBlock, db ttlDB) {
 
-	txidFile, err := os.OpenFile(
-		filepath.Join(utdir.TtlDir.base, "txidFile"),
-		os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	txidOffsetFile, err := os.OpenFile(
-		filepath.Join(utdir.TtlDir.base, "txidOffsetFile"),
-		os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	startOffset, err := txidFile.Seek(0, 2)
-	if err != nil {
-		panic(err)
-	}
-	startOffset >>= 3 // divide by 8 to get the offset in miniTxids
-
-	// seek to the end of the offset file as TxidSortWriterWorker will start
-	// appending to it
-	_, err = txidOffsetFile.Seek(0, 2)
-	if err != nil {
-		panic(err)
-	}
 	writeBlockChan := make(chan ttlWriteBlock, 10)
 	lookupChan := make(chan ttlLookupBlock, 10)
 	goChan := make(chan bool, 10)
 
-	go TxidSortWriterWorker(
-		writeBlockChan, goChan, startOffset, txidFile, txidOffsetFile)
+	go TxidSortWriterWorker(writeBlockChan, goChan, db)
 
 	// TTLLookupWorker needs to send the final data to the flatFileWorker
-	go TTLLookupWorker(
-		lookupChan, ttlResultChan, goChan, txidFile, txidOffsetFile)
+	go TTLLookupWorker(lookupChan, ttlResultChan, goChan, db)
 
 	for {
 		bnr, open := <-bnrChan
@@ -74,6 +43,7 @@ func BNRTTLSpliter(
 
 		wb.createHeight = bnr.Height
 		wb.mTxids = make([]miniTx, len(transactions))
+		wb.outSkipList = bnr.outSkipList
 		// fmt.Printf("h %d inskip %v\n", bnr.Height, bnr.inSkipList)
 		keepSkippingInputs = inskipMax > 0 // if none to skip, don't check
 
@@ -85,6 +55,7 @@ func BNRTTLSpliter(
 			// first add all the outputs in this tx, then range through the
 			// outputs and decrement them if they're on the skiplist
 			mtx := tx.MsgTx()
+			wb.mTxids[txInBlock].outputs = uint16(len(mtx.TxOut))
 			outputInBlock += uint16(len(mtx.TxOut))
 
 			// for all the txins, throw that into the work as well; just a bunch of
@@ -123,34 +94,27 @@ func BNRTTLSpliter(
 	close(lookupChan)
 }
 
-// TxidSortWriterWorker takes miniTxids in, sorts them, and writes them
-// into a flat file (also writes the offsets files.  The offset file
-// doesn't describe byte offsets, but rather 8 byte miniTxids
+// TxidSortWriterWorker takes miniTxids in and puts them in the TTL db.  For
+// the flat db that means sorting them and writing them into a flat file (also
+// writes the offsets files.  The offset file doesn't describe byte offsets,
+// but rather 8 byte miniTxids
 func TxidSortWriterWorker(
-	tChan chan ttlWriteBlock, goChan chan bool, startOffset int64,
-	miniTxidFile, txidOffsetFile io.Writer) {
+	tChan chan ttlWriteBlock, goChan chan bool, db ttlDB) {
 
-	// sort then write.
 	for {
 		wb, open := <-tChan
 		if !open {
 			// fmt.Printf("TxidSortWriterWorker finished at height %d\n", wb.createHeight)
 			break
 		}
-		// first write the current start offset, then increment it for next time
-		// fmt.Printf("write h %d startOffset %d\t", height, startOffset)
-		err := binary.Write(txidOffsetFile, binary.BigEndian, startOffset)
-		if err != nil {
-			panic(err)
-		}
-		startOffset += int64(len(wb.mTxids))
-		sortTxids(wb.mTxids)
-		err = wb.serialize(miniTxidFile)
+		err := db.putBlock(wb)
 		if err != nil {
 			fmt.Printf("TTLWriteBlock write error: %s\n", err.Error())
 		}
 		goChan <- true // tell the TTLLookupWorker to start on the block just done
 	}
+	// lets TTLLookupWorker see that there's nothing more coming
+	close(goChan)
 }
 
 // TODO: if the utxo is coinbase, don't have to look up position in block
@@ -164,10 +128,7 @@ func TxidSortWriterWorker(
 // TTL lookup worker after its done writing to its files
 func TTLLookupWorker(
 	lChan chan ttlLookupBlock, ttlResultChan chan ttlResultBlock, goChan chan bool,
-	txidFile, txidOffsetFile *os.File) {
-	var seekHeight int32
-	var heightOffset, nextOffset int64
-	var startOffsetBytes, nextOffsetBytes [8]byte
+	db ttlDB) {
 
 	for {
 		<-goChan
@@ -184,36 +145,6 @@ func TTLLookupWorker(
 		sortMiniIns(lub.spentTxos)
 		for i, stxo := range lub.spentTxos {
 			// fmt.Printf("need txid %x from height %d\n", stxo.hashprefix, stxo.height)
-			if stxo.createHeight != seekHeight { // height change, get byte offsets
-				// subtract 1 from stxo height because this file starts at height 1
-				_, err := txidOffsetFile.ReadAt(
-					startOffsetBytes[:], int64(stxo.createHeight-1)*8)
-				if err != nil {
-					fmt.Printf("tried to read at txidoffset file byte %d  ",
-						(stxo.createHeight-1)*8)
-					panic(err)
-				}
-
-				heightOffset = int64(binary.BigEndian.Uint64(startOffsetBytes[:]))
-
-				// TODO: make sure this is OK.  If we always have a
-				// block after the one we're seeking this will not error.
-
-				_, err = txidOffsetFile.ReadAt(
-					nextOffsetBytes[:], int64(stxo.createHeight)*8)
-				if err != nil {
-					fmt.Printf("tried to read next at %d  ", stxo.createHeight*8)
-					panic(err)
-				}
-				nextOffset = int64(binary.BigEndian.Uint64(nextOffsetBytes[:]))
-				// if nextOffset==heightOffset{}
-				if nextOffset < heightOffset {
-					fmt.Printf("nextOffset %d < start %d byte %d\n",
-						nextOffset, heightOffset, stxo.createHeight*8)
-					panic("bad offset")
-				}
-				seekHeight = stxo.createHeight
-			}
 			if stxo.createHeight == resultBlock.destroyHeight {
 				fmt.Printf("\tXXXXh %d stxo %d trying to write 0 TTL %x:%d.\n",
 					resultBlock.destroyHeight, i, stxo.hashprefix, stxo.idx)
@@ -223,31 +154,20 @@ func TTLLookupWorker(
 			}
 
 			resultBlock.results[i].createHeight = stxo.createHeight
-			// fmt.Printf("search for create height %d %x:%d from %d range %d\n",
-			// stxo.createHeight, stxo.hashprefix, stxo.idx,
-			// heightOffset, nextOffset-heightOffset)
-
-			resultBlock.results[i].indexWithinBlock =
-				binSearch(stxo, heightOffset, nextOffset, txidFile)
-
-			// if resultBlock.results[i].indexWithinBlock == 116 {
-			// fmt.Printf("# h %d stxo %x:%d writes ttl value %d to h %d idxinblk %d\n",
-			// lub.destroyHeight, stxo.hashprefix, stxo.idx,
-			// lub.destroyHeight-resultBlock.results[i].createHeight,
-			// stxo.createHeight,
-			// resultBlock.results[i].indexWithinBlock)
-			// }
+			// fmt.Printf("search for create height %d %x:%d\n",
+			// stxo.createHeight, stxo.hashprefix, stxo.idx)
 
+			idx, err := db.lookup(stxo)
+			if err != nil {
+				panic(err)
+			}
+			resultBlock.results[i].indexWithinBlock = idx
 		}
 
 		ttlResultChan <- resultBlock
 	}
 
-	err := txidFile.Close()
-	if err != nil {
-		panic(err)
-	}
-	err = txidOffsetFile.Close()
+	err := db.close()
 	if err != nil {
 		panic(err)
 	}
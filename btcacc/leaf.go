@@ -42,7 +42,8 @@ func (l *LeafData) ToString() (s string) {
 	s += fmt.Sprintf("cb %v ", l.Coinbase)
 	s += fmt.Sprintf("amt %d ", l.Amt)
 	s += fmt.Sprintf("pks %x ", l.PkScript)
-	s += fmt.Sprintf("%x ", l.LeafHash())
+	h, _ := l.LeafHash(LeafHashVersion)
+	s += fmt.Sprintf("%x ", h)
 	s += fmt.Sprintf("size %d", l.SerializeSize())
 	return
 }
@@ -92,13 +93,31 @@ func (l *LeafData) SerializeSize() int {
 
 func (l *LeafData) Deserialize(r io.Reader) (err error) {
 	_, err = io.ReadFull(r, l.BlockHash[:])
+	if err != nil {
+		return
+	}
 	_, err = io.ReadFull(r, l.TxHash[:])
+	if err != nil {
+		return
+	}
 	err = binary.Read(r, binary.BigEndian, &l.Index)
+	if err != nil {
+		return
+	}
 	err = binary.Read(r, binary.BigEndian, &l.Height)
+	if err != nil {
+		return
+	}
 	err = binary.Read(r, binary.BigEndian, &l.Amt)
+	if err != nil {
+		return
+	}
 
 	var pkSize uint16
 	err = binary.Read(r, binary.BigEndian, &pkSize)
+	if err != nil {
+		return
+	}
 	if pkSize > 10000 {
 		err = fmt.Errorf("bh %x op %s pksize %d byte too long",
 			l.BlockHash, l.OPString(), pkSize)
@@ -106,6 +125,9 @@ func (l *LeafData) Deserialize(r io.Reader) (err error) {
 	}
 	l.PkScript = make([]byte, pkSize)
 	_, err = io.ReadFull(r, l.PkScript)
+	if err != nil {
+		return
+	}
 	if l.Height&1 == 1 {
 		l.Coinbase = true
 	}
@@ -119,9 +141,21 @@ func (l *LeafData) Deserialize(r io.Reader) (err error) {
 // can use tags for PkScript
 // so it's just height, coinbaseness, amt, pkscript tag
 
-// LeafHash turns a LeafData into a LeafHash
-func (l *LeafData) LeafHash() [32]byte {
-	var buf bytes.Buffer
-	l.Serialize(&buf)
-	return sha512.Sum512_256(buf.Bytes())
+// LeafHashVersion is the leaf hash commitment used by the bridgenode and the
+// CSN.  Proofs for leaves hashed with one version are useless to a forest
+// built with another, so both sides need to agree on this.
+const LeafHashVersion uint8 = 1
+
+// LeafHash turns a LeafData into a LeafHash using the given leaf hash version.
+// Version 1 is sha512_256 of the serialized LeafData.
+// Errors on an unknown version.
+func (l *LeafData) LeafHash(version uint8) ([32]byte, error) {
+	switch version {
+	case 1:
+		var buf bytes.Buffer
+		l.Serialize(&buf)
+		return sha512.Sum512_256(buf.Bytes()), nil
+	}
+	return [32]byte{}, fmt.Errorf(
+		"LeafHash: unknown leaf hash version %d", version)
 }
@@ -2,6 +2,7 @@ package btcacc
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"testing"
 )
@@ -36,3 +37,58 @@ func TestLeafDataSerialize(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// Golden leaf hashes for LeafHashVersion 1.  If these change, every forest
+// and every proof out there stops matching.
+func TestLeafHashVectors(t *testing.T) {
+	tests := []struct {
+		ld   LeafData
+		hash string
+	}{
+		{
+			ld:   LeafData{},
+			hash: "023af1ef1b738f0d39f4c71bd4e46f0db004f79ba037141649ae41937b17950d",
+		},
+		{
+			ld: LeafData{
+				TxHash:   Hash{1, 2, 3, 4},
+				Index:    0,
+				Height:   2,
+				Coinbase: false,
+				Amt:      3000,
+				PkScript: []byte{1, 2, 3, 4, 5, 6},
+			},
+			hash: "3ee7facaa0f802b4e3033c54f1a7d676e3769209ed55b5ae09b661287ad06f72",
+		},
+		{
+			ld: LeafData{
+				BlockHash: [32]byte{0xff},
+				TxHash:    Hash{0xaa, 0xbb},
+				Index:     7,
+				Height:    680000,
+				Coinbase:  true,
+				Amt:       625000000,
+				PkScript:  []byte{0x76, 0xa9, 0x14},
+			},
+			hash: "6ca09470b7e68e0755f6e5d2cb94beaf8c49ea0d95dffe46cb0a3600e08be6d0",
+		},
+	}
+
+	for i, test := range tests {
+		h, err := test.ld.LeafHash(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hex.EncodeToString(h[:]) != test.hash {
+			t.Fatalf("vector %d: got %x expected %s", i, h, test.hash)
+		}
+	}
+}
+
+func TestLeafHashUnknownVersion(t *testing.T) {
+	var ld LeafData
+	_, err := ld.LeafHash(0)
+	if err == nil {
+		t.Fatal("expected LeafHash to error on version 0")
+	}
+}
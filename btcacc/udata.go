@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/btcsuite/btcutil"
 	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
 )
 
 type UData struct {
@@ -29,18 +31,107 @@ func (ud *UData) ProofSanity(nl uint64, h uint8) bool {
 	return true
 }
 
-// on disk
-// aaff aaff 0000 0014 0000 0001 0000 0001 0000 0000 0000 0000 0000 0000
-//  magic   |   size  |  height | numttls |   ttl0  | numTgts | (proof)
+const (
+	// TTLSize is how many bytes each TTL value takes up in serialized UData.
+	TTLSize = 3
 
-// ToBytes serializes UData into bytes.
+	// TTLSizeV1 is the TTL size of the v1 proof format, which wrote every
+	// TTL as a 4 byte int32.
+	TTLSizeV1 = 4
+
+	// MaxTTL is the biggest TTL a 3 byte field can hold.  TTLs that are
+	// longer than this, and txos that are never spent, are saved as MaxTTL.
+	MaxTTL = 0xffffff
+
+	// maxTTLs is the most TTLs a UData can say it has.  There's one TTL per
+	// output, and a block can't have anywhere near this many outputs.
+	maxTTLs = 1 << 20
+)
+
+// PutTTL writes ttl as a 3 byte big endian int into b, saturating at MaxTTL.
+func PutTTL(b []byte, ttl int32) {
+	if ttl < 0 || ttl > MaxTTL {
+		ttl = MaxTTL
+	}
+	b[0] = byte(ttl >> 16)
+	b[1] = byte(ttl >> 8)
+	b[2] = byte(ttl)
+}
+
+// TTLFromBytes reads back a 3 byte TTL written with PutTTL.
+func TTLFromBytes(b []byte) int32 {
+	return int32(b[0])<<16 | int32(b[1])<<8 | int32(b[2])
+}
+
+// CheckBlock makes sure the UData is for the given block.  There should be
+// one target and one LeafData, in order, for every input that needs a proof
+// (everything but the coinbase and inputs spending outputs from the same
+// block), and one TTL for every output in the block.
+// Returns an error naming the first input that doesn't match.
+func (ud *UData) CheckBlock(blk *btcutil.Block) error {
+	inCount, outCount, inskip, _ := util.DedupeBlock(blk)
+	numProofs := int(inCount) - len(inskip)
+
+	if len(ud.AccProof.Targets) != numProofs {
+		return fmt.Errorf("CheckBlock h %d: %d inputs need proofs but "+
+			"%d targets", ud.Height, numProofs, len(ud.AccProof.Targets))
+	}
+	if len(ud.Stxos) != numProofs {
+		return fmt.Errorf("CheckBlock h %d: %d inputs need proofs but "+
+			"%d leafdatas", ud.Height, numProofs, len(ud.Stxos))
+	}
+	if len(ud.TxoTTLs) != int(outCount) {
+		return fmt.Errorf("CheckBlock h %d: %d outputs but %d ttls",
+			ud.Height, outCount, len(ud.TxoTTLs))
+	}
+
+	var inputInBlock uint32
+	var stxo int
+	for txInBlock, tx := range blk.Transactions() {
+		for i, txin := range tx.MsgTx().TxIn {
+			// coinbase and same block spends have no leafdata
+			if len(inskip) > 0 && inskip[0] == inputInBlock {
+				inskip = inskip[1:]
+				inputInBlock++
+				continue
+			}
+
+			op := txin.PreviousOutPoint
+			ld := ud.Stxos[stxo]
+			if Hash(op.Hash) != ld.TxHash || op.Index != ld.Index {
+				return fmt.Errorf("CheckBlock h %d: tx %d %s input %d "+
+					"spends %s but leafdata %d is %s", ud.Height, txInBlock,
+					tx.Hash().String(), i, op.String(), stxo, ld.OPString())
+			}
+			stxo++
+			inputInBlock++
+		}
+	}
+
+	return nil
+}
+
+// on disk (v2)
+// aaffaafe 00000013 00000001 00000001 000000 00000000 00000000
+//  magic  |  size  | height | numttls | ttl0 | numTgts | (proof)
+
+// Serialize writes UData in the v2 format.
 // First, height, 4 bytes.
-// Then, number of TTL values (4 bytes, even though we only need 2)
-// Then a bunch of TTL values, (4B each) one for each txo in the associated block
+// Then, number of TTL values (4 bytes)
+// Then a bunch of TTL values, (3B each) one for each txo in the associated block
 // batch proof
 // Bunch of LeafDatas
-
 func (ud *UData) Serialize(w io.Writer) (err error) {
+	return ud.serialize(w, TTLSize)
+}
+
+// SerializeV1 writes UData in the old v1 format, which is the same as v2
+// except that TTLs are 4 bytes each.
+func (ud *UData) SerializeV1(w io.Writer) (err error) {
+	return ud.serialize(w, TTLSizeV1)
+}
+
+func (ud *UData) serialize(w io.Writer, ttlSize int) (err error) {
 	err = binary.Write(w, binary.BigEndian, ud.Height)
 	if err != nil { // ^ 4B block height
 		return
@@ -49,8 +140,14 @@ func (ud *UData) Serialize(w io.Writer) (err error) {
 	if err != nil { // ^ 4B num ttls
 		return
 	}
+	var ttlBytes [TTLSizeV1]byte
 	for _, ttlval := range ud.TxoTTLs { // write all ttls
-		err = binary.Write(w, binary.BigEndian, ttlval)
+		if ttlSize == TTLSizeV1 {
+			binary.BigEndian.PutUint32(ttlBytes[:], uint32(ttlval))
+		} else {
+			PutTTL(ttlBytes[:], ttlval)
+		}
+		_, err = w.Write(ttlBytes[:ttlSize])
 		if err != nil {
 			return
 		}
@@ -93,14 +190,24 @@ func (ud *UData) SerializeSize() int {
 			b.Len(), ud.AccProof.SerializeSize())
 	}
 
-	guess := 8 + (4 * len(ud.TxoTTLs)) + ud.AccProof.SerializeSize() + ldsize
+	guess := 8 + (TTLSize * len(ud.TxoTTLs)) +
+		ud.AccProof.SerializeSize() + ldsize
 
-	// 8B height & numTTLs, 4B per TTL, accProof size, leaf sizes
+	// 8B height & numTTLs, 3B per TTL, accProof size, leaf sizes
 	return guess
 }
 
+// Deserialize reads UData in the v2 format, with 3 byte TTLs.
 func (ud *UData) Deserialize(r io.Reader) (err error) {
+	return ud.deserialize(r, TTLSize)
+}
 
+// DeserializeV1 reads UData in the v1 format, with 4 byte TTLs.
+func (ud *UData) DeserializeV1(r io.Reader) (err error) {
+	return ud.deserialize(r, TTLSizeV1)
+}
+
+func (ud *UData) deserialize(r io.Reader, ttlSize int) (err error) {
 	err = binary.Read(r, binary.BigEndian, &ud.Height)
 	if err != nil { // ^ 4B block height
 		fmt.Printf("ud deser Height err %s\n", err.Error())
@@ -114,16 +221,26 @@ func (ud *UData) Deserialize(r io.Reader) (err error) {
 		fmt.Printf("ud deser numTTLs err %s\n", err.Error())
 		return
 	}
+	if numTTLs > maxTTLs {
+		err = fmt.Errorf("ud deser %d ttls - too many", numTTLs)
+		return
+	}
 	// fmt.Printf("read ttls %d\n", numTTLs)
 	// fmt.Printf("UData deser read h %d - %d ttls ", ud.Height, numTTLs)
 
 	ud.TxoTTLs = make([]int32, numTTLs)
-	for i, _ := range ud.TxoTTLs { // write all ttls
-		err = binary.Read(r, binary.BigEndian, &ud.TxoTTLs[i])
+	var ttlBytes [TTLSizeV1]byte
+	for i, _ := range ud.TxoTTLs { // read all ttls
+		_, err = io.ReadFull(r, ttlBytes[:ttlSize])
 		if err != nil {
 			fmt.Printf("ud deser LeafTTLs[%d] err %s\n", i, err.Error())
 			return
 		}
+		if ttlSize == TTLSizeV1 {
+			ud.TxoTTLs[i] = int32(binary.BigEndian.Uint32(ttlBytes[:]))
+		} else {
+			ud.TxoTTLs[i] = TTLFromBytes(ttlBytes[:])
+		}
 		// fmt.Printf("read ttl[%d] %d\n", i, ud.TxoTTLs[i])
 	}
 
@@ -175,13 +292,24 @@ func (ud *UData) ToCompactBytes() (b []byte) {
 func GenUData(delLeaves []LeafData, forest *accumulator.Forest, height int32) (
 	ud UData, err error) {
 
-	ud.Height = height
-	ud.Stxos = delLeaves
 	// make slice of hashes from leafdata
-	delHashes := make([]accumulator.Hash, len(ud.Stxos))
-	for i, _ := range ud.Stxos {
-		delHashes[i] = ud.Stxos[i].LeafHash()
+	delHashes := make([]accumulator.Hash, len(delLeaves))
+	for i, _ := range delLeaves {
+		delHashes[i], err = delLeaves[i].LeafHash(LeafHashVersion)
+		if err != nil {
+			return
+		}
 	}
+	return GenUDataFromHashes(delLeaves, delHashes, forest, height)
+}
+
+// GenUDataFromHashes is GenUData for when the leaf hashes of delLeaves have
+// already been computed.  delHashes[i] must be the hash of delLeaves[i].
+func GenUDataFromHashes(delLeaves []LeafData, delHashes []accumulator.Hash,
+	forest *accumulator.Forest, height int32) (ud UData, err error) {
+
+	ud.Height = height
+	ud.Stxos = delLeaves
 	// generate block proof. Errors if the tx cannot be proven
 	// Should never error out with genproofs as it takes
 	// blk*.dat files which have already been vetted by Bitcoin Core
@@ -202,3 +330,32 @@ func GenUData(delLeaves []LeafData, forest *accumulator.Forest, height int32) (
 	// }
 	return
 }
+
+// ModifyFromUData checks the UData's proof against the forest's current roots,
+// and if it's good, deletes the proven leaves and adds adds.
+// This would be a Forest method but accumulator can't import btcacc.
+func ModifyFromUData(forest *accumulator.Forest, ud *UData,
+	adds []accumulator.Leaf) (*accumulator.UndoBlock, error) {
+
+	if len(ud.AccProof.Targets) != len(ud.Stxos) {
+		return nil, fmt.Errorf("ModifyFromUData h %d: %d targets but %d "+
+			"leafdatas", ud.Height, len(ud.AccProof.Targets), len(ud.Stxos))
+	}
+
+	delHashes := make([]accumulator.Hash, len(ud.Stxos))
+	var err error
+	for i, _ := range ud.Stxos {
+		delHashes[i], err = ud.Stxos[i].LeafHash(LeafHashVersion)
+		if err != nil {
+			return nil, fmt.Errorf("ModifyFromUData h %d: %s",
+				ud.Height, err.Error())
+		}
+	}
+	err = forest.VerifyBatchProof(delHashes, ud.AccProof)
+	if err != nil {
+		return nil, fmt.Errorf("ModifyFromUData h %d: %s",
+			ud.Height, err.Error())
+	}
+
+	return forest.Modify(adds, ud.AccProof.Targets)
+}
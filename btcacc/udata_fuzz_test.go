@@ -0,0 +1,45 @@
+//go:build go1.18
+// +build go1.18
+
+package btcacc
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzUDataDeserialize feeds arbitrary bytes to both UData deserializers.
+// They have to give an error, or a UData that serializes back to the bytes
+// that were read.
+func FuzzUDataDeserialize(f *testing.F) {
+	ud := testUData()
+	var buf, bufV1 bytes.Buffer
+	ud.Serialize(&buf)
+	ud.SerializeV1(&bufV1)
+	f.Add(buf.Bytes(), false)
+	f.Add(bufV1.Bytes(), true)
+	// says it has lots of ttls but doesn't
+	f.Add([]byte{0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}, false)
+	f.Fuzz(func(t *testing.T, data []byte, v1 bool) {
+		var ud UData
+		r := bytes.NewReader(data)
+		deserialize, serialize := ud.Deserialize, ud.Serialize
+		if v1 {
+			deserialize, serialize = ud.DeserializeV1, ud.SerializeV1
+		}
+		err := deserialize(r)
+		if err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		err = serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data[:len(data)-r.Len()]) {
+			t.Fatalf("read %x but serialized %x",
+				data[:len(data)-r.Len()], buf.Bytes())
+		}
+	})
+}
@@ -0,0 +1,250 @@
+package btcacc
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func testUData() UData {
+	return UData{
+		Height: 12,
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{3, 9},
+			Proof:   []accumulator.Hash{{1}, {2}, {3}},
+		},
+		Stxos: []LeafData{
+			{TxHash: Hash{4}, Index: 1, Height: 5, Amt: 1000,
+				PkScript: []byte{1, 2, 3}},
+			{TxHash: Hash{6}, Index: 0, Height: 7, Coinbase: true, Amt: 50,
+				PkScript: []byte{4, 5}},
+		},
+		TxoTTLs: []int32{0, 1, 300, 70000, MaxTTL},
+	}
+}
+
+func TestUDataSerialize(t *testing.T) {
+	ud := testUData()
+
+	var buf bytes.Buffer
+	err := ud.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != ud.SerializeSize() {
+		t.Fatalf("wrote %d bytes but SerializeSize says %d",
+			buf.Len(), ud.SerializeSize())
+	}
+
+	var check UData
+	err = check.Deserialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ud, check) {
+		t.Fatalf("v2 round trip mismatch\nbefore %v\nafter  %v", ud, check)
+	}
+}
+
+func TestUDataSerializeV1(t *testing.T) {
+	ud := testUData()
+
+	var buf bytes.Buffer
+	err := ud.SerializeV1(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// v1 is 1 byte longer for every ttl
+	if buf.Len() != ud.SerializeSize()+len(ud.TxoTTLs) {
+		t.Fatalf("wrote %d bytes but expected %d",
+			buf.Len(), ud.SerializeSize()+len(ud.TxoTTLs))
+	}
+
+	var check UData
+	err = check.DeserializeV1(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ud, check) {
+		t.Fatalf("v1 round trip mismatch\nbefore %v\nafter  %v", ud, check)
+	}
+}
+
+func TestPutTTL(t *testing.T) {
+	tests := []struct {
+		in, out int32
+	}{
+		{0, 0},
+		{1, 1},
+		{MaxTTL, MaxTTL},
+		{MaxTTL + 1, MaxTTL},
+		{0x7fffffff, MaxTTL},
+		{-1, MaxTTL},
+	}
+	var b [TTLSize]byte
+	for _, test := range tests {
+		PutTTL(b[:], test.in)
+		got := TTLFromBytes(b[:])
+		if got != test.out {
+			t.Fatalf("PutTTL %d read back %d, expected %d",
+				test.in, got, test.out)
+		}
+	}
+}
+
+// checkBlockTestData makes a block with a coinbase, a tx spending 2 old
+// outputs, and a tx spending 1 old output and 1 output from earlier in the
+// same block.  Along with it comes the UData the bridgenode would make.
+func checkBlockTestData() (*btcutil.Block, UData) {
+	old := []wire.OutPoint{
+		{Hash: chainhash.Hash{1}, Index: 0},
+		{Hash: chainhash.Hash{2}, Index: 3},
+		{Hash: chainhash.Hash{3}, Index: 1},
+	}
+	pkScript := []byte{0x51}
+
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), nil, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50, pkScript))
+
+	tx1 := wire.NewMsgTx(1)
+	tx1.AddTxIn(wire.NewTxIn(&old[0], nil, nil))
+	tx1.AddTxIn(wire.NewTxIn(&old[1], nil, nil))
+	tx1.AddTxOut(wire.NewTxOut(10, pkScript))
+	tx1.AddTxOut(wire.NewTxOut(20, pkScript))
+
+	tx1Hash := tx1.TxHash()
+	tx2 := wire.NewMsgTx(1)
+	tx2.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&tx1Hash, 1), nil, nil))
+	tx2.AddTxIn(wire.NewTxIn(&old[2], nil, nil))
+	tx2.AddTxOut(wire.NewTxOut(25, pkScript))
+
+	var msgBlock wire.MsgBlock
+	msgBlock.AddTransaction(coinbase)
+	msgBlock.AddTransaction(tx1)
+	msgBlock.AddTransaction(tx2)
+
+	ud := UData{
+		Height: 5,
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{0, 1, 2},
+		},
+		TxoTTLs: make([]int32, 4),
+	}
+	for _, op := range old {
+		ud.Stxos = append(ud.Stxos, LeafData{
+			TxHash: Hash(op.Hash), Index: op.Index, PkScript: pkScript})
+	}
+
+	return btcutil.NewBlock(&msgBlock), ud
+}
+
+func TestUDataCheckBlock(t *testing.T) {
+	blk, ud := checkBlockTestData()
+	err := ud.CheckBlock(blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong outpoint for the last input
+	blk, ud = checkBlockTestData()
+	ud.Stxos[2].Index = 7
+	err = ud.CheckBlock(blk)
+	if err == nil || !strings.Contains(err.Error(), "tx 2") {
+		t.Fatalf("expected mismatch on tx 2, got %v", err)
+	}
+
+	// missing a ttl
+	blk, ud = checkBlockTestData()
+	ud.TxoTTLs = ud.TxoTTLs[1:]
+	err = ud.CheckBlock(blk)
+	if err == nil {
+		t.Fatal("expected error for missing ttl")
+	}
+
+	// extra target
+	blk, ud = checkBlockTestData()
+	ud.AccProof.Targets = append(ud.AccProof.Targets, 3)
+	err = ud.CheckBlock(blk)
+	if err == nil {
+		t.Fatal("expected error for extra target")
+	}
+}
+
+func TestModifyFromUData(t *testing.T) {
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+
+	// leaves for blocks 1 and 2
+	var lds []LeafData
+	for i := 0; i < 20; i++ {
+		lds = append(lds, LeafData{
+			TxHash:   Hash{byte(i), 0xff},
+			Index:    uint32(i),
+			Height:   int32(1 + i/10),
+			Amt:      int64(1000 + i),
+			PkScript: []byte{0x51},
+		})
+	}
+	leaves := make([]accumulator.Leaf, len(lds))
+	for i, ld := range lds {
+		h, err := ld.LeafHash(LeafHashVersion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves[i] = accumulator.Leaf{Hash: h}
+	}
+
+	_, err := forest.Modify(leaves[:10], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// block 2 spends a few of block 1's leaves and adds the rest
+	ud, err := GenUData([]LeafData{lds[1], lds[4], lds[7]}, forest, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// send it through serialization like a client would get it
+	var buf bytes.Buffer
+	err = ud.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readUD UData
+	err = readUD.Deserialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bad leafdata should fail to verify and leave the forest alone
+	badUD := readUD
+	badUD.Stxos = append([]LeafData{}, readUD.Stxos...)
+	badUD.Stxos[0].Amt++
+	_, err = ModifyFromUData(forest, &badUD, leaves[10:])
+	if err == nil {
+		t.Fatal("expected bad leafdata to fail verification")
+	}
+	if forest.FindLeaf(leaves[10].Hash) || !forest.FindLeaf(leaves[1].Hash) {
+		t.Fatal("forest changed after failed ModifyFromUData")
+	}
+
+	_, err = ModifyFromUData(forest, &readUD, leaves[10:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range leaves {
+		spent := i == 1 || i == 4 || i == 7
+		if forest.FindLeaf(l.Hash) == spent {
+			t.Fatalf("leaf %d: spent %v but found %v",
+				i, spent, forest.FindLeaf(l.Hash))
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// foresttool looks at and fixes the forest a bridge node saved, without
+// running the bridge node.  Point -dir at the forestdata directory, like
+// ~/.utreexo/testnet3/forestdata, and give -type the forest type the bridge
+// node was run with.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+const usage = `usage: foresttool <command> -dir=path/to/forestdata [options]
+
+COMMANDS:
+  inspect       print the forest's stats and roots
+  verify        check every hash in the forest and the positionMap
+  repair-index  hash every node above the leaves again, for when the
+                leaves are right but verify finds bad nodes. Needs -write
+  compact       cut the forest files down to what the leaves need.
+                Needs -write
+  export        write every hash in the forest as JSON, to -out or stdout
+
+OPTIONS:
+  -dir          the bridge node's forestdata directory
+  -type=disk    the forest type the bridge node used (ram, disk, cache, cow)
+  -write        open the forest files for writing.  Nothing is ever
+                changed without it
+  -out          file for export to write to
+`
+
+// The file names the bridge node uses in its forestdata directory
+const (
+	forestFileName = "forestfile.dat"
+	miscFileName   = "miscforestfile.dat"
+	cowDirName     = "cow"
+)
+
+// cowMaxCache is how many MB of ram a cow forest gets
+const cowMaxCache = 500
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run does the command in args[0] with the options after it.
+func run(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	cmd := args[0]
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	dir := fs.String("dir", "", "the bridge node's forestdata directory")
+	forestType := fs.String("type", "disk", "ram, disk, cache or cow")
+	write := fs.Bool("write", false, "open the forest files for writing")
+	outFile := fs.String("out", "", "file for export to write to")
+	err := fs.Parse(args[1:])
+	if err != nil {
+		return fmt.Errorf("%s\n%s", err.Error(), usage)
+	}
+	if *dir == "" {
+		return fmt.Errorf("no -dir given\n%s", usage)
+	}
+
+	switch cmd {
+	case "inspect", "verify", "export":
+	case "repair-index", "compact":
+		if !*write {
+			return fmt.Errorf("%s changes the forest files, so it needs -write",
+				cmd)
+		}
+	default:
+		return fmt.Errorf("unknown command %q\n%s", cmd, usage)
+	}
+
+	ff, err := openForest(*dir, *forestType, *write)
+	if err != nil {
+		return err
+	}
+	defer ff.close()
+
+	switch cmd {
+	case "inspect":
+		return inspect(ff.forest, out)
+	case "verify":
+		err = ff.forest.AssertInvariants()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "forest OK")
+		return nil
+	case "repair-index":
+		err = ff.forest.Rehash()
+		if err != nil {
+			return err
+		}
+		err = ff.save()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "hashed every node above the leaves again")
+		return nil
+	case "compact":
+		return compact(ff, out)
+	default: // export
+		return export(ff.forest, *outFile, out)
+	}
+}
+
+// forestFiles is a forest restored from a forestdata directory and the files
+// it came from.
+type forestFiles struct {
+	forest     *accumulator.Forest
+	forestType string
+
+	// forestFile is nil for a cow forest
+	forestFile, miscFile *os.File
+	// miscRest is what the bridge node saves after the forest in the misc
+	// file, so save can put it back
+	miscRest []byte
+}
+
+// openForest restores the forest in dir.  Unless write is set, the files are
+// opened read only and so is the forest.
+func openForest(dir, forestType string, write bool) (*forestFiles, error) {
+	flags := os.O_RDONLY
+	if write {
+		flags = os.O_RDWR
+	}
+	ff := &forestFiles{forestType: forestType}
+	var err error
+	ff.miscFile, err = os.OpenFile(filepath.Join(dir, miscFileName), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	var toRAM, cached bool
+	var cowDir string
+	maxCache := 0
+	switch forestType {
+	case "ram":
+		toRAM = true
+	case "disk":
+	case "cache":
+		cached = true
+	case "cow":
+		cowDir = filepath.Join(dir, cowDirName)
+		maxCache = cowMaxCache
+	default:
+		ff.close()
+		return nil, fmt.Errorf("unknown forest type %q", forestType)
+	}
+	if forestType != "cow" {
+		ff.forestFile, err = os.OpenFile(
+			filepath.Join(dir, forestFileName), flags, 0600)
+		if err != nil {
+			ff.close()
+			return nil, err
+		}
+	}
+
+	var opts []accumulator.ForestOption
+	if !write {
+		opts = append(opts, accumulator.ReadOnly())
+	}
+	ff.forest, err = accumulator.RestoreForest(
+		ff.miscFile, ff.forestFile, toRAM, cached, cowDir, maxCache, opts...)
+	if err != nil {
+		ff.close()
+		return nil, err
+	}
+	ff.miscRest, err = ioutil.ReadAll(ff.miscFile)
+	if err != nil {
+		ff.close()
+		return nil, err
+	}
+	return ff, nil
+}
+
+// save writes the forest back to its files, the same way the bridge node
+// does when it exits.
+func (ff *forestFiles) save() error {
+	var err error
+	switch ff.forestType {
+	case "ram":
+		err = ff.forest.WriteForestToDisk(ff.forestFile, true, false)
+	case "cow":
+		err = ff.forest.WriteForestToDisk(nil, false, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = ff.miscFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = ff.miscFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	err = ff.forest.WriteMiscData(ff.miscFile)
+	if err != nil {
+		return err
+	}
+	_, err = ff.miscFile.Write(ff.miscRest)
+	if err != nil {
+		return err
+	}
+	return ff.miscFile.Sync()
+}
+
+func (ff *forestFiles) close() {
+	if ff.forestFile != nil {
+		ff.forestFile.Close()
+	}
+	ff.miscFile.Close()
+}
+
+func inspect(f *accumulator.Forest, out io.Writer) error {
+	numLeaves, rows := f.ReconstructStats()
+	fmt.Fprintf(out, "%d leaves in %d rows\n", numLeaves, rows)
+	fmt.Fprintln(out, f.Stats())
+	roots := f.GetRoots()
+	fmt.Fprintf(out, "%d roots:\n", len(roots))
+	for i, r := range roots {
+		fmt.Fprintf(out, "\t%d %s\n", i, r)
+	}
+	return nil
+}
+
+// compact shrinks disk and cache forest files down to the rows the leaves
+// need, and removes the cow forest files that aren't used anymore.
+func compact(ff *forestFiles, out io.Writer) error {
+	switch ff.forestType {
+	case "cow":
+		err := ff.forest.MaintainCowForest()
+		if err != nil {
+			return err
+		}
+	case "disk", "cache":
+		err := ff.forest.ShrinkFile()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("can't compact a %s forest; "+
+			"the file is the same as a disk forest's, so use -type=disk",
+			ff.forestType)
+	}
+	err := ff.save()
+	if err != nil {
+		return err
+	}
+	numLeaves, rows := ff.forest.ReconstructStats()
+	fmt.Fprintf(out, "compacted to %d leaves in %d rows\n", numLeaves, rows)
+	return nil
+}
+
+// export writes the forest as JSON to outFile, or out if there's no outFile.
+func export(f *accumulator.Forest, outFile string, out io.Writer) error {
+	b, err := f.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if outFile == "" {
+		_, err = out.Write(append(b, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(outFile, b, 0600)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// The tests run foresttool by running the test binary again with
+// FORESTTOOL_MAIN set, which makes it run main instead of the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("FORESTTOOL_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// foresttool runs the tool with args and gives back what it printed.
+func foresttool(args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "FORESTTOOL_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// makeForestDir saves a forest with 1000 leaves added and 900 of them
+// deleted in a new forestdata directory, like the bridge node would.  cow
+// forests go in the cow directory, everything else in forestfile.dat.
+func makeForestDir(t *testing.T, cow bool) (string, *accumulator.Forest) {
+	dir, err := ioutil.TempDir("", "foresttool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var f *accumulator.Forest
+	if cow {
+		f = accumulator.NewForest(accumulator.CowForest, nil,
+			filepath.Join(dir, cowDirName), cowMaxCache)
+	} else {
+		f = accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	}
+	adds := make([]accumulator.Leaf, 1000)
+	for i := range adds {
+		adds[i].Hash = accumulator.Hash{uint8(i), uint8(i >> 8), 0xee}
+	}
+	dels := make([]uint64, 900)
+	for i := range dels {
+		dels[i] = uint64(i + 50)
+	}
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cow {
+		err = f.WriteForestToDisk(nil, false, true)
+	} else {
+		var forestFile *os.File
+		forestFile, err = os.Create(filepath.Join(dir, forestFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer forestFile.Close()
+		err = f.WriteForestToDisk(forestFile, true, false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile, err := os.Create(filepath.Join(dir, miscFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer miscFile.Close()
+	err = f.WriteMiscData(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = miscFile.Write([]byte{btcacc.LeafHashVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, f
+}
+
+func TestInspectVerify(t *testing.T) {
+	for _, forestType := range []string{"ram", "disk", "cache", "cow"} {
+		dir, f := makeForestDir(t, forestType == "cow")
+		defer os.RemoveAll(dir)
+
+		out, err := foresttool("inspect", "-dir="+dir, "-type="+forestType)
+		if err != nil {
+			t.Fatalf("%s: %s %s", forestType, err.Error(), out)
+		}
+		if !strings.Contains(out, "100 leaves in 10 rows") {
+			t.Fatalf("%s: inspect printed %s", forestType, out)
+		}
+		for _, r := range f.GetRoots() {
+			if !strings.Contains(out, r.String()) {
+				t.Fatalf("%s: root %s missing from %s", forestType, r, out)
+			}
+		}
+
+		out, err = foresttool("verify", "-dir="+dir, "-type="+forestType)
+		if err != nil || !strings.Contains(out, "forest OK") {
+			t.Fatalf("%s: verify gave %v %s", forestType, err, out)
+		}
+	}
+}
+
+func TestRepairIndex(t *testing.T) {
+	dir, f := makeForestDir(t, false)
+	defer os.RemoveAll(dir)
+	misc, err := ioutil.ReadFile(filepath.Join(dir, miscFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// break the node above the first 2 leaves, at 1024 with 10 rows
+	forestFile, err := os.OpenFile(
+		filepath.Join(dir, forestFileName), os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = forestFile.WriteAt(bytes.Repeat([]byte{0xba}, 32), 1024*32)
+	forestFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := foresttool("verify", "-dir="+dir)
+	if err == nil || !strings.Contains(out, "1024") {
+		t.Fatalf("verify gave %v %s, expected an error at 1024", err, out)
+	}
+
+	// nothing gets changed without -write
+	out, err = foresttool("repair-index", "-dir="+dir)
+	if err == nil || !strings.Contains(out, "-write") {
+		t.Fatalf("repair-index without -write gave %v %s", err, out)
+	}
+
+	out, err = foresttool("repair-index", "-dir="+dir, "-write")
+	if err != nil {
+		t.Fatalf("%s %s", err.Error(), out)
+	}
+	out, err = foresttool("verify", "-dir="+dir)
+	if err != nil {
+		t.Fatalf("verify after repair-index: %s %s", err.Error(), out)
+	}
+	out, err = foresttool("inspect", "-dir="+dir)
+	if err != nil || !strings.Contains(out, f.GetRoots()[0].String()) {
+		t.Fatalf("inspect after repair-index gave %v %s", err, out)
+	}
+	newMisc, err := ioutil.ReadFile(filepath.Join(dir, miscFileName))
+	if err != nil || !bytes.Equal(misc, newMisc) {
+		t.Fatalf("misc file changed from %x to %x %v", misc, newMisc, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	for _, forestType := range []string{"disk", "cow"} {
+		dir, f := makeForestDir(t, forestType == "cow")
+		defer os.RemoveAll(dir)
+
+		_, err := foresttool("compact", "-dir="+dir, "-type="+forestType)
+		if err == nil {
+			t.Fatalf("%s: compact worked without -write", forestType)
+		}
+		out, err := foresttool(
+			"compact", "-dir="+dir, "-type="+forestType, "-write")
+		if err != nil {
+			t.Fatalf("%s: %s %s", forestType, err.Error(), out)
+		}
+
+		// 100 leaves fit in 7 rows, but cow forests don't shrink
+		expected := "100 leaves in 7 rows"
+		if forestType == "cow" {
+			expected = "100 leaves in 10 rows"
+		}
+		out, err = foresttool("inspect", "-dir="+dir, "-type="+forestType)
+		if err != nil || !strings.Contains(out, expected) {
+			t.Fatalf("%s: inspect after compact gave %v %s",
+				forestType, err, out)
+		}
+		if !strings.Contains(out, f.GetRoots()[0].String()) {
+			t.Fatalf("%s: roots changed by compact: %s", forestType, out)
+		}
+		out, err = foresttool("verify", "-dir="+dir, "-type="+forestType)
+		if err != nil {
+			t.Fatalf("%s: verify after compact: %s %s",
+				forestType, err.Error(), out)
+		}
+		if forestType == "disk" {
+			stat, err := os.Stat(filepath.Join(dir, forestFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size() != ((2<<7)-1)*32 {
+				t.Fatalf("forest file is %d bytes after compact",
+					stat.Size())
+			}
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	dir, f := makeForestDir(t, false)
+	defer os.RemoveAll(dir)
+
+	outFile := filepath.Join(dir, "export.json")
+	out, err := foresttool("export", "-dir="+dir, "-out="+outFile)
+	if err != nil {
+		t.Fatalf("%s %s", err.Error(), out)
+	}
+	b, err := ioutil.ReadFile(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported accumulator.Forest
+	err = exported.UnmarshalJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exported.AssertEqual(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stdout works too
+	out, err = foresttool("export", "-dir="+dir)
+	if err != nil || strings.TrimSpace(out) != string(b) {
+		t.Fatalf("export to stdout gave %v %s", err, out)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/mit-dci/utreexo/util"
 )
 
 var PollardFilePath string = "pollardFile"
@@ -25,6 +26,8 @@ OPTIONS:
 
   -host                        server to connect to.  Default to localhost
                                if you need a public server, try 35.188.186.244
+                               Without a port, uses 8338 on mainnet and
+                               testnet, 18338 on regtest and 38338 on signet
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -108,12 +111,17 @@ func Parse(args []string) (*Config, error) {
 	cfg.quitafter = *quitafter
 	cfg.checkSig = *checkSig
 
+	// servers for each network listen on their own port
+	port, err := util.DefaultServerPort(cfg.params)
+	if err != nil {
+		return nil, err
+	}
 	// if no host was given, default to localhost
 	if *remoteHost == "" {
-		cfg.remoteHost = "127.0.0.1:8338"
+		cfg.remoteHost = "127.0.0.1:" + port
 	} else {
 		if !strings.ContainsRune(*remoteHost, ':') {
-			str := *remoteHost + ":8338"
+			str := *remoteHost + ":" + port
 			cfg.remoteHost = str
 		}
 	}
@@ -38,8 +38,8 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 
 	// Reads blocks asynchronously from blk*.dat files, and the proof.dat, and DB
 	// this will be a network reader, with the server sending the same stuff over
-	go uwire.UblockNetworkReader(
-		ublockQueue, c.remoteHost, c.CurrentHeight, lookahead)
+	go uwire.UblockNetworkReader(ublockQueue, c.remoteHost,
+		c.CurrentHeight, lookahead, c.Params.Net)
 
 	var plustime time.Duration
 	starttime := time.Now()
@@ -162,7 +162,11 @@ func (c *Csn) putBlockInPollard(
 	// to be proven.
 	delHashes := make([]accumulator.Hash, len(ub.UtreexoData.Stxos))
 	for i, _ := range ub.UtreexoData.Stxos {
-		delHashes[i] = ub.UtreexoData.Stxos[i].LeafHash()
+		delHashes[i], err = ub.UtreexoData.Stxos[i].LeafHash(
+			btcacc.LeafHashVersion)
+		if err != nil {
+			return err
+		}
 	}
 
 	*totalDels += len(ub.UtreexoData.AccProof.Targets) // for benchmarking
@@ -203,8 +207,11 @@ func (c *Csn) putBlockInPollard(
 	}
 
 	// get hashes to add into the accumulator
-	blockAdds := uwire.BlockToAddLeaves(
+	blockAdds, err := uwire.BlockToAddLeaves(
 		ub.Block, remember, outskip, ub.UtreexoData.Height, outCount)
+	if err != nil {
+		return err
+	}
 	*totalTXOAdded += len(blockAdds) // for benchmarking
 
 	// Utreexo tree modification. blockAdds are the added txos and
@@ -62,6 +62,21 @@ func GenHashForNet(p chaincfg.Params) (*Hash, error) {
 	return nil, fmt.Errorf("net not supported")
 }
 
+// DefaultServerPort gives the port the bridge node serves blocks on for a
+// network, and that CSNs connect to.  Mainnet and testnet share 8338,
+// which is what bridges have always used.
+func DefaultServerPort(p chaincfg.Params) (string, error) {
+	switch p.Name {
+	case "testnet3", "mainnet":
+		return "8338", nil
+	case "regtest":
+		return "18338", nil
+	case "signet":
+		return "38338", nil
+	}
+	return "", fmt.Errorf("net not supported")
+}
+
 // HashFromString hashes the given string with sha256
 func HashFromString(s string) Hash {
 	return sha256.Sum256([]byte(s))
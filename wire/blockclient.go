@@ -0,0 +1,226 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// errWrongHeight is when the server sends a block other than the next one.
+// Reconnecting won't fix that, so BlockClient stops.
+var errWrongHeight = errors.New("BlockClient: server sent the wrong height")
+
+// BlockClient gets UBlocks from a bridge node's block server.  Unlike
+// UblockNetworkReader it doesn't give up when the connection drops: it
+// dials again, waiting longer after each failure, and asks for the rest of
+// the range starting after the last block it got all of.
+type BlockClient struct {
+	// DialTimeout is how long each dial gets
+	DialTimeout time.Duration
+	// MinBackoff is the wait before the first reconnect.  It doubles after
+	// every failure in a row, up to MaxBackoff.
+	MinBackoff, MaxBackoff time.Duration
+	// MaxRetries is how many times in a row reconnecting can fail before
+	// RequestRange gives up.  A block coming in starts the count over.
+	MaxRetries int
+	// Net is the network the server has to be on.  0 skips the check, for
+	// servers from before there was one.
+	Net wire.BitcoinNet
+
+	addr string
+
+	mtx  sync.Mutex
+	conn net.Conn
+	err  error
+	quit chan struct{}
+}
+
+// NewBlockClient gives a BlockClient with the default timeouts: a 2 second
+// dial timeout and reconnects from half a second up to 30 seconds apart, 10
+// times.
+func NewBlockClient() *BlockClient {
+	return &BlockClient{
+		DialTimeout: 2 * time.Second,
+		MinBackoff:  500 * time.Millisecond,
+		MaxBackoff:  30 * time.Second,
+		MaxRetries:  10,
+		quit:        make(chan struct{}),
+	}
+}
+
+// Connect dials the server at addr.  Reconnects go to the same addr.
+func (bc *BlockClient) Connect(addr string) error {
+	bc.addr = addr
+	conn, err := bc.dial()
+	if err != nil {
+		return err
+	}
+	bc.mtx.Lock()
+	bc.conn = conn
+	bc.mtx.Unlock()
+	return nil
+}
+
+// RequestRange asks for the blocks from from to to, and gives them back in
+// order on the channel.  Going backwards works too, with to below from.
+// The channel is closed after to, when the server says it has no proof for
+// the next height or is on another network, or when reconnecting fails
+// MaxRetries times in a row; Err says which.  The server never has a proof for block 0, so that's
+// skipped.  Only one range can be requested at a time.
+func (bc *BlockClient) RequestRange(from, to int32) <-chan UBlock {
+	blocks := make(chan UBlock, 10)
+	go bc.readRange(blocks, from, to)
+	return blocks
+}
+
+// Err gives why the last RequestRange channel was closed: nil if it got
+// every block, a *NoProofError if the server ran out of proofs, a
+// *WrongNetworkError if it's on a different network than Net, or the last
+// connection error.  Only call it after the channel is closed.
+func (bc *BlockClient) Err() error {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	return bc.err
+}
+
+// Close stops any RequestRange and hangs up.
+func (bc *BlockClient) Close() error {
+	bc.mtx.Lock()
+	defer bc.mtx.Unlock()
+	select {
+	case <-bc.quit:
+	default:
+		close(bc.quit)
+	}
+	if bc.conn == nil {
+		return nil
+	}
+	return bc.conn.Close()
+}
+
+func (bc *BlockClient) dial() (net.Conn, error) {
+	if bc.addr == "" {
+		return nil, errors.New("BlockClient: not connected")
+	}
+	d := net.Dialer{Timeout: bc.DialTimeout}
+	return d.Dial("tcp", bc.addr)
+}
+
+// readRange reads blocks until the range is done, reconnecting as needed.
+func (bc *BlockClient) readRange(blocks chan<- UBlock, from, to int32) {
+	var direction int32 = 1
+	if to < from {
+		direction = -1
+	}
+	next := from
+	retries := 0
+	backoff := bc.MinBackoff
+
+	err := func() error {
+		bc.mtx.Lock()
+		conn := bc.conn
+		bc.mtx.Unlock()
+		for {
+			var err error
+			if conn == nil {
+				conn, err = bc.dial()
+			}
+			if err == nil {
+				bc.mtx.Lock()
+				bc.conn = conn
+				bc.mtx.Unlock()
+				var got int
+				got, err = bc.readFrom(conn, blocks, &next, to, direction)
+				if err == nil {
+					return nil
+				}
+				var noProof *NoProofError
+				var wrongNet *WrongNetworkError
+				if errors.As(err, &noProof) || errors.As(err, &wrongNet) ||
+					errors.Is(err, errWrongHeight) {
+					return err
+				}
+				if got > 0 {
+					retries = 0
+					backoff = bc.MinBackoff
+				}
+				conn.Close()
+				conn = nil
+			}
+
+			select {
+			case <-bc.quit:
+				return err
+			default:
+			}
+			if retries == bc.MaxRetries {
+				return fmt.Errorf("BlockClient: gave up at height %d "+
+					"after %d retries: %w", next, retries, err)
+			}
+			retries++
+			select {
+			case <-bc.quit:
+				return err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > bc.MaxBackoff {
+				backoff = bc.MaxBackoff
+			}
+		}
+	}()
+
+	bc.mtx.Lock()
+	bc.err = err
+	bc.mtx.Unlock()
+	close(blocks)
+}
+
+// readFrom asks conn for next through to and sends what comes back on
+// blocks, moving next along after every whole block.  Gives how many blocks
+// it got, and a nil error once to has been sent.
+func (bc *BlockClient) readFrom(conn net.Conn, blocks chan<- UBlock,
+	next *int32, to, direction int32) (int, error) {
+
+	err := WriteRequest(conn, bc.Net, *next, to)
+	if err != nil {
+		return 0, err
+	}
+
+	got := 0
+	for {
+		ub, err := ReadUBlock(conn)
+		if noProof, ok := err.(*NoProofError); ok && noProof.Height == 0 {
+			// there's never a proof for genesis
+			if *next == 0 {
+				*next += direction
+			}
+			if (direction == 1 && *next > to) ||
+				(direction == -1 && *next < to) {
+				return got, nil
+			}
+			continue
+		}
+		if err != nil {
+			return got, err
+		}
+		if ub.UtreexoData.Height != *next {
+			return got, fmt.Errorf("%w: got %d, expected %d",
+				errWrongHeight, ub.UtreexoData.Height, *next)
+		}
+		select {
+		case blocks <- ub:
+		case <-bc.quit:
+			return got, errors.New("BlockClient: closed")
+		}
+		got++
+		if *next == to {
+			return got, nil
+		}
+		*next += direction
+	}
+}
@@ -0,0 +1,167 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// testBlockServer serves made up UBlocks up to tip the same way the bridge
+// node's server does.  The first connection gets hung up on halfway through
+// block dropAt.
+type testBlockServer struct {
+	listener *net.TCPListener
+	tip      int32
+	dropAt   int32
+	// the heights each connection asked to start from
+	froms chan int32
+}
+
+func newTestBlockServer(t *testing.T, tip, dropAt int32) *testBlockServer {
+	listener, err := net.ListenTCP(
+		"tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testBlockServer{listener: listener, tip: tip, dropAt: dropAt,
+		froms: make(chan int32, 100)}
+	go s.accept()
+	return s
+}
+
+func (s *testBlockServer) accept() {
+	for first := true; ; first = false {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serve(c, first)
+	}
+}
+
+func (s *testBlockServer) serve(c net.Conn, drop bool) {
+	defer c.Close()
+	var from, to int32
+	if binary.Read(c, binary.BigEndian, &from) != nil ||
+		binary.Read(c, binary.BigEndian, &to) != nil {
+		return
+	}
+	s.froms <- from
+	if from > s.tip {
+		WriteNoProof(c, from)
+		return
+	}
+	if to > s.tip {
+		to = s.tip
+	}
+	for h := from; h <= to; h++ {
+		if h == 0 {
+			WriteNoProof(c, 0)
+			continue
+		}
+		b := testUBlockBytes(h)
+		if drop && h == s.dropAt {
+			c.Write(b[:len(b)/2])
+			return
+		}
+		_, err := c.Write(b)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// testUBlockBytes makes a serialized UBlock for height h, with just a
+// coinbase that has the height in it.
+func testUBlockBytes(h int32) []byte {
+	msgBlock := wire.NewMsgBlock(&wire.BlockHeader{Nonce: uint32(h)})
+	tx := wire.NewMsgTx(1)
+	tx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: math.MaxUint32},
+		[]byte{byte(h), byte(h >> 8)}, nil))
+	tx.AddTxOut(wire.NewTxOut(50, []byte{0x51}))
+	msgBlock.AddTransaction(tx)
+	ub := UBlock{
+		Block:       btcutil.NewBlock(msgBlock),
+		UtreexoData: btcacc.UData{Height: h},
+	}
+	var buf bytes.Buffer
+	err := ub.Serialize(&buf)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBlockClientResume(t *testing.T) {
+	s := newTestBlockServer(t, 20, 6)
+	defer s.listener.Close()
+
+	bc := NewBlockClient()
+	bc.MinBackoff = time.Millisecond
+	bc.MaxBackoff = 10 * time.Millisecond
+	err := bc.Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	// the first connection drops in the middle of block 6, so the client
+	// has to come back for 6 and nothing before it
+	height := int32(1)
+	for ub := range bc.RequestRange(0, 15) {
+		if ub.UtreexoData.Height != height {
+			t.Fatalf("got block %d, expected %d",
+				ub.UtreexoData.Height, height)
+		}
+		if ub.Block.MsgBlock().Header.Nonce != uint32(height) {
+			t.Fatalf("block %d has the wrong contents", height)
+		}
+		height++
+	}
+	if height != 16 {
+		t.Fatalf("stopped at %d, expected 16", height)
+	}
+	if bc.Err() != nil {
+		t.Fatal(bc.Err())
+	}
+	for _, expected := range []int32{0, 6} {
+		from := <-s.froms
+		if from != expected {
+			t.Fatalf("connection asked from %d, expected %d", from, expected)
+		}
+	}
+
+	// asking past the tip gets what there is, then a NoProofError for the
+	// height after it
+	height = 18
+	for ub := range bc.RequestRange(18, math.MaxInt32) {
+		if ub.UtreexoData.Height != height {
+			t.Fatalf("got block %d, expected %d",
+				ub.UtreexoData.Height, height)
+		}
+		height++
+	}
+	var noProof *NoProofError
+	if height != 21 || !errors.As(bc.Err(), &noProof) || noProof.Height != 21 {
+		t.Fatalf("stopped at %d with %v, expected 21 and no proof for 21",
+			height, bc.Err())
+	}
+
+	// a server that's gone is given up on
+	s.listener.Close()
+	bc.MaxRetries = 2
+	for range bc.RequestRange(30, 40) {
+		t.Fatal("got a block from a closed server")
+	}
+	if bc.Err() == nil {
+		t.Fatal("no error from a closed server")
+	}
+}
@@ -0,0 +1,88 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+/*
+A client asks the server for blocks by sending the 4 byte height to start
+from and the 4 byte height to go to.  Before that it can send a hello: the
+hello magic and the 4 byte magic of the network it's on.  If the server is
+on a different network it sends the wrong network magic and its own network
+magic, and hangs up.  Clients that don't send a hello get blocks from
+whatever network the server is on, like before there was one.
+*/
+
+// helloMagic starts a hello.  It's -2 as a height, which nobody asks for.
+var helloMagic = [4]byte{0xff, 0xff, 0xff, 0xfe}
+
+// wrongNetMagic starts the server's answer to a hello from another network,
+// in place of a block.  Like noProofMagic, a block can't start like this.
+var wrongNetMagic = [4]byte{0xff, 0xff, 0xff, 0xfd}
+
+// WrongNetworkError is what ReadUBlock gives when the server is on a
+// different network than the one in the hello.
+type WrongNetworkError struct {
+	// Net is the network the server is on
+	Net wire.BitcoinNet
+}
+
+func (e *WrongNetworkError) Error() string {
+	return fmt.Sprintf("server is on network %s", e.Net)
+}
+
+// WriteRequest asks the server for the blocks from from to to.  A btcnet
+// of 0 leaves out the hello.
+func WriteRequest(w io.Writer, btcnet wire.BitcoinNet, from, to int32) error {
+	var msg [16]byte
+	buf := msg[:8]
+	if btcnet != 0 {
+		copy(msg[:4], helloMagic[:])
+		binary.LittleEndian.PutUint32(msg[4:8], uint32(btcnet))
+		buf = msg[:]
+	}
+	binary.BigEndian.PutUint32(buf[len(buf)-8:], uint32(from))
+	binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(to))
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadRequest reads what a client asks for.  btcnet is the network from the
+// hello, or 0 if it didn't send one.
+func ReadRequest(r io.Reader) (btcnet wire.BitcoinNet, from, to int32,
+	err error) {
+
+	var start [4]byte
+	_, err = io.ReadFull(r, start[:])
+	if err != nil {
+		return
+	}
+	if start == helloMagic {
+		_, err = io.ReadFull(r, start[:])
+		if err != nil {
+			return
+		}
+		btcnet = wire.BitcoinNet(binary.LittleEndian.Uint32(start[:]))
+		_, err = io.ReadFull(r, start[:])
+		if err != nil {
+			return
+		}
+	}
+	from = int32(binary.BigEndian.Uint32(start[:]))
+	err = binary.Read(r, binary.BigEndian, &to)
+	return
+}
+
+// WriteWrongNetwork tells a client it's on a different network than the
+// server, which is on btcnet.
+func WriteWrongNetwork(w io.Writer, btcnet wire.BitcoinNet) error {
+	var msg [8]byte
+	copy(msg[:4], wrongNetMagic[:])
+	binary.LittleEndian.PutUint32(msg[4:], uint32(btcnet))
+	_, err := w.Write(msg[:])
+	return err
+}
@@ -0,0 +1,53 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+func TestRequestHello(t *testing.T) {
+	for _, test := range []struct {
+		params   *chaincfg.Params
+		from, to int32
+	}{
+		{&chaincfg.RegressionNetParams, 0, 100},
+		{&chaincfg.SigNetParams, 50, 1},
+		{&chaincfg.MainNetParams, 1, -1 >> 1},
+		// no hello, like old clients
+		{&chaincfg.Params{}, 7, 8},
+	} {
+		var buf bytes.Buffer
+		err := WriteRequest(&buf, test.params.Net, test.from, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.params.Net == 0 && buf.Len() != 8 {
+			t.Fatalf("request without a hello is %d bytes, expected 8",
+				buf.Len())
+		}
+		btcnet, from, to, err := ReadRequest(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if btcnet != test.params.Net || from != test.from || to != test.to {
+			t.Fatalf("read %s %d to %d, wrote %s %d to %d", btcnet, from, to,
+				test.params.Net, test.from, test.to)
+		}
+	}
+}
+
+func TestReadWrongNetwork(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteWrongNetwork(&buf, chaincfg.SigNetParams.Net)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadUBlock(&buf)
+	var wrongNet *WrongNetworkError
+	if !errors.As(err, &wrongNet) || wrongNet.Net != chaincfg.SigNetParams.Net {
+		t.Fatalf("got error %v, expected the server to be on signet", err)
+	}
+}
@@ -1,6 +1,7 @@
 package wire
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -21,10 +22,11 @@ import (
 )
 
 // UblockNetworkReader gets Ublocks from the remote host and puts em in the
-// channel.  It'll try to fill the channel buffer.
+// channel.  It'll try to fill the channel buffer.  The server has to be on
+// btcnet, unless it's 0.
 func UblockNetworkReader(
 	blockChan chan UBlock, remoteServer string,
-	curHeight, lookahead int32) {
+	curHeight, lookahead int32, btcnet wire.BitcoinNet) {
 
 	d := net.Dialer{Timeout: 2 * time.Second}
 	con, err := d.Dial("tcp", remoteServer)
@@ -37,13 +39,7 @@ func UblockNetworkReader(
 	var ub UBlock
 	// var ublen uint32
 	// request range from curHeight to latest block
-	err = binary.Write(con, binary.BigEndian, curHeight)
-	if err != nil {
-		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
-			con.RemoteAddr().String(), err.Error())
-		panic(e)
-	}
-	err = binary.Write(con, binary.BigEndian, int32(math.MaxInt32))
+	err = WriteRequest(con, btcnet, curHeight, math.MaxInt32)
 	if err != nil {
 		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
 			con.RemoteAddr().String(), err.Error())
@@ -54,7 +50,20 @@ func UblockNetworkReader(
 	// Need to sort the blocks though if you're doing that
 	for ; ; curHeight++ {
 
-		err = ub.Deserialize(con)
+		ub, err = ReadUBlock(con)
+		if noProof, ok := err.(*NoProofError); ok {
+			// there's never a proof for genesis, so keep going from block 1
+			fmt.Printf("%s: %s\n", con.RemoteAddr().String(), noProof.Error())
+			if noProof.Height == 0 {
+				continue
+			}
+			return
+		}
+		if wrongNet, ok := err.(*WrongNetworkError); ok {
+			fmt.Printf("%s: %s but we're on %s\n", con.RemoteAddr().String(),
+				wrongNet.Error(), btcnet)
+			return
+		}
 		if err != nil {
 			fmt.Printf("Deserialize error from connection %s %s\n",
 				con.RemoteAddr().String(), err.Error())
@@ -64,6 +73,63 @@ func UblockNetworkReader(
 	}
 }
 
+// noProofMagic starts a message from the server saying it has no proof for a
+// height, in place of a block.  Blocks start with their version, which is
+// never -1, so a block can't start like this.
+var noProofMagic = [4]byte{0xff, 0xff, 0xff, 0xff}
+
+// NoProofError is what ReadUBlock gives when the server says it has no proof
+// for a height.  There's never one for block 0.
+type NoProofError struct {
+	Height int32
+}
+
+func (e *NoProofError) Error() string {
+	return fmt.Sprintf("server has no proof for height %d", e.Height)
+}
+
+// WriteNoProof tells the client there's no proof for height, instead of
+// sending a block.  It's the magic and then the 4 byte height.
+func WriteNoProof(w io.Writer, height int32) error {
+	var msg [8]byte
+	copy(msg[:4], noProofMagic[:])
+	binary.BigEndian.PutUint32(msg[4:], uint32(height))
+	_, err := w.Write(msg[:])
+	return err
+}
+
+// ReadUBlock reads the next message from the server.  That's usually a
+// UBlock, but if the server has no proof for the height the error is a
+// *NoProofError, and if it's on another network a *WrongNetworkError.
+func ReadUBlock(r io.Reader) (ub UBlock, err error) {
+	var start [4]byte
+	_, err = io.ReadFull(r, start[:])
+	if err != nil {
+		return
+	}
+	if start == noProofMagic {
+		var height int32
+		err = binary.Read(r, binary.BigEndian, &height)
+		if err != nil {
+			return
+		}
+		err = &NoProofError{Height: height}
+		return
+	}
+	if start == wrongNetMagic {
+		var btcnet uint32
+		err = binary.Read(r, binary.LittleEndian, &btcnet)
+		if err != nil {
+			return
+		}
+		err = &WrongNetworkError{Net: wire.BitcoinNet(btcnet)}
+		return
+	}
+	// it was a block, so put the start back
+	err = ub.Deserialize(io.MultiReader(bytes.NewReader(start[:]), r))
+	return
+}
+
 // BlockToAdds turns all the new utxos in a msgblock into leafTxos
 // uses remember slice up to number of txos, but doesn't check that it's the
 // right length.  Similar with skiplist, doesn't check it.
@@ -72,7 +138,7 @@ func BlockToAddLeaves(
 	remember []bool,
 	skiplist []uint32,
 	height int32,
-	outCount uint32) (leaves []accumulator.Leaf) {
+	outCount uint32) (leaves []accumulator.Leaf, err error) {
 
 	// We're overallocating a little bit since all the unspendables
 	// won't be appended. It's ok though for the pre-allocation savings.
@@ -106,7 +172,11 @@ func BlockToAddLeaves(
 			}
 			l.Amt = out.Value
 			l.PkScript = out.PkScript
-			uleaf := accumulator.Leaf{Hash: l.LeafHash()}
+			uleaf := accumulator.Leaf{}
+			uleaf.Hash, err = l.LeafHash(btcacc.LeafHashVersion)
+			if err != nil {
+				return nil, err
+			}
 			if uint32(len(remember)) > txonum {
 				uleaf.Remember = remember[txonum]
 			}